@@ -8,6 +8,7 @@ import (
 	"encoding/csv"
 	"fmt"
 	"github.com/c-bata/go-prompt"
+	"github.com/spf13/pflag"
 	cobraprompt "github.com/stromland/cobra-prompt"
 	"os"
 	"strconv"
@@ -21,41 +22,180 @@ var appPrompt = &cobraprompt.CobraPrompt{
 	ShowHelpCommandAndFlags:  false,
 	DisableCompletionCommand: false,
 	AddDefaultExitCommand:    false,
-	GoPromptOptions: []prompt.Option{
-		prompt.OptionPrefix(">> "),
-		prompt.OptionMaxSuggestion(0),
-	},
+	InArgsParser:             cmd.SplitArgs,
 	OnErrorFunc: func(err error) {
+		internal.Journal(internal.JournalError, "", internal.GetSession().AccountId, err.Error())
 		if strings.Contains(err.Error(), "unknown command") {
 			return
 		}
 	},
 }
 
+// keptHistory is the lines entered that may stay in the prompt's history, and restartPrompt is set when the prompt
+// stopped after a line that may hold a PIN
+var (
+	keptHistory   []string
+	restartPrompt bool
+)
+
+// promptOptions builds the prompt with the history kept so far
+func promptOptions() []prompt.Option {
+	return []prompt.Option{
+		prompt.OptionPrefix(">> "),
+		prompt.OptionMaxSuggestion(0),
+		prompt.OptionHistory(append([]string{}, keptHistory...)),
+		prompt.OptionSetExitCheckerOnInput(leaveOutOfHistory),
+	}
+}
+
+// leaveOutOfHistory stops the prompt once a line that may hold a PIN has run, so that it is started again without the
+// line in its history. go-prompt adds every line entered to its history and has no option to leave a line out
+func leaveOutOfHistory(line string, breakline bool) bool {
+	if !breakline || strings.TrimSpace(line) == "" {
+		return false
+	}
+	if cmd.KeepInHistory(line) {
+		keptHistory = append(keptHistory, line)
+		return false
+	}
+	restartPrompt = true
+	return true
+}
+
 func main() {
 
+	// options for the terminal come before any command: atm-sim --receipts file [command]
+	options := pflag.NewFlagSet("atm-sim", pflag.ContinueOnError)
+	options.SetInterspersed(false)
+	receipts := options.String("receipts", string(internal.ConsoleReceipt), "how receipts are produced: console, file, escpos or none")
+	receiptDir := options.String("receipt-dir", "receipts", "directory file and ESC/POS receipts are written to")
+	accountLogin := options.Bool("account-login", false, "let authorize log in by account number without a card, for development only")
+	if err := options.Parse(os.Args[1:]); err != nil {
+		if err == pflag.ErrHelp {
+			return
+		}
+		os.Exit(2)
+	}
+
 	// initialize the application
 	initLogger()
+	cmd.AllowAccountLogin(*accountLogin)
 
 	// this could be injected from a config file or somewhere external
 	startingCashInMachine := 10000.00
 	initData(startingCashInMachine)
+	ledger := internal.GetLedgerService()
+	terminalId := os.Getenv("ATM_TERMINAL_ID")
+	if terminalId == "" {
+		terminalId = internal.DefaultTerminalId
+	}
+	ledger.SetTerminalId(terminalId)
+	ledger.SetHoldPolicy(holdPolicy())
+	// cardless withdrawals staged from the command line are collected at the prompt
+	stagedFile := os.Getenv("ATM_STAGED_WITHDRAWALS")
+	if stagedFile == "" {
+		stagedFile = "staged-withdrawals.json"
+	}
+	if err := ledger.OpenStagedWithdrawals(stagedFile); err != nil {
+		fmt.Println("Unable to read the staged withdrawals:", err)
+		os.Exit(-1)
+	}
+	if *receipts != "none" {
+		mode, err := internal.ParseReceiptMode(*receipts)
+		if err != nil {
+			fmt.Println(err.Error())
+			os.Exit(2)
+		}
+		internal.SetReceiptPrinter(&internal.ReceiptPrinter{Mode: mode, Dir: *receiptDir})
+	}
+	internal.SetJournal(internal.NewElectronicJournal("journal", ledger.GetTerminalId()))
+	// PINs leave the PIN pad encrypted with TDES DUKPT, or AES DUKPT when the PIN pad is set to use it, under a key
+	// for this terminal whose transaction counter carries on from the last run
+	pinPad := internal.NewSimulatorPINPad(terminalId, os.Getenv("ATM_PIN_ENCRYPTION") == "aes")
+	ksnFile := os.Getenv("ATM_PIN_PAD_KSN")
+	if ksnFile == "" {
+		ksnFile = "pinpad-ksn.json"
+	}
+	if err := pinPad.OpenKSNFile(ksnFile); err != nil {
+		fmt.Println("Unable to read the PIN pad's KSN:", err)
+		os.Exit(-1)
+	}
+	internal.SetPINPad(pinPad)
+	// the security module refuses PIN blocks whose transaction counter it has seen, in this run or an earlier one
+	counterFile := os.Getenv("ATM_SECURITY_MODULE_KSN")
+	if counterFile == "" {
+		counterFile = "security-module-ksn.json"
+	}
+	if err := internal.GetSecurityModule().OpenCounterFile(counterFile); err != nil {
+		fmt.Println("Unable to read the security module's counters:", err)
+		os.Exit(-1)
+	}
+	sessions := internal.GetSessionManager()
+	sessions.SetPolicy(internal.SessionPolicy{IdleTimeout: 2 * time.Minute, AbsoluteTimeout: 15 * time.Minute, WarningBefore: 30 * time.Second})
 
-	// monitor session timeouts
-	go func() {
-		ticker := time.NewTicker(1 * time.Minute) // Adjust the ticker interval as needed
-		for range ticker.C {
-			internal.Logger.Println("tick...")
-			session := internal.GetSession()
-			// Check for session expiration if the user is authenticated
-			if session.IsAuthenticated && time.Since(session.LastActivityTime) > 2*time.Minute {
-				internal.Logger.Printf("session expired for %s", session.AccountId)
-				session.IsAuthenticated = false
-				session.AccountId = ""
-				fmt.Println("Session expired due to inactivity.")
+	// commands given on the command line, such as generating statements, are run once without the prompt
+	if options.NArg() > 0 {
+		cmd.RootCmd.SetArgs(options.Args())
+		if err := cmd.ExecuteCommandLine(); err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// the terminal can share its accounts with other terminals through a remote bank host
+	if address := os.Getenv("ATM_BANK_HOST"); address != "" {
+		var err error
+		if os.Getenv("ATM_BANK_PROTOCOL") == "iso8583" {
+			err = cmd.ConnectISOHost(address, os.Getenv("ATM_ISO8583_SPEC"), internal.DefaultHostTimeout)
+		} else {
+			credentials := cmd.BankHostCredentials{CAFile: os.Getenv("ATM_BANK_CA"), CertFile: os.Getenv("ATM_BANK_CERT"),
+				KeyFile: os.Getenv("ATM_BANK_KEY"), Plaintext: os.Getenv("ATM_BANK_PLAINTEXT") == "true"}
+			err = cmd.ConnectBankHost(address, credentials, internal.DefaultHostTimeout)
+		}
+		if err != nil {
+			fmt.Println("Unable to connect to the bank host:", err)
+			os.Exit(-1)
+		}
+		fmt.Printf("Connected to bank host %s\n", address)
+		// small withdrawals can be approved offline while the bank host can not be reached
+		if limit, _ := strconv.ParseFloat(os.Getenv("ATM_STANDIN_LIMIT"), 64); limit > 0 {
+			accountLimit, _ := strconv.ParseFloat(os.Getenv("ATM_STANDIN_ACCOUNT_LIMIT"), 64)
+			total, _ := strconv.ParseFloat(os.Getenv("ATM_STANDIN_TOTAL"), 64)
+			queueFile := os.Getenv("ATM_ADVICE_QUEUE")
+			if queueFile == "" {
+				queueFile = "advices.json"
+			}
+			policy := internal.StandInPolicy{MaxWithdrawal: limit, MaxPerAccount: accountLimit, MaxTotal: total}
+			if err := cmd.EnableStandIn(policy, queueFile); err != nil {
+				fmt.Println("Unable to enable stand-in:", err)
+				os.Exit(-1)
+			}
+		}
+	}
+
+	// warn the customer before their session times out and tell them when it has
+	sessions.OnWarning(func(session internal.UserSession, remaining time.Duration) {
+		internal.GetDevices().Display.Show(fmt.Sprintf("\nSession will expire in %s, press enter to continue.\n", remaining))
+	})
+	sessions.OnEnd(func(session internal.UserSession, reason internal.SessionEndReason) {
+		if reason == internal.SessionLoggedOut {
+			return
+		}
+		internal.Journal(internal.JournalAuth, "", session.AccountId, "session ended: "+string(reason))
+		display := internal.GetDevices().Display
+		if reason == internal.SessionIdleTimeout {
+			display.Show("\nSession expired due to inactivity.\n")
+		} else {
+			display.Show("\nSession expired.\n")
+		}
+		if session.CardPAN != "" {
+			if err := internal.GetDevices().CardReader.EjectCard(); err != nil {
+				internal.Logger.Printf("unable to eject card %s: %+v\n", internal.MaskAccount(session.CardPAN), err)
 			}
+			internal.Journal(internal.JournalCard, "", session.AccountId, fmt.Sprintf("card %s ejected", internal.MaskAccount(session.CardPAN)))
+			display.Show("Please take your card.\n")
 		}
-	}()
+	})
 
 	cmd.RootCmd.SetHelpTemplate(`Available Commands:
 {{- range $index, $command := .Commands}}
@@ -64,7 +204,59 @@ func main() {
 
 	// start the prompt
 	fmt.Println("Welcome to the ATM simulator. Enter 'help' for available commands.")
-	appPrompt.Run()
+	for {
+		appPrompt.GoPromptOptions, restartPrompt = promptOptions(), false
+		appPrompt.Run()
+		if !restartPrompt {
+			return
+		}
+	}
+}
+
+// holdPolicy reads the deposit hold policy from the environment: the first ATM_HOLD_AVAILABLE dollars of each deposit
+// can be withdrawn at once and the rest is held for ATM_HOLD_DAYS days of ATM_HOLD_DAY_LENGTH
+func holdPolicy() internal.HoldPolicy {
+	policy := internal.HoldPolicy{ImmediatelyAvailable: 200.00, HoldDays: 2}
+	var err error
+	if value := os.Getenv("ATM_HOLD_AVAILABLE"); value != "" {
+		if policy.ImmediatelyAvailable, err = strconv.ParseFloat(value, 64); err != nil || policy.ImmediatelyAvailable < 0 {
+			fmt.Printf("invalid ATM_HOLD_AVAILABLE \"%s\"\n", value)
+			os.Exit(-1)
+		}
+	}
+	if value := os.Getenv("ATM_HOLD_DAYS"); value != "" {
+		if policy.HoldDays, err = strconv.Atoi(value); err != nil || policy.HoldDays < 0 {
+			fmt.Printf("invalid ATM_HOLD_DAYS \"%s\"\n", value)
+			os.Exit(-1)
+		}
+	}
+	if value := os.Getenv("ATM_HOLD_DAY_LENGTH"); value != "" {
+		if policy.DayLength, err = time.ParseDuration(value); err != nil || policy.DayLength <= 0 {
+			fmt.Printf("invalid ATM_HOLD_DAY_LENGTH \"%s\"\n", value)
+			os.Exit(-1)
+		}
+	}
+	return policy
+}
+
+// secondFactorPolicy reads when accounts enrolled for one-time codes must give one from the environment:
+// ATM_TOTP_ON_LOGIN asks for a code when the customer logs in and ATM_TOTP_WITHDRAWAL_THRESHOLD for withdrawals above it
+func secondFactorPolicy() internal.SecondFactorPolicy {
+	policy := internal.SecondFactorPolicy{WithdrawalThreshold: 500.00}
+	var err error
+	if value := os.Getenv("ATM_TOTP_ON_LOGIN"); value != "" {
+		if policy.OnLogin, err = strconv.ParseBool(value); err != nil {
+			fmt.Printf("invalid ATM_TOTP_ON_LOGIN \"%s\"\n", value)
+			os.Exit(-1)
+		}
+	}
+	if value := os.Getenv("ATM_TOTP_WITHDRAWAL_THRESHOLD"); value != "" {
+		if policy.WithdrawalThreshold, err = strconv.ParseFloat(value, 64); err != nil || policy.WithdrawalThreshold < 0 {
+			fmt.Printf("invalid ATM_TOTP_WITHDRAWAL_THRESHOLD \"%s\"\n", value)
+			os.Exit(-1)
+		}
+	}
+	return policy
 }
 
 func initLogger() {
@@ -152,7 +344,100 @@ func initData(startingCash float64) {
 	}
 	auth := internal.GetAuthorizationService()
 	auth.SetAuthData(authAccounts)
+	auth.SetSecondFactorPolicy(secondFactorPolicy())
 
 	ledger := internal.GetLedgerService()
 	ledger.SetInitialBalances(startingCash, ledgerAccounts)
+
+	initCards()
+	initOperators()
+}
+
+func initCards() {
+	internal.Logger.Println("reading in card data")
+	file, err := Asset("data/cards.csv")
+	if err != nil {
+		internal.Logger.Printf("Error opening file: %+v", err)
+		fmt.Println("Error opening file:", err)
+		os.Exit(-1)
+	}
+	records, err := csv.NewReader(bytes.NewReader(file)).ReadAll()
+	if err != nil {
+		fmt.Println("Error reading CSV:", err)
+		internal.Logger.Printf("Error reading CSV: %+v\n", err)
+		os.Exit(-1)
+	}
+
+	// map the field names to their locations in the array
+	fieldIndexes := make(map[string]int)
+	for i, field := range records[0] {
+		fieldIndexes[field] = i
+	}
+	for _, field := range []string{"PAN", "EXPIRY", "SERVICE_CODE", "ACCOUNTS", "STATUS"} {
+		if _, ok := fieldIndexes[field]; !ok {
+			internal.Logger.Printf("column index missing for %s\n", field)
+			os.Exit(-1)
+		}
+	}
+
+	cards := map[string]internal.Card{}
+	for i, record := range records[1:] {
+		if len(record) != len(fieldIndexes) {
+			internal.Logger.Println("Invalid record:", record)
+			continue
+		}
+		card, err := internal.NewCard(record[fieldIndexes["PAN"]], record[fieldIndexes["EXPIRY"]], record[fieldIndexes["SERVICE_CODE"]],
+			record[fieldIndexes["ACCOUNTS"]], record[fieldIndexes["STATUS"]])
+		if err != nil {
+			internal.Logger.Printf("Error reading card record %d: %+v\n", i+1, err)
+			continue
+		}
+		cards[card.PAN] = card
+	}
+	internal.Logger.Printf("found %d cards\n", len(cards))
+	internal.GetCardReader().SetCards(cards)
+}
+
+func initOperators() {
+	internal.Logger.Println("reading in operator data")
+	file, err := Asset("data/operators.csv")
+	if err != nil {
+		internal.Logger.Printf("Error opening file: %+v", err)
+		fmt.Println("Error opening file:", err)
+		os.Exit(-1)
+	}
+	records, err := csv.NewReader(bytes.NewReader(file)).ReadAll()
+	if err != nil {
+		fmt.Println("Error reading CSV:", err)
+		internal.Logger.Printf("Error reading CSV: %+v\n", err)
+		os.Exit(-1)
+	}
+
+	// map the field names to their locations in the array
+	fieldIndexes := make(map[string]int)
+	for i, field := range records[0] {
+		fieldIndexes[field] = i
+	}
+	for _, field := range []string{"OPERATOR_ID", "PASSCODE"} {
+		if _, ok := fieldIndexes[field]; !ok {
+			internal.Logger.Printf("column index missing for %s\n", field)
+			os.Exit(-1)
+		}
+	}
+
+	passcodes := map[string]internal.EncryptedPin{}
+	for _, record := range records[1:] {
+		if len(record) != len(fieldIndexes) {
+			internal.Logger.Println("Invalid record:", record)
+			continue
+		}
+		enc, err := internal.EncryptPin(record[fieldIndexes["PASSCODE"]])
+		if err != nil {
+			fmt.Printf("error reading operator data\n")
+			os.Exit(-1)
+		}
+		passcodes[record[fieldIndexes["OPERATOR_ID"]]] = enc
+	}
+	internal.Logger.Printf("found %d operators\n", len(passcodes))
+	internal.GetOperators().SetOperators(passcodes)
 }
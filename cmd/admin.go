@@ -0,0 +1,436 @@
+package cmd
+
+import (
+	"agile-coder.com/atm-sim/internal"
+	"fmt"
+	"github.com/spf13/cobra"
+	"strings"
+)
+
+// adminCmd groups the commands used by the machine operator. They require an operator to be signed on
+var adminCmd = &cobra.Command{
+	Use:   "admin",
+	Short: "operator commands",
+	Long: `Commands for the machine operator such as verifying deposited cheques and enrolling one-time codes.
+The operator signs on with admin login first`,
+}
+
+// adminLoginCmd signs an operator on at the terminal
+var adminLoginCmd = &cobra.Command{
+	Use:   "login",
+	Short: "sign on as an operator",
+	Long: `Signs an operator on so that the operator commands can be run. Takes one parameter, the operator id.
+The passcode is then asked for and is not shown on the screen. The operator is signed off after 5 minutes idle`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("%s requires 1 parameter: operator id. You will be asked for your passcode.\n", cmd.Name())
+		}
+		if err := operatorSignOn(args[0]); err != nil {
+			return err
+		}
+		fmt.Printf("Operator %s signed on.\n", args[0])
+		return nil
+	},
+}
+
+// operatorSignOn asks for the operator's passcode and signs them on
+func operatorSignOn(operatorId string) error {
+	fmt.Print("Passcode: ")
+	passcode, err := internal.ReadConsoleSecret()
+	fmt.Println()
+	if err != nil {
+		return err
+	}
+	if !internal.GetOperators().SignOn(operatorId, passcode) {
+		internal.Logger.Printf("invalid operator sign on attempt for %s\n", operatorId)
+		internal.Journal(internal.JournalAuth, "", "", fmt.Sprintf("operator %s sign on rejected", operatorId))
+		return fmt.Errorf("Operator sign on failed.\n")
+	}
+	internal.Journal(internal.JournalAuth, "", "", fmt.Sprintf("operator %s signed on", operatorId))
+	return nil
+}
+
+// adminLogoutCmd signs the operator off
+var adminLogoutCmd = &cobra.Command{
+	Use:   "logout",
+	Short: "sign off as an operator",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 0 {
+			return fmt.Errorf("the logout command does not take any parameters\n")
+		}
+		operatorId := internal.GetOperators().SignOff()
+		if operatorId == "" {
+			fmt.Println("No operator is signed on.")
+			return nil
+		}
+		internal.Journal(internal.JournalAuth, "", "", fmt.Sprintf("operator %s signed off", operatorId))
+		fmt.Printf("Operator %s signed off.\n", operatorId)
+		return nil
+	},
+}
+
+// chequesCmd lists the cheques waiting for verification
+var chequesCmd = &cobra.Command{
+	Use:   "cheques",
+	Short: "list cheques pending verification",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 0 {
+			return fmt.Errorf("the cheques command does not take any parameters\n")
+		}
+		cheques := internal.GetLedgerService().GetPendingCheques()
+		if len(cheques) == 0 {
+			fmt.Println("No cheques pending verification")
+			return nil
+		}
+		fmt.Println("id\t\taccount\t\tnumber\t\tamount\t\tpayer\t\timage")
+		for _, cheque := range cheques {
+			fmt.Printf("%s\t\t%s\t\t%s\t\t%.2f\t\t%s\t\t%s\n", cheque.Id, cheque.AccountId, cheque.Number, cheque.Amount, cheque.Payer, cheque.ImagePath)
+		}
+		return nil
+	},
+}
+
+// approveChequeCmd posts the funds from a verified cheque
+var approveChequeCmd = &cobra.Command{
+	Use:   "approve-cheque",
+	Short: "approve a pending cheque",
+	Long:  `Approves a pending cheque, making its funds available. Takes one parameter, the cheque id`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("%s requires 1 parameter: cheque id\n", cmd.Name())
+		}
+		cheque, err := internal.GetLedgerService().ApproveCheque(args[0])
+		if err != nil {
+			return err
+		}
+		internal.Journal(internal.JournalTransaction, cheque.TransactionId, cheque.AccountId, fmt.Sprintf("cheque %s approved", cheque.Id))
+		fmt.Printf("Cheque %s approved. $%.2f is now available to %s.\n", cheque.Id, cheque.Amount, cheque.AccountId)
+		return nil
+	},
+}
+
+// rejectChequeCmd reverses the funds from a cheque that failed verification
+var rejectChequeCmd = &cobra.Command{
+	Use:   "reject-cheque",
+	Short: "reject a pending cheque",
+	Long:  `Rejects a pending cheque, reversing its deposit. Takes the cheque id followed by the reason`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 2 {
+			return fmt.Errorf("%s requires 2 parameters: cheque id, reason\n", cmd.Name())
+		}
+		cheque, err := internal.GetLedgerService().RejectCheque(args[0], strings.Join(args[1:], " "))
+		if err != nil {
+			return err
+		}
+		internal.Journal(internal.JournalTransaction, cheque.TransactionId, cheque.AccountId, fmt.Sprintf("cheque %s rejected: %s", cheque.Id, cheque.Reason))
+		fmt.Printf("Cheque %s rejected. $%.2f has been reversed from %s.\n", cheque.Id, cheque.Amount, cheque.AccountId)
+		return nil
+	},
+}
+
+// totpForce lets totp-enroll replace an existing enrollment
+var totpForce bool
+
+// totpEnrollCmd enrolls an account for one-time codes
+var totpEnrollCmd = &cobra.Command{
+	Use:   "totp-enroll",
+	Short: "enroll an account for one-time codes",
+	Long: `Generates a new one-time code secret for an account and prints the provisioning URI to add it
+to an authenticator app. Takes one parameter, the account number. An existing secret is only replaced with --force`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		defer resetFlags(cmd)
+		if len(args) != 1 {
+			return fmt.Errorf("%s requires 1 parameter: account number\n", cmd.Name())
+		}
+		auth := internal.GetAuthorizationService()
+		if auth.IsTOTPEnrolled(args[0]) && !totpForce {
+			return fmt.Errorf("%s is already enrolled for one-time codes, use --force to replace its secret.\n", args[0])
+		}
+		secret, err := auth.EnrollTOTP(args[0])
+		if err != nil {
+			return err
+		}
+		uri, err := auth.TOTPProvisioningURI(args[0])
+		if err != nil {
+			return err
+		}
+		internal.Journal(internal.JournalAuth, "", args[0], "enrolled for one-time codes")
+		fmt.Printf("secret: %s\nuri: %s\n", secret, uri)
+		return nil
+	},
+}
+
+// totpURICmd prints the provisioning URI for an enrolled account
+var totpURICmd = &cobra.Command{
+	Use:   "totp-uri",
+	Short: "print the one-time code provisioning URI",
+	Long:  `Prints the provisioning URI for an account enrolled for one-time codes. Takes one parameter, the account number`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("%s requires 1 parameter: account number\n", cmd.Name())
+		}
+		uri, err := internal.GetAuthorizationService().TOTPProvisioningURI(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Println(uri)
+		return nil
+	},
+}
+
+// advicesCmd lists the withdrawals approved in stand-in that the bank host has not posted
+var advicesCmd = &cobra.Command{
+	Use:   "advices",
+	Short: "list offline withdrawals waiting for the bank host",
+	Long: `Lists the advices for withdrawals approved offline that are waiting to be forwarded, those the bank host rejected
+and the reversals of cash the dispenser did not present that are waiting for the bank host`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 0 {
+			return fmt.Errorf("the advices command does not take any parameters\n")
+		}
+		standIn, err := standInHost()
+		if err != nil {
+			return err
+		}
+		pending, rejected, reversals := standIn.Queue().Pending(), standIn.Queue().Rejected(), standIn.Queue().Reversals()
+		if len(pending) == 0 && len(rejected) == 0 && len(reversals) == 0 {
+			fmt.Println("No advices waiting for the bank host")
+			return nil
+		}
+		fmt.Println("id\t\taccount\t\tamount\t\tapproved\t\tstatus")
+		for _, advice := range pending {
+			fmt.Printf("%s\t\t%s\t\t%.2f\t\t%s\t\tpending\n", advice.AdviceId, advice.AccountId, advice.Amount, advice.ApprovedAt.Format("2006-01-02 15:04:05"))
+		}
+		for _, rejection := range rejected {
+			advice := rejection.Advice
+			fmt.Printf("%s\t\t%s\t\t%.2f\t\t%s\t\trejected: %s\n", advice.AdviceId, advice.AccountId, advice.Amount, advice.ApprovedAt.Format("2006-01-02 15:04:05"), rejection.Reason)
+		}
+		for _, reversal := range reversals {
+			fmt.Printf("Reversal of $%.2f of withdrawal %s pending: %s\n", reversal.Amount, reversal.TransactionId, reversal.Reason)
+		}
+		return nil
+	},
+}
+
+// forwardAdvicesCmd sends the queued advices to the bank host without waiting for the next transaction
+var forwardAdvicesCmd = &cobra.Command{
+	Use:   "forward-advices",
+	Short: "forward offline withdrawals to the bank host",
+	Long:  `Forwards the advices for withdrawals approved offline and the queued reversals to the bank host now, rather than before the next transaction`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 0 {
+			return fmt.Errorf("the forward-advices command does not take any parameters\n")
+		}
+		standIn, err := standInHost()
+		if err != nil {
+			return err
+		}
+		report, err := standIn.Forward()
+		fmt.Printf("Posted %d, already posted %d, rejected %d, remaining %d.\n", report.Posted, report.Duplicates, len(report.Rejected), report.Remaining)
+		for _, rejection := range report.Rejected {
+			fmt.Printf("Advice %s for %s rejected: %s\n", rejection.Advice.AdviceId, rejection.Advice.AccountId, rejection.Reason)
+		}
+		if report.Reversed > 0 {
+			fmt.Printf("Reversals posted %d.\n", report.Reversed)
+		}
+		return err
+	},
+}
+
+// reversalId and reversalReason identify and explain a reversal made by the operator
+var (
+	reversalId     string
+	reversalReason string
+	// reversalOperator signs on the operator for a reversal run from the command line
+	reversalOperator string
+)
+
+// reverseCmd reverses all or part of a posted transaction, such as cash that was not dispensed
+var reverseCmd = &cobra.Command{
+	Use:   "reverse",
+	Short: "reverse a transaction",
+	Long: `Reverses a withdrawal, deposit or fee, putting cash that was not dispensed back into this machine's cash and
+refunding the overdraft fee of a withdrawal that no longer overdraws the account. Takes the transaction id and
+optionally the amount to reverse, all of what has not been reversed when left out. A reversal that is repeated is
+only applied once; give each partial reversal of the same transaction its own --id. From the command line the
+operator signs on with --operator, reading the passcode from standard input:
+	echo <passcode> | atm-sim admin reverse <transaction id> --operator ops01`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		defer resetFlags(cmd)
+		if len(args) < 1 || len(args) > 2 {
+			return fmt.Errorf("%s requires 1 or 2 parameters: transaction id, amount\n", cmd.Name())
+		}
+		// a reversal moves money, so it needs an operator's passcode even from the command line
+		if commandLine {
+			if reversalOperator == "" {
+				return fmt.Errorf("reverse requires --operator when run from the command line\n")
+			}
+			if err := operatorSignOn(reversalOperator); err != nil {
+				return err
+			}
+			defer internal.GetOperators().SignOff()
+		} else if reversalOperator != "" {
+			return fmt.Errorf("--operator can only be given when reverse is run from the command line, use admin login\n")
+		}
+		request := internal.ReversalRequest{ReversalId: reversalId, TransactionId: args[0], Reason: reversalReason}
+		if len(args) == 2 {
+			amount, err := internal.StringToMoney(args[1])
+			if err != nil {
+				return err
+			}
+			request.Amount = amount
+		}
+		result, err := internal.ReverseTransaction(request)
+		if err != nil {
+			return err
+		}
+		if result.Repeated {
+			fmt.Printf("Reversal %s had already been applied.\n", result.TransactionId)
+			return nil
+		}
+		internal.Journal(internal.JournalTransaction, result.TransactionId, result.AccountId,
+			fmt.Sprintf("reversed $%.2f of %s %s by operator %s", result.AmountReversed, result.OriginalType, args[0], internal.GetOperators().SignedOn()))
+		fmt.Printf("Reversed $%.2f of %s %s as %s.\n", result.AmountReversed, result.OriginalType, args[0], result.TransactionId)
+		if result.FeeTransactionId != "" {
+			internal.Journal(internal.JournalTransaction, result.FeeTransactionId, result.AccountId, fmt.Sprintf("overdraft fee $%.2f refunded", result.FeeRefunded))
+			fmt.Printf("Overdraft fee of $%.2f refunded.\n", result.FeeRefunded)
+		}
+		fmt.Printf("Balance of %s: $%.2f\n", result.AccountId, result.RemainingBalance)
+		return nil
+	},
+}
+
+// dispenserCmd shows the state of the cash dispenser
+var dispenserCmd = &cobra.Command{
+	Use:   "dispenser",
+	Short: "show the cash dispenser status",
+	Long:  `Shows whether the cash dispenser is in service, the faults injected for the next dispense and the cash in its bins`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 0 {
+			return fmt.Errorf("the dispenser command does not take any parameters\n")
+		}
+		dispenser, err := simulatedDispenser()
+		if err != nil {
+			return err
+		}
+		status := dispenser.Details()
+		if status.Fault == "" {
+			fmt.Println("Dispenser: ready")
+		} else {
+			fmt.Printf("Dispenser: out of service (%s)\n", status.Fault)
+		}
+		for _, injected := range status.Injected {
+			fmt.Printf("Injected fault: %s after %d notes\n", injected.Fault, injected.AfterNotes)
+		}
+		fmt.Printf("Cassette: $%.2f\nDispensed: $%.2f\nReject bin: $%.2f\nRetract bin: $%.2f\nShortage: $%.2f\n", internal.GetLedgerService().GetAvailableCash(),
+			status.Dispensed, status.RejectBin, status.RetractBin, status.Shortage)
+		return nil
+	},
+}
+
+// faultAfterNotes is how many notes are picked before an injected fault
+var faultAfterNotes int
+
+// injectFaultCmd makes the cash dispenser fail on the next withdrawal
+var injectFaultCmd = &cobra.Command{
+	Use:   "inject-fault",
+	Short: "make the cash dispenser fail on the next withdrawal",
+	Long: `Injects a fault into the cash dispenser for the next withdrawal: jam, note-reject, cassette-empty, shutter or not-taken.
+A jam, note reject or empty cassette happens after --after notes have been picked. Cash that is not presented is reversed;
+a jam or shutter fault leaves the dispenser out of service until clear-dispenser is run`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		defer resetFlags(cmd)
+		if len(args) != 1 {
+			return fmt.Errorf("%s requires 1 parameter: fault\n", cmd.Name())
+		}
+		dispenser, err := simulatedDispenser()
+		if err != nil {
+			return err
+		}
+		if err := dispenser.Inject(internal.DispenserFault(args[0]), faultAfterNotes); err != nil {
+			return err
+		}
+		fmt.Printf("The next withdrawal will fail with %s.\n", args[0])
+		return nil
+	},
+}
+
+// clearDispenserCmd puts the cash dispenser back in service
+var clearDispenserCmd = &cobra.Command{
+	Use:   "clear-dispenser",
+	Short: "put the cash dispenser back in service",
+	Long:  `Clears a jam or shutter fault, the notes in the transport are already counted in the reject bin, and drops the injected faults`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 0 {
+			return fmt.Errorf("the clear-dispenser command does not take any parameters\n")
+		}
+		dispenser, err := simulatedDispenser()
+		if err != nil {
+			return err
+		}
+		dispenser.Clear()
+		fmt.Println("Dispenser back in service.")
+		return nil
+	},
+}
+
+// devicesCmd shows the status of the terminal's devices
+var devicesCmd = &cobra.Command{
+	Use:   "devices",
+	Short: "show the status of the terminal's devices",
+	Long:  `Shows the state of the card reader, PIN pad, cash dispenser, deposit module, receipt printer and display`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 0 {
+			return fmt.Errorf("the devices command does not take any parameters\n")
+		}
+		for _, status := range internal.GetDevices().Statuses() {
+			if status.Detail == "" {
+				fmt.Printf("%-4s %s\n", status.Class, status.State)
+			} else {
+				fmt.Printf("%-4s %s: %s\n", status.Class, status.State, status.Detail)
+			}
+		}
+		return nil
+	},
+}
+
+// simulatedDispenser returns the terminal's cash dispenser when it is simulated, faults can only be injected into those
+func simulatedDispenser() (*internal.SimulatedCashDispenser, error) {
+	dispenser, ok := internal.GetDevices().CashDispenser.(*internal.SimulatedCashDispenser)
+	if !ok {
+		return nil, fmt.Errorf("The cash dispenser is not simulated.\n")
+	}
+	return dispenser, nil
+}
+
+// standInHost returns the connected bank host when stand-in is enabled
+func standInHost() (*internal.StandInHost, error) {
+	standIn, ok := connectedHost.(*internal.StandInHost)
+	if !ok {
+		return nil, fmt.Errorf("Stand-in is not enabled, connect to a bank host with --stand-in-limit.\n")
+	}
+	return standIn, nil
+}
+
+func init() {
+	adminCmd.AddCommand(adminLoginCmd)
+	adminCmd.AddCommand(adminLogoutCmd)
+	totpEnrollCmd.Flags().BoolVar(&totpForce, "force", false, "replace the secret of an account already enrolled")
+	adminCmd.AddCommand(totpEnrollCmd)
+	adminCmd.AddCommand(totpURICmd)
+	adminCmd.AddCommand(chequesCmd)
+	adminCmd.AddCommand(approveChequeCmd)
+	adminCmd.AddCommand(rejectChequeCmd)
+	adminCmd.AddCommand(advicesCmd)
+	reverseCmd.Flags().StringVar(&reversalId, "id", "", "identifies the reversal so that repeating it does not reverse again, the transaction id by default")
+	reverseCmd.Flags().StringVar(&reversalReason, "reason", "", "why the transaction is reversed, recorded in the history")
+	reverseCmd.Flags().StringVar(&reversalOperator, "operator", "", "operator making the reversal from the command line")
+	adminCmd.AddCommand(reverseCmd)
+	adminCmd.AddCommand(forwardAdvicesCmd)
+	adminCmd.AddCommand(dispenserCmd)
+	injectFaultCmd.Flags().IntVar(&faultAfterNotes, "after", 0, "number of notes picked before a jam, note reject or empty cassette")
+	adminCmd.AddCommand(injectFaultCmd)
+	adminCmd.AddCommand(clearDispenserCmd)
+	adminCmd.AddCommand(devicesCmd)
+	RootCmd.AddCommand(adminCmd)
+}
@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// SplitArgs splits a prompt line into arguments on whitespace, keeping quoted text together
+// so that values such as a cheque payer may contain spaces
+func SplitArgs(line string) []string {
+	var args []string
+	var current strings.Builder
+	var quote rune
+	inArg := false
+	for _, r := range line {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote == 0 && (r == '"' || r == '\''):
+			quote = r
+			inArg = true
+		case quote == 0 && (r == ' ' || r == '\t'):
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args
+}
+
+// commands that ask for a PIN or passcode, with the number of parameters they take
+var secretCommands = map[string]int{"authorize": 1, "insert-card": 2, "admin login": 1}
+
+// pinPattern matches a parameter that looks like a PIN
+var pinPattern = regexp.MustCompile(`^[0-9]{4,6}$`)
+
+// KeepInHistory reports whether a line entered at the prompt may be kept in the prompt's history. A command that asks
+// for a PIN or passcode is left out when it has more parameters than it takes or one that looks like a PIN, as the
+// customer may have typed their PIN on the command line
+func KeepInHistory(line string) bool {
+	args := SplitArgs(line)
+	if len(args) == 0 {
+		return false
+	}
+	name, params := args[0], args[1:]
+	if name == "admin" && len(params) > 0 {
+		name, params = name+" "+params[0], params[1:]
+	}
+	count, ok := secretCommands[name]
+	if !ok {
+		return true
+	}
+	if len(params) > count {
+		return false
+	}
+	for _, param := range params {
+		if pinPattern.MatchString(param) {
+			return false
+		}
+	}
+	return true
+}
+
+// resetFlags puts a command's flags back to their defaults so that they do not carry over
+// into the next command entered at the prompt
+func resetFlags(cmd *cobra.Command) {
+	cmd.Flags().VisitAll(func(flag *pflag.Flag) {
+		if flag.Changed {
+			if slice, ok := flag.Value.(pflag.SliceValue); ok {
+				_ = slice.Replace(nil)
+			} else {
+				_ = flag.Value.Set(flag.DefValue)
+			}
+			flag.Changed = false
+		}
+	})
+}
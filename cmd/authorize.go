@@ -2,11 +2,21 @@ package cmd
 
 import (
 	"agile-coder.com/atm-sim/internal"
+	"errors"
 	"fmt"
 	"github.com/spf13/cobra"
 	"strings"
 )
 
+// accountLogin lets authorize log in by account number, for development only
+var accountLogin bool
+
+// AllowAccountLogin lets customers log in by account number without a card. The card's expiry, hotlist and
+// check digit are then never checked, so it is only for development
+func AllowAccountLogin(allow bool) {
+	accountLogin = allow
+}
+
 // authorizeCmd represents the authorize command
 var authorizeCmd = &cobra.Command{
 	Use:   "authorize",
@@ -16,39 +26,88 @@ var authorizeCmd = &cobra.Command{
 - deposit
 - withdrawal
 - view transaction history
-The command takes two inputs - account number and pin`,
+The command takes one input - the account number. The PIN is then asked for
+and is not shown on the screen. Customers log in with insert-card; authorize is only available
+for development, when the simulator is started with --account-login`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		// parameter validation
-		params := []string{"account number", "pin"}
+		if !accountLogin {
+			return fmt.Errorf("Please insert your card to log in.\n")
+		}
+		// parameter validation, the PIN is never accepted as an argument so it can not end up in the history
+		params := []string{"account number"}
 		if len(args) != len(params) {
-			return fmt.Errorf("%s requires %d parameters: %s\n", cmd.Name(), len(params), strings.Join(params, ", "))
+			return fmt.Errorf("%s requires %d parameter: %s. You will be asked for your PIN.\n", cmd.Name(), len(params), strings.Join(params, ", "))
 		}
 
-		accountId := args[0]
-		pin := args[1]
-		return authCommand(accountId, pin)
+		return authCommand(args[0])
 	},
 }
 
-func authCommand(accountId string, pin string) error {
+// authCommand asks for the PIN and verifies it with the bank host, starting the customer's session
+func authCommand(accountId string) error {
+	ok, err := verifyCustomer(accountId)
+	if ok {
+		say("%s successfully authorized.\n", accountId)
+		session := internal.GetSession()
+		session.IsAuthenticated = true
+		session.AccountId = accountId
+		internal.GetSessionManager().Start(session)
+	}
+	return err
+}
+
+// verifyCustomer asks for the PIN, and a one-time code when the account needs one, and verifies them with the bank host
+func verifyCustomer(accountId string) (bool, error) {
 
-	authService := internal.GetAuthorizationService()
-	if authService == nil {
-		return fmt.Errorf("authService is nil\n")
+	// the PIN leaves the PIN pad encrypted, bound to the card when the customer inserted one
+	host := internal.GetBankHost()
+	ok := false
+	block, err := readPIN()
+	var invalid *internal.InvalidInputError
+	if err != nil && !errors.As(err, &invalid) {
+		return false, err
+	}
+	if err == nil {
+		ok, err = host.Authenticate(accountId, block)
+	}
+	if ok {
+		var required bool
+		required, err = host.SecondFactorRequired(accountId, 0)
+		if err != nil {
+			ok = false
+		} else if required {
+			ok = askForOneTimeCode(accountId)
+		}
 	}
-	ok, err := authService.Authenticate(accountId, pin)
 
 	if ok {
-		fmt.Printf("%s successfully authorized.\n", accountId)
 		internal.Logger.Printf("successful login for %s\n", accountId)
-		session := internal.GetSession()
-		session.IsAuthenticated = true
-		session.AccountId = accountId
+		internal.Journal(internal.JournalAuth, "", accountId, "PIN verified")
 	} else {
-		fmt.Println("Authorization failed.")
+		say("Authorization failed.\n")
 		internal.Logger.Printf("invalid login attempt for %s\n", accountId)
+		internal.Journal(internal.JournalAuth, "", accountId, "PIN rejected")
 	}
-	return err
+	return ok, err
+}
+
+// askForOneTimeCode prompts for and verifies a one-time code from the account's authenticator
+func askForOneTimeCode(accountId string) bool {
+	say("One-time code: ")
+	code, err := readLine()
+	if err != nil {
+		return false
+	}
+	ok, err := internal.GetBankHost().VerifyOneTimeCode(accountId, code)
+	if err != nil {
+		say("%s\n", err.Error())
+	}
+	if ok {
+		internal.Journal(internal.JournalAuth, "", accountId, "one-time code verified")
+	} else {
+		internal.Journal(internal.JournalAuth, "", accountId, "one-time code rejected")
+	}
+	return ok
 }
 
 func init() {
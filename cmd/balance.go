@@ -10,13 +10,19 @@ import (
 var balanceCmd = &cobra.Command{
 	Use:   "balance",
 	Short: "return the balance",
-	Long:  `This command returns the account balance in US dollars`,
+	Long: `This command returns the account balance in US dollars.
+The ledger balance includes deposited funds that are still on hold,
+the available balance is the amount that may be withdrawn`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if len(args) != 0 {
 			return fmt.Errorf("the balance command does not take any parameters\n")
 		}
 		session := internal.GetSession()
-		fmt.Printf("balance: $%.2f\n", internal.GetLedgerService().GetBalance(session.AccountId))
+		balance, err := internal.GetBankHost().Balance(session.AccountId)
+		if err != nil {
+			return err
+		}
+		say("balance: $%.2f\navailable: $%.2f\n", balance.Balance, balance.Available)
 		return nil
 	},
 }
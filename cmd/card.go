@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"agile-coder.com/atm-sim/internal"
+	"fmt"
+	"github.com/spf13/cobra"
+	"strconv"
+)
+
+// insertCardCmd represents inserting a card into the card reader
+var insertCardCmd = &cobra.Command{
+	Use:   "insert-card",
+	Short: "insert a card and enter the PIN",
+	Long: `Simulates inserting a card into the machine. Takes the card number and, optionally,
+which of the card's accounts to use. The PIN is then asked for`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 || len(args) > 2 {
+			return fmt.Errorf("%s requires 1 or 2 parameters: card number, account number\n", cmd.Name())
+		}
+		session := internal.GetSession()
+		if session.CardPAN != "" {
+			return fmt.Errorf("A card is already inserted.\n")
+		}
+		reader := internal.GetDevices().CardReader
+		pan, err := reader.AcceptCard(args[0])
+		if err != nil {
+			return err
+		}
+		masked := internal.MaskAccount(pan)
+		card, err := internal.GetCardReader().ReadCard(pan)
+		if err != nil {
+			internal.Journal(internal.JournalCard, "", "", fmt.Sprintf("card %s rejected: %s", masked, err.Error()))
+			if err := reader.EjectCard(); err != nil {
+				internal.Logger.Printf("unable to eject card %s: %+v\n", masked, err)
+			}
+			say("Please take your card.\n")
+			return err
+		}
+		internal.Journal(internal.JournalCard, "", "", fmt.Sprintf("card %s inserted", masked))
+
+		accountId, err := selectCardAccount(card, args[1:])
+		if err != nil {
+			ejectCard(session)
+			return err
+		}
+		session.CardPAN = pan
+		err = authCommand(accountId)
+		if !session.IsAuthenticated {
+			ejectCard(session)
+		}
+		return err
+	},
+}
+
+// ejectCardCmd represents ejecting the card, which ends the customer's session
+var ejectCardCmd = &cobra.Command{
+	Use:   "eject-card",
+	Short: "eject the card",
+	Long:  `Ejects the card from the machine and logs out the customer`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 0 {
+			return fmt.Errorf("the eject-card command does not take any parameters\n")
+		}
+		session := internal.GetSession()
+		if session.CardPAN == "" {
+			say("No card is inserted.\n")
+			return nil
+		}
+		if session.IsAuthenticated {
+			internal.Journal(internal.JournalAuth, "", session.AccountId, "logged out")
+			say("Account %s logged out.\n", session.AccountId)
+			internal.GetSessionManager().End(session.Id, internal.SessionLoggedOut)
+			session.IsAuthenticated = false
+			session.AccountId = ""
+		}
+		ejectCard(session)
+		return nil
+	},
+}
+
+// selectCardAccount picks the account to use from those linked to the card, asking the customer when there is a choice
+func selectCardAccount(card *internal.Card, args []string) (string, error) {
+	if len(args) == 1 {
+		if !card.LinksAccount(args[0]) {
+			return "", fmt.Errorf("Account %s can not be used with this card.\n", args[0])
+		}
+		return args[0], nil
+	}
+	if len(card.Accounts) == 1 {
+		return card.Accounts[0], nil
+	}
+	say("Select an account:\n")
+	for i, account := range card.Accounts {
+		say("%d. %s\n", i+1, account)
+	}
+	say("Account: ")
+	answer, err := readLine()
+	if err != nil {
+		return "", err
+	}
+	choice, err := strconv.Atoi(answer)
+	if err != nil || choice < 1 || choice > len(card.Accounts) {
+		return "", fmt.Errorf("invalid account selection \"%s\"\n", answer)
+	}
+	return card.Accounts[choice-1], nil
+}
+
+// ejectCard returns the card to the customer
+func ejectCard(session *internal.UserSession) {
+	masked := internal.MaskAccount(session.CardPAN)
+	if err := internal.GetDevices().CardReader.EjectCard(); err != nil {
+		internal.Logger.Printf("unable to eject card %s: %+v\n", masked, err)
+	}
+	internal.Journal(internal.JournalCard, "", session.AccountId, fmt.Sprintf("card %s ejected", masked))
+	session.CardPAN = ""
+	say("Please take your card.\n")
+}
+
+func init() {
+	RootCmd.AddCommand(insertCardCmd)
+	RootCmd.AddCommand(ejectCardCmd)
+}
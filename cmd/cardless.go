@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"agile-coder.com/atm-sim/internal"
+	"fmt"
+	"github.com/spf13/cobra"
+	"time"
+)
+
+var (
+	// stagedExpiry is how long a staged withdrawal code stays valid
+	stagedExpiry time.Duration
+	// stagedAccount is the account a withdrawal is staged for from the command line
+	stagedAccount string
+)
+
+// stageWithdrawalCmd represents the stage-withdrawal command
+var stageWithdrawalCmd = &cobra.Command{
+	Use:   "stage-withdrawal",
+	Short: "set up a cardless withdrawal",
+	Long: `reserve funds for a cardless withdrawal and get a one-time code to collect them
+requires one parameter, the amount to withdraw in units of $20
+the code can be entered with the redeem command, without a card or PIN, until it expires.
+amounts over the second factor threshold ask for a one-time code from accounts enrolled for them.
+It can also be run from the command line with --account when the simulator is started with --account-login,
+reading the PIN from standard input:
+	echo 1234 | atm-sim --account-login stage-withdrawal 100 --account 1434597300`,
+	Run: func(cmd *cobra.Command, args []string) {
+		defer resetFlags(cmd)
+		if len(args) != 1 {
+			say("stage-withdrawal takes one parameter - amount of the withdrawal\n")
+			return
+		}
+		// staged withdrawals are reserved and collected at this machine
+		if internal.IsRemoteHost() {
+			say("Cardless withdrawals are not available when connected to a bank host.\n")
+			return
+		}
+		accountId := internal.GetSession().AccountId
+		if stagedAccount != "" {
+			if !commandLine {
+				say("--account can only be given when stage-withdrawal is run from the command line.\n")
+				return
+			}
+			// like authorize, logging in by account number without a card needs --account-login
+			if !accountLogin {
+				say("Please insert your card to log in.\n")
+				return
+			}
+			if ok, err := verifyCustomer(stagedAccount); !ok {
+				if err != nil {
+					say("%s\n", err.Error())
+				}
+				return
+			}
+			accountId = stagedAccount
+		}
+		// staging reserves the cash like a withdrawal, so large amounts need a one-time code in the same way
+		if amount, err := internal.StringToMoney(args[0]); err == nil {
+			required, err := internal.GetBankHost().SecondFactorRequired(accountId, amount)
+			if err != nil {
+				journalError(err)
+				say("%s\n", err.Error())
+				return
+			}
+			if required && !askForOneTimeCode(accountId) {
+				say("Invalid one-time code. Withdrawal cancelled.\n")
+				return
+			}
+		}
+		staged, err := internal.GetLedgerService().StageWithdrawal(accountId, args[0], stagedExpiry)
+		if err != nil {
+			journalError(err)
+			say("%s\n", err.Error())
+			return
+		}
+		internal.Journal(internal.JournalTransaction, "", accountId,
+			fmt.Sprintf("cardless withdrawal $%.2f staged until %s", staged.Amount, staged.Expires.Format(time.RFC3339)))
+		say("Withdrawal code: %s\nCollect $%.2f before %s\n", staged.Code, staged.Amount, staged.Expires.Format("2006-01-02 15:04:05"))
+	},
+}
+
+// redeemCmd represents the redeem command
+var redeemCmd = &cobra.Command{
+	Use:   "redeem",
+	Short: "collect a cardless withdrawal",
+	Long: `collect cash staged with stage-withdrawal
+requires one parameter, the one-time withdrawal code
+no authorization is needed, each code can be used once`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			say("redeem takes one parameter - the withdrawal code\n")
+			return
+		}
+		// staged withdrawals are reserved and collected at this machine
+		if internal.IsRemoteHost() {
+			say("Cardless withdrawals are not available when connected to a bank host.\n")
+			return
+		}
+		staged, result, err := internal.GetLedgerService().RedeemWithdrawal(args[0])
+		if err != nil {
+			journalError(err)
+			say("%s\n", err.Error())
+			return
+		}
+		internal.Journal(internal.JournalTransaction, result.TransactionId, staged.AccountId,
+			fmt.Sprintf("cardless withdrawal $%.2f balance $%.2f", result.AmountWithdrawn, result.RemainingBalance))
+		if !dispense(staged.AccountId, result) {
+			return
+		}
+		say("Amount dispensed: $%.2f\n", result.AmountWithdrawn)
+		offerReceipt(internal.NewWithdrawalReceipt(staged.AccountId, result))
+	},
+}
+
+func init() {
+	stageWithdrawalCmd.Flags().StringVar(&stagedAccount, "account", "", "account to stage the withdrawal for, when run from the command line")
+	stageWithdrawalCmd.Flags().DurationVar(&stagedExpiry, "expires", 30*time.Minute, "how long the withdrawal code stays valid")
+	RootCmd.AddCommand(stageWithdrawalCmd)
+	RootCmd.AddCommand(redeemCmd)
+}
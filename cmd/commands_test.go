@@ -3,14 +3,19 @@ package cmd
 import (
 	"agile-coder.com/atm-sim/internal"
 	"bytes"
+	"crypto/sha1"
+	"encoding/base32"
 	"fmt"
 	"github.com/spf13/cobra"
 	"github.com/stretchr/testify/assert"
 	"io"
+	"net"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestAuthorizeCmd(t *testing.T) {
@@ -18,15 +23,24 @@ func TestAuthorizeCmd(t *testing.T) {
 	testCases := []struct {
 		name           string
 		args           []string
+		pin            string
 		expectedOutput string
 	}{
-		{name: "no params", args: []string{}, expectedOutput: "authorize requires 2 parameters: account number, pin\n"},
-		{name: "too many params", args: []string{accountId, "0000", "foo"}, expectedOutput: "authorize requires 2 parameters: account number, pin\n"},
-		{name: "good pin", args: []string{accountId, "0000"}, expectedOutput: "jc123 successfully authorized.\n"},
-		{name: "bad pin", args: []string{accountId, "1111"}, expectedOutput: "Authorization failed.\n"},
+		{name: "no params", args: []string{}, expectedOutput: "authorize requires 1 parameter: account number. You will be asked for your PIN.\n"},
+		{name: "pin as a param", args: []string{accountId, "0000"}, expectedOutput: "authorize requires 1 parameter: account number. You will be asked for your PIN.\n"},
+		{name: "good pin", args: []string{accountId}, pin: "0000\n", expectedOutput: "PIN: \njc123 successfully authorized.\n"},
+		{name: "bad pin", args: []string{accountId}, pin: "1111\n", expectedOutput: "PIN: \nAuthorization failed.\n"},
 	}
 
+	// without --account-login customers must insert their card
+	_, err := runAndGetOutput(authorizeCmd, "authorize", []string{accountId})
+	assert.EqualError(t, err, "Please insert your card to log in.\n")
+
+	AllowAccountLogin(true)
+	defer AllowAccountLogin(false)
+	defer internal.SetConsoleInput(nil)
 	for _, test := range testCases {
+		internal.SetConsoleInput(strings.NewReader(test.pin))
 		authService := internal.GetAuthorizationService()
 		encryptedPin, err := internal.EncryptPin("0000")
 		if err != nil {
@@ -52,7 +66,7 @@ func TestBalanceCmd(t *testing.T) {
 		expectedOutput string
 	}{
 		{name: "too many params", args: []string{"foo"}, balance: 40.00, expectedOutput: "the balance command does not take any parameters\n"},
-		{name: "value", args: []string{}, balance: 40.00, expectedOutput: "balance: $40.00\n"},
+		{name: "value", args: []string{}, balance: 40.00, expectedOutput: "balance: $40.00\navailable: $40.00\n"},
 	}
 
 	for _, test := range testCases {
@@ -93,6 +107,12 @@ func TestDepositCmd(t *testing.T) {
 		{name: "not a number",
 			args:           []string{"xyzzy"},
 			expectedOutput: "invalid input: invalid number format xyzzy\n"},
+		{name: "cash notes",
+			args:           []string{"--notes", "20x2,5x4"},
+			expectedOutput: "Current balance: $100.00\n"},
+		{name: "notes and amount",
+			args:           []string{"--notes", "20x2", "40.00"},
+			expectedOutput: "deposit does not take an amount when notes are given\n"},
 	}
 
 	for _, test := range testCases {
@@ -130,6 +150,65 @@ func TestLogoutCmd(t *testing.T) {
 	assert.Equal(t, expectedOutput, capturedText)
 }
 
+func TestSessionLifecycle(t *testing.T) {
+	accountId := "jc123"
+	authService := internal.GetAuthorizationService()
+	encryptedPin, err := internal.EncryptPin("0000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authService.SetAuthData(map[string]internal.EncryptedPin{accountId: encryptedPin})
+	AllowAccountLogin(true)
+	defer AllowAccountLogin(false)
+	defer internal.SetConsoleInput(nil)
+	internal.SetConsoleInput(strings.NewReader("0000\n"))
+	if _, err := runAndGetOutput(authorizeCmd, "authorize", []string{accountId}); err != nil {
+		t.Fatal(err)
+	}
+	session := internal.GetSession()
+	manager := internal.GetSessionManager()
+	id := session.Id
+	if id == "" || manager.Lookup(id) != session {
+		t.Fatalf("expected the authorized session to be tracked, got id %q", id)
+	}
+	if _, err := runAndGetOutput(logoutCmd, "logout", []string{}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, manager.Lookup(id))
+	assert.False(t, session.IsAuthenticated)
+}
+
+func TestSessionTimeout(t *testing.T) {
+	accountId := "jc123"
+	fakeClock := internal.NewFakeClock(time.Date(2023, 5, 1, 9, 0, 0, 0, time.UTC))
+	internal.SetClock(fakeClock)
+	defer internal.SetClock(nil)
+	manager := internal.GetSessionManager()
+	manager.SetPolicy(internal.SessionPolicy{IdleTimeout: 2 * time.Minute})
+	defer manager.SetPolicy(internal.DefaultSessionPolicy)
+
+	session := internal.GetSession()
+	session.IsAuthenticated = true
+	session.AccountId = accountId
+	manager.Start(session)
+	internal.GetLedgerService().SetInitialBalances(10000, map[string]float64{accountId: 40.00})
+
+	fakeClock.Advance(90 * time.Second)
+	capturedText, err := runAndGetOutput(balanceCmd, "balance", []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "balance: $40.00\navailable: $40.00\n", capturedText)
+
+	// the balance command counted as activity
+	fakeClock.Advance(90 * time.Second)
+	assert.True(t, session.IsAuthenticated)
+	fakeClock.Advance(30 * time.Second)
+	assert.False(t, session.IsAuthenticated)
+	_, err = runAndGetOutput(balanceCmd, "balance", []string{})
+	assert.EqualError(t, err, "Authorization required.\n")
+}
+
 func TestLogoutCmdNoUser(t *testing.T) {
 	session := internal.GetSession()
 	session.IsAuthenticated = false
@@ -189,11 +268,126 @@ func TestHistoryDetail(t *testing.T) {
 		t.Error("history command failed")
 	} else {
 		lines := strings.Split(capturedText, "\n")
-		assert.Equal(t, "date\t\t\t\tamount\t\tbalance", lines[0])
+		assert.Equal(t, "date\t\t\t\tamount\t\tbalance\t\ttransaction\t\ttype\t\tterminal\t\tparent\t\tdescription", lines[0])
 		historyLine := strings.Split(lines[1], "\t\t")
 		assert.Equal(t, "40.00", historyLine[1])
 		assert.Equal(t, "80.00", historyLine[2])
+		assert.Equal(t, ledger.GetHistory(accountId)[0].Id, historyLine[3])
+		assert.Equal(t, "deposit", historyLine[4])
+		assert.Equal(t, "-", historyLine[6])
+	}
+}
+
+func TestHistoryFilters(t *testing.T) {
+	accountId := "jc789"
+	session := internal.GetSession()
+	session.IsAuthenticated = true
+	session.AccountId = accountId
+
+	ledger := internal.GetLedgerService()
+	ledger.SetInitialBalances(10000, map[string]float64{
+		accountId: 40.00,
+	})
+	for _, amount := range []string{"10.00", "20.00", "30.00"} {
+		if _, err := ledger.Deposit(accountId, amount); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if _, err := ledger.Withdraw(accountId, "20.00"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	testCases := []struct {
+		name    string
+		args    []string
+		amounts []string
+		footer  string
+	}{
+		{name: "mini statement", args: []string{"--mini", "2"}, amounts: []string{"30.00", "-20.00"}, footer: "showing 1-2 of 4"},
+		{name: "type", args: []string{"--type", "withdrawal"}, amounts: []string{"-20.00"}},
+		{name: "page", args: []string{"--page", "2", "--page-size", "3"}, amounts: []string{"-20.00"}, footer: "showing 4-4 of 4"},
+		{name: "sort", args: []string{"--sort", "desc", "--min", "20"}, amounts: []string{"-20.00", "30.00", "20.00"}},
+		{name: "amounts under a dollar", args: []string{"--min", "0.50", "--max", "10.5"}, amounts: []string{"10.00"}},
+	}
+	for _, test := range testCases {
+		capturedText, err := runAndGetOutput(historyCmd, "history", test.args)
+		if err != nil {
+			t.Fatalf("%s failed: %s", test.name, err.Error())
+		}
+		lines := strings.Split(strings.TrimSuffix(capturedText, "\n"), "\n")[1:]
+		if test.footer != "" {
+			assert.Equal(t, test.footer, lines[len(lines)-1], test.name)
+			lines = lines[:len(lines)-1]
+		}
+		var amounts []string
+		for _, line := range lines {
+			amounts = append(amounts, strings.Split(line, "\t\t")[1])
+		}
+		assert.Equal(t, test.amounts, amounts, test.name)
+	}
+
+	_, err := runAndGetOutput(historyCmd, "history", []string{"--page", "1", "--limit", "2"})
+	assert.EqualError(t, err, "--page can not be combined with --limit or --offset\n")
+	_, err = runAndGetOutput(historyCmd, "history", []string{"--max", "-5"})
+	assert.EqualError(t, err, "invalid --max \"-5\", expected an amount such as 0.50\n")
+}
+
+func TestExportCmd(t *testing.T) {
+	accountId := "jc123"
+	session := internal.GetSession()
+	session.IsAuthenticated = true
+	session.AccountId = accountId
+
+	ledger := internal.GetLedgerService()
+	ledger.SetInitialBalances(10000, map[string]float64{
+		accountId: 40.00,
+	})
+	if _, err := ledger.Deposit(accountId, "40.00"); err != nil {
+		t.Fatal(err.Error())
 	}
+	path := filepath.Join(t.TempDir(), "history.qif")
+	capturedText, err := runAndGetOutput(exportCmd, "export", []string{"--format", "qif", "--output", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, fmt.Sprintf("Exported %d transactions to %s\n", len(ledger.GetHistory(accountId)), path), capturedText)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, strings.HasPrefix(string(data), "!Type:Bank\n"))
+
+	_, err = runAndGetOutput(exportCmd, "export", []string{"--format", "pdf"})
+	assert.EqualError(t, err, "invalid input: unknown export format \"pdf\"")
+}
+
+func TestGenerateStatementsCmd(t *testing.T) {
+	signOnOperator(t)
+	accountId := "jc123"
+	session := internal.GetSession()
+	session.IsAuthenticated = false
+
+	ledger := internal.GetLedgerService()
+	ledger.SetInitialBalances(10000, map[string]float64{
+		accountId: 40.00,
+	})
+	dir := t.TempDir()
+	history := filepath.Join(dir, "history.jsonl")
+	date := time.Date(2026, 9, 3, 10, 0, 0, 0, time.Local)
+	err := internal.ExportHistoryFile(history, internal.JSONLinesExport, accountId, []internal.LedgerHistoryEntry{
+		{Id: "A1", Type: internal.DepositTransaction, Date: date, Amount: 20, Balance: 60},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := filepath.Join(dir, "out")
+	capturedText, err := runAndGetOutput(statementsCmd, "statements", []string{"generate", "--period", "2026-09", "--history", history, "-o", output})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, strings.HasPrefix(capturedText, "jc123: 1 transactions, closing balance $60.00, written to"), capturedText)
+	_, err = os.Stat(filepath.Join(output, "jc123-2026-09.html"))
+	assert.NoError(t, err)
 }
 
 func TestUnauthorizedCmd(t *testing.T) {
@@ -272,41 +466,1135 @@ func TestWithdrawCommand(t *testing.T) {
 	}
 }
 
-func runAndGetOutput(cmd *cobra.Command, commandName string, args []string) (string, error) {
+func TestWithdrawPartialDispenseCommand(t *testing.T) {
+	testCases := []struct {
+		name           string
+		answer         string
+		expectedOutput string
+		endingCash     float64
+	}{
+		{name: "accepted",
+			answer:         "y\n",
+			expectedOutput: "This machine can only dispense $20.00 of the requested $40.00. Would you like $20.00 instead? (y/n): Amount dispensed: $20.00\nCurrent balance:20.00\n",
+			endingCash:     10.00,
+		},
+		{name: "declined",
+			answer:         "n\n",
+			expectedOutput: "This machine can only dispense $20.00 of the requested $40.00. Would you like $20.00 instead? (y/n): Withdrawal cancelled.\n",
+			endingCash:     30.00,
+		},
+	}
+
+	defer internal.SetConsoleInput(nil)
+	for _, test := range testCases {
+		accountId := "jc123"
+		session := internal.GetSession()
+		session.IsAuthenticated = true
+		session.AccountId = accountId
+
+		ledger := internal.GetLedgerService()
+		ledger.SetInitialBalances(30.00, map[string]float64{
+			accountId: 40.00,
+		})
+		internal.SetConsoleInput(strings.NewReader(test.answer))
+
+		capturedText, err := runAndGetOutput(withdrawCmd, "withdraw", []string{"40.00"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, test.expectedOutput, capturedText, "%s failed", test.name)
+		assert.Equal(t, test.endingCash, ledger.GetAvailableCash(), "%s failed", test.name)
+	}
+}
+
+func TestAdminChequeCmds(t *testing.T) {
+	signOnOperator(t)
+	accountId := "jc123"
+	session := internal.GetSession()
+	session.IsAuthenticated = false
+	image := filepath.Join(t.TempDir(), "cheque.png")
+	if err := os.WriteFile(image, []byte("image"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ledger := internal.GetLedgerService()
+	ledger.SetInitialBalances(10000, map[string]float64{
+		accountId: 40.00,
+	})
+	cheque, err := ledger.DepositCheque(accountId, internal.Cheque{Number: "1001", Payer: "ACME Corp", ImagePath: image, Amount: 25})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	capturedText, err := runAndGetOutput(adminCmd, "admin", []string{"cheques"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, capturedText, "CHQ0001\t\tjc123\t\t1001\t\t25.00\t\tACME Corp")
+
+	capturedText, err = runAndGetOutput(adminCmd, "admin", []string{"approve-cheque", cheque.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Cheque CHQ0001 approved. $25.00 is now available to jc123.\n", capturedText)
+	assert.Equal(t, 65.00, ledger.GetAvailableBalance(accountId))
+}
+
+func TestAdminReverseCmd(t *testing.T) {
+	signOnOperator(t)
+	accountId := "jc123"
 	internal.InitLogger("", true)
-	oldStdout := os.Stdout
-	r, w, _ := os.Pipe()
-	os.Stdout = w
-	defer func() {
-		os.Stdout = oldStdout
-	}()
+	session := internal.GetSession()
+	session.IsAuthenticated = false
+	ledger := internal.GetLedgerService()
+	ledger.SetInitialBalances(1000, map[string]float64{accountId: 40.00})
+	withdrawal, err := internal.WithdrawCash(accountId, "60", false, internal.NewIdempotencyKey())
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	// Start capturing stdout
-	var capturedOutput bytes.Buffer
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		_, _ = io.Copy(&capturedOutput, r)
-	}()
+	capturedText, err := runAndGetOutput(adminCmd, "admin", []string{"reverse", withdrawal.TransactionId, "20", "--id", "R1", "--reason", "jammed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	history := ledger.GetHistory(accountId)
+	reversal := history[len(history)-1]
+	assert.Equal(t, fmt.Sprintf("Reversed $20.00 of withdrawal %s as %s.\nOverdraft fee of $5.00 refunded.\nBalance of jc123: $0.00\n",
+		withdrawal.TransactionId, history[len(history)-2].Id), capturedText)
+	assert.Equal(t, "reversal: overdraft fee", reversal.Description)
+	assert.Equal(t, 960.00, ledger.GetAvailableCash())
 
-	// Execute the command
-	RootCmd.AddCommand(cmd)
-	cmd.SetArgs(args)
-	RootCmd.SetArgs(append([]string{commandName}, args...))
-	err := cmd.Execute()
+	capturedText, err = runAndGetOutput(adminCmd, "admin", []string{"reverse", withdrawal.TransactionId, "20", "--id", "R1"})
 	if err != nil {
-		return "", err
+		t.Fatal(err)
 	}
-	// Close the writer and wait for the goroutine to finish
-	err = w.Close()
+	assert.Equal(t, fmt.Sprintf("Reversal %s had already been applied.\n", history[len(history)-2].Id), capturedText)
+	assert.Equal(t, 960.00, ledger.GetAvailableCash())
+
+	_, err = runAndGetOutput(adminCmd, "admin", []string{"reverse", withdrawal.TransactionId, "60"})
+	assert.EqualError(t, err, fmt.Sprintf("invalid input: $40.00 of transaction %s can be reversed, not $60.00", withdrawal.TransactionId))
+	_, err = runAndGetOutput(adminCmd, "admin", []string{"reverse"})
+	assert.EqualError(t, err, "reverse requires 1 or 2 parameters: transaction id, amount\n")
+	_, err = runAndGetOutput(adminCmd, "admin", []string{"reverse", withdrawal.TransactionId, "--operator", "ops01"})
+	assert.EqualError(t, err, "--operator can only be given when reverse is run from the command line, use admin login\n")
+
+	// from the command line the operator's passcode is needed for each reversal
+	internal.GetOperators().SignOff()
+	commandLine = true
+	defer func() { commandLine = false }()
+	defer internal.SetConsoleInput(nil)
+	_, err = runAndGetOutput(adminCmd, "admin", []string{"reverse", withdrawal.TransactionId, "20"})
+	assert.EqualError(t, err, "reverse requires --operator when run from the command line\n")
+	internal.SetConsoleInput(strings.NewReader("1111\n"))
+	_, err = runAndGetOutput(adminCmd, "admin", []string{"reverse", withdrawal.TransactionId, "20", "--operator", "ops01"})
+	assert.EqualError(t, err, "Operator sign on failed.\n")
+	assert.Equal(t, 960.00, ledger.GetAvailableCash())
+	internal.SetConsoleInput(strings.NewReader("24681357\n"))
+	capturedText, err = runAndGetOutput(adminCmd, "admin", []string{"reverse", withdrawal.TransactionId, "20", "--operator", "ops01"})
 	if err != nil {
-		return "", fmt.Errorf("failed to close: %s", err.Error())
+		t.Fatal(err)
 	}
-	wg.Wait()
-	// Restore the original stdout
-	os.Stdout = oldStdout
+	assert.Contains(t, capturedText, "Passcode: \nReversed $20.00 of withdrawal "+withdrawal.TransactionId)
+	assert.Equal(t, 980.00, ledger.GetAvailableCash())
+	assert.Equal(t, "", internal.GetOperators().SignedOn())
+}
 
-	// Get the captured output
-	return capturedOutput.String(), nil
+func TestSplitArgs(t *testing.T) {
+	assert.Equal(t, []string{"deposit", "--payer", "ACME Corp", "--cheque", "12", "40.00"},
+		SplitArgs(`deposit  --payer "ACME Corp" --cheque 12 40.00`))
+	assert.Equal(t, []string{"reject-cheque", "CHQ0001", "it's bad"}, SplitArgs(`reject-cheque CHQ0001 "it's bad"`))
+	assert.Empty(t, SplitArgs("   "))
+}
+
+func TestKeepInHistory(t *testing.T) {
+	for line, keep := range map[string]bool{
+		"withdraw 1000":                                true,
+		"authorize 1434597300":                         true,
+		"authorize 1434597300 4557":                    false,
+		"authorize 4557":                               false,
+		"insert-card 4000001434597308":                 true,
+		"insert-card 4000001434597308 4557":            false,
+		"insert-card 4000001434597308 1434597300 4557": false,
+		"admin login ops01":                            true,
+		"admin login ops01 37191642":                   false,
+		"admin cheques":                                true,
+		"":                                             false,
+	} {
+		assert.Equal(t, keep, KeepInHistory(line), line)
+	}
+}
+
+func TestWithdrawReceipt(t *testing.T) {
+	accountId := "jc123"
+	session := internal.GetSession()
+	session.IsAuthenticated = true
+	session.AccountId = accountId
+
+	ledger := internal.GetLedgerService()
+	ledger.SetInitialBalances(10000, map[string]float64{
+		accountId: 40.00,
+	})
+	var receipt bytes.Buffer
+	internal.SetReceiptPrinter(&internal.ReceiptPrinter{Mode: internal.ConsoleReceipt, Output: &receipt})
+	defer internal.SetReceiptPrinter(nil)
+	internal.SetConsoleInput(strings.NewReader("y\n"))
+	defer internal.SetConsoleInput(nil)
+
+	capturedText, err := runAndGetOutput(withdrawCmd, "withdraw", []string{"60.00"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Amount dispensed: $60.00\nYou have been charged an overdraft fee of $5. Current balance:-25.00\nDo you want a receipt? (y/n): ", capturedText)
+	history := ledger.GetHistory(accountId)
+	assert.Contains(t, receipt.String(), "TRANSACTION"+strings.Repeat(" ", 9)+history[len(history)-2].Id+"\n")
+	assert.Contains(t, receipt.String(), "FEE                        $5.00\n")
+	assert.Contains(t, receipt.String(), "BALANCE                  -$25.00\n")
+}
+
+func TestJournalCmds(t *testing.T) {
+	accountId := "jc123"
+	session := internal.GetSession()
+	session.IsAuthenticated = true
+	session.AccountId = accountId
+
+	ledger := internal.GetLedgerService()
+	ledger.SetInitialBalances(10000, map[string]float64{
+		accountId: 40.00,
+	})
+	internal.SetJournal(internal.NewElectronicJournal(t.TempDir(), "ATM00001"))
+	defer internal.SetJournal(nil)
+
+	if _, err := runAndGetOutput(withdrawCmd, "withdraw", []string{"20.00"}); err != nil {
+		t.Fatal(err)
+	}
+	history := ledger.GetHistory(accountId)
+	transactionId := history[len(history)-1].Id
+
+	// the customer can not search the journal
+	_, err := runAndGetOutput(ejCmd, "ej", []string{"search", "--account", accountId})
+	assert.EqualError(t, err, "Operator sign on required, use admin login.\n")
+
+	signOnOperator(t)
+	capturedText, err := runAndGetOutput(ejCmd, "ej", []string{"search", "--txn", transactionId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(capturedText, "\n"), "\n")
+	assert.Len(t, lines, 2)
+	assert.Contains(t, lines[0], "|ATM00001|TXN  |"+transactionId+"|jc123           |withdrawal $20.00 partial=false balance $20.00")
+	assert.Contains(t, lines[1], "|ATM00001|CASH |"+transactionId+"|jc123           |dispensed 20x1")
+
+	capturedText, err = runAndGetOutput(ejCmd, "ej", []string{"search", "--account", accountId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, capturedText, "|CMD  |            |jc123           |withdraw 20.00\n")
+	assert.Contains(t, capturedText, "|CMD  |            |jc123           |ej search by operator ops01\n")
+}
+
+func TestJournalHidesSecrets(t *testing.T) {
+	internal.InitLogger("", true)
+	session := internal.GetSession()
+	session.IsAuthenticated = false
+	ej := internal.NewElectronicJournal(t.TempDir(), "ATM00001")
+	internal.SetJournal(ej)
+	defer internal.SetJournal(nil)
+	defer internal.SetConsoleInput(nil)
+
+	// the commands fail, but are journaled before they run
+	for _, args := range [][]string{{"insert-card", "4000002859459818", "2859459814", "4557"}, {"admin", "login", "ops01", "9876"},
+		{"authorize", "2859459814", "1234"}} {
+		internal.SetConsoleInput(strings.NewReader(""))
+		command, _, err := RootCmd.Find(args[:1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = runAndGetOutput(command, args[0], args[1:])
+	}
+	records, err := ej.Search(internal.JournalQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var text strings.Builder
+	for _, record := range records {
+		text.WriteString(record.Format() + "\n")
+	}
+	for _, secret := range []string{"4000002859459818", " 4557", " 9876", " 1234"} {
+		assert.NotContains(t, text.String(), secret)
+	}
+	assert.Contains(t, text.String(), "|insert-card ************9818 2859459814\n")
+	assert.Contains(t, text.String(), "|admin login ops01\n")
+	assert.Contains(t, text.String(), "|authorize 2859459814\n")
+}
+
+func TestInsertCardCmd(t *testing.T) {
+	accountId := "1434597300"
+	encryptedPin, err := internal.EncryptPin("4557")
+	if err != nil {
+		t.Fatal(err)
+	}
+	internal.GetAuthorizationService().SetAuthData(map[string]internal.EncryptedPin{accountId: encryptedPin})
+	cards := map[string]internal.Card{}
+	for _, record := range [][]string{
+		{"4000001434597308", "12/49", "201", accountId + ";2001377812", "active"},
+		{"4000009999999991", "12/49", "201", accountId, "hotlisted"},
+	} {
+		card, err := internal.NewCard(record[0], record[1], record[2], record[3], record[4])
+		if err != nil {
+			t.Fatal(err)
+		}
+		cards[card.PAN] = card
+	}
+	internal.GetCardReader().SetCards(cards)
+
+	testCases := []struct {
+		name           string
+		args           []string
+		input          string
+		expectedOutput string
+		authenticated  bool
+	}{
+		{name: "choose account", args: []string{"4000001434597308"}, input: "1\n4557\n",
+			expectedOutput: "Select an account:\n1. 1434597300\n2. 2001377812\nAccount: PIN: \n1434597300 successfully authorized.\n", authenticated: true},
+		{name: "account given", args: []string{"4000001434597308", accountId}, input: "4557\n",
+			expectedOutput: "PIN: \n1434597300 successfully authorized.\n", authenticated: true},
+		{name: "bad pin", args: []string{"4000001434597308", accountId}, input: "1111\n",
+			expectedOutput: "PIN: \nAuthorization failed.\nPlease take your card.\n", authenticated: false},
+		{name: "hotlisted", args: []string{"4000009999999991"},
+			expectedOutput: "This card can not be used. Please contact your bank.", authenticated: false},
+		{name: "unlinked account", args: []string{"4000001434597308", "2859459814"},
+			expectedOutput: "Account 2859459814 can not be used with this card.\n", authenticated: false},
+	}
+
+	defer internal.SetConsoleInput(nil)
+	for _, test := range testCases {
+		session := internal.GetSession()
+		session.IsAuthenticated = false
+		session.AccountId = ""
+		session.CardPAN = ""
+		internal.SetConsoleInput(strings.NewReader(test.input))
+		capturedText, err := runAndGetOutput(insertCardCmd, "insert-card", test.args)
+		if err != nil {
+			assert.Equal(t, test.expectedOutput, err.Error(), test.name)
+		} else {
+			assert.Equal(t, test.expectedOutput, capturedText, test.name)
+		}
+		assert.Equal(t, test.authenticated, session.IsAuthenticated, test.name)
+		if test.authenticated {
+			assert.Equal(t, "4000001434597308", session.CardPAN, test.name)
+			capturedText, err = runAndGetOutput(ejectCardCmd, "eject-card", []string{})
+			assert.NoError(t, err)
+			assert.Equal(t, "Account 1434597300 logged out.\nPlease take your card.\n", capturedText, test.name)
+		}
+		assert.Equal(t, "", session.CardPAN, test.name)
+	}
+}
+
+func TestTOTPEnrollCmd(t *testing.T) {
+	signOnOperator(t)
+	accountId := "totp01"
+	session := internal.GetSession()
+	session.IsAuthenticated = false
+	auth := internal.GetAuthorizationService()
+	auth.SetAuthData(map[string]internal.EncryptedPin{accountId: {}})
+
+	capturedText, err := runAndGetOutput(adminCmd, "admin", []string{"totp-enroll", accountId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri, err := auth.TOTPProvisioningURI(accountId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, capturedText, "uri: "+uri+"\n")
+
+	// enrolling again would lock the customer out of the authenticator app they set up
+	_, err = runAndGetOutput(adminCmd, "admin", []string{"totp-enroll", accountId})
+	assert.EqualError(t, err, "totp01 is already enrolled for one-time codes, use --force to replace its secret.\n")
+	replaced, _ := auth.TOTPProvisioningURI(accountId)
+	assert.Equal(t, uri, replaced)
+
+	capturedText, err = runAndGetOutput(adminCmd, "admin", []string{"totp-enroll", accountId, "--force"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	replaced, _ = auth.TOTPProvisioningURI(accountId)
+	assert.NotEqual(t, uri, replaced)
+	assert.Contains(t, capturedText, "uri: "+replaced+"\n")
+
+	// the operator must be signed on to enroll or show the secret
+	internal.GetOperators().SignOff()
+	for _, args := range [][]string{{"totp-enroll", accountId, "--force"}, {"totp-uri", accountId}} {
+		_, err = runAndGetOutput(adminCmd, "admin", args)
+		assert.EqualError(t, err, "Operator sign on required, use admin login.\n", args[0])
+	}
+}
+
+func TestAuthorizeSecondFactor(t *testing.T) {
+	accountId := "jc123"
+	auth := internal.GetAuthorizationService()
+	encryptedPin, err := internal.EncryptPin("0000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.SetAuthData(map[string]internal.EncryptedPin{accountId: encryptedPin})
+	auth.SetSecondFactorPolicy(internal.SecondFactorPolicy{OnLogin: true})
+	defer auth.SetSecondFactorPolicy(internal.SecondFactorPolicy{})
+	encoded, err := auth.EnrollTOTP(accountId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := internal.TOTPCode(secret, time.Now(), 6, sha1.New)
+
+	testCases := []struct {
+		name           string
+		input          string
+		expectedOutput string
+	}{
+		{name: "wrong code", input: "0000\n000000\n", expectedOutput: "PIN: \nOne-time code: Authorization failed.\n"},
+		{name: "valid code", input: "0000\n" + code + "\n", expectedOutput: "PIN: \nOne-time code: jc123 successfully authorized.\n"},
+	}
+	AllowAccountLogin(true)
+	defer AllowAccountLogin(false)
+	defer internal.SetConsoleInput(nil)
+	for _, test := range testCases {
+		internal.SetConsoleInput(strings.NewReader(test.input))
+		capturedText, err := runAndGetOutput(authorizeCmd, "authorize", []string{accountId})
+		if err != nil {
+			assert.Equal(t, test.expectedOutput, err.Error(), test.name)
+		} else {
+			assert.Equal(t, test.expectedOutput, capturedText, test.name)
+		}
+	}
+}
+
+func TestWithdrawSecondFactor(t *testing.T) {
+	accountId := "jc123"
+	session := internal.GetSession()
+	session.IsAuthenticated = true
+	session.AccountId = accountId
+
+	ledger := internal.GetLedgerService()
+	auth := internal.GetAuthorizationService()
+	auth.SetAuthData(map[string]internal.EncryptedPin{accountId: {}})
+	auth.SetSecondFactorPolicy(internal.SecondFactorPolicy{WithdrawalThreshold: 100})
+	defer auth.SetSecondFactorPolicy(internal.SecondFactorPolicy{})
+	encoded, err := auth.EnrollTOTP(accountId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := internal.TOTPCode(secret, time.Now(), 6, sha1.New)
+
+	testCases := []struct {
+		name           string
+		amount         string
+		input          string
+		expectedOutput string
+	}{
+		{name: "below threshold", amount: "100.00", expectedOutput: "Amount dispensed: $100.00\nCurrent balance:400.00\n"},
+		{name: "wrong code", amount: "120.00", input: "000000\n", expectedOutput: "One-time code: Invalid one-time code. Withdrawal cancelled.\n"},
+		{name: "valid code", amount: "120.00", input: code + "\n", expectedOutput: "One-time code: Amount dispensed: $120.00\nCurrent balance:380.00\n"},
+		{name: "reused code", amount: "120.00", input: code + "\n",
+			expectedOutput: "One-time code: This one-time code has already been used.\nInvalid one-time code. Withdrawal cancelled.\n"},
+	}
+	defer internal.SetConsoleInput(nil)
+	for _, test := range testCases {
+		ledger.SetInitialBalances(10000, map[string]float64{
+			accountId: 500.00,
+		})
+		internal.SetConsoleInput(strings.NewReader(test.input))
+		capturedText, err := runAndGetOutput(withdrawCmd, "withdraw", []string{test.amount})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, test.expectedOutput, capturedText, test.name)
+	}
+}
+
+func TestCardlessWithdrawalCmds(t *testing.T) {
+	accountId := "jc123"
+	session := internal.GetSession()
+	session.IsAuthenticated = true
+	session.AccountId = accountId
+	ledger := internal.GetLedgerService()
+	ledger.SetInitialBalances(10000, map[string]float64{
+		accountId: 500.00,
+	})
+
+	capturedText, err := runAndGetOutput(stageWithdrawalCmd, "stage-withdrawal", []string{"100", "--expires", "10m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, capturedText, "Collect $100.00 before")
+	staged := ledger.GetStagedWithdrawals(accountId)
+	if len(staged) != 1 {
+		t.Fatalf("expected 1 staged withdrawal got %d", len(staged))
+	}
+	capturedText, err = runAndGetOutput(balanceCmd, "balance", []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "balance: $500.00\navailable: $400.00\n", capturedText)
+
+	// the code is collected without an authorized customer
+	session.IsAuthenticated = false
+	session.AccountId = ""
+	capturedText, err = runAndGetOutput(redeemCmd, "redeem", []string{staged[0].Code})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Amount dispensed: $100.00\n", capturedText)
+	assert.Equal(t, 400.00, ledger.GetBalance(accountId))
+
+	capturedText, err = runAndGetOutput(redeemCmd, "redeem", []string{staged[0].Code})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "This withdrawal code is not valid.\n", capturedText)
+
+	// from the command line a withdrawal is staged for an account after checking its PIN
+	encryptedPin, err := internal.EncryptPin("0000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	internal.GetAuthorizationService().SetAuthData(map[string]internal.EncryptedPin{accountId: encryptedPin})
+	defer internal.SetConsoleInput(nil)
+	_, err = runAndGetOutput(stageWithdrawalCmd, "stage-withdrawal", []string{"60", "--account", accountId})
+	assert.EqualError(t, err, "Authorization required.\n")
+	commandLine = true
+	defer func() { commandLine = false }()
+	capturedText, err = runAndGetOutput(stageWithdrawalCmd, "stage-withdrawal", []string{"60", "--account", accountId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Please insert your card to log in.\n", capturedText)
+	AllowAccountLogin(true)
+	defer AllowAccountLogin(false)
+	internal.SetConsoleInput(strings.NewReader("1111\n"))
+	capturedText, err = runAndGetOutput(stageWithdrawalCmd, "stage-withdrawal", []string{"60", "--account", accountId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "PIN: \nAuthorization failed.\n", capturedText)
+	internal.SetConsoleInput(strings.NewReader("0000\n"))
+	capturedText, err = runAndGetOutput(stageWithdrawalCmd, "stage-withdrawal", []string{"60", "--account", accountId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, capturedText, "Collect $60.00 before")
+	assert.Len(t, ledger.GetStagedWithdrawals(accountId), 1)
+	assert.False(t, session.IsAuthenticated)
+
+	// staging over the second factor threshold needs a one-time code, as a withdrawal does
+	auth := internal.GetAuthorizationService()
+	auth.SetSecondFactorPolicy(internal.SecondFactorPolicy{WithdrawalThreshold: 100})
+	defer auth.SetSecondFactorPolicy(internal.SecondFactorPolicy{})
+	if _, err := auth.EnrollTOTP(accountId); err != nil {
+		t.Fatal(err)
+	}
+	internal.SetConsoleInput(strings.NewReader("0000\n000000\n"))
+	capturedText, err = runAndGetOutput(stageWithdrawalCmd, "stage-withdrawal", []string{"120", "--account", accountId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "PIN: \nOne-time code: Invalid one-time code. Withdrawal cancelled.\n", capturedText)
+	assert.Len(t, ledger.GetStagedWithdrawals(accountId), 1)
+}
+
+func TestServeCmd(t *testing.T) {
+	// customers log in to the API by account number, which needs --account-login
+	_, err := runAndGetOutput(serveCmd, "serve", []string{})
+	assert.EqualError(t, err, "The API logs customers in by account number. Start the simulator with --account-login to serve it.\n")
+	AllowAccountLogin(true)
+	defer AllowAccountLogin(false)
+	_, err = runAndGetOutput(serveCmd, "serve", []string{"--cert", "api.pem"})
+	assert.EqualError(t, err, "--cert and --key must be given together\n")
+	assert.Equal(t, "localhost:8080", serveCmd.Flags().Lookup("addr").DefValue)
+}
+
+func TestRemoteBankHost(t *testing.T) {
+	accountId := "jc123"
+	internal.InitLogger("", true)
+	dir := t.TempDir()
+	if err := internal.GenerateCertificates(dir, []string{"127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := internal.HostTLSConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostLedger := &internal.Ledger{}
+	hostLedger.SetInitialBalances(0, map[string]float64{accountId: 300.00})
+	encryptedPin, err := internal.EncryptPin("0000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostAuth := &internal.Authorization{}
+	hostAuth.SetAuthData(map[string]internal.EncryptedPin{accountId: encryptedPin})
+	server := internal.NewBankHostServer(internal.NewLocalHost(hostLedger, hostAuth), tlsConfig)
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	defer server.Stop()
+
+	// the terminal's own ledger holds the cash but not the account, and it presents the certificate for its id
+	terminal := internal.GetLedgerService()
+	terminal.SetInitialBalances(1000, map[string]float64{})
+	terminal.SetTerminalId("ATM00002")
+	defer terminal.SetTerminalId("")
+	if err := internal.IssueTerminalCertificate(dir, "ATM00002"); err != nil {
+		t.Fatal(err)
+	}
+	session := internal.GetSession()
+	session.IsAuthenticated = false
+	// the connection is only unencrypted when asked for
+	_, err = runAndGetOutput(connectCmd, "connect", []string{listener.Addr().String()})
+	assert.EqualError(t, err, "the bank host CA certificate is required, give --ca or --plaintext to connect without TLS\n")
+	capturedText, err := runAndGetOutput(connectCmd, "connect", []string{listener.Addr().String(), "--ca", filepath.Join(dir, internal.CACertificateFile)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, fmt.Sprintf("Connected to bank host %s\n", listener.Addr()), capturedText)
+	defer disconnectBankHost()
+
+	// the host declines requests for the account until the customer's PIN has been verified
+	session.IsAuthenticated = true
+	session.AccountId = accountId
+	capturedText, err = runAndGetOutput(withdrawCmd, "withdraw", []string{"100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Your PIN has not been verified. Please log in again.\n", capturedText)
+	session.IsAuthenticated = false
+	AllowAccountLogin(true)
+	defer AllowAccountLogin(false)
+	defer internal.SetConsoleInput(nil)
+	internal.SetConsoleInput(strings.NewReader("0000\n"))
+	capturedText, err = runAndGetOutput(authorizeCmd, "authorize", []string{accountId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "PIN: \njc123 successfully authorized.\n", capturedText)
+
+	capturedText, err = runAndGetOutput(withdrawCmd, "withdraw", []string{"100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Amount dispensed: $100.00\nCurrent balance:200.00\n", capturedText)
+	assert.Equal(t, 200.00, hostLedger.GetBalance(accountId))
+	assert.Equal(t, 900.00, terminal.GetAvailableCash())
+
+	capturedText, err = runAndGetOutput(balanceCmd, "balance", []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "balance: $200.00\navailable: $200.00\n", capturedText)
+
+	capturedText, err = runAndGetOutput(depositCmd, "deposit", []string{"50", "--cheque", "1001", "--payer", "acme", "--image", "cheque.png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Cheque deposits are not available when connected to a bank host.\n", capturedText)
+	session.IsAuthenticated = false
+}
+
+func TestISO8583BankHost(t *testing.T) {
+	accountId := "jc123"
+	internal.InitLogger("", true)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	hostLedger := &internal.Ledger{}
+	hostLedger.SetInitialBalances(0, map[string]float64{accountId: 300.00})
+	encryptedPin, err := internal.EncryptPin("0000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostAuth := &internal.Authorization{}
+	hostAuth.SetAuthData(map[string]internal.EncryptedPin{accountId: encryptedPin})
+	go func() {
+		_ = internal.NewISOHostServer(hostLedger, hostAuth, nil).Serve(listener)
+	}()
+
+	terminal := internal.GetLedgerService()
+	terminal.SetInitialBalances(1000, map[string]float64{})
+	session := internal.GetSession()
+	session.IsAuthenticated = false
+	capturedText, err := runAndGetOutput(connectCmd, "connect", []string{listener.Addr().String(), "--protocol", "iso8583"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, fmt.Sprintf("Connected to bank host %s\n", listener.Addr()), capturedText)
+	defer disconnectBankHost()
+
+	// the host declines requests for the account until the customer's PIN has been verified
+	session.IsAuthenticated = true
+	session.AccountId = accountId
+	capturedText, err = runAndGetOutput(withdrawCmd, "withdraw", []string{"100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Your PIN has not been verified. Please log in again.\n", capturedText)
+	assert.Equal(t, 300.00, hostLedger.GetBalance(accountId))
+	session.IsAuthenticated = false
+
+	AllowAccountLogin(true)
+	defer AllowAccountLogin(false)
+	defer internal.SetConsoleInput(nil)
+	internal.SetConsoleInput(strings.NewReader("0000\n"))
+	capturedText, err = runAndGetOutput(authorizeCmd, "authorize", []string{accountId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "PIN: \njc123 successfully authorized.\n", capturedText)
+
+	// the receipt is built from the host's response, as the host does not send the history
+	var receipt bytes.Buffer
+	internal.SetReceiptPrinter(&internal.ReceiptPrinter{Mode: internal.ConsoleReceipt, Output: &receipt})
+	defer internal.SetReceiptPrinter(nil)
+	internal.SetConsoleInput(strings.NewReader("y\n"))
+	capturedText, err = runAndGetOutput(withdrawCmd, "withdraw", []string{"100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Amount dispensed: $100.00\nCurrent balance:200.00\nDo you want a receipt? (y/n): ", capturedText)
+	assert.Equal(t, 200.00, hostLedger.GetBalance(accountId))
+	assert.Equal(t, 900.00, terminal.GetAvailableCash())
+	assert.Contains(t, receipt.String(), "TRANSACTION"+strings.Repeat(" ", 9)+hostLedger.GetHistory(accountId)[0].Id+"\n")
+	assert.Contains(t, receipt.String(), "BALANCE                  $200.00\n")
+	internal.SetConsoleInput(strings.NewReader("n\n"))
+
+	_, err = runAndGetOutput(depositCmd, "deposit", []string{"40"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 240.00, hostLedger.GetBalance(accountId))
+
+	capturedText, err = runAndGetOutput(balanceCmd, "balance", []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "balance: $240.00\navailable: $240.00\n", capturedText)
+	session.IsAuthenticated = false
+
+	_, err = runAndGetOutput(connectCmd, "connect", []string{listener.Addr().String(), "--protocol", "x25"})
+	assert.EqualError(t, err, "unknown protocol \"x25\", use grpc or iso8583\n")
+}
+
+// unreachableHost is a local bank host that can be taken down, or made to post deposits without answering
+type unreachableHost struct {
+	*internal.LocalHost
+	down       bool
+	unanswered int
+}
+
+func (host *unreachableHost) SecondFactorRequired(accountId string, withdrawal float64) (bool, error) {
+	if host.down {
+		return false, &internal.HostUnavailableError{NotSent: true}
+	}
+	return host.LocalHost.SecondFactorRequired(accountId, withdrawal)
+}
+
+func (host *unreachableHost) Withdraw(request internal.WithdrawalRequest) (*internal.WithdrawResult, error) {
+	if host.down {
+		return &internal.WithdrawResult{}, &internal.HostUnavailableError{NotSent: true}
+	}
+	return host.LocalHost.Withdraw(request)
+}
+
+func (host *unreachableHost) Advise(advice internal.WithdrawalAdvice) (*internal.WithdrawResult, error) {
+	if host.down {
+		return &internal.WithdrawResult{}, &internal.HostUnavailableError{NotSent: true}
+	}
+	return host.LocalHost.Advise(advice)
+}
+
+// Deposit posts the deposit without answering while unanswered deposits remain
+func (host *unreachableHost) Deposit(request internal.DepositRequest) (*internal.DepositResult, error) {
+	if host.down {
+		return nil, &internal.HostUnavailableError{NotSent: true}
+	}
+	result, err := host.LocalHost.Deposit(request)
+	if err == nil && host.unanswered > 0 {
+		host.unanswered--
+		return nil, &internal.HostUnavailableError{}
+	}
+	return result, err
+}
+
+func (host *unreachableHost) Close() error {
+	return nil
+}
+
+func TestStandInCmds(t *testing.T) {
+	signOnOperator(t)
+	accountId := "jc123"
+	internal.InitLogger("", true)
+	hostLedger := &internal.Ledger{}
+	hostLedger.SetInitialBalances(0, map[string]float64{accountId: 300.00})
+	host := &unreachableHost{LocalHost: internal.NewLocalHost(hostLedger, &internal.Authorization{})}
+	terminal := internal.GetLedgerService()
+	terminal.SetInitialBalances(1000, map[string]float64{})
+	session := internal.GetSession()
+	session.IsAuthenticated = false
+
+	_, err := runAndGetOutput(adminCmd, "admin", []string{"advices"})
+	assert.EqualError(t, err, "Stand-in is not enabled, connect to a bank host with --stand-in-limit.\n")
+	useBankHost(host)
+	defer disconnectBankHost()
+	queueFile := filepath.Join(t.TempDir(), "advices.json")
+	if err := EnableStandIn(internal.StandInPolicy{MaxWithdrawal: 60}, queueFile); err != nil {
+		t.Fatal(err)
+	}
+
+	host.down = true
+	session.IsAuthenticated = true
+	session.AccountId = accountId
+	capturedText, err := runAndGetOutput(withdrawCmd, "withdraw", []string{"60"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Amount dispensed: $60.00\nApproved offline. Your balance will be updated when the bank can be reached.\n", capturedText)
+	assert.Equal(t, 940.00, terminal.GetAvailableCash())
+	capturedText, err = runAndGetOutput(withdrawCmd, "withdraw", []string{"80"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Unable to reach the bank at this time.\n", capturedText)
+	session.IsAuthenticated = false
+
+	capturedText, err = runAndGetOutput(adminCmd, "admin", []string{"advices"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, capturedText, "\t\tjc123\t\t60.00\t\t")
+	assert.Contains(t, capturedText, "\t\tpending\n")
+	saved, err := os.ReadFile(queueFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(saved), `"account_id": "jc123"`)
+
+	_, err = runAndGetOutput(adminCmd, "admin", []string{"forward-advices"})
+	assert.EqualError(t, err, "Unable to reach the bank at this time.")
+	host.down = false
+	capturedText, err = runAndGetOutput(adminCmd, "admin", []string{"forward-advices"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Posted 1, already posted 0, rejected 0, remaining 0.\n", capturedText)
+	assert.Equal(t, 240.00, hostLedger.GetBalance(accountId))
+	assert.Equal(t, "cash withdrawal (offline)", hostLedger.GetHistory(accountId)[0].Description)
+}
+
+func TestNDCTerminalCmd(t *testing.T) {
+	accountId := "jc123"
+	pan := "4111111111111111"
+	internal.InitLogger("", true)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	encryptedPin, err := internal.EncryptPin("1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostAuth := &internal.Authorization{}
+	hostAuth.SetAuthData(map[string]internal.EncryptedPin{accountId: encryptedPin})
+	hostLedger := &internal.Ledger{}
+	hostLedger.SetInitialBalances(0, map[string]float64{accountId: 80.00})
+	card, err := internal.NewCard(pan, "12/49", "101", accountId, "active")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cards := &internal.CardReader{}
+	cards.SetCards(map[string]internal.Card{pan: card})
+	hostAuth.SetCardReader(cards)
+	go func() {
+		_ = internal.NewNDCHost(hostLedger, hostAuth, cards).Serve(listener)
+	}()
+
+	internal.GetSession().IsAuthenticated = false
+	internal.GetLedgerService().SetInitialBalances(1000, map[string]float64{})
+	defer internal.SetConsoleInput(nil)
+	internal.SetConsoleInput(strings.NewReader(pan + "\n1234\nA\n40\n" + "exit\n"))
+	capturedText, err := runAndGetOutput(ndcTerminalCmd, "ndc-terminal", []string{listener.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, capturedText, "Please take your cash.\nWITHDRAWAL $40.00 TXN ")
+	assert.Contains(t, capturedText, "Thank you.\nPlease take your card.\n")
+	assert.Equal(t, 40.00, hostLedger.GetBalance(accountId))
+	assert.Equal(t, 960.00, internal.GetLedgerService().GetAvailableCash())
+}
+
+func runAndGetOutput(cmd *cobra.Command, commandName string, args []string) (string, error) {
+	internal.InitLogger("", true)
+	oldStdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+	defer func() {
+		os.Stdout = oldStdout
+	}()
+
+	// Start capturing stdout
+	var capturedOutput bytes.Buffer
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(&capturedOutput, r)
+	}()
+
+	// Execute the command
+	RootCmd.AddCommand(cmd)
+	cmd.SetArgs(args)
+	RootCmd.SetArgs(append([]string{commandName}, args...))
+	err := cmd.Execute()
+	if err != nil {
+		return "", err
+	}
+	// Close the writer and wait for the goroutine to finish
+	err = w.Close()
+	if err != nil {
+		return "", fmt.Errorf("failed to close: %s", err.Error())
+	}
+	wg.Wait()
+	// Restore the original stdout
+	os.Stdout = oldStdout
+
+	// Get the captured output
+	return capturedOutput.String(), nil
+}
+
+func TestDispenserCmds(t *testing.T) {
+	signOnOperator(t)
+	accountId := "jc123"
+	internal.InitLogger("", true)
+	internal.SetDevices(nil)
+	defer internal.SetDevices(nil)
+	session := internal.GetSession()
+	session.IsAuthenticated = true
+	session.AccountId = accountId
+	ledger := internal.GetLedgerService()
+	ledger.SetInitialBalances(1000, map[string]float64{accountId: 100.00})
+
+	capturedText, err := runAndGetOutput(adminCmd, "admin", []string{"inject-fault", "jam", "--after", "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "The next withdrawal will fail with jam.\n", capturedText)
+	_, err = runAndGetOutput(adminCmd, "admin", []string{"inject-fault", "fire"})
+	assert.EqualError(t, err, "invalid input: unknown dispenser fault \"fire\"")
+
+	capturedText, _ = runAndGetOutput(withdrawCmd, "withdraw", []string{"60"})
+	assert.Equal(t, "The cash dispenser failed. $60.00 was not dispensed and has been returned to your account.\n", capturedText)
+	assert.Equal(t, 100.00, ledger.GetBalance(accountId))
+	capturedText, _ = runAndGetOutput(withdrawCmd, "withdraw", []string{"20"})
+	assert.Equal(t, "The cash dispenser is out of service.\n", capturedText)
+
+	capturedText, err = runAndGetOutput(adminCmd, "admin", []string{"dispenser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Dispenser: out of service (jam)\nCassette: $960.00\nDispensed: $0.00\nReject bin: $40.00\nRetract bin: $0.00\nShortage: $0.00\n", capturedText)
+
+	capturedText, err = runAndGetOutput(adminCmd, "admin", []string{"clear-dispenser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Dispenser back in service.\n", capturedText)
+	capturedText, _ = runAndGetOutput(withdrawCmd, "withdraw", []string{"20"})
+	assert.Equal(t, "Amount dispensed: $20.00\nCurrent balance:80.00\n", capturedText)
+	assert.Equal(t, 940.00, ledger.GetAvailableCash())
+}
+
+func TestScriptedDevices(t *testing.T) {
+	accountId := "1434597300"
+	internal.InitLogger("", true)
+	encryptedPin, err := internal.EncryptPin("4557")
+	if err != nil {
+		t.Fatal(err)
+	}
+	internal.GetAuthorizationService().SetAuthData(map[string]internal.EncryptedPin{accountId: encryptedPin})
+	card, err := internal.NewCard("4000001434597308", "12/49", "201", accountId+";2001377812", "active")
+	if err != nil {
+		t.Fatal(err)
+	}
+	internal.GetCardReader().SetCards(map[string]internal.Card{card.PAN: card})
+	ledger := internal.GetLedgerService()
+	ledger.SetInitialBalances(1000, map[string]float64{accountId: 100.00})
+	session := internal.GetSession()
+	session.IsAuthenticated = false
+	session.AccountId = ""
+	session.CardPAN = ""
+
+	// the customer picks the first account, enters the PIN, declines a receipt and asks for one for the withdrawal
+	devices := internal.NewScriptedDevices("1", "4557", "n", "y")
+	internal.SetDevices(devices)
+	defer internal.SetDevices(nil)
+	defer resetFlags(depositCmd)
+	for _, step := range [][]string{{"insert-card", "4000001434597308"}, {"deposit", "--notes", "20x2,5x4"}, {"withdraw", "60"}, {"eject-card"}} {
+		command, _, err := RootCmd.Find(step[:1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		capturedText, err := runAndGetOutput(command, step[0], step[1:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "", capturedText, step[0])
+	}
+
+	display := devices.Display.(*internal.ScriptedDisplay)
+	deposits := devices.DepositModule.(*internal.ScriptedDepositModule)
+	assert.Equal(t, "Select an account:\n1. 1434597300\n2. 2001377812\nAccount: PIN: \n1434597300 successfully authorized.\n"+
+		"Current balance: $160.00\nDo you want a receipt? (y/n): "+
+		"Amount dispensed: $60.00\nCurrent balance:100.00\nDo you want a receipt? (y/n): "+
+		"Account 1434597300 logged out.\nPlease take your card.\n", display.Text())
+	assert.Equal(t, 1, devices.CardReader.(*internal.ScriptedCardReader).Ejected)
+	assert.Equal(t, map[int]int{20: 2, 5: 4}, deposits.Stored)
+	receipts := devices.ReceiptPrinter.(*internal.ScriptedReceiptPrinter).Receipts
+	if assert.Len(t, receipts, 1) {
+		assert.Equal(t, -60.00, receipts[0].Amount)
+	}
+
+	// notes the deposit module refuses are given back before the deposit is posted
+	deposits.Reject = []int{5}
+	session.IsAuthenticated = true
+	session.AccountId = accountId
+	devices.PINPad.(*internal.ScriptedPINPad).Entries = []string{"n"}
+	if _, err := runAndGetOutput(depositCmd, "deposit", []string{"--notes", "20x1,5x2"}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[int]int{20: 3, 5: 4}, deposits.Stored)
+	assert.Contains(t, display.Text(), "Some notes were not accepted, please take them.\nCurrent balance: $120.00\n")
+	session.IsAuthenticated = false
+	session.AccountId = ""
+}
+
+func TestDepositCashNotAnswered(t *testing.T) {
+	accountId := "jc123"
+	internal.InitLogger("", true)
+	hostLedger := &internal.Ledger{}
+	hostLedger.SetInitialBalances(0, map[string]float64{accountId: 100.00})
+	host := &unreachableHost{LocalHost: internal.NewLocalHost(hostLedger, &internal.Authorization{})}
+	useBankHost(host)
+	defer disconnectBankHost()
+	devices := internal.NewScriptedDevices()
+	internal.SetDevices(devices)
+	defer internal.SetDevices(nil)
+	deposits := devices.DepositModule.(*internal.ScriptedDepositModule)
+	session := internal.GetSession()
+	session.IsAuthenticated = true
+	session.AccountId = accountId
+	defer func() {
+		session.IsAuthenticated = false
+		session.AccountId = ""
+	}()
+
+	// a deposit that was not answered is sent again with the same key and posted once
+	host.unanswered = 1
+	devices.PINPad.(*internal.ScriptedPINPad).Entries = []string{"n"}
+	if _, err := runAndGetOutput(depositCmd, "deposit", []string{"--notes", "20x2"}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 140.00, hostLedger.GetBalance(accountId))
+	assert.Equal(t, map[int]int{20: 2}, deposits.Stored)
+
+	// notes are kept when the deposit is still not answered, as it may have been posted
+	host.unanswered = depositResends + 1
+	display := devices.Display.(*internal.ScriptedDisplay)
+	if _, err := runAndGetOutput(depositCmd, "deposit", []string{"--notes", "50x1"}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, display.Text(), "The bank did not confirm your deposit. Your notes have been kept and the deposit will be confirmed by the bank.\n"+
+		"Unable to reach the bank at this time.\n")
+	assert.Equal(t, 190.00, hostLedger.GetBalance(accountId))
+	assert.Equal(t, map[int]int{20: 2, 50: 1}, deposits.Stored)
+	assert.Empty(t, deposits.Returned)
+
+	// and given back when the deposit did not reach the host
+	host.unanswered = 0
+	host.down = true
+	if _, err := runAndGetOutput(depositCmd, "deposit", []string{"--notes", "10x1"}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, display.Text(), "Please take your notes.\nUnable to reach the bank at this time.\n")
+	assert.Equal(t, map[int]int{10: 1}, deposits.Returned)
+	assert.Equal(t, 190.00, hostLedger.GetBalance(accountId))
+}
+
+// signOnOperator signs a test operator on for the operator commands, signing them off when the test ends
+func signOnOperator(t *testing.T) {
+	t.Helper()
+	passcode, err := internal.EncryptPin("24681357")
+	if err != nil {
+		t.Fatal(err)
+	}
+	operators := internal.GetOperators()
+	operators.SetOperators(map[string]internal.EncryptedPin{"ops01": passcode})
+	if !operators.SignOn("ops01", "24681357") {
+		t.Fatal("unable to sign on the test operator")
+	}
+	t.Cleanup(func() { operators.SignOff() })
+}
+
+func TestAdminLoginCmd(t *testing.T) {
+	internal.InitLogger("", true)
+	passcode, err := internal.EncryptPin("24681357")
+	if err != nil {
+		t.Fatal(err)
+	}
+	internal.GetOperators().SetOperators(map[string]internal.EncryptedPin{"ops01": passcode})
+	session := internal.GetSession()
+	session.IsAuthenticated = false
+	defer internal.SetConsoleInput(nil)
+
+	// no operator command runs until an operator signs on, whether or not a customer is authorized
+	for _, args := range [][]string{{"admin", "cheques"}, {"admin", "totp-uri", "jc123"}, {"admin", "reverse", "000000000000"},
+		{"admin", "inject-fault", "jam"}, {"admin", "clear-dispenser"}, {"statements", "generate"}} {
+		command, _, err := RootCmd.Find(args[:1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = runAndGetOutput(command, args[0], args[1:])
+		assert.EqualError(t, err, "Operator sign on required, use admin login.\n", strings.Join(args, " "))
+	}
+
+	internal.SetConsoleInput(strings.NewReader("1111\n"))
+	_, err = runAndGetOutput(adminCmd, "admin", []string{"login", "ops01"})
+	assert.EqualError(t, err, "Operator sign on failed.\n")
+	internal.SetConsoleInput(strings.NewReader("24681357\n"))
+	capturedText, err := runAndGetOutput(adminCmd, "admin", []string{"login", "ops01"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Passcode: \nOperator ops01 signed on.\n", capturedText)
+	capturedText, err = runAndGetOutput(adminCmd, "admin", []string{"cheques"})
+	assert.NoError(t, err)
+	assert.Equal(t, "No cheques pending verification\n", capturedText)
+
+	// the operator is signed off after being idle
+	clock := internal.NewFakeClock(time.Now())
+	internal.SetClock(clock)
+	defer internal.SetClock(nil)
+	assert.Equal(t, "ops01", internal.GetOperators().SignedOn())
+	clock.Advance(internal.DefaultOperatorTimeout)
+	_, err = runAndGetOutput(adminCmd, "admin", []string{"cheques"})
+	assert.EqualError(t, err, "Operator sign on required, use admin login.\n")
+	capturedText, _ = runAndGetOutput(adminCmd, "admin", []string{"logout"})
+	assert.Equal(t, "No operator is signed on.\n", capturedText)
 }
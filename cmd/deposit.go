@@ -2,31 +2,161 @@ package cmd
 
 import (
 	"agile-coder.com/atm-sim/internal"
+	"errors"
 	"fmt"
 	"github.com/spf13/cobra"
 )
 
+// flags describing the type of deposit
+var (
+	depositNotes       string
+	depositChequeNum   string
+	depositChequePayer string
+	depositChequeImage string
+)
+
 // depositCmd represents the deposit command
 var depositCmd = &cobra.Command{
 	Use:   "deposit",
 	Short: "make a deposit",
 	Long: `Deposit funds in the account
-required parameter: amount to deposit in dollars and cents`,
+required parameter: amount to deposit in dollars and cents
+cash deposits may instead give the notes inserted, e.g. --notes 20x3,100x1
+cheque deposits require --cheque <number> --payer <name> --image <path> and the amount;
+the funds from a cheque are held until the cheque has been verified`,
 	Run: func(cmd *cobra.Command, args []string) {
-		if len(args) != 1 {
-			fmt.Println("deposit takes one parameter - amount of the deposit")
-			return
-		}
+		defer resetFlags(cmd)
 		session := internal.GetSession()
-		newBalance, err := internal.GetLedgerService().Deposit(session.AccountId, args[0])
+		var result *internal.DepositResult
+		var err error
+		switch {
+		case depositNotes != "":
+			if len(args) != 0 {
+				say("deposit does not take an amount when notes are given\n")
+				return
+			}
+			var notes map[int]int
+			notes, err = internal.ParseNotes(depositNotes)
+			if err == nil {
+				result, err = depositCash(session.AccountId, notes)
+			}
+		case depositChequeNum != "":
+			if len(args) != 1 {
+				say("deposit takes one parameter - amount of the cheque\n")
+				return
+			}
+			// cheques are verified at the machine they were deposited in
+			if internal.IsRemoteHost() {
+				say("Cheque deposits are not available when connected to a bank host.\n")
+				return
+			}
+			result, err = depositCheque(session.AccountId, args[0])
+		default:
+			if len(args) != 1 {
+				say("deposit takes one parameter - amount of the deposit\n")
+				return
+			}
+			result, err = internal.DepositFunds(session.AccountId, args[0], internal.NewIdempotencyKey())
+		}
 		if err != nil {
-			fmt.Println(err.Error())
+			journalError(err)
+			say("%s\n", err.Error())
 		} else {
-			fmt.Printf("Current balance: $%.2f\n", newBalance)
+			transactionId := result.Entry.Id
+			internal.Journal(internal.JournalTransaction, transactionId, session.AccountId, fmt.Sprintf("deposit balance $%.2f", result.Entry.Balance))
+			say("Current balance: $%.2f\n", result.Entry.Balance)
+			if result.Pending > 0 {
+				say("$%.2f is on hold. Available balance: $%.2f\n", result.Pending, result.Available)
+			}
+			offerReceipt(internal.NewDepositReceipt(session.AccountId, result))
 		}
 	},
 }
 
+// depositResends is how many times a cash deposit the bank host did not answer is sent again with the same key
+const depositResends = 2
+
+// depositCash counts the notes into escrow on the deposit module, storing them once the deposit is posted.
+// The notes are given back only when the deposit is declined or did not reach the bank host. One the host did not
+// answer is sent again with the same key, so it is posted once, and if it is still not answered the notes are kept
+// and journaled for the bank to confirm the deposit
+func depositCash(accountId string, notes map[int]int) (*internal.DepositResult, error) {
+	module := internal.GetDevices().DepositModule
+	accepted, err := module.AcceptNotes(notes)
+	if err != nil {
+		return nil, err
+	}
+	if internal.FormatNotes(accepted) != internal.FormatNotes(notes) {
+		say("Some notes were not accepted, please take them.\n")
+	}
+	key := internal.NewIdempotencyKey()
+	result, err := internal.DepositNotes(accountId, accepted, key)
+	for resend := 0; resend < depositResends && notAnswered(err); resend++ {
+		internal.Logger.Printf("cash deposit %s was not answered, sending it again: %+v\n", key, err)
+		result, err = internal.DepositNotes(accountId, accepted, key)
+	}
+	if notAnswered(err) {
+		if err := module.StoreNotes(); err != nil {
+			internal.Logger.Printf("unable to store the notes in escrow: %+v\n", err)
+		}
+		internal.Journal(internal.JournalError, key, accountId, "cash deposit not confirmed by the bank host, kept "+internal.FormatNotes(accepted))
+		say("The bank did not confirm your deposit. Your notes have been kept and the deposit will be confirmed by the bank.\n")
+		return nil, err
+	}
+	if err != nil {
+		if err := module.ReturnNotes(); err != nil {
+			internal.Logger.Printf("unable to return the notes in escrow: %+v\n", err)
+		}
+		say("Please take your notes.\n")
+		return nil, err
+	}
+	if err := module.StoreNotes(); err != nil {
+		internal.Logger.Printf("unable to store the notes in escrow: %+v\n", err)
+	}
+	internal.Journal(internal.JournalCash, result.Entry.Id, accountId, "accepted "+internal.FormatNotes(accepted))
+	return result, nil
+}
+
+// notAnswered tells whether a request may have reached the bank host without an answer coming back
+func notAnswered(err error) bool {
+	var unavailable *internal.HostUnavailableError
+	return errors.As(err, &unavailable) && !unavailable.NotSent
+}
+
+// depositCheque puts a cheque in this machine's verification queue
+func depositCheque(accountId string, amount string) (*internal.DepositResult, error) {
+	chequeAmount, err := internal.StringToMoney(amount)
+	if err != nil {
+		return nil, err
+	}
+	ledger := internal.GetLedgerService()
+	cheque, err := ledger.DepositCheque(accountId, internal.Cheque{
+		Number:    depositChequeNum,
+		Payer:     depositChequePayer,
+		ImagePath: depositChequeImage,
+		Amount:    chequeAmount,
+	})
+	if err != nil {
+		return nil, err
+	}
+	say("Cheque %s received and is pending verification.\n", cheque.Id)
+	entry := internal.LedgerHistoryEntry{Id: cheque.TransactionId, Balance: ledger.GetBalance(accountId)}
+	for _, posted := range ledger.GetHistory(accountId) {
+		if posted.Id == cheque.TransactionId {
+			entry = posted
+		}
+	}
+	return &internal.DepositResult{
+		Entry:     entry,
+		Available: ledger.GetAvailableBalance(accountId),
+		Pending:   ledger.GetPendingFunds(accountId),
+	}, nil
+}
+
 func init() {
+	depositCmd.Flags().StringVar(&depositNotes, "notes", "", "notes inserted as <denomination>x<count>, comma separated")
+	depositCmd.Flags().StringVar(&depositChequeNum, "cheque", "", "cheque number")
+	depositCmd.Flags().StringVar(&depositChequePayer, "payer", "", "name of the cheque payer")
+	depositCmd.Flags().StringVar(&depositChequeImage, "image", "", "path to the scanned cheque image")
 	RootCmd.AddCommand(depositCmd)
 }
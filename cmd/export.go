@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"agile-coder.com/atm-sim/internal"
+	"fmt"
+	"github.com/spf13/cobra"
+	"strings"
+)
+
+// flags for the export command
+var (
+	exportFormat string
+	exportOutput string
+)
+
+// exportCmd represents the export command
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "export transaction history to a file",
+	Long: `writes the transaction history of the account to a file
+--format is one of csv, jsonl, ofx or qif (default csv)
+--output is the file to write, defaulting to <account>-history.<format>`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		defer resetFlags(cmd)
+		if len(args) != 0 {
+			return fmt.Errorf("the export command does not take any parameters\n")
+		}
+		format, err := internal.ParseExportFormat(exportFormat)
+		if err != nil {
+			return err
+		}
+		session := internal.GetSession()
+		path := exportOutput
+		if path == "" {
+			path = fmt.Sprintf("%s-history.%s", session.AccountId, format)
+		}
+		entries, _, err := internal.GetBankHost().History(session.AccountId, internal.HistoryQuery{})
+		if err != nil {
+			return err
+		}
+		if err = internal.ExportHistoryFile(path, format, session.AccountId, entries); err != nil {
+			return err
+		}
+		fmt.Printf("Exported %d transactions to %s\n", len(entries), path)
+		return nil
+	},
+}
+
+func init() {
+	var formats []string
+	for _, format := range internal.ExportFormats {
+		formats = append(formats, string(format))
+	}
+	exportCmd.Flags().StringVar(&exportFormat, "format", string(internal.CSVExport), "export format: "+strings.Join(formats, ", "))
+	exportCmd.Flags().StringVarP(&exportOutput, "output", "o", "", "file to write the export to")
+	RootCmd.AddCommand(exportCmd)
+}
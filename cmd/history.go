@@ -4,32 +4,163 @@ import (
 	"agile-coder.com/atm-sim/internal"
 	"fmt"
 	"github.com/spf13/cobra"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const historyDateFormat = "2006-01-02"
+
+// flags for filtering and paging the history
+var (
+	historyFrom     string
+	historyTo       string
+	historyTypes    string
+	historyMin      string
+	historyMax      string
+	historyLimit    int
+	historyOffset   int
+	historyPage     int
+	historyPageSize int
+	historySort     string
+	historyMini     int
 )
 
 // historyCmd represents the history command
 var historyCmd = &cobra.Command{
 	Use:   "history",
 	Short: "view transaction history",
-	Long:  `shows a history of all deposits and withdrawals`,
+	Long: `shows a history of all deposits, withdrawals, fees and reversals
+the history can be filtered by date (--from, --to as YYYY-MM-DD, both inclusive),
+transaction type (--type, comma separated) and amount (--min, --max),
+sorted (--sort asc|desc) and paged with --limit/--offset or --page/--page-size
+--mini N shows a mini statement of the last N transactions`,
 	RunE: func(cmd *cobra.Command, args []string) error {
+		defer resetFlags(cmd)
 		if len(args) != 0 {
 			return fmt.Errorf("the history command does not take any parameters\n")
 		}
+		query, err := historyQuery()
+		if err != nil {
+			return err
+		}
 		session := internal.GetSession()
-		historyEntries := internal.GetLedgerService().GetHistory(session.AccountId)
+		historyEntries, total, err := internal.GetBankHost().History(session.AccountId, query)
+		if err != nil {
+			return err
+		}
+		if historyMini > 0 {
+			// a mini statement lists the most recent transactions oldest first
+			for i, j := 0, len(historyEntries)-1; i < j; i, j = i+1, j-1 {
+				historyEntries[i], historyEntries[j] = historyEntries[j], historyEntries[i]
+			}
+		}
 		if len(historyEntries) == 0 {
-			fmt.Println("No history found")
+			say("No history found\n")
 			return nil
 		}
-		fmt.Println("date\t\t\t\tamount\t\tbalance")
+		say("date\t\t\t\tamount\t\tbalance\t\ttransaction\t\ttype\t\tterminal\t\tparent\t\tdescription\n")
 		for _, entry := range historyEntries {
 			formattedDate := entry.Date.Format("2006-01-02 15:04:05Z")
-			fmt.Printf("%s\t\t%.2f\t\t%.2f\n", formattedDate, entry.Amount, entry.Balance)
+			parentId := entry.ParentId
+			if parentId == "" {
+				parentId = "-"
+			}
+			say("%s\t\t%.2f\t\t%.2f\t\t%s\t\t%s\t\t%s\t\t%s\t\t%s\n", formattedDate, entry.Amount, entry.Balance,
+				entry.Id, entry.Type, entry.TerminalId, parentId, entry.Description)
+		}
+		if len(historyEntries) < total {
+			say("showing %d-%d of %d\n", query.Offset+1, query.Offset+len(historyEntries), total)
 		}
 		return nil
 	},
 }
 
+// historyQuery maps the history flags on to a ledger history query
+func historyQuery() (internal.HistoryQuery, error) {
+	query := internal.HistoryQuery{Offset: historyOffset, Limit: historyLimit}
+	var err error
+	if historyFrom != "" {
+		if query.From, err = time.ParseInLocation(historyDateFormat, historyFrom, time.Local); err != nil {
+			return query, fmt.Errorf("invalid --from date \"%s\", expected YYYY-MM-DD\n", historyFrom)
+		}
+	}
+	if historyTo != "" {
+		if query.To, err = time.ParseInLocation(historyDateFormat, historyTo, time.Local); err != nil {
+			return query, fmt.Errorf("invalid --to date \"%s\", expected YYYY-MM-DD\n", historyTo)
+		}
+		// include the whole of the last day
+		query.To = query.To.AddDate(0, 0, 1)
+	}
+	if historyTypes != "" {
+		for _, name := range strings.Split(historyTypes, ",") {
+			transactionType, err := internal.ParseTransactionType(strings.TrimSpace(name))
+			if err != nil {
+				return query, err
+			}
+			query.Types = append(query.Types, transactionType)
+		}
+	}
+	if historyMin != "" {
+		minAmount, err := parseAmountFilter("--min", historyMin)
+		if err != nil {
+			return query, err
+		}
+		query.MinAmount = &minAmount
+	}
+	if historyMax != "" {
+		maxAmount, err := parseAmountFilter("--max", historyMax)
+		if err != nil {
+			return query, err
+		}
+		query.MaxAmount = &maxAmount
+	}
+	switch historySort {
+	case "asc":
+	case "desc":
+		query.Descending = true
+	default:
+		return query, fmt.Errorf("invalid --sort \"%s\", expected asc or desc\n", historySort)
+	}
+	if historyLimit < 0 || historyOffset < 0 || historyPage < 0 || historyPageSize < 1 || historyMini < 0 {
+		return query, fmt.Errorf("paging values must not be negative\n")
+	}
+	if historyPage > 0 {
+		if historyLimit > 0 || historyOffset > 0 {
+			return query, fmt.Errorf("--page can not be combined with --limit or --offset\n")
+		}
+		query.Offset = (historyPage - 1) * historyPageSize
+		query.Limit = historyPageSize
+	}
+	if historyMini > 0 {
+		query.Descending = true
+		query.Offset = 0
+		query.Limit = historyMini
+	}
+	return query, nil
+}
+
+// parseAmountFilter reads an amount to filter the history by. Unlike a withdrawal any amount of cents is allowed
+func parseAmountFilter(flag string, value string) (float64, error) {
+	amount, err := strconv.ParseFloat(strings.TrimPrefix(value, "$"), 64)
+	if err != nil || amount < 0 || math.IsInf(amount, 0) || math.IsNaN(amount) {
+		return 0, fmt.Errorf("invalid %s \"%s\", expected an amount such as 0.50\n", flag, value)
+	}
+	return amount, nil
+}
+
 func init() {
+	historyCmd.Flags().StringVar(&historyFrom, "from", "", "only show transactions on or after this date (YYYY-MM-DD)")
+	historyCmd.Flags().StringVar(&historyTo, "to", "", "only show transactions on or before this date (YYYY-MM-DD)")
+	historyCmd.Flags().StringVar(&historyTypes, "type", "", "only show these transaction types, comma separated")
+	historyCmd.Flags().StringVar(&historyMin, "min", "", "only show transactions of at least this amount")
+	historyCmd.Flags().StringVar(&historyMax, "max", "", "only show transactions of at most this amount")
+	historyCmd.Flags().IntVar(&historyLimit, "limit", 0, "maximum number of transactions to show")
+	historyCmd.Flags().IntVar(&historyOffset, "offset", 0, "number of transactions to skip")
+	historyCmd.Flags().IntVar(&historyPage, "page", 0, "page of transactions to show")
+	historyCmd.Flags().IntVar(&historyPageSize, "page-size", 10, "number of transactions per page")
+	historyCmd.Flags().StringVar(&historySort, "sort", "asc", "sort order by date, asc or desc")
+	historyCmd.Flags().IntVar(&historyMini, "mini", 0, "mini statement of the last N transactions")
 	RootCmd.AddCommand(historyCmd)
 }
@@ -0,0 +1,287 @@
+package cmd
+
+import (
+	"agile-coder.com/atm-sim/internal"
+	"agile-coder.com/atm-sim/internal/iso8583"
+	"crypto/tls"
+	"fmt"
+	"github.com/spf13/cobra"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	bankHostAddress string
+	bankHostCerts   string
+	bankHostNames   []string
+	bankTerminals   []string
+	connectTLS      BankHostCredentials
+	connectTimeout  time.Duration
+	connectProtocol string
+	connectSpec     string
+	standInPolicy   internal.StandInPolicy
+	adviceQueueFile string
+)
+
+// BankHostCredentials are what a terminal uses to connect to the gRPC bank host
+type BankHostCredentials struct {
+	// CAFile is the CA certificate the bank host certificate is signed by
+	CAFile string
+	// CertFile and KeyFile are the terminal's certificate and key, terminal-<id>.pem and terminal-<id>-key.pem next to
+	// the CA certificate by default, or terminal.pem and terminal-key.pem when none was issued for the terminal id
+	CertFile string
+	KeyFile  string
+	// Plaintext connects without TLS, to a host that does not use it
+	Plaintext bool
+}
+
+// hostConnection is a remote bank host that holds a connection open
+type hostConnection interface {
+	internal.BankHost
+	Close() error
+}
+
+// the remote bank host the terminal is connected to, nil when using the local ledger
+var connectedHost hostConnection
+
+// bankHostCmd runs the bank host service
+var bankHostCmd = &cobra.Command{
+	Use:   "bank-host",
+	Short: "run the bank host for remote terminals",
+	Long: `Runs the bank host as a gRPC service so that several terminals can share the same accounts. Usually run
+from the command line:
+	atm-sim bank-host --addr :9443 --certs certs
+certificates for TLS are generated in the --certs directory if there are none, with terminal.pem for terminal
+ATM00001. --terminals issues terminal-<id>.pem for other terminals. Only terminals presenting a certificate
+signed by the same CA are accepted, and only for the terminal id in their certificate; they connect with
+	connect <host>:9443 --ca certs/ca.pem`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		defer resetFlags(cmd)
+		if len(args) != 0 {
+			return fmt.Errorf("the bank-host command does not take any parameters\n")
+		}
+		if !certificatesExist(bankHostCerts) {
+			if err := internal.GenerateCertificates(bankHostCerts, bankHostNames); err != nil {
+				return err
+			}
+			fmt.Printf("Generated certificates in %s\n", bankHostCerts)
+		}
+		for _, terminalId := range bankTerminals {
+			certFile, _ := internal.TerminalCertificateFiles(terminalId)
+			if _, err := os.Stat(filepath.Join(bankHostCerts, certFile)); err == nil || terminalId == internal.DefaultTerminalId {
+				continue
+			}
+			if err := internal.IssueTerminalCertificate(bankHostCerts, terminalId); err != nil {
+				return err
+			}
+			fmt.Printf("Issued %s for terminal %s\n", certFile, terminalId)
+		}
+		tlsConfig, err := internal.HostTLSConfig(bankHostCerts)
+		if err != nil {
+			return err
+		}
+		listener, err := net.Listen("tcp", bankHostAddress)
+		if err != nil {
+			return err
+		}
+		internal.GetLedgerService().SetIdempotencyWindow(idempotencyWindow)
+		host := internal.NewLocalHost(internal.GetLedgerService(), internal.GetAuthorizationService())
+		internal.Logger.Printf("bank host listening on %s\n", listener.Addr())
+		fmt.Printf("Bank host listening on %s\n", listener.Addr())
+		return internal.NewBankHostServer(host, tlsConfig).Serve(listener)
+	},
+}
+
+// connectCmd connects the terminal to a remote bank host
+var connectCmd = &cobra.Command{
+	Use:   "connect",
+	Short: "connect to a bank host",
+	Long: `Connects this terminal to a remote bank host, started with the bank-host command. Balances, deposits,
+withdrawals and history then come from the bank host while cash is dispensed from this machine.
+The gRPC bank host is verified with the CA certificate in --ca and the terminal presents the certificate in --cert;
+--plaintext connects without TLS instead. With --protocol iso8583 the terminal sends ISO 8583 messages to a host started with the iso-host command,
+using the field spec in --spec if one is given.
+With --stand-in-limit withdrawals up to the limit are approved offline while the bank host can not be reached and
+forwarded to it as advices, kept in --advice-queue until it has posted them.
+requires one parameter, the address of the bank host`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		defer resetFlags(cmd)
+		if len(args) != 1 {
+			return fmt.Errorf("%s requires 1 parameter: the bank host address\n", cmd.Name())
+		}
+		if internal.GetSession().IsAuthenticated {
+			return fmt.Errorf("Please log out before changing the bank host.\n")
+		}
+		var err error
+		switch connectProtocol {
+		case "grpc":
+			err = ConnectBankHost(args[0], connectTLS, connectTimeout)
+		case "iso8583":
+			err = ConnectISOHost(args[0], connectSpec, connectTimeout)
+		default:
+			err = fmt.Errorf("unknown protocol \"%s\", use grpc or iso8583\n", connectProtocol)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Connected to bank host %s\n", args[0])
+		if standInPolicy.MaxWithdrawal > 0 {
+			if err := EnableStandIn(standInPolicy, adviceQueueFile); err != nil {
+				return err
+			}
+			fmt.Printf("Withdrawals up to $%.2f are approved offline when the bank host can not be reached.\n", standInPolicy.MaxWithdrawal)
+		}
+		return nil
+	},
+}
+
+// disconnectCmd goes back to the local ledger
+var disconnectCmd = &cobra.Command{
+	Use:   "disconnect",
+	Short: "disconnect from the bank host",
+	Long:  `Disconnects from the remote bank host and goes back to the accounts held by this machine`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 0 {
+			return fmt.Errorf("the disconnect command does not take any parameters\n")
+		}
+		if connectedHost == nil {
+			fmt.Println("Not connected to a bank host.")
+			return nil
+		}
+		if internal.GetSession().IsAuthenticated {
+			return fmt.Errorf("Please log out before changing the bank host.\n")
+		}
+		disconnectBankHost()
+		fmt.Println("Disconnected from the bank host.")
+		return nil
+	},
+}
+
+// ConnectBankHost sends the terminal's transactions to the bank host at address over TLS, verifying the host with
+// the CA certificate and presenting the terminal's certificate. The connection is only unencrypted when asked for
+func ConnectBankHost(address string, credentials BankHostCredentials, timeout time.Duration) error {
+	var tlsConfig *tls.Config
+	switch {
+	case credentials.Plaintext && credentials.CAFile != "":
+		return fmt.Errorf("--plaintext can not be used with --ca\n")
+	case credentials.Plaintext:
+		internal.Logger.Printf("connecting to bank host %s without TLS\n", address)
+	case credentials.CAFile == "":
+		return fmt.Errorf("the bank host CA certificate is required, give --ca or --plaintext to connect without TLS\n")
+	default:
+		// the certificate issued for this terminal's id is used when there is one next to the CA certificate
+		dir := filepath.Dir(credentials.CAFile)
+		defaultCert, defaultKey := internal.TerminalCertificateFiles(internal.GetLedgerService().GetTerminalId())
+		if _, err := os.Stat(filepath.Join(dir, defaultCert)); err != nil {
+			defaultCert, defaultKey = internal.TerminalCertificateFile, internal.TerminalKeyFile
+		}
+		certFile, keyFile := credentials.CertFile, credentials.KeyFile
+		if certFile == "" {
+			certFile = filepath.Join(dir, defaultCert)
+		}
+		if keyFile == "" {
+			keyFile = filepath.Join(dir, defaultKey)
+		}
+		var err error
+		if tlsConfig, err = internal.TerminalTLSConfig(credentials.CAFile, certFile, keyFile); err != nil {
+			return err
+		}
+	}
+	client, err := internal.DialBankHost(address, tlsConfig)
+	if err != nil {
+		return err
+	}
+	client.Timeout = timeout
+	useBankHost(client)
+	return nil
+}
+
+// ConnectISOHost sends the terminal's transactions as ISO 8583 messages to the host at address,
+// using the field spec in specFile or the default spec when there is none
+func ConnectISOHost(address string, specFile string, timeout time.Duration) error {
+	var spec *iso8583.Spec
+	if specFile != "" {
+		var err error
+		if spec, err = iso8583.LoadSpecFile(specFile); err != nil {
+			return err
+		}
+	}
+	client, err := internal.DialISOHost(address, spec)
+	if err != nil {
+		return err
+	}
+	client.Timeout = timeout
+	useBankHost(client)
+	return nil
+}
+
+// EnableStandIn approves withdrawals within policy while the connected bank host can not be reached,
+// keeping the advices for them in queueFile until the host has posted them
+func EnableStandIn(policy internal.StandInPolicy, queueFile string) error {
+	if connectedHost == nil {
+		return fmt.Errorf("Stand-in needs a connection to a bank host.\n")
+	}
+	if _, ok := connectedHost.(*internal.StandInHost); ok {
+		return fmt.Errorf("Stand-in is already enabled.\n")
+	}
+	queue, err := internal.OpenAdviceQueue(queueFile)
+	if err != nil {
+		return err
+	}
+	connectedHost = internal.NewStandInHost(connectedHost, policy, queue)
+	internal.SetBankHost(connectedHost)
+	if pending := len(queue.Pending()); pending > 0 {
+		internal.Logger.Printf("%d advices waiting to be forwarded from %s\n", pending, queueFile)
+	}
+	return nil
+}
+
+// certificatesExist checks whether dir holds the certificates for the bank host and its terminals
+func certificatesExist(dir string) bool {
+	for _, file := range []string{internal.HostCertificateFile, internal.TerminalCertificateFile} {
+		if _, err := os.Stat(filepath.Join(dir, file)); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func useBankHost(host hostConnection) {
+	if connectedHost != nil {
+		disconnectBankHost()
+	}
+	connectedHost = host
+	internal.SetBankHost(host)
+}
+
+func disconnectBankHost() {
+	if err := connectedHost.Close(); err != nil {
+		internal.Logger.Printf("error closing the bank host connection: %+v\n", err)
+	}
+	connectedHost = nil
+	internal.SetBankHost(nil)
+}
+
+func init() {
+	bankHostCmd.Flags().StringVar(&bankHostAddress, "addr", ":9443", "address to listen on")
+	bankHostCmd.Flags().StringVar(&bankHostCerts, "certs", "certs", "directory holding the TLS certificates")
+	bankHostCmd.Flags().StringSliceVar(&bankHostNames, "hosts", []string{"localhost", "127.0.0.1"}, "host names and addresses to generate the certificate for")
+	bankHostCmd.Flags().StringSliceVar(&bankTerminals, "terminals", nil, "ids of the terminals to issue certificates for, terminal-<id>.pem in --certs")
+	bankHostCmd.Flags().DurationVar(&idempotencyWindow, "idempotency-window", internal.DefaultIdempotencyWindow, "how long a deposit or withdrawal is remembered by its idempotency key")
+	connectCmd.Flags().StringVar(&connectTLS.CAFile, "ca", "", "CA certificate the bank host certificate is signed by")
+	connectCmd.Flags().StringVar(&connectTLS.CertFile, "cert", "", "terminal certificate presented to the bank host, terminal-<id>.pem or terminal.pem next to --ca by default")
+	connectCmd.Flags().StringVar(&connectTLS.KeyFile, "key", "", "key of the terminal certificate, next to --ca by default")
+	connectCmd.Flags().BoolVar(&connectTLS.Plaintext, "plaintext", false, "connect to the bank host without TLS")
+	connectCmd.Flags().DurationVar(&connectTimeout, "timeout", internal.DefaultHostTimeout, "deadline for each call to the bank host")
+	connectCmd.Flags().StringVar(&connectProtocol, "protocol", "grpc", "protocol the bank host speaks, grpc or iso8583")
+	connectCmd.Flags().StringVar(&connectSpec, "spec", "", "ISO 8583 field spec in JSON, replacing fields of the default spec")
+	connectCmd.Flags().Float64Var(&standInPolicy.MaxWithdrawal, "stand-in-limit", 0, "largest withdrawal approved offline when the bank host can not be reached, 0 to approve none")
+	connectCmd.Flags().Float64Var(&standInPolicy.MaxPerAccount, "stand-in-account-limit", 0, "most an account may withdraw offline until its advices are posted, 0 for no limit")
+	connectCmd.Flags().Float64Var(&standInPolicy.MaxTotal, "stand-in-total", 0, "most the terminal approves offline until its advices are posted, 0 for no limit")
+	connectCmd.Flags().StringVar(&adviceQueueFile, "advice-queue", "advices.json", "file holding the advices for withdrawals approved offline")
+	RootCmd.AddCommand(bankHostCmd)
+	RootCmd.AddCommand(connectCmd)
+	RootCmd.AddCommand(disconnectCmd)
+}
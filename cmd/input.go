@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"agile-coder.com/atm-sim/internal"
+	"fmt"
+	"strings"
+)
+
+// say shows text to the customer on the terminal's display
+func say(format string, a ...interface{}) {
+	internal.GetDevices().Display.Show(fmt.Sprintf(format, a...))
+}
+
+// readLine reads the customer's answer from the PIN pad
+func readLine() (string, error) {
+	return internal.GetDevices().PINPad.GetData()
+}
+
+// readPIN asks for the customer's PIN, which the PIN pad encrypts bound to the card in the reader
+func readPIN() (internal.PINBlock, error) {
+	say("PIN: ")
+	block, err := internal.GetDevices().PINPad.GetPIN(internal.GetSession().CardPAN)
+	say("\n")
+	return block, err
+}
+
+// confirm asks the customer a yes/no question and reports whether they answered yes
+func confirm(question string) bool {
+	say("%s (y/n): ", question)
+	answer, err := readLine()
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(answer)
+	return answer == "y" || answer == "yes"
+}
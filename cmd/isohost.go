@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"agile-coder.com/atm-sim/internal"
+	"agile-coder.com/atm-sim/internal/iso8583"
+	"fmt"
+	"github.com/spf13/cobra"
+	"net"
+)
+
+var (
+	isoHostAddress string
+	isoHostSpec    string
+)
+
+// isoHostCmd runs the bank host for terminals and switches speaking ISO 8583
+var isoHostCmd = &cobra.Command{
+	Use:   "iso-host",
+	Short: "run an ISO 8583 bank host",
+	Long: `Runs a bank host that accepts ISO 8583 messages over TCP, each preceded by its length in two bytes.
+Authorization (0100), financial (0200), advice (0220), reversal (0400) and network management (0800) messages are
+answered from this machine's accounts. Usually run from the command line:
+	atm-sim iso-host --addr :8583 --spec spec.json
+terminals connect with
+	connect <host>:8583 --protocol iso8583`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		defer resetFlags(cmd)
+		if len(args) != 0 {
+			return fmt.Errorf("the iso-host command does not take any parameters\n")
+		}
+		var spec *iso8583.Spec
+		if isoHostSpec != "" {
+			var err error
+			if spec, err = iso8583.LoadSpecFile(isoHostSpec); err != nil {
+				return err
+			}
+		}
+		internal.GetLedgerService().SetIdempotencyWindow(idempotencyWindow)
+		listener, err := net.Listen("tcp", isoHostAddress)
+		if err != nil {
+			return err
+		}
+		internal.Logger.Printf("ISO 8583 host listening on %s\n", listener.Addr())
+		fmt.Printf("ISO 8583 host listening on %s\n", listener.Addr())
+		return internal.NewISOHostServer(internal.GetLedgerService(), internal.GetAuthorizationService(), spec).Serve(listener)
+	},
+}
+
+func init() {
+	isoHostCmd.Flags().StringVar(&isoHostAddress, "addr", ":8583", "address to listen on")
+	isoHostCmd.Flags().StringVar(&isoHostSpec, "spec", "", "ISO 8583 field spec in JSON, replacing fields of the default spec")
+	isoHostCmd.Flags().DurationVar(&idempotencyWindow, "idempotency-window", internal.DefaultIdempotencyWindow, "how long a deposit or withdrawal is remembered by its idempotency key")
+	RootCmd.AddCommand(isoHostCmd)
+}
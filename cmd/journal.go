@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"agile-coder.com/atm-sim/internal"
+	"fmt"
+	"github.com/spf13/cobra"
+	"strings"
+	"time"
+)
+
+// flags for searching the electronic journal
+var (
+	journalTransaction string
+	journalAccount     string
+	journalFrom        string
+	journalTo          string
+)
+
+// formats accepted for the journal search time range
+var journalSearchFormats = []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02"}
+
+// ejCmd groups the electronic journal commands
+var ejCmd = &cobra.Command{
+	Use:   "ej",
+	Short: "electronic journal",
+	Long:  `Commands for the electronic journal of all terminal activity`,
+}
+
+// ejSearchCmd looks up records in the electronic journal
+var ejSearchCmd = &cobra.Command{
+	Use:   "search",
+	Short: "search the electronic journal",
+	Long: `Searches the electronic journal by --txn transaction id, --account, and time range
+--from and --to given as YYYY-MM-DD, YYYY-MM-DDTHH:MM or YYYY-MM-DDTHH:MM:SS (--to is exclusive)`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		defer resetFlags(cmd)
+		if len(args) != 0 {
+			return fmt.Errorf("the search command does not take any parameters\n")
+		}
+		ej := internal.GetJournal()
+		if ej == nil {
+			return fmt.Errorf("the electronic journal is not enabled\n")
+		}
+		query := internal.JournalQuery{TransactionId: journalTransaction, AccountId: journalAccount}
+		var err error
+		if query.From, err = parseJournalTime("--from", journalFrom); err != nil {
+			return err
+		}
+		if query.To, err = parseJournalTime("--to", journalTo); err != nil {
+			return err
+		}
+		records, err := ej.Search(query)
+		if err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			fmt.Println("No journal records found")
+			return nil
+		}
+		for _, record := range records {
+			fmt.Println(record.Format())
+		}
+		return nil
+	},
+}
+
+func parseJournalTime(flag string, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	for _, format := range journalSearchFormats {
+		if parsed, err := time.ParseInLocation(format, value, time.Local); err == nil {
+			return parsed, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid %s time \"%s\"\n", flag, value)
+}
+
+// journalCommand records a command entered at the terminal without the card number or a PIN mistakenly typed after it.
+// Operator commands record the operator signed on, so that searches of the journal can be traced to who made them
+func journalCommand(cmd *cobra.Command, args []string) {
+	if !cmd.HasParent() {
+		return
+	}
+	text := strings.TrimSpace(cmd.CommandPath() + " " + strings.Join(journalArgs(cmd, args), " "))
+	if requiresOperator(cmd) && !commandLine {
+		if operatorId := internal.GetOperators().SignedOn(); operatorId != "" {
+			text += " by operator " + operatorId
+		}
+	}
+	internal.Journal(internal.JournalCommand, "", internal.GetSession().AccountId, text)
+}
+
+// journalArgs drops the parameters past those a command that asks for a PIN or passcode takes, as they may be the secret,
+// and masks the card number given to insert-card
+func journalArgs(cmd *cobra.Command, args []string) []string {
+	name := cmd.Name()
+	if parent := cmd.Parent(); parent != nil && parent.HasParent() {
+		name = parent.Name() + " " + name
+	}
+	count, ok := secretCommands[name]
+	if !ok {
+		return args
+	}
+	if len(args) > count {
+		args = args[:count]
+	}
+	args = append([]string{}, args...)
+	if name == "insert-card" && len(args) > 0 {
+		args[0] = internal.MaskAccount(args[0])
+	}
+	return args
+}
+
+// journalError records an error shown to the customer
+func journalError(err error) {
+	internal.Journal(internal.JournalError, "", internal.GetSession().AccountId, err.Error())
+}
+
+func init() {
+	ejSearchCmd.Flags().StringVar(&journalTransaction, "txn", "", "transaction id")
+	ejSearchCmd.Flags().StringVar(&journalAccount, "account", "", "account id")
+	ejSearchCmd.Flags().StringVar(&journalFrom, "from", "", "earliest time to include")
+	ejSearchCmd.Flags().StringVar(&journalTo, "to", "", "time to include records up to")
+	ejCmd.AddCommand(ejSearchCmd)
+	RootCmd.AddCommand(ejCmd)
+}
@@ -2,7 +2,6 @@ package cmd
 
 import (
 	"agile-coder.com/atm-sim/internal"
-	"fmt"
 	"github.com/spf13/cobra"
 )
 
@@ -15,11 +14,16 @@ var logoutCmd = &cobra.Command{
 		session := internal.GetSession()
 		if session.IsAuthenticated {
 			currentAccountId := session.AccountId
+			internal.GetSessionManager().End(session.Id, internal.SessionLoggedOut)
 			session.IsAuthenticated = false
 			session.AccountId = ""
-			fmt.Printf("Account %s logged out.\n", currentAccountId)
+			internal.Journal(internal.JournalAuth, "", currentAccountId, "logged out")
+			say("Account %s logged out.\n", currentAccountId)
+			if session.CardPAN != "" {
+				ejectCard(session)
+			}
 		} else {
-			fmt.Println("No account is currently authorized.")
+			say("No account is currently authorized.\n")
 		}
 	},
 }
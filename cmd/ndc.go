@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"agile-coder.com/atm-sim/internal"
+	"fmt"
+	"github.com/spf13/cobra"
+	"net"
+)
+
+var (
+	ndcHostAddress string
+	ndcLUNO        string
+)
+
+// ndcHostCmd runs the stand-in host for NDC-style terminals
+var ndcHostCmd = &cobra.Command{
+	Use:   "ndc-host",
+	Short: "run a host for NDC-style terminals",
+	Long: `Runs a host for terminals speaking NDC-style messages over TCP, each preceded by its length in two bytes.
+Each terminal that connects is sent the screens and states for a withdrawal, deposit and balance flow, put in
+service, and has its transaction requests answered from this machine's accounts. Usually run from the command line:
+	atm-sim ndc-host --addr :4000`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		defer resetFlags(cmd)
+		if len(args) != 0 {
+			return fmt.Errorf("the ndc-host command does not take any parameters\n")
+		}
+		listener, err := net.Listen("tcp", ndcHostAddress)
+		if err != nil {
+			return err
+		}
+		internal.Logger.Printf("NDC host listening on %s\n", listener.Addr())
+		fmt.Printf("NDC host listening on %s\n", listener.Addr())
+		host := internal.NewNDCHost(internal.GetLedgerService(), internal.GetAuthorizationService(), internal.GetCardReader())
+		return host.Serve(listener)
+	},
+}
+
+// ndcTerminalCmd runs this machine as an NDC-style terminal
+var ndcTerminalCmd = &cobra.Command{
+	Use:   "ndc-terminal",
+	Short: "run as an NDC-style terminal",
+	Long: `Connects to an NDC host and runs this machine as a terminal driven by the screens and states the host sends.
+Each screen is shown and the customer's answer read from the PIN pad, which masks the PIN; the function keys are
+entered as A to D. Cash is dispensed from this machine. Enter exit when asked for a card to go back to the prompt.
+requires one parameter, the address of the host`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		defer resetFlags(cmd)
+		if len(args) != 1 {
+			return fmt.Errorf("%s requires 1 parameter: the host address\n", cmd.Name())
+		}
+		if internal.GetSession().IsAuthenticated {
+			return fmt.Errorf("Please log out before running as an NDC terminal.\n")
+		}
+		conn, err := net.Dial("tcp", args[0])
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		internal.Logger.Printf("NDC terminal %s connected to %s\n", ndcLUNO, args[0])
+		return internal.NewNDCTerminal(conn, ndcLUNO, internal.GetDevices()).Run()
+	},
+}
+
+func init() {
+	ndcHostCmd.Flags().StringVar(&ndcHostAddress, "addr", ":4000", "address to listen on")
+	ndcTerminalCmd.Flags().StringVar(&ndcLUNO, "luno", "001", "logical unit number identifying this terminal to the host")
+	RootCmd.AddCommand(ndcHostCmd)
+	RootCmd.AddCommand(ndcTerminalCmd)
+}
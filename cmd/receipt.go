@@ -0,0 +1,27 @@
+package cmd
+
+import (
+	"agile-coder.com/atm-sim/internal"
+)
+
+// offerReceipt asks the customer whether they want a receipt for a transaction and, if so, produces it.
+// The receipt is built from the bank host's response, so it can be printed by hosts without a transaction history.
+// Nothing is asked when receipts are disabled
+func offerReceipt(receipt *internal.Receipt) {
+	printer := internal.GetDevices().ReceiptPrinter
+	if printer == nil || receipt.TransactionId == "" {
+		return
+	}
+	if !confirm("Do you want a receipt?") {
+		return
+	}
+	path, err := printer.Print(receipt)
+	if err != nil {
+		internal.Logger.Printf("failed to print receipt for %s: %+v\n", receipt.TransactionId, err)
+		say("Unable to print a receipt at this time.\n")
+		return
+	}
+	if path != "" {
+		say("Receipt saved to %s\n", path)
+	}
+}
@@ -4,23 +4,94 @@ import (
 	"agile-coder.com/atm-sim/internal"
 	"fmt"
 	"github.com/spf13/cobra"
-	"time"
 )
 
 var RootCmd = &cobra.Command{
 	Use:          "",
 	SilenceUsage: true,
+	// pressing enter on its own keeps the session alive
+	Run: func(cmd *cobra.Command, args []string) {},
 	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		journalCommand(cmd, args)
+		if requiresOperator(cmd) && !commandLine && internal.GetOperators().SignedOn() == "" {
+			return fmt.Errorf("Operator sign on required, use admin login.\n")
+		}
 		session := internal.GetSession()
-		cmdName := cmd.Name()
-		if cmdName != "" && cmdName != "authorize" && cmdName != "logout" && cmdName != "end" && cmdName != "help" && !session.IsAuthenticated {
+		if requiresAuthorization(cmd) && !session.IsAuthenticated {
 			return fmt.Errorf("Authorization required.\n")
 		}
-		session.LastActivityTime = time.Now()
+		session.LastActivityTime = internal.GetClock().Now()
+		internal.GetSessionManager().Touch(session.Id)
 		return nil
 	},
 }
 
+// commands that can be run without an authorized customer, including any of their sub commands
+var unauthorizedCommands = map[string]bool{
+	"authorize":    true,
+	"logout":       true,
+	"end":          true,
+	"help":         true,
+	"insert-card":  true,
+	"eject-card":   true,
+	"redeem":       true,
+	"serve":        true,
+	"bank-host":    true,
+	"connect":      true,
+	"disconnect":   true,
+	"iso-host":     true,
+	"ndc-host":     true,
+	"ndc-terminal": true,
+}
+
+// commands for the machine operator, including any of their sub commands. They need an operator signed on
+// instead of an authorized customer
+var operatorCommands = map[string]bool{
+	"admin":      true,
+	"statements": true,
+	"ej":         true,
+}
+
+// commandLine is set when a single command is run from the shell rather than the prompt. Whoever can run the
+// simulator from the shell already has the operator's access to its data, so no operator sign on is needed
+var commandLine bool
+
+// ExecuteCommandLine runs the command given on the command line
+func ExecuteCommandLine() error {
+	commandLine = true
+	return RootCmd.Execute()
+}
+
+// requiresAuthorization checks whether a customer must be authorized to run the command
+func requiresAuthorization(cmd *cobra.Command) bool {
+	if !cmd.HasParent() {
+		return false
+	}
+	// a withdrawal staged from the command line asks for the customer's PIN itself
+	if cmd == stageWithdrawalCmd && commandLine && stagedAccount != "" {
+		return false
+	}
+	for c := cmd; c.HasParent(); c = c.Parent() {
+		if unauthorizedCommands[c.Name()] || operatorCommands[c.Name()] {
+			return false
+		}
+	}
+	return true
+}
+
+// requiresOperator checks whether an operator must be signed on to run the command
+func requiresOperator(cmd *cobra.Command) bool {
+	if cmd == adminLoginCmd || cmd == adminLogoutCmd {
+		return false
+	}
+	for c := cmd; c.HasParent(); c = c.Parent() {
+		if operatorCommands[c.Name()] {
+			return true
+		}
+	}
+	return false
+}
+
 func init() {
 	// remove extra help cruft
 	RootCmd.SetHelpTemplate(`
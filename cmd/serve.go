@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"agile-coder.com/atm-sim/internal"
+	"fmt"
+	"github.com/spf13/cobra"
+	"net/http"
+	"time"
+)
+
+var (
+	// serveAddress is the address the API server listens on
+	serveAddress string
+	// serveCert and serveKey are the certificate and key the API is served with over TLS
+	serveCert string
+	serveKey  string
+	// idempotencyWindow is how long the servers keep the outcome of a request sent with an idempotency key
+	idempotencyWindow time.Duration
+)
+
+// serveCmd runs the HTTP API server
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "serve the ATM operations over HTTP",
+	Long: `Runs an HTTP server exposing authenticate, balance, deposit, withdraw, history and logout as a JSON API,
+backed by the same ledger and accounts as the terminal. Customers log in by account number without a card,
+so it is only available when the simulator is started with --account-login. Usually run from the command line:
+	atm-sim --account-login serve --addr :8443 --cert api.pem --key api-key.pem
+it listens on localhost without TLS unless --cert and --key are given. The OpenAPI document is served at /v1/openapi.json. Deposits and withdrawals sent with an Idempotency-Key header
+are posted once, the same response is returned for the key until the --idempotency-window has passed`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		defer resetFlags(cmd)
+		if len(args) != 0 {
+			return fmt.Errorf("the serve command does not take any parameters\n")
+		}
+		// like authorize, logging in by account number without a card needs --account-login
+		if !accountLogin {
+			return fmt.Errorf("The API logs customers in by account number. Start the simulator with --account-login to serve it.\n")
+		}
+		if (serveCert == "") != (serveKey == "") {
+			return fmt.Errorf("--cert and --key must be given together\n")
+		}
+		internal.GetLedgerService().SetIdempotencyWindow(idempotencyWindow)
+		server := &http.Server{
+			Addr:              serveAddress,
+			Handler:           internal.NewAPIServer(),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		internal.Logger.Printf("api server listening on %s\n", serveAddress)
+		if serveCert != "" {
+			fmt.Printf("Serving the ATM API over TLS on %s\n", serveAddress)
+			return server.ListenAndServeTLS(serveCert, serveKey)
+		}
+		fmt.Printf("Serving the ATM API on %s\n", serveAddress)
+		return server.ListenAndServe()
+	},
+}
+
+func init() {
+	serveCmd.Flags().StringVar(&serveAddress, "addr", "localhost:8080", "address to listen on")
+	serveCmd.Flags().StringVar(&serveCert, "cert", "", "certificate to serve the API over TLS with")
+	serveCmd.Flags().StringVar(&serveKey, "key", "", "key of the --cert certificate")
+	serveCmd.Flags().DurationVar(&idempotencyWindow, "idempotency-window", internal.DefaultIdempotencyWindow, "how long a deposit or withdrawal is remembered by its idempotency key")
+	RootCmd.AddCommand(serveCmd)
+}
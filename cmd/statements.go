@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"agile-coder.com/atm-sim/internal"
+	"errors"
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"sort"
+)
+
+// flags for generating statements
+var (
+	statementPeriod   string
+	statementHistory  []string
+	statementOutput   string
+	statementAccounts []string
+)
+
+// statementsCmd groups the account statement commands
+var statementsCmd = &cobra.Command{
+	Use:   "statements",
+	Short: "account statements",
+	Long:  `Commands for producing periodic account statements`,
+}
+
+// generateStatementsCmd builds the monthly statements for each account
+var generateStatementsCmd = &cobra.Command{
+	Use:   "generate",
+	Short: "generate monthly account statements",
+	Long: `Generates a statement for each account for the month given by --period (YYYY-MM).
+Statements are written as plain text, Markdown and HTML files to the --output directory.
+The history is read from JSON Lines exports given with --history, or taken from this
+session's ledger when none are given. --account limits the statements to the given accounts`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		defer resetFlags(cmd)
+		if len(args) != 0 {
+			return fmt.Errorf("the generate command does not take any parameters\n")
+		}
+		if statementPeriod == "" {
+			return fmt.Errorf("--period is required\n")
+		}
+		periodStart, err := internal.ParseStatementPeriod(statementPeriod)
+		if err != nil {
+			return err
+		}
+		ledger := internal.GetLedgerService()
+		histories, err := statementHistories(ledger)
+		if err != nil {
+			return err
+		}
+		accounts := statementAccounts
+		if len(accounts) == 0 {
+			accounts = ledger.GetAccounts()
+			for account := range histories {
+				if !contains(accounts, account) {
+					accounts = append(accounts, account)
+				}
+			}
+			sort.Strings(accounts)
+		}
+
+		var failed []string
+		for _, account := range accounts {
+			statement, err := internal.BuildStatement(account, periodStart, histories[account], ledger.GetBalance(account))
+			var balanceErr *internal.StatementBalanceError
+			if errors.As(err, &balanceErr) {
+				internal.Logger.Println(err.Error())
+				fmt.Println(err.Error())
+				failed = append(failed, account)
+				continue
+			}
+			paths, err := internal.WriteStatementFiles(statementOutput, statement)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s: %d transactions, closing balance $%.2f, written to %v\n", account, len(statement.Transactions), statement.ClosingBalance, paths)
+		}
+		if len(failed) > 0 {
+			return fmt.Errorf("%d statements did not balance: %v\n", len(failed), failed)
+		}
+		return nil
+	},
+}
+
+// statementHistories reads the history files given, or uses the ledger's history when there are none
+func statementHistories(ledger *internal.Ledger) (map[string][]internal.LedgerHistoryEntry, error) {
+	histories := map[string][]internal.LedgerHistoryEntry{}
+	if len(statementHistory) == 0 {
+		for _, account := range ledger.GetAccounts() {
+			histories[account] = ledger.GetHistory(account)
+		}
+		return histories, nil
+	}
+	for _, path := range statementHistory {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		fileHistories, err := internal.ReadHistory(file)
+		_ = file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s\n", path, err.Error())
+		}
+		for account, entries := range fileHistories {
+			histories[account] = append(histories[account], entries...)
+		}
+	}
+	return histories, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	generateStatementsCmd.Flags().StringVar(&statementPeriod, "period", "", "statement month as YYYY-MM")
+	generateStatementsCmd.Flags().StringArrayVar(&statementHistory, "history", nil, "JSON Lines history export to read, may be repeated")
+	generateStatementsCmd.Flags().StringVarP(&statementOutput, "output", "o", "statements", "directory to write the statements to")
+	generateStatementsCmd.Flags().StringArrayVar(&statementAccounts, "account", nil, "only generate statements for this account, may be repeated")
+	statementsCmd.AddCommand(generateStatementsCmd)
+	RootCmd.AddCommand(statementsCmd)
+}
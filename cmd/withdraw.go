@@ -2,10 +2,14 @@ package cmd
 
 import (
 	"agile-coder.com/atm-sim/internal"
+	"errors"
 	"fmt"
 	"github.com/spf13/cobra"
 )
 
+// acceptPartial lets the customer consent to a partial dispense up front
+var acceptPartial bool
+
 // withdrawCmd represents the withdraw command
 var withdrawCmd = &cobra.Command{
 	Use:   "withdraw",
@@ -13,26 +17,104 @@ var withdrawCmd = &cobra.Command{
 	Long: `withdraw funds from the account
 requires one parameter, the amount to withdraw
 accounts are not allowed to overdraw so the requested amount must be less or equal to
-the current account balance`,
+the current account balance
+if the machine cannot dispense the full amount the customer is asked whether to accept
+the maximum available amount instead; --accept-partial answers yes in advance
+withdrawals over the second factor threshold ask for a one-time code from accounts enrolled for them`,
 	Run: func(cmd *cobra.Command, args []string) {
 		var overdraftMessage string
 		if len(args) != 1 {
-			fmt.Println("withdraw takes one parameter - amount of the deposit")
+			say("withdraw takes one parameter - amount of the deposit\n")
 			return
 		}
 		session := internal.GetSession()
-		newBalance, err := internal.GetLedgerService().Withdraw(session.AccountId, args[0])
+		// large withdrawals may need a one-time code, an invalid amount is reported by the bank host
+		if amount, err := internal.StringToMoney(args[0]); err == nil {
+			required, err := internal.GetBankHost().SecondFactorRequired(session.AccountId, amount)
+			if err != nil {
+				journalError(err)
+				say("%s\n", err.Error())
+				return
+			}
+			if required && !askForOneTimeCode(session.AccountId) {
+				say("Invalid one-time code. Withdrawal cancelled.\n")
+				return
+			}
+		}
+		// the key stays the same when the customer accepts a partial dispense, it is one transaction
+		key := internal.NewIdempotencyKey()
+		newBalance, err := internal.WithdrawCash(session.AccountId, args[0], acceptPartial, key)
+		var partialErr *internal.PartialDispenseError
+		if errors.As(err, &partialErr) {
+			if !confirm(fmt.Sprintf("%s Would you like $%.2f instead?", partialErr.Error(), partialErr.Available)) {
+				internal.Logger.Printf("partial dispense declined by %s\n", session.AccountId)
+				internal.Journal(internal.JournalTransaction, "", session.AccountId, fmt.Sprintf("partial dispense of $%.2f declined", partialErr.Available))
+				say("Withdrawal cancelled.\n")
+				return
+			}
+			newBalance, err = internal.WithdrawCash(session.AccountId, args[0], true, key)
+		}
 		if err != nil {
-			fmt.Println(err.Error())
+			journalError(err)
+			say("%s\n", err.Error())
+			return
+		}
+		if newBalance.Offline {
+			internal.Journal(internal.JournalTransaction, newBalance.TransactionId, session.AccountId,
+				fmt.Sprintf("withdrawal $%.2f partial=%t approved offline, advice queued", newBalance.AmountWithdrawn, newBalance.WasPartial))
+		} else {
+			internal.Journal(internal.JournalTransaction, newBalance.TransactionId, session.AccountId,
+				fmt.Sprintf("withdrawal $%.2f partial=%t balance $%.2f", newBalance.AmountWithdrawn, newBalance.WasPartial, newBalance.RemainingBalance))
+		}
+		if newBalance.WasOverdrawn {
+			internal.Journal(internal.JournalTransaction, newBalance.FeeTransactionId, session.AccountId, fmt.Sprintf("overdraft fee $%.2f", internal.OverdraftFee))
+		}
+		if !dispense(session.AccountId, newBalance) {
+			return
+		}
+		// the balance is not known until the bank host posts the advice for an offline withdrawal
+		if newBalance.Offline {
+			say("Amount dispensed: $%.2f\nApproved offline. Your balance will be updated when the bank can be reached.\n", newBalance.AmountWithdrawn)
 			return
 		}
 		if newBalance.WasOverdrawn {
 			overdraftMessage = "You have been charged an overdraft fee of $5. "
 		}
-		fmt.Printf("Amount dispensed: $%.2f\n%sCurrent balance:%.2f\n", newBalance.AmountWithdrawn, overdraftMessage, newBalance.RemainingBalance)
+		say("Amount dispensed: $%.2f\n%sCurrent balance:%.2f\n", newBalance.AmountWithdrawn, overdraftMessage, newBalance.RemainingBalance)
+		offerReceipt(internal.NewWithdrawalReceipt(session.AccountId, newBalance))
 	},
 }
 
+// dispense presents the cash for an approved withdrawal, journaling where the notes went and the reversal of any
+// that were not presented. It tells whether the customer took the cash
+func dispense(accountId string, withdrawal *internal.WithdrawResult) bool {
+	result, err := internal.DispenseCash(withdrawal)
+	if err == nil {
+		internal.Journal(internal.JournalCash, withdrawal.TransactionId, accountId,
+			"dispensed "+internal.FormatNotes(map[int]int{20: int(result.Presented / 20)}))
+		return true
+	}
+	var fault *internal.DispenserFaultError
+	if errors.As(err, &fault) {
+		internal.Journal(internal.JournalCash, withdrawal.TransactionId, accountId, fmt.Sprintf("dispenser %s presented $%.2f rejected $%.2f retracted $%.2f",
+			fault.Fault, result.Presented, result.Rejected, result.Retracted))
+	}
+	if reversal := result.Reversal; reversal != nil && reversal.Queued {
+		internal.Journal(internal.JournalTransaction, withdrawal.TransactionId, accountId,
+			fmt.Sprintf("reversal of $%.2f of withdrawal %s queued for the bank host", reversal.AmountReversed, withdrawal.TransactionId))
+	} else if reversal != nil {
+		internal.Journal(internal.JournalTransaction, reversal.TransactionId, accountId,
+			fmt.Sprintf("reversed $%.2f of withdrawal %s", reversal.AmountReversed, withdrawal.TransactionId))
+		if reversal.FeeTransactionId != "" {
+			internal.Journal(internal.JournalTransaction, reversal.FeeTransactionId, accountId, fmt.Sprintf("overdraft fee $%.2f refunded", reversal.FeeRefunded))
+		}
+	}
+	internal.Journal(internal.JournalError, withdrawal.TransactionId, accountId, err.Error())
+	say("%s\n", err.Error())
+	return false
+}
+
 func init() {
+	withdrawCmd.Flags().BoolVar(&acceptPartial, "accept-partial", false, "dispense the maximum available amount if the machine is low on cash")
 	RootCmd.AddCommand(withdrawCmd)
 }
@@ -0,0 +1,457 @@
+package internal
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// MaxLoginFailures is how many failed logins in a row an account can have over the API before its login is locked
+	MaxLoginFailures = 3
+	// LoginLockout is how long API login stays locked for an account after too many failed logins
+	LoginLockout = 15 * time.Minute
+)
+
+// OpenAPIDocument describes the HTTP API served by APIServer
+//
+//go:embed openapi.json
+var OpenAPIDocument []byte
+
+// APIServer exposes the ATM operations over HTTP with JSON bodies. Customers authenticate with their account
+// and PIN and get a session token to send as a bearer token on the other requests
+type APIServer struct {
+	ledger   *Ledger
+	auth     *Authorization
+	sessions *SessionManager
+	// map of account # to the failed logins since the last successful one, so that PINs can not be guessed
+	loginFailures map[string]*loginFailures
+	// the ledger is not safe for concurrent use so requests are handled one at a time
+	lock sync.Mutex
+	mux  *http.ServeMux
+}
+
+// apiError is the JSON body returned for a failed request
+type apiError struct {
+	Error apiErrorDetail `json:"error"`
+}
+
+type apiErrorDetail struct {
+	Code      string       `json:"code"`
+	Message   string       `json:"message"`
+	Available *json.Number `json:"available,omitempty"`
+}
+
+// loginFailures counts the failed logins for an account and when it can log in again after too many
+type loginFailures struct {
+	count       int
+	lockedUntil time.Time
+}
+
+type loginRequest struct {
+	AccountId   string `json:"account_id"`
+	Pin         string `json:"pin"`
+	OneTimeCode string `json:"one_time_code,omitempty"`
+}
+
+type loginResponse struct {
+	Token     string `json:"token"`
+	AccountId string `json:"account_id"`
+	Expires   string `json:"expires,omitempty"`
+}
+
+type balanceResponse struct {
+	AccountId string      `json:"account_id"`
+	Balance   json.Number `json:"balance"`
+	Available json.Number `json:"available"`
+}
+
+type depositRequest struct {
+	Amount string `json:"amount"`
+}
+
+type depositResponse struct {
+	TransactionId string      `json:"transaction_id"`
+	Balance       json.Number `json:"balance"`
+	Available     json.Number `json:"available"`
+}
+
+type withdrawalRequest struct {
+	Amount        string `json:"amount"`
+	AcceptPartial bool   `json:"accept_partial,omitempty"`
+	OneTimeCode   string `json:"one_time_code,omitempty"`
+}
+
+type withdrawalResponse struct {
+	TransactionId    string      `json:"transaction_id"`
+	FeeTransactionId string      `json:"fee_transaction_id,omitempty"`
+	AmountDispensed  json.Number `json:"amount_dispensed"`
+	Fee              json.Number `json:"fee"`
+	Balance          json.Number `json:"balance"`
+	Partial          bool        `json:"partial"`
+}
+
+type historyResponse struct {
+	Entries []exportRecord `json:"entries"`
+	Total   int            `json:"total"`
+}
+
+// NewAPIServer creates an API server backed by the shared ledger, authorization and session services
+func NewAPIServer() *APIServer {
+	server := &APIServer{ledger: GetLedgerService(), auth: GetAuthorizationService(), sessions: GetSessionManager(),
+		loginFailures: map[string]*loginFailures{}, mux: http.NewServeMux()}
+	server.mux.HandleFunc("/v1/openapi.json", server.handleOpenAPI)
+	server.mux.HandleFunc("/v1/sessions", server.handleSessions)
+	server.mux.HandleFunc("/v1/balance", server.authorized(http.MethodGet, server.handleBalance))
+	server.mux.HandleFunc("/v1/deposits", server.authorized(http.MethodPost, server.handleDeposit))
+	server.mux.HandleFunc("/v1/withdrawals", server.authorized(http.MethodPost, server.handleWithdrawal))
+	server.mux.HandleFunc("/v1/history", server.authorized(http.MethodGet, server.handleHistory))
+	return server
+}
+
+func (server *APIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	Logger.Printf("api request %s %s\n", r.Method, r.URL.Path)
+	server.mux.ServeHTTP(w, r)
+}
+
+func (server *APIServer) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(OpenAPIDocument)
+}
+
+// handleSessions logs in with POST and logs out with DELETE
+func (server *APIServer) handleSessions(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		server.handleLogin(w, r)
+	case http.MethodDelete:
+		session := server.sessionFor(r)
+		if session == nil {
+			writeAPIError(w, http.StatusUnauthorized, "unauthorized", "Authorization required.")
+			return
+		}
+		Journal(JournalAuth, "", session.AccountId, "logged out of the api")
+		server.sessions.End(session.Id, SessionLoggedOut)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeMethodNotAllowed(w, http.MethodPost+", "+http.MethodDelete)
+	}
+}
+
+func (server *APIServer) handleLogin(w http.ResponseWriter, r *http.Request) {
+	var request loginRequest
+	if !readJSON(w, r, &request) {
+		return
+	}
+	if request.AccountId == "" {
+		writeError(w, &InvalidInputError{"account_id is required"})
+		return
+	}
+	failures := server.loginFailures[request.AccountId]
+	if failures != nil && clock.Now().Before(failures.lockedUntil) {
+		Logger.Printf("api login attempt for %s while its login is locked\n", request.AccountId)
+		writeError(w, &LoginLockedError{})
+		return
+	}
+	ok, err := server.auth.Authenticate(request.AccountId, request.Pin)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if ok && server.auth.RequiresSecondFactorForLogin(request.AccountId) {
+		ok, err = server.auth.VerifyTOTP(request.AccountId, request.OneTimeCode)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	if !ok {
+		Logger.Printf("invalid api login attempt for %s\n", request.AccountId)
+		Journal(JournalAuth, "", request.AccountId, "api PIN rejected")
+		if failures == nil {
+			failures = &loginFailures{}
+			server.loginFailures[request.AccountId] = failures
+		}
+		failures.count++
+		if failures.count >= MaxLoginFailures {
+			failures.count = 0
+			failures.lockedUntil = clock.Now().Add(LoginLockout)
+			Logger.Printf("too many failed api logins for %s, login locked until %s\n", request.AccountId, failures.lockedUntil.Format(time.RFC3339))
+			Journal(JournalAuth, "", request.AccountId, "api login locked")
+		}
+		writeAPIError(w, http.StatusUnauthorized, "authorization_failed", "Authorization failed.")
+		return
+	}
+	delete(server.loginFailures, request.AccountId)
+	session := &UserSession{IsAuthenticated: true, AccountId: request.AccountId}
+	server.sessions.Start(session)
+	Logger.Printf("successful api login for %s\n", request.AccountId)
+	Journal(JournalAuth, "", request.AccountId, "api PIN verified")
+	response := loginResponse{Token: session.Id, AccountId: session.AccountId}
+	if absolute := server.sessions.Policy().AbsoluteTimeout; absolute > 0 {
+		response.Expires = session.Started.Add(absolute).Format(time.RFC3339)
+	}
+	writeJSON(w, http.StatusCreated, response)
+}
+
+func (server *APIServer) handleBalance(w http.ResponseWriter, r *http.Request, session *UserSession) {
+	writeJSON(w, http.StatusOK, balanceResponse{
+		AccountId: session.AccountId,
+		Balance:   json.Number(formatAmount(server.ledger.GetBalance(session.AccountId))),
+		Available: json.Number(formatAmount(server.ledger.GetAvailableBalance(session.AccountId))),
+	})
+}
+
+func (server *APIServer) handleDeposit(w http.ResponseWriter, r *http.Request, session *UserSession) {
+	var request depositRequest
+	if !readJSON(w, r, &request) {
+		return
+	}
+	key, ok := idempotencyKey(w, r)
+	if !ok {
+		return
+	}
+	result, err := server.ledger.PostDeposit(DepositRequest{TerminalId: server.ledger.terminalId, AccountId: session.AccountId,
+		Amount: request.Amount, IdempotencyKey: key})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if result.Replayed {
+		w.Header().Set("Idempotent-Replayed", "true")
+	} else {
+		Journal(JournalTransaction, result.Entry.Id, session.AccountId, fmt.Sprintf("api deposit $%s balance $%.2f", request.Amount, result.Entry.Balance))
+	}
+	writeJSON(w, http.StatusCreated, depositResponse{
+		TransactionId: result.Entry.Id,
+		Balance:       json.Number(formatAmount(result.Entry.Balance)),
+		Available:     json.Number(formatAmount(result.Available)),
+	})
+}
+
+func (server *APIServer) handleWithdrawal(w http.ResponseWriter, r *http.Request, session *UserSession) {
+	var request withdrawalRequest
+	if !readJSON(w, r, &request) {
+		return
+	}
+	key, ok := idempotencyKey(w, r)
+	if !ok {
+		return
+	}
+	// the one-time code of a withdrawal sent again has already been used
+	amount, err := StringToMoney(request.Amount)
+	if err == nil && !server.ledger.remembered(session.AccountId, key) && server.auth.RequiresSecondFactorForWithdrawal(session.AccountId, amount) {
+		ok, err := server.auth.VerifyTOTP(session.AccountId, request.OneTimeCode)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if !ok {
+			writeAPIError(w, http.StatusUnauthorized, "invalid_one_time_code", "Invalid one-time code.")
+			return
+		}
+	}
+	result, err := server.ledger.withdraw(WithdrawalRequest{AccountId: session.AccountId, Amount: request.Amount,
+		AcceptPartial: request.AcceptPartial, Description: "cash withdrawal", IdempotencyKey: key})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	fee := 0.0
+	if result.WasOverdrawn {
+		fee = OverdraftFee
+	}
+	if result.Replayed {
+		w.Header().Set("Idempotent-Replayed", "true")
+	} else {
+		Journal(JournalTransaction, result.TransactionId, session.AccountId,
+			fmt.Sprintf("api withdrawal $%.2f partial=%t balance $%.2f", result.AmountWithdrawn, result.WasPartial, result.RemainingBalance))
+	}
+	writeJSON(w, http.StatusCreated, withdrawalResponse{
+		TransactionId:    result.TransactionId,
+		FeeTransactionId: result.FeeTransactionId,
+		AmountDispensed:  json.Number(formatAmount(result.AmountWithdrawn)),
+		Fee:              json.Number(formatAmount(fee)),
+		Balance:          json.Number(formatAmount(result.RemainingBalance)),
+		Partial:          result.WasPartial,
+	})
+}
+
+// handleHistory returns the account history, filtered and paged with the from, to, type, limit, offset and sort parameters
+func (server *APIServer) handleHistory(w http.ResponseWriter, r *http.Request, session *UserSession) {
+	query, err := parseHistoryParameters(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	entries, total := server.ledger.QueryHistory(session.AccountId, query)
+	response := historyResponse{Entries: []exportRecord{}, Total: total}
+	for _, entry := range entries {
+		response.Entries = append(response.Entries, newExportRecord(session.AccountId, entry))
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func parseHistoryParameters(r *http.Request) (HistoryQuery, error) {
+	var query HistoryQuery
+	values := r.URL.Query()
+	for _, name := range []string{"from", "to"} {
+		value := values.Get(name)
+		if value == "" {
+			continue
+		}
+		date, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return query, &InvalidInputError{fmt.Sprintf("%s must be an RFC 3339 time", name)}
+		}
+		if name == "from" {
+			query.From = date
+		} else {
+			query.To = date
+		}
+	}
+	for _, name := range values["type"] {
+		transactionType, err := ParseTransactionType(name)
+		if err != nil {
+			return query, err
+		}
+		query.Types = append(query.Types, transactionType)
+	}
+	for name, target := range map[string]*int{"limit": &query.Limit, "offset": &query.Offset} {
+		value := values.Get(name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return query, &InvalidInputError{fmt.Sprintf("%s must be a non-negative number", name)}
+		}
+		*target = n
+	}
+	switch values.Get("sort") {
+	case "", "asc":
+	case "desc":
+		query.Descending = true
+	default:
+		return query, &InvalidInputError{"sort must be asc or desc"}
+	}
+	return query, nil
+}
+
+// authorized wraps a handler that needs an authorized session and accepts a single method
+func (server *APIServer) authorized(method string, handler func(http.ResponseWriter, *http.Request, *UserSession)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			writeMethodNotAllowed(w, method)
+			return
+		}
+		session := server.sessionFor(r)
+		if session == nil {
+			writeAPIError(w, http.StatusUnauthorized, "unauthorized", "Authorization required.")
+			return
+		}
+		server.sessions.Touch(session.Id)
+		handler(w, r, session)
+	}
+}
+
+// sessionFor returns the active session named by the request's bearer token
+func (server *APIServer) sessionFor(r *http.Request) *UserSession {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || token == "" {
+		return nil
+	}
+	session := server.sessions.Lookup(strings.TrimSpace(token))
+	if session == nil || !session.IsAuthenticated {
+		return nil
+	}
+	return session
+}
+
+// idempotencyKey reads the optional Idempotency-Key header, writing an error when it is too long
+func idempotencyKey(w http.ResponseWriter, r *http.Request) (string, bool) {
+	key := strings.TrimSpace(r.Header.Get("Idempotency-Key"))
+	if len(key) > 255 {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request", "the Idempotency-Key header must be at most 255 characters")
+		return "", false
+	}
+	return key, true
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, target any) bool {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(target); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request", fmt.Sprintf("invalid request body: %v", err))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		Logger.Printf("failed to write api response: %+v\n", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, code string, message string) {
+	writeJSON(w, status, apiError{Error: apiErrorDetail{Code: code, Message: message}})
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+}
+
+// writeError maps an error from the ledger or authorization services on to an HTTP status and error code
+func writeError(w http.ResponseWriter, err error) {
+	status, code := http.StatusInternalServerError, "internal_error"
+	detail := apiErrorDetail{Message: err.Error()}
+	var onHold *FundsOnHoldError
+	var partial *PartialDispenseError
+	switch {
+	case errors.As(err, new(*InvalidInputError)):
+		status, code = http.StatusBadRequest, "invalid_input"
+	case errors.As(err, new(*InvalidAmountError)):
+		status, code = http.StatusBadRequest, "invalid_amount"
+	case errors.As(err, new(*InsufficientFundsError)):
+		status, code = http.StatusUnprocessableEntity, "insufficient_funds"
+	case errors.As(err, new(*OverdrawnError)):
+		status, code = http.StatusUnprocessableEntity, "overdrawn"
+	case errors.As(err, &onHold):
+		status, code = http.StatusUnprocessableEntity, "funds_on_hold"
+		available := json.Number(formatAmount(onHold.Available))
+		detail.Available = &available
+	case errors.As(err, &partial):
+		status, code = http.StatusConflict, "partial_dispense"
+		available := json.Number(formatAmount(partial.Available))
+		detail.Available = &available
+	case errors.As(err, new(*NoMoneyLeftError)):
+		status, code = http.StatusServiceUnavailable, "no_cash"
+	case errors.As(err, new(*OneTimeCodeReusedError)):
+		status, code = http.StatusUnauthorized, "one_time_code_reused"
+	case errors.As(err, new(*LoginLockedError)):
+		status, code = http.StatusTooManyRequests, "login_locked"
+	case errors.As(err, new(*IdempotencyKeyReusedError)):
+		status, code = http.StatusUnprocessableEntity, "idempotency_key_reused"
+	}
+	if status == http.StatusInternalServerError {
+		Logger.Printf("unexpected api error: %+v\n", err)
+	}
+	detail.Code = code
+	writeJSON(w, status, apiError{Error: detail})
+}
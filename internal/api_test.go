@@ -0,0 +1,179 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// apiCall sends a request to the server and decodes the JSON response into result
+func apiCall(t *testing.T, server http.Handler, method string, path string, token string, body string, result any) int {
+	t.Helper()
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, request)
+	if result != nil && recorder.Body.Len() > 0 {
+		if err := json.Unmarshal(recorder.Body.Bytes(), result); err != nil {
+			t.Fatalf("%s %s: invalid response body %q: %v", method, path, recorder.Body.String(), err)
+		}
+	}
+	return recorder.Code
+}
+
+func setUpAPIServer(t *testing.T) *APIServer {
+	InitLogger("", true)
+	encryptedPin, err := EncryptPin("1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	GetAuthorizationService().SetAuthData(map[string]EncryptedPin{"jc123": encryptedPin})
+	GetLedgerService().SetInitialBalances(10000, map[string]float64{"jc123": 100.00})
+	return NewAPIServer()
+}
+
+func TestAPISession(t *testing.T) {
+	server := setUpAPIServer(t)
+
+	var failure apiError
+	status := apiCall(t, server, http.MethodPost, "/v1/sessions", "", `{"account_id":"jc123","pin":"0000"}`, &failure)
+	if status != http.StatusUnauthorized || failure.Error.Code != "authorization_failed" {
+		t.Errorf("expected a rejected PIN got %d %+v", status, failure)
+	}
+	status = apiCall(t, server, http.MethodPost, "/v1/sessions", "", `{"account_id":"jc123","pin":"12"}`, &failure)
+	if status != http.StatusBadRequest || failure.Error.Code != "invalid_input" {
+		t.Errorf("expected an invalid PIN got %d %+v", status, failure)
+	}
+	status = apiCall(t, server, http.MethodGet, "/v1/balance", "", "", &failure)
+	if status != http.StatusUnauthorized || failure.Error.Code != "unauthorized" {
+		t.Errorf("expected a missing token to be rejected got %d %+v", status, failure)
+	}
+
+	var login loginResponse
+	status = apiCall(t, server, http.MethodPost, "/v1/sessions", "", `{"account_id":"jc123","pin":"1234"}`, &login)
+	if status != http.StatusCreated || login.Token == "" {
+		t.Fatalf("expected a session token got %d %+v", status, login)
+	}
+	var balance balanceResponse
+	status = apiCall(t, server, http.MethodGet, "/v1/balance", login.Token, "", &balance)
+	if status != http.StatusOK || balance.Balance != "100.00" || balance.Available != "100.00" {
+		t.Errorf("unexpected balance %d %+v", status, balance)
+	}
+
+	status = apiCall(t, server, http.MethodDelete, "/v1/sessions", login.Token, "", nil)
+	if status != http.StatusNoContent {
+		t.Errorf("expected to log out got %d", status)
+	}
+	status = apiCall(t, server, http.MethodGet, "/v1/balance", login.Token, "", &failure)
+	if status != http.StatusUnauthorized {
+		t.Errorf("expected the token to stop working after logging out got %d", status)
+	}
+}
+
+func TestAPILoginLockout(t *testing.T) {
+	fakeClock := NewFakeClock(time.Date(2023, 5, 1, 9, 0, 0, 0, time.UTC))
+	SetClock(fakeClock)
+	defer SetClock(nil)
+	server := setUpAPIServer(t)
+
+	var failure apiError
+	for i := 0; i < MaxLoginFailures; i++ {
+		status := apiCall(t, server, http.MethodPost, "/v1/sessions", "", `{"account_id":"jc123","pin":"0000"}`, &failure)
+		if status != http.StatusUnauthorized || failure.Error.Code != "authorization_failed" {
+			t.Fatalf("expected a rejected PIN got %d %+v", status, failure)
+		}
+	}
+	// once locked even the right PIN is refused, so PINs can not be guessed
+	status := apiCall(t, server, http.MethodPost, "/v1/sessions", "", `{"account_id":"jc123","pin":"1234"}`, &failure)
+	if status != http.StatusTooManyRequests || failure.Error.Code != "login_locked" {
+		t.Errorf("expected the login to be locked got %d %+v", status, failure)
+	}
+	fakeClock.Advance(LoginLockout)
+	var login loginResponse
+	if status := apiCall(t, server, http.MethodPost, "/v1/sessions", "", `{"account_id":"jc123","pin":"1234"}`, &login); status != http.StatusCreated {
+		t.Errorf("expected to log in after the lockout got %d", status)
+	}
+}
+
+func TestAPITransactions(t *testing.T) {
+	server := setUpAPIServer(t)
+	var login loginResponse
+	if status := apiCall(t, server, http.MethodPost, "/v1/sessions", "", `{"account_id":"jc123","pin":"1234"}`, &login); status != http.StatusCreated {
+		t.Fatalf("login failed with %d", status)
+	}
+	defer GetSessionManager().End(login.Token, SessionLoggedOut)
+
+	var deposit depositResponse
+	status := apiCall(t, server, http.MethodPost, "/v1/deposits", login.Token, `{"amount":"50.00"}`, &deposit)
+	if status != http.StatusCreated || deposit.Balance != "150.00" || deposit.TransactionId == "" {
+		t.Errorf("unexpected deposit %d %+v", status, deposit)
+	}
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		code   string
+	}{
+		{name: "bad amount", body: `{"amount":"abc"}`, status: http.StatusBadRequest, code: "invalid_amount"},
+		{name: "unknown field", body: `{"amount":"20","pin":"1234"}`, status: http.StatusBadRequest, code: "invalid_request"},
+		{name: "partial dispense", body: `{"amount":"20000"}`, status: http.StatusConflict, code: "partial_dispense"},
+	}
+	for _, test := range tests {
+		var failure apiError
+		status = apiCall(t, server, http.MethodPost, "/v1/withdrawals", login.Token, test.body, &failure)
+		if status != test.status || failure.Error.Code != test.code {
+			t.Errorf("%s: expected %d %s got %d %+v", test.name, test.status, test.code, status, failure)
+		}
+	}
+
+	var withdrawal withdrawalResponse
+	status = apiCall(t, server, http.MethodPost, "/v1/withdrawals", login.Token, `{"amount":"160"}`, &withdrawal)
+	if status != http.StatusCreated || withdrawal.AmountDispensed != "160.00" || withdrawal.Fee != "5.00" || withdrawal.Balance != "-15.00" {
+		t.Errorf("unexpected withdrawal %d %+v", status, withdrawal)
+	}
+
+	var failure apiError
+	status = apiCall(t, server, http.MethodPost, "/v1/withdrawals", login.Token, `{"amount":"20"}`, &failure)
+	if status != http.StatusUnprocessableEntity || failure.Error.Code != "overdrawn" {
+		t.Errorf("expected an overdrawn account to be refused got %d %+v", status, failure)
+	}
+
+	var history historyResponse
+	status = apiCall(t, server, http.MethodGet, "/v1/history?sort=desc&limit=2", login.Token, "", &history)
+	if status != http.StatusOK || history.Total != 3 || len(history.Entries) != 2 {
+		t.Fatalf("unexpected history %d %+v", status, history)
+	}
+	if history.Entries[0].Type != FeeTransaction || history.Entries[0].ParentId != withdrawal.TransactionId {
+		t.Errorf("expected the fee first got %+v", history.Entries[0])
+	}
+	status = apiCall(t, server, http.MethodGet, "/v1/history?type=bogus", login.Token, "", &failure)
+	if status != http.StatusBadRequest {
+		t.Errorf("expected an unknown type to be rejected got %d", status)
+	}
+	status = apiCall(t, server, http.MethodPost, "/v1/balance", login.Token, "", &failure)
+	if status != http.StatusMethodNotAllowed {
+		t.Errorf("expected the wrong method to be rejected got %d", status)
+	}
+}
+
+func TestAPIOpenAPIDocument(t *testing.T) {
+	server := setUpAPIServer(t)
+	var document struct {
+		OpenAPI string                     `json:"openapi"`
+		Paths   map[string]json.RawMessage `json:"paths"`
+	}
+	if status := apiCall(t, server, http.MethodGet, "/v1/openapi.json", "", "", &document); status != http.StatusOK {
+		t.Fatalf("unexpected status %d", status)
+	}
+	for _, path := range []string{"/v1/sessions", "/v1/balance", "/v1/deposits", "/v1/withdrawals", "/v1/history"} {
+		if _, ok := document.Paths[path]; !ok {
+			t.Errorf("the OpenAPI document does not describe %s", path)
+		}
+	}
+}
@@ -12,9 +12,14 @@ type SessionGetter interface {
 
 // UserSession stores the state of the session
 type UserSession struct {
+	// Id identifies the session to the SessionManager, it changes each time the customer authorizes
+	Id               string
 	IsAuthenticated  bool
 	AccountId        string
 	LastActivityTime time.Time
+	Started          time.Time
+	// CardPAN is the card in the reader, if the customer inserted one
+	CardPAN string
 }
 
 // the shared session object
@@ -36,6 +41,11 @@ type EncryptedPin struct {
 
 type Authorization struct {
 	accounts map[string]EncryptedPin
+	// map of account # to its TOTP enrollment
+	totp         map[string]*totpEnrollment
+	secondFactor SecondFactorPolicy
+	// cards checks the card a PIN block is bound to, the shared card reader when nil
+	cards *CardReader
 }
 
 // the shared authorization object
@@ -50,18 +60,22 @@ func (auth *Authorization) SetAuthData(authData map[string]EncryptedPin) {
 	auth.accounts = authData
 }
 
-// Authenticate the provided pin against the hashed pin for a given account id
-func (auth *Authorization) Authenticate(accountId string, pin string) (bool, error) {
+// SetCardReader sets the cards PIN blocks are checked against
+func (auth *Authorization) SetCardReader(cards *CardReader) {
+	auth.cards = cards
+}
 
-	if pin == "" {
-		return false, &InvalidInputError{fmt.Sprintf("invalid pin: \"%s\"", pin)}
+func (auth *Authorization) cardReader() *CardReader {
+	if auth.cards == nil {
+		return cardReader
 	}
-	_, err := strconv.ParseInt(pin, 0, 64)
-	if err != nil {
-		return false, &InvalidInputError{"pin must be numeric"}
-	}
-	if len(pin) != 4 {
-		return false, &InvalidInputError{"the pin must be a 4-digit number"}
+	return auth.cards
+}
+
+// Authenticate the provided pin against the hashed pin for a given account id
+func (auth *Authorization) Authenticate(accountId string, pin string) (bool, error) {
+	if err := validatePin(pin); err != nil {
+		return false, err
 	}
 
 	encryptedPinData := auth.accounts[accountId]
@@ -71,3 +85,18 @@ func (auth *Authorization) Authenticate(accountId string, pin string) (bool, err
 		return false, nil
 	}
 }
+
+// validatePin checks that a pin is a 4-digit number
+func validatePin(pin string) error {
+	if pin == "" {
+		return &InvalidInputError{fmt.Sprintf("invalid pin: \"%s\"", pin)}
+	}
+	_, err := strconv.ParseInt(pin, 0, 64)
+	if err != nil {
+		return &InvalidInputError{"pin must be numeric"}
+	}
+	if len(pin) != 4 {
+		return &InvalidInputError{"the pin must be a 4-digit number"}
+	}
+	return nil
+}
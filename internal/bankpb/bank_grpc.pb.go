@@ -0,0 +1,405 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: bank.proto
+
+package bankpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	BankHost_Authenticate_FullMethodName         = "/atmsim.bank.v1.BankHost/Authenticate"
+	BankHost_SecondFactorRequired_FullMethodName = "/atmsim.bank.v1.BankHost/SecondFactorRequired"
+	BankHost_VerifyOneTimeCode_FullMethodName    = "/atmsim.bank.v1.BankHost/VerifyOneTimeCode"
+	BankHost_GetBalance_FullMethodName           = "/atmsim.bank.v1.BankHost/GetBalance"
+	BankHost_Deposit_FullMethodName              = "/atmsim.bank.v1.BankHost/Deposit"
+	BankHost_Withdraw_FullMethodName             = "/atmsim.bank.v1.BankHost/Withdraw"
+	BankHost_Advise_FullMethodName               = "/atmsim.bank.v1.BankHost/Advise"
+	BankHost_Reverse_FullMethodName              = "/atmsim.bank.v1.BankHost/Reverse"
+	BankHost_GetHistory_FullMethodName           = "/atmsim.bank.v1.BankHost/GetHistory"
+)
+
+// BankHostClient is the client API for BankHost service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type BankHostClient interface {
+	Authenticate(ctx context.Context, in *AuthenticateRequest, opts ...grpc.CallOption) (*AuthenticateResponse, error)
+	SecondFactorRequired(ctx context.Context, in *SecondFactorRequest, opts ...grpc.CallOption) (*SecondFactorResponse, error)
+	VerifyOneTimeCode(ctx context.Context, in *VerifyOneTimeCodeRequest, opts ...grpc.CallOption) (*VerifyOneTimeCodeResponse, error)
+	GetBalance(ctx context.Context, in *BalanceRequest, opts ...grpc.CallOption) (*BalanceResponse, error)
+	Deposit(ctx context.Context, in *DepositRequest, opts ...grpc.CallOption) (*DepositResponse, error)
+	Withdraw(ctx context.Context, in *WithdrawRequest, opts ...grpc.CallOption) (*WithdrawResponse, error)
+	Advise(ctx context.Context, in *AdviceRequest, opts ...grpc.CallOption) (*WithdrawResponse, error)
+	Reverse(ctx context.Context, in *ReversalRequest, opts ...grpc.CallOption) (*ReversalResponse, error)
+	GetHistory(ctx context.Context, in *HistoryRequest, opts ...grpc.CallOption) (*HistoryResponse, error)
+}
+
+type bankHostClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewBankHostClient(cc grpc.ClientConnInterface) BankHostClient {
+	return &bankHostClient{cc}
+}
+
+func (c *bankHostClient) Authenticate(ctx context.Context, in *AuthenticateRequest, opts ...grpc.CallOption) (*AuthenticateResponse, error) {
+	out := new(AuthenticateResponse)
+	err := c.cc.Invoke(ctx, BankHost_Authenticate_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *bankHostClient) SecondFactorRequired(ctx context.Context, in *SecondFactorRequest, opts ...grpc.CallOption) (*SecondFactorResponse, error) {
+	out := new(SecondFactorResponse)
+	err := c.cc.Invoke(ctx, BankHost_SecondFactorRequired_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *bankHostClient) VerifyOneTimeCode(ctx context.Context, in *VerifyOneTimeCodeRequest, opts ...grpc.CallOption) (*VerifyOneTimeCodeResponse, error) {
+	out := new(VerifyOneTimeCodeResponse)
+	err := c.cc.Invoke(ctx, BankHost_VerifyOneTimeCode_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *bankHostClient) GetBalance(ctx context.Context, in *BalanceRequest, opts ...grpc.CallOption) (*BalanceResponse, error) {
+	out := new(BalanceResponse)
+	err := c.cc.Invoke(ctx, BankHost_GetBalance_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *bankHostClient) Deposit(ctx context.Context, in *DepositRequest, opts ...grpc.CallOption) (*DepositResponse, error) {
+	out := new(DepositResponse)
+	err := c.cc.Invoke(ctx, BankHost_Deposit_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *bankHostClient) Withdraw(ctx context.Context, in *WithdrawRequest, opts ...grpc.CallOption) (*WithdrawResponse, error) {
+	out := new(WithdrawResponse)
+	err := c.cc.Invoke(ctx, BankHost_Withdraw_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *bankHostClient) Advise(ctx context.Context, in *AdviceRequest, opts ...grpc.CallOption) (*WithdrawResponse, error) {
+	out := new(WithdrawResponse)
+	err := c.cc.Invoke(ctx, BankHost_Advise_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *bankHostClient) Reverse(ctx context.Context, in *ReversalRequest, opts ...grpc.CallOption) (*ReversalResponse, error) {
+	out := new(ReversalResponse)
+	err := c.cc.Invoke(ctx, BankHost_Reverse_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *bankHostClient) GetHistory(ctx context.Context, in *HistoryRequest, opts ...grpc.CallOption) (*HistoryResponse, error) {
+	out := new(HistoryResponse)
+	err := c.cc.Invoke(ctx, BankHost_GetHistory_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// BankHostServer is the server API for BankHost service.
+// All implementations must embed UnimplementedBankHostServer
+// for forward compatibility
+type BankHostServer interface {
+	Authenticate(context.Context, *AuthenticateRequest) (*AuthenticateResponse, error)
+	SecondFactorRequired(context.Context, *SecondFactorRequest) (*SecondFactorResponse, error)
+	VerifyOneTimeCode(context.Context, *VerifyOneTimeCodeRequest) (*VerifyOneTimeCodeResponse, error)
+	GetBalance(context.Context, *BalanceRequest) (*BalanceResponse, error)
+	Deposit(context.Context, *DepositRequest) (*DepositResponse, error)
+	Withdraw(context.Context, *WithdrawRequest) (*WithdrawResponse, error)
+	Advise(context.Context, *AdviceRequest) (*WithdrawResponse, error)
+	Reverse(context.Context, *ReversalRequest) (*ReversalResponse, error)
+	GetHistory(context.Context, *HistoryRequest) (*HistoryResponse, error)
+	mustEmbedUnimplementedBankHostServer()
+}
+
+// UnimplementedBankHostServer must be embedded to have forward compatible implementations.
+type UnimplementedBankHostServer struct {
+}
+
+func (UnimplementedBankHostServer) Authenticate(context.Context, *AuthenticateRequest) (*AuthenticateResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Authenticate not implemented")
+}
+func (UnimplementedBankHostServer) SecondFactorRequired(context.Context, *SecondFactorRequest) (*SecondFactorResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SecondFactorRequired not implemented")
+}
+func (UnimplementedBankHostServer) VerifyOneTimeCode(context.Context, *VerifyOneTimeCodeRequest) (*VerifyOneTimeCodeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method VerifyOneTimeCode not implemented")
+}
+func (UnimplementedBankHostServer) GetBalance(context.Context, *BalanceRequest) (*BalanceResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBalance not implemented")
+}
+func (UnimplementedBankHostServer) Deposit(context.Context, *DepositRequest) (*DepositResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Deposit not implemented")
+}
+func (UnimplementedBankHostServer) Withdraw(context.Context, *WithdrawRequest) (*WithdrawResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Withdraw not implemented")
+}
+func (UnimplementedBankHostServer) Advise(context.Context, *AdviceRequest) (*WithdrawResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Advise not implemented")
+}
+func (UnimplementedBankHostServer) Reverse(context.Context, *ReversalRequest) (*ReversalResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Reverse not implemented")
+}
+func (UnimplementedBankHostServer) GetHistory(context.Context, *HistoryRequest) (*HistoryResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetHistory not implemented")
+}
+func (UnimplementedBankHostServer) mustEmbedUnimplementedBankHostServer() {}
+
+// UnsafeBankHostServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to BankHostServer will
+// result in compilation errors.
+type UnsafeBankHostServer interface {
+	mustEmbedUnimplementedBankHostServer()
+}
+
+func RegisterBankHostServer(s grpc.ServiceRegistrar, srv BankHostServer) {
+	s.RegisterService(&BankHost_ServiceDesc, srv)
+}
+
+func _BankHost_Authenticate_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AuthenticateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BankHostServer).Authenticate(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: BankHost_Authenticate_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BankHostServer).Authenticate(ctx, req.(*AuthenticateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BankHost_SecondFactorRequired_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SecondFactorRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BankHostServer).SecondFactorRequired(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: BankHost_SecondFactorRequired_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BankHostServer).SecondFactorRequired(ctx, req.(*SecondFactorRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BankHost_VerifyOneTimeCode_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(VerifyOneTimeCodeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BankHostServer).VerifyOneTimeCode(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: BankHost_VerifyOneTimeCode_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BankHostServer).VerifyOneTimeCode(ctx, req.(*VerifyOneTimeCodeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BankHost_GetBalance_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BalanceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BankHostServer).GetBalance(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: BankHost_GetBalance_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BankHostServer).GetBalance(ctx, req.(*BalanceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BankHost_Deposit_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DepositRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BankHostServer).Deposit(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: BankHost_Deposit_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BankHostServer).Deposit(ctx, req.(*DepositRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BankHost_Withdraw_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(WithdrawRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BankHostServer).Withdraw(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: BankHost_Withdraw_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BankHostServer).Withdraw(ctx, req.(*WithdrawRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BankHost_Advise_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AdviceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BankHostServer).Advise(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: BankHost_Advise_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BankHostServer).Advise(ctx, req.(*AdviceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BankHost_Reverse_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReversalRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BankHostServer).Reverse(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: BankHost_Reverse_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BankHostServer).Reverse(ctx, req.(*ReversalRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BankHost_GetHistory_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(HistoryRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BankHostServer).GetHistory(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: BankHost_GetHistory_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BankHostServer).GetHistory(ctx, req.(*HistoryRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// BankHost_ServiceDesc is the grpc.ServiceDesc for BankHost service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var BankHost_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "atmsim.bank.v1.BankHost",
+	HandlerType: (*BankHostServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Authenticate",
+			Handler:    _BankHost_Authenticate_Handler,
+		},
+		{
+			MethodName: "SecondFactorRequired",
+			Handler:    _BankHost_SecondFactorRequired_Handler,
+		},
+		{
+			MethodName: "VerifyOneTimeCode",
+			Handler:    _BankHost_VerifyOneTimeCode_Handler,
+		},
+		{
+			MethodName: "GetBalance",
+			Handler:    _BankHost_GetBalance_Handler,
+		},
+		{
+			MethodName: "Deposit",
+			Handler:    _BankHost_Deposit_Handler,
+		},
+		{
+			MethodName: "Withdraw",
+			Handler:    _BankHost_Withdraw_Handler,
+		},
+		{
+			MethodName: "Advise",
+			Handler:    _BankHost_Advise_Handler,
+		},
+		{
+			MethodName: "Reverse",
+			Handler:    _BankHost_Reverse_Handler,
+		},
+		{
+			MethodName: "GetHistory",
+			Handler:    _BankHost_GetHistory_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "bank.proto",
+}
@@ -0,0 +1,4 @@
+// Package bankpb holds the protocol buffer and gRPC definitions for the bank host service
+package bankpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative bank.proto
@@ -0,0 +1,246 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"os"
+	"time"
+)
+
+const (
+	withdrawalCodeDigits = 8
+	// MaxWithdrawalCodeFailures is how many wrong withdrawal codes can be entered in a row before redeem is locked
+	MaxWithdrawalCodeFailures = 5
+	// WithdrawalCodeLockout is how long redeem stays locked after too many wrong withdrawal codes
+	WithdrawalCodeLockout = 15 * time.Minute
+)
+
+// StagedWithdrawal is a cardless withdrawal set up in advance, collected at the machine with its one-time code
+type StagedWithdrawal struct {
+	Code      string    `json:"code"`
+	AccountId string    `json:"account_id"`
+	Amount    float64   `json:"amount"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"`
+}
+
+// stagedWithdrawalsFile is how the staged withdrawals are kept in their file, with the wrong codes entered so that
+// the lockout holds across every process redeeming them
+type stagedWithdrawalsFile struct {
+	Withdrawals      map[string]*StagedWithdrawal `json:"withdrawals"`
+	CodeFailures     int                          `json:"code_failures"`
+	CodesLockedUntil time.Time                    `json:"codes_locked_until"`
+}
+
+// OpenStagedWithdrawals keeps the staged cardless withdrawals in path, so that withdrawals staged from the command line
+// can be collected at the terminal. The file is read again each time the staged withdrawals are used
+func (ledger *Ledger) OpenStagedWithdrawals(path string) error {
+	ledger.stagedPath = path
+	return ledger.loadStagedWithdrawals()
+}
+
+// StageWithdrawal reserves funds in an account for a cardless withdrawal, returning the one-time code
+// that collects them. The code can be used once, until it expires after ttl
+func (ledger *Ledger) StageWithdrawal(accountId string, amount string, ttl time.Duration) (*StagedWithdrawal, error) {
+	dollarAmount, err := StringToMoney(amount)
+	if err != nil {
+		return nil, err
+	}
+	if math.Mod(dollarAmount, 20) != 0 {
+		return nil, &InvalidAmountError{message: "Withdrawals must be in units of $20."}
+	}
+	if ttl <= 0 {
+		return nil, &InvalidInputError{"the withdrawal code must expire in the future"}
+	}
+	// cardless withdrawals can not overdraw the account
+	if available := ledger.GetAvailableBalance(accountId); dollarAmount > available {
+		return nil, &InsufficientFundsError{}
+	}
+	code, err := ledger.newWithdrawalCode()
+	if err != nil {
+		return nil, err
+	}
+	now := clock.Now()
+	staged := &StagedWithdrawal{Code: code, AccountId: accountId, Amount: dollarAmount, Created: now, Expires: now.Add(ttl)}
+	if ledger.stagedWithdrawals == nil {
+		ledger.stagedWithdrawals = map[string]*StagedWithdrawal{}
+	}
+	ledger.stagedWithdrawals[code] = staged
+	if err := ledger.saveStagedWithdrawals(); err != nil {
+		delete(ledger.stagedWithdrawals, code)
+		return nil, err
+	}
+	Logger.Printf("staged cardless withdrawal of %.2f for %s until %s\n", dollarAmount, accountId, staged.Expires.Format(time.RFC3339))
+	return staged, nil
+}
+
+// RedeemWithdrawal dispenses a staged cardless withdrawal. The code is used up once the cash is dispensed.
+// After MaxWithdrawalCodeFailures wrong codes in a row no code is accepted for WithdrawalCodeLockout, so codes can not be guessed
+func (ledger *Ledger) RedeemWithdrawal(code string) (*StagedWithdrawal, *WithdrawResult, error) {
+	now := clock.Now()
+	ledger.refreshStagedWithdrawals()
+	if now.Before(ledger.codesLockedUntil) {
+		Logger.Println("cardless withdrawal code entered while redeem is locked")
+		return nil, nil, &WithdrawalCodesLockedError{}
+	}
+	staged, ok := ledger.stagedWithdrawals[code]
+	if !ok {
+		Logger.Println("invalid cardless withdrawal code entered")
+		ledger.codeFailures++
+		if ledger.codeFailures >= MaxWithdrawalCodeFailures {
+			ledger.codeFailures = 0
+			ledger.codesLockedUntil = now.Add(WithdrawalCodeLockout)
+			Logger.Printf("too many invalid cardless withdrawal codes, redeem locked until %s\n", ledger.codesLockedUntil.Format(time.RFC3339))
+		}
+		if err := ledger.saveStagedWithdrawals(); err != nil {
+			Logger.Printf("unable to save the staged withdrawals: %+v\n", err)
+		}
+		return nil, nil, &InvalidWithdrawalCodeError{}
+	}
+	ledger.codeFailures = 0
+	if err := dispenserReady(); err != nil {
+		return staged, &WithdrawResult{}, err
+	}
+	// release the reservation so the withdrawal can use the funds, putting it back if the withdrawal fails
+	delete(ledger.stagedWithdrawals, code)
+	if err := ledger.saveStagedWithdrawals(); err != nil {
+		ledger.stagedWithdrawals[code] = staged
+		return staged, &WithdrawResult{}, err
+	}
+	// cardless withdrawals can not overdraw the account, even if the funds were spent since it was staged
+	if available := ledger.GetAvailableBalance(staged.AccountId); staged.Amount > available {
+		ledger.stagedWithdrawals[code] = staged
+		if saveErr := ledger.saveStagedWithdrawals(); saveErr != nil {
+			Logger.Printf("unable to save the staged withdrawals: %+v\n", saveErr)
+		}
+		Logger.Printf("cardless withdrawal of %.2f for %s refused, only %.2f available\n", staged.Amount, staged.AccountId, available)
+		return staged, &WithdrawResult{RemainingBalance: ledger.balances[staged.AccountId]}, &InsufficientFundsError{}
+	}
+	result, err := ledger.withdraw(WithdrawalRequest{AccountId: staged.AccountId, Amount: fmt.Sprintf("%.2f", staged.Amount), Description: "cardless withdrawal"})
+	if err != nil {
+		ledger.stagedWithdrawals[code] = staged
+		if saveErr := ledger.saveStagedWithdrawals(); saveErr != nil {
+			Logger.Printf("unable to save the staged withdrawals: %+v\n", saveErr)
+		}
+		return staged, result, err
+	}
+	Logger.Printf("cardless withdrawal of %.2f collected for %s\n", staged.Amount, staged.AccountId)
+	return staged, result, nil
+}
+
+// CancelStagedWithdrawal releases the funds reserved for a cardless withdrawal that has not been collected
+func (ledger *Ledger) CancelStagedWithdrawal(accountId string, code string) error {
+	ledger.refreshStagedWithdrawals()
+	staged, ok := ledger.stagedWithdrawals[code]
+	if !ok || staged.AccountId != accountId {
+		return &InvalidWithdrawalCodeError{}
+	}
+	delete(ledger.stagedWithdrawals, code)
+	if err := ledger.saveStagedWithdrawals(); err != nil {
+		ledger.stagedWithdrawals[code] = staged
+		return err
+	}
+	Logger.Printf("cancelled cardless withdrawal of %.2f for %s\n", staged.Amount, accountId)
+	return nil
+}
+
+// GetStagedWithdrawals returns the cardless withdrawals for an account that can still be collected
+func (ledger *Ledger) GetStagedWithdrawals(accountId string) []*StagedWithdrawal {
+	ledger.refreshStagedWithdrawals()
+	var staged []*StagedWithdrawal
+	for _, withdrawal := range ledger.stagedWithdrawals {
+		if withdrawal.AccountId == accountId {
+			staged = append(staged, withdrawal)
+		}
+	}
+	return staged
+}
+
+// GetReservedFunds returns the funds in an account reserved for cardless withdrawals
+func (ledger *Ledger) GetReservedFunds(accountId string) float64 {
+	ledger.refreshStagedWithdrawals()
+	reserved := 0.0
+	for _, staged := range ledger.stagedWithdrawals {
+		if staged.AccountId == accountId {
+			reserved += staged.Amount
+		}
+	}
+	return reserved
+}
+
+// refreshStagedWithdrawals reads the withdrawals staged and the wrong codes entered since they were last used and releases the funds reserved
+// for those whose codes have expired
+func (ledger *Ledger) refreshStagedWithdrawals() {
+	if err := ledger.loadStagedWithdrawals(); err != nil {
+		Logger.Printf("unable to read the staged withdrawals: %+v\n", err)
+	}
+	now := clock.Now()
+	expired := false
+	for code, staged := range ledger.stagedWithdrawals {
+		if !now.Before(staged.Expires) {
+			Logger.Printf("cardless withdrawal of %.2f for %s expired\n", staged.Amount, staged.AccountId)
+			delete(ledger.stagedWithdrawals, code)
+			expired = true
+		}
+	}
+	if expired {
+		if err := ledger.saveStagedWithdrawals(); err != nil {
+			Logger.Printf("unable to save the staged withdrawals: %+v\n", err)
+		}
+	}
+}
+
+// loadStagedWithdrawals reads the staged withdrawals from their file, if they are kept in one
+func (ledger *Ledger) loadStagedWithdrawals() error {
+	if ledger.stagedPath == "" {
+		return nil
+	}
+	data, err := os.ReadFile(ledger.stagedPath)
+	if os.IsNotExist(err) {
+		ledger.stagedWithdrawals = map[string]*StagedWithdrawal{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	file := stagedWithdrawalsFile{}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("unable to read the staged withdrawals %s: %w", ledger.stagedPath, err)
+	}
+	if file.Withdrawals == nil {
+		file.Withdrawals = map[string]*StagedWithdrawal{}
+	}
+	ledger.stagedWithdrawals = file.Withdrawals
+	ledger.codeFailures, ledger.codesLockedUntil = file.CodeFailures, file.CodesLockedUntil
+	return nil
+}
+
+// saveStagedWithdrawals writes the staged withdrawals and the redeem lockout to their file, if they are kept in one
+func (ledger *Ledger) saveStagedWithdrawals() error {
+	if ledger.stagedPath == "" {
+		return nil
+	}
+	return writeJSONFile(ledger.stagedPath, stagedWithdrawalsFile{
+		Withdrawals:      ledger.stagedWithdrawals,
+		CodeFailures:     ledger.codeFailures,
+		CodesLockedUntil: ledger.codesLockedUntil,
+	})
+}
+
+// newWithdrawalCode generates a random numeric code not already in use
+func (ledger *Ledger) newWithdrawalCode() (string, error) {
+	limit := big.NewInt(int64(math.Pow10(withdrawalCodeDigits)))
+	for {
+		n, err := rand.Int(rand.Reader, limit)
+		if err != nil {
+			return "", err
+		}
+		code := fmt.Sprintf("%0*d", withdrawalCodeDigits, n.Int64())
+		if _, used := ledger.stagedWithdrawals[code]; !used {
+			return code, nil
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStageWithdrawal(t *testing.T) {
+	const accountId = "jc123"
+	tests := []struct {
+		name   string
+		amount string
+		ttl    time.Duration
+		err    error
+	}{
+		{name: "valid", amount: "100", ttl: time.Minute},
+		{name: "not units of 20", amount: "110", ttl: time.Minute, err: &InvalidAmountError{message: "Withdrawals must be in units of $20."}},
+		{name: "more than available", amount: "520", ttl: time.Minute, err: &InsufficientFundsError{}},
+		{name: "already expired", amount: "100", ttl: 0, err: &InvalidInputError{"the withdrawal code must expire in the future"}},
+	}
+	InitLogger("", true)
+	for _, test := range tests {
+		ledger := &Ledger{}
+		ledger.SetInitialBalances(10000, map[string]float64{
+			accountId: 500.00,
+		})
+		staged, err := ledger.StageWithdrawal(accountId, test.amount, test.ttl)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: unexpected error %+v\n", test.name, err)
+		}
+		if err != nil {
+			continue
+		}
+		if len(staged.Code) != withdrawalCodeDigits {
+			t.Errorf("%s: unexpected code %q\n", test.name, staged.Code)
+		}
+		if available := ledger.GetAvailableBalance(accountId); available != 400.00 {
+			t.Errorf("%s: expected the funds to be reserved, available %.2f\n", test.name, available)
+		}
+		// a card withdrawal into the reserved funds overdraws the available balance, after which nothing is available
+		if result, err := ledger.Withdraw(accountId, "420"); err != nil || !result.WasOverdrawn {
+			t.Errorf("%s: expected the withdrawal to overdraw the available funds got %+v %+v\n", test.name, result, err)
+		}
+		if _, err := ledger.Withdraw(accountId, "20"); !errors.Is(err, &FundsOnHoldError{}) {
+			t.Errorf("%s: expected reserved funds to be unavailable got %+v\n", test.name, err)
+		}
+	}
+}
+
+func TestRedeemWithdrawal(t *testing.T) {
+	const accountId = "jc123"
+	InitLogger("", true)
+	fakeClock := NewFakeClock(time.Date(2023, 5, 1, 9, 0, 0, 0, time.UTC))
+	SetClock(fakeClock)
+	defer SetClock(nil)
+	ledger := &Ledger{}
+	ledger.SetInitialBalances(10000, map[string]float64{
+		accountId: 500.00,
+	})
+	staged, err := ledger.StageWithdrawal(accountId, "100", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ledger.RedeemWithdrawal("00000000x"); !errors.Is(err, &InvalidWithdrawalCodeError{}) {
+		t.Errorf("expected an unknown code to be rejected got %+v", err)
+	}
+	_, result, err := ledger.RedeemWithdrawal(staged.Code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.AmountWithdrawn != 100.00 || result.RemainingBalance != 400.00 {
+		t.Errorf("unexpected withdrawal %+v", result)
+	}
+	history := ledger.GetHistory(accountId)
+	if last := history[len(history)-1]; last.Description != "cardless withdrawal" {
+		t.Errorf("unexpected history entry %+v", last)
+	}
+	if _, _, err := ledger.RedeemWithdrawal(staged.Code); !errors.Is(err, &InvalidWithdrawalCodeError{}) {
+		t.Errorf("expected a used code to be rejected got %+v", err)
+	}
+
+	// an expired code releases the reservation and can not be redeemed
+	staged, err = ledger.StageWithdrawal(accountId, "100", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakeClock.Advance(59 * time.Second)
+	if available := ledger.GetAvailableBalance(accountId); available != 300.00 {
+		t.Errorf("expected the funds to be reserved until the code expires, available %.2f", available)
+	}
+	fakeClock.Advance(time.Second)
+	if available := ledger.GetAvailableBalance(accountId); available != 400.00 {
+		t.Errorf("expected the expired reservation to be released, available %.2f", available)
+	}
+	if _, _, err := ledger.RedeemWithdrawal(staged.Code); !errors.Is(err, &InvalidWithdrawalCodeError{}) {
+		t.Errorf("expected an expired code to be rejected got %+v", err)
+	}
+
+	// a code is kept if the machine can not dispense it
+	staged, err = ledger.StageWithdrawal(accountId, "100", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ledger.availableCash = 0
+	if _, _, err := ledger.RedeemWithdrawal(staged.Code); !errors.Is(err, &NoMoneyLeftError{}) {
+		t.Errorf("expected the machine to be empty got %+v", err)
+	}
+	if len(ledger.GetStagedWithdrawals(accountId)) != 1 {
+		t.Errorf("expected the code to remain staged")
+	}
+
+	// nor is it collected once the funds it reserved have gone, as the account can not be overdrawn
+	ledger.availableCash = 10000
+	ledger.balances[accountId] = 60.00
+	if _, _, err := ledger.RedeemWithdrawal(staged.Code); !errors.Is(err, &InsufficientFundsError{}) {
+		t.Errorf("expected the withdrawal to be refused got %+v", err)
+	}
+	if balance := ledger.GetBalance(accountId); balance != 60.00 || len(ledger.GetStagedWithdrawals(accountId)) != 1 {
+		t.Errorf("expected nothing to be withdrawn and the code to remain staged, balance %.2f", balance)
+	}
+}
+
+func TestRedeemWithdrawalLockout(t *testing.T) {
+	const accountId = "jc123"
+	InitLogger("", true)
+	fakeClock := NewFakeClock(time.Date(2023, 5, 1, 9, 0, 0, 0, time.UTC))
+	SetClock(fakeClock)
+	defer SetClock(nil)
+	ledger := &Ledger{}
+	ledger.SetInitialBalances(10000, map[string]float64{
+		accountId: 500.00,
+	})
+	staged, err := ledger.StageWithdrawal(accountId, "100", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < MaxWithdrawalCodeFailures; i++ {
+		if _, _, err := ledger.RedeemWithdrawal(fmt.Sprintf("%08d", i)); !errors.Is(err, &InvalidWithdrawalCodeError{}) {
+			t.Fatalf("expected a wrong code to be rejected got %+v", err)
+		}
+	}
+	// once locked even the right code is refused, so codes can not be guessed
+	if _, _, err := ledger.RedeemWithdrawal(staged.Code); !errors.Is(err, &WithdrawalCodesLockedError{}) {
+		t.Errorf("expected redeem to be locked got %+v", err)
+	}
+	fakeClock.Advance(WithdrawalCodeLockout)
+	if _, _, err := ledger.RedeemWithdrawal(staged.Code); err != nil {
+		t.Errorf("expected the code to be accepted after the lockout got %+v", err)
+	}
+}
+
+func TestStagedWithdrawalsFile(t *testing.T) {
+	const accountId = "jc123"
+	InitLogger("", true)
+	path := filepath.Join(t.TempDir(), "staged.json")
+	balances := map[string]float64{accountId: 500.00}
+	stager := &Ledger{}
+	stager.SetInitialBalances(10000, balances)
+	if err := stager.OpenStagedWithdrawals(path); err != nil {
+		t.Fatal(err)
+	}
+	terminal := &Ledger{}
+	terminal.SetInitialBalances(10000, map[string]float64{accountId: 500.00})
+	if err := terminal.OpenStagedWithdrawals(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// a withdrawal staged by one process is reserved and collected in another
+	staged, err := stager.StageWithdrawal(accountId, "100", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if available := terminal.GetAvailableBalance(accountId); available != 400.00 {
+		t.Errorf("expected the staged funds to be reserved, available %.2f", available)
+	}
+	if _, _, err := terminal.RedeemWithdrawal(staged.Code); err != nil {
+		t.Fatal(err)
+	}
+	if staged := stager.GetStagedWithdrawals(accountId); len(staged) != 0 {
+		t.Errorf("expected the collected code to be used up got %+v", staged)
+	}
+
+	// wrong codes count towards the lockout whichever process they are entered in
+	staged, err = stager.StageWithdrawal(accountId, "100", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < MaxWithdrawalCodeFailures; i++ {
+		redeemer := stager
+		if i%2 == 1 {
+			redeemer = terminal
+		}
+		if _, _, err := redeemer.RedeemWithdrawal(fmt.Sprintf("%08d", i)); !errors.Is(err, &InvalidWithdrawalCodeError{}) {
+			t.Fatalf("expected a wrong code to be rejected got %+v", err)
+		}
+	}
+	restarted := &Ledger{}
+	restarted.SetInitialBalances(10000, map[string]float64{accountId: 400.00})
+	if err := restarted.OpenStagedWithdrawals(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := restarted.RedeemWithdrawal(staged.Code); !errors.Is(err, &WithdrawalCodesLockedError{}) {
+		t.Errorf("expected redeem to stay locked after a restart got %+v", err)
+	}
+}
@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const cardExpiryFormat = "01/06"
+
+// CardStatus is whether a card may be used
+type CardStatus string
+
+const (
+	CardActive    CardStatus = "active"
+	CardHotlisted CardStatus = "hotlisted"
+)
+
+// Card is a bank card that can be inserted into the machine
+type Card struct {
+	// PAN is the primary account number printed on the card
+	PAN string
+	// Expiry is the last moment the card is valid, the end of its expiry month
+	Expiry time.Time
+	// ServiceCode is the 3 digit service code from the magnetic stripe
+	ServiceCode string
+	// Accounts are the accounts the card can be used with, the first being the default
+	Accounts []string
+	Status   CardStatus
+}
+
+// CardReader validates the cards inserted into the machine
+type CardReader struct {
+	cards map[string]Card
+}
+
+// the shared card reader
+var cardReader = &CardReader{}
+
+func GetCardReader() *CardReader {
+	return cardReader
+}
+
+// SetCards sets the CardReader with a map of PAN to card record
+func (reader *CardReader) SetCards(cards map[string]Card) {
+	reader.cards = cards
+}
+
+// ReadCard validates an inserted card, returning its record if it may be used
+func (reader *CardReader) ReadCard(pan string) (*Card, error) {
+	masked := MaskAccount(pan)
+	if !LuhnValid(pan) {
+		Logger.Printf("card %s rejected: invalid PAN\n", masked)
+		return nil, &InvalidCardError{}
+	}
+	card, ok := reader.cards[pan]
+	if !ok {
+		Logger.Printf("card %s rejected: unknown card\n", masked)
+		return nil, &UnknownCardError{}
+	}
+	if card.Status == CardHotlisted {
+		Logger.Printf("card %s rejected: hotlisted\n", masked)
+		return nil, &HotlistedCardError{}
+	}
+	if card.Status != CardActive {
+		Logger.Printf("card %s rejected: status %s\n", masked, card.Status)
+		return nil, &InvalidCardError{}
+	}
+	if !clock.Now().Before(card.Expiry) {
+		Logger.Printf("card %s rejected: expired %s\n", masked, card.Expiry.Format(cardExpiryFormat))
+		return nil, &ExpiredCardError{}
+	}
+	Logger.Printf("card %s accepted\n", masked)
+	return &card, nil
+}
+
+// LinksAccount checks whether the card with pan is known and can be used with the account, whatever its status
+func (reader *CardReader) LinksAccount(pan string, accountId string) bool {
+	card, ok := reader.cards[pan]
+	return ok && card.LinksAccount(accountId)
+}
+
+// LinksAccount checks whether the card can be used with the account
+func (card *Card) LinksAccount(accountId string) bool {
+	for _, account := range card.Accounts {
+		if account == accountId {
+			return true
+		}
+	}
+	return false
+}
+
+// LuhnValid checks a PAN's Luhn check digit
+func LuhnValid(pan string) bool {
+	if len(pan) < 12 || len(pan) > 19 {
+		return false
+	}
+	sum := 0
+	for i := 0; i < len(pan); i++ {
+		digit := pan[len(pan)-1-i]
+		if digit < '0' || digit > '9' {
+			return false
+		}
+		value := int(digit - '0')
+		if i%2 == 1 {
+			value *= 2
+			if value > 9 {
+				value -= 9
+			}
+		}
+		sum += value
+	}
+	return sum%10 == 0
+}
+
+// NewCard creates a card record from its stored fields. expiry is in the form MM/YY and
+// accounts are separated by ';'
+func NewCard(pan string, expiry string, serviceCode string, accounts string, status string) (Card, error) {
+	expiryMonth, err := time.ParseInLocation(cardExpiryFormat, expiry, time.Local)
+	if err != nil {
+		return Card{}, &InvalidInputError{fmt.Sprintf("invalid card expiry \"%s\"", expiry)}
+	}
+	if len(serviceCode) != 3 {
+		return Card{}, &InvalidInputError{fmt.Sprintf("invalid service code \"%s\"", serviceCode)}
+	}
+	card := Card{
+		PAN:         pan,
+		Expiry:      expiryMonth.AddDate(0, 1, 0),
+		ServiceCode: serviceCode,
+		Accounts:    strings.Split(accounts, ";"),
+		Status:      CardStatus(strings.ToLower(status)),
+	}
+	return card, nil
+}
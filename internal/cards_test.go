@@ -0,0 +1,64 @@
+package internal
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLuhnValid(t *testing.T) {
+	tests := map[string]bool{
+		"4000001434597308": true,
+		"4111111111111111": true,
+		"4000001434597309": false,
+		"40000014345973a8": false,
+		"1234":             false,
+	}
+	for pan, expected := range tests {
+		if LuhnValid(pan) != expected {
+			t.Errorf("expected Luhn check of %s to be %t", pan, expected)
+		}
+	}
+}
+
+func TestReadCard(t *testing.T) {
+	InitLogger("", true)
+	cards := map[string]Card{}
+	for _, record := range [][]string{
+		{"4000001434597308", "12/49", "201", "1434597300;2001377812", "active"},
+		{"4000002001377819", "01/24", "201", "2001377812", "active"},
+		{"4000009999999991", "12/49", "201", "1434597300", "HOTLISTED"},
+	} {
+		card, err := NewCard(record[0], record[1], record[2], record[3], record[4])
+		if err != nil {
+			t.Fatal(err)
+		}
+		cards[card.PAN] = card
+	}
+	reader := &CardReader{}
+	reader.SetCards(cards)
+
+	tests := []struct {
+		name string
+		pan  string
+		err  error
+	}{
+		{name: "valid card", pan: "4000001434597308", err: nil},
+		{name: "expired card", pan: "4000002001377819", err: &ExpiredCardError{}},
+		{name: "hotlisted card", pan: "4000009999999991", err: &HotlistedCardError{}},
+		{name: "unknown card", pan: "4111111111111111", err: &UnknownCardError{}},
+		{name: "bad check digit", pan: "4000001434597309", err: &InvalidCardError{}},
+	}
+	for _, test := range tests {
+		card, err := reader.ReadCard(test.pan)
+		if !errors.Is(err, test.err) || (test.err != nil && !errors.Is(test.err, err)) {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+		if test.err == nil && (card == nil || !card.LinksAccount("2001377812") || card.LinksAccount("2859459814")) {
+			t.Errorf("%s: unexpected card %+v", test.name, card)
+		}
+	}
+
+	if _, err := NewCard("4000001434597308", "2099-12", "201", "1434597300", "active"); err == nil {
+		t.Errorf("expected an error for an invalid expiry")
+	}
+}
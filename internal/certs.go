@@ -0,0 +1,227 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// files written by GenerateCertificates
+const (
+	CACertificateFile       = "ca.pem"
+	CAKeyFile               = "ca-key.pem"
+	HostCertificateFile     = "host.pem"
+	HostKeyFile             = "host-key.pem"
+	TerminalCertificateFile = "terminal.pem"
+	TerminalKeyFile         = "terminal-key.pem"
+)
+
+// DefaultTerminalId identifies a terminal that has not been given an id, the terminal certificate generated
+// with the bank host's is for it
+const DefaultTerminalId = "ATM00001"
+
+// terminalIdPattern is what a terminal id in a certificate and its file names may hold
+var terminalIdPattern = regexp.MustCompile(`^[A-Za-z0-9-]{1,16}$`)
+
+const certificateLifetime = 365 * 24 * time.Hour
+
+// GenerateCertificates creates a local certificate authority, a bank host certificate signed by it valid for the given
+// host names and IP addresses, and a certificate for the terminal DefaultTerminalId, and writes them to dir. Terminals
+// trust the CA certificate and the bank host only accepts terminals presenting a certificate signed by it, for the
+// terminal id in the certificate. Certificates for other terminals are issued with IssueTerminalCertificate
+func GenerateCertificates(dir string, hosts []string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	now := clock.Now()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          newSerialNumber(),
+		Subject:               pkix.Name{Organization: []string{"ATM Simulator"}, CommonName: "ATM Simulator local CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(certificateLifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return err
+	}
+
+	hostKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	hostTemplate := &x509.Certificate{
+		SerialNumber: newSerialNumber(),
+		Subject:      pkix.Name{Organization: []string{"ATM Simulator"}, CommonName: "bank host"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(certificateLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			hostTemplate.IPAddresses = append(hostTemplate.IPAddresses, ip)
+		} else {
+			hostTemplate.DNSNames = append(hostTemplate.DNSNames, host)
+		}
+	}
+	hostDER, err := x509.CreateCertificate(rand.Reader, hostTemplate, caCert, &hostKey.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	hostKeyDER, err := x509.MarshalECPrivateKey(hostKey)
+	if err != nil {
+		return err
+	}
+
+	caKeyDER, err := x509.MarshalECPrivateKey(caKey)
+	if err != nil {
+		return err
+	}
+
+	if err := writePEM(filepath.Join(dir, CACertificateFile), "CERTIFICATE", caDER, 0644); err != nil {
+		return err
+	}
+	if err := writePEM(filepath.Join(dir, CAKeyFile), "EC PRIVATE KEY", caKeyDER, 0600); err != nil {
+		return err
+	}
+	if err := writePEM(filepath.Join(dir, HostCertificateFile), "CERTIFICATE", hostDER, 0644); err != nil {
+		return err
+	}
+	if err := writePEM(filepath.Join(dir, HostKeyFile), "EC PRIVATE KEY", hostKeyDER, 0600); err != nil {
+		return err
+	}
+	Logger.Printf("generated bank host certificates in %s for %v\n", dir, hosts)
+	return issueTerminalCertificate(caCert, caKey, DefaultTerminalId, filepath.Join(dir, TerminalCertificateFile), filepath.Join(dir, TerminalKeyFile))
+}
+
+// TerminalCertificateFiles returns the names of the certificate and key IssueTerminalCertificate writes for a terminal
+func TerminalCertificateFiles(terminalId string) (string, string) {
+	return "terminal-" + terminalId + ".pem", "terminal-" + terminalId + "-key.pem"
+}
+
+// IssueTerminalCertificate signs a certificate for a terminal with the CA GenerateCertificates wrote to dir, and writes
+// it to dir with its key. The bank host only accepts requests from the terminal for the terminal id in its certificate
+func IssueTerminalCertificate(dir string, terminalId string) error {
+	if !terminalIdPattern.MatchString(terminalId) {
+		return &InvalidInputError{fmt.Sprintf("invalid terminal id %q, expected up to 16 letters, digits or dashes", terminalId)}
+	}
+	caCert, err := tls.LoadX509KeyPair(filepath.Join(dir, CACertificateFile), filepath.Join(dir, CAKeyFile))
+	if err != nil {
+		return err
+	}
+	ca, err := x509.ParseCertificate(caCert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	caKey, ok := caCert.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return &InvalidInputError{fmt.Sprintf("the CA key in %s is not an ECDSA key", dir)}
+	}
+	certFile, keyFile := TerminalCertificateFiles(terminalId)
+	return issueTerminalCertificate(ca, caKey, terminalId, filepath.Join(dir, certFile), filepath.Join(dir, keyFile))
+}
+
+// issueTerminalCertificate writes a certificate for a terminal signed by the CA, with the terminal id as its common name
+func issueTerminalCertificate(caCert *x509.Certificate, caKey *ecdsa.PrivateKey, terminalId string, certFile string, keyFile string) error {
+	now := clock.Now()
+	terminalKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	terminalTemplate := &x509.Certificate{
+		SerialNumber: newSerialNumber(),
+		Subject:      pkix.Name{Organization: []string{"ATM Simulator"}, CommonName: terminalId},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(certificateLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	terminalDER, err := x509.CreateCertificate(rand.Reader, terminalTemplate, caCert, &terminalKey.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	terminalKeyDER, err := x509.MarshalECPrivateKey(terminalKey)
+	if err != nil {
+		return err
+	}
+	if err := writePEM(certFile, "CERTIFICATE", terminalDER, 0644); err != nil {
+		return err
+	}
+	Logger.Printf("issued a certificate for terminal %s in %s\n", terminalId, certFile)
+	return writePEM(keyFile, "EC PRIVATE KEY", terminalKeyDER, 0600)
+}
+
+// HostTLSConfig loads the bank host certificate written by GenerateCertificates, requiring terminals to present
+// a certificate signed by the CA in the same directory
+func HostTLSConfig(dir string) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(filepath.Join(dir, HostCertificateFile), filepath.Join(dir, HostKeyFile))
+	if err != nil {
+		return nil, err
+	}
+	pool, err := loadCertPool(filepath.Join(dir, CACertificateFile))
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{certificate}, ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert,
+		MinVersion: tls.VersionTLS12}, nil
+}
+
+// TerminalTLSConfig trusts the bank host certificates signed by the CA in caFile and presents the terminal
+// certificate in certFile, with its key in keyFile
+func TerminalTLSConfig(caFile string, certFile string, keyFile string) (*tls.Config, error) {
+	pool, err := loadCertPool(caFile)
+	if err != nil {
+		return nil, err
+	}
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{certificate}, MinVersion: tls.VersionTLS12}, nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, &InvalidInputError{fmt.Sprintf("no certificates found in %s", caFile)}
+	}
+	return pool, nil
+}
+
+func writePEM(path string, blockType string, der []byte, mode os.FileMode) error {
+	return os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), mode)
+}
+
+func newSerialNumber() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		panic(fmt.Sprintf("unable to generate a certificate serial number: %v", err))
+	}
+	return serial
+}
@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock tells the time and schedules work for later. Everything time dependent goes through it so that
+// tests and simulations can control the passage of time
+type Clock interface {
+	Now() time.Time
+	// AfterFunc calls f in its own goroutine once d has elapsed
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a pending call scheduled with Clock.AfterFunc
+type Timer interface {
+	// Stop prevents the call if it has not happened yet, returning false if it already has or was stopped
+	Stop() bool
+}
+
+// realClock is the system clock
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// RealClock returns the system clock
+func RealClock() Clock {
+	return realClock{}
+}
+
+// the shared clock
+var clock Clock = realClock{}
+
+func GetClock() Clock {
+	return clock
+}
+
+// SetClock replaces the clock used by the application, nil restores the system clock
+func SetClock(c Clock) {
+	if c == nil {
+		c = realClock{}
+	}
+	clock = c
+}
+
+// FakeClock is a Clock that only moves when told to. Calls scheduled with AfterFunc happen during Advance,
+// in the order they are due, on the goroutine calling Advance
+type FakeClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock   *FakeClock
+	due     time.Time
+	f       func()
+	stopped bool
+}
+
+// NewFakeClock creates a FakeClock set to start
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	timer := &fakeTimer{clock: c, due: c.now.Add(d), f: f}
+	c.timers = append(c.timers, timer)
+	return timer
+}
+
+// Advance moves the clock forward, making any calls that become due along the way
+func (c *FakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	target := c.now.Add(d)
+	c.lock.Unlock()
+	for {
+		c.lock.Lock()
+		timer := c.nextDue(target)
+		if timer == nil {
+			c.now = target
+			c.lock.Unlock()
+			return
+		}
+		c.now = timer.due
+		c.lock.Unlock()
+		timer.f()
+	}
+}
+
+// Set moves the clock to t, making any calls due by then
+func (c *FakeClock) Set(t time.Time) {
+	c.Advance(t.Sub(c.Now()))
+}
+
+// nextDue removes and returns the earliest timer due by target, the lock must be held
+func (c *FakeClock) nextDue(target time.Time) *fakeTimer {
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if !timer.stopped {
+			pending = append(pending, timer)
+		}
+	}
+	c.timers = pending
+	sort.SliceStable(c.timers, func(i, j int) bool {
+		return c.timers[i].due.Before(c.timers[j].due)
+	})
+	if len(c.timers) == 0 || c.timers[0].due.After(target) {
+		return nil
+	}
+	timer := c.timers[0]
+	timer.stopped = true
+	c.timers = c.timers[1:]
+	return timer
+}
+
+func (timer *fakeTimer) Stop() bool {
+	timer.clock.lock.Lock()
+	defer timer.clock.lock.Unlock()
+	if timer.stopped {
+		return false
+	}
+	timer.stopped = true
+	return true
+}
@@ -0,0 +1,41 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2023, 5, 1, 9, 0, 0, 0, time.UTC)
+	fakeClock := NewFakeClock(start)
+	var fired []time.Time
+	record := func() { fired = append(fired, fakeClock.Now()) }
+
+	fakeClock.AfterFunc(3*time.Minute, record)
+	fakeClock.AfterFunc(time.Minute, func() {
+		record()
+		// calls scheduled while advancing happen in the same advance when they are due
+		fakeClock.AfterFunc(30*time.Second, record)
+	})
+	stopped := fakeClock.AfterFunc(2*time.Minute, record)
+	if !stopped.Stop() {
+		t.Error("expected a pending timer to stop")
+	}
+
+	fakeClock.Advance(2 * time.Minute)
+	expected := []time.Time{start.Add(time.Minute), start.Add(90 * time.Second)}
+	if len(fired) != len(expected) || !fired[0].Equal(expected[0]) || !fired[1].Equal(expected[1]) {
+		t.Fatalf("expected calls at %v got %v", expected, fired)
+	}
+	if !fakeClock.Now().Equal(start.Add(2 * time.Minute)) {
+		t.Errorf("unexpected time %v", fakeClock.Now())
+	}
+
+	fakeClock.Set(start.Add(time.Hour))
+	if len(fired) != 3 || !fired[2].Equal(start.Add(3*time.Minute)) {
+		t.Errorf("expected the last call at 3 minutes got %v", fired)
+	}
+	if stopped.Stop() {
+		t.Error("expected a stopped timer to report it was already stopped")
+	}
+}
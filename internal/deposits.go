@@ -0,0 +1,224 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// noteDenominations are the US dollar notes accepted by the deposit module
+var noteDenominations = []int{1, 2, 5, 10, 20, 50, 100}
+
+// ChequeStatus is the verification state of a deposited cheque
+type ChequeStatus string
+
+const (
+	ChequePending  ChequeStatus = "pending"
+	ChequeApproved ChequeStatus = "approved"
+	ChequeRejected ChequeStatus = "rejected"
+)
+
+// Cheque holds the details captured when a cheque is deposited
+type Cheque struct {
+	Number    string
+	Payer     string
+	ImagePath string
+	Amount    float64
+}
+
+// ChequeDeposit is a cheque in the verification queue
+type ChequeDeposit struct {
+	Cheque
+	Id        string
+	AccountId string
+	// TransactionId is the ledger history entry for the deposit
+	TransactionId string
+	Date          time.Time
+	Status        ChequeStatus
+	Reason        string
+}
+
+// DepositCash adds a cash deposit to a given account. notes maps the note denomination to the number of notes
+func (ledger *Ledger) DepositCash(accountId string, notes map[int]int) (float64, error) {
+	request, err := cashDepositRequest(accountId, notes)
+	if err != nil {
+		return ledger.balances[accountId], err
+	}
+	request.TerminalId = ledger.terminalId
+	result, err := ledger.PostDeposit(request)
+	if err != nil {
+		return ledger.balances[accountId], err
+	}
+	return result.Entry.Balance, nil
+}
+
+// cashDepositRequest checks the notes inserted and totals them up as a deposit
+func cashDepositRequest(accountId string, notes map[int]int) (DepositRequest, error) {
+	total := 0
+	for denomination, count := range notes {
+		if !isNoteDenomination(denomination) {
+			return DepositRequest{}, &InvalidAmountError{message: fmt.Sprintf("$%d is not a valid note", denomination)}
+		}
+		if count < 0 {
+			return DepositRequest{}, &InvalidAmountError{message: fmt.Sprintf("invalid number of $%d notes %d", denomination, count)}
+		}
+		total += denomination * count
+	}
+	if total == 0 {
+		return DepositRequest{}, &InvalidAmountError{message: "no notes were deposited"}
+	}
+	Logger.Printf("cash deposit for %s: %s\n", accountId, FormatNotes(notes))
+	return DepositRequest{AccountId: accountId, Amount: fmt.Sprintf("%d.00", total), Description: "cash deposit " + FormatNotes(notes)}, nil
+}
+
+// DepositCheque credits a cheque to a given account. The full amount is held until an operator
+// approves the cheque and is reversed if the cheque is rejected
+func (ledger *Ledger) DepositCheque(accountId string, cheque Cheque) (*ChequeDeposit, error) {
+	if _, err := strconv.ParseUint(cheque.Number, 10, 64); err != nil {
+		return nil, &InvalidInputError{fmt.Sprintf("invalid cheque number \"%s\"", cheque.Number)}
+	}
+	if cheque.Payer == "" {
+		return nil, &InvalidInputError{"the cheque payer is required"}
+	}
+	if _, err := os.Stat(cheque.ImagePath); err != nil {
+		return nil, &InvalidInputError{fmt.Sprintf("cheque image not found \"%s\"", cheque.ImagePath)}
+	}
+	if cheque.Amount <= 0 {
+		return nil, &InvalidAmountError{message: "the cheque amount must be greater than zero"}
+	}
+
+	deposit := &ChequeDeposit{
+		Cheque:    cheque,
+		Id:        fmt.Sprintf("CHQ%04d", len(ledger.cheques)+1),
+		AccountId: accountId,
+		Date:      clock.Now(),
+		Status:    ChequePending,
+	}
+	Logger.Printf("cheque %s deposited by %s: number %s, payer %s, amount %.2f\n", deposit.Id, accountId, cheque.Number, cheque.Payer, cheque.Amount)
+	entry := ledger.credit(accountId, LedgerHistoryEntry{
+		Type:        DepositTransaction,
+		Description: fmt.Sprintf("cheque %s from %s (%s)", cheque.Number, cheque.Payer, deposit.Id),
+		Amount:      cheque.Amount,
+	})
+	deposit.TransactionId = entry.Id
+	if ledger.holds == nil {
+		ledger.holds = map[string][]depositHold{}
+	}
+	ledger.holds[accountId] = append(ledger.holds[accountId], depositHold{amount: cheque.Amount, chequeId: deposit.Id})
+	ledger.cheques = append(ledger.cheques, deposit)
+	return deposit, nil
+}
+
+// GetPendingCheques returns the cheques waiting for verification
+func (ledger *Ledger) GetPendingCheques() []*ChequeDeposit {
+	var pending []*ChequeDeposit
+	for _, cheque := range ledger.cheques {
+		if cheque.Status == ChequePending {
+			pending = append(pending, cheque)
+		}
+	}
+	return pending
+}
+
+// ApproveCheque marks a cheque as verified and makes its funds available
+func (ledger *Ledger) ApproveCheque(id string) (*ChequeDeposit, error) {
+	cheque, err := ledger.pendingCheque(id)
+	if err != nil {
+		return nil, err
+	}
+	ledger.releaseChequeHold(cheque)
+	cheque.Status = ChequeApproved
+	Logger.Printf("cheque %s approved for %s\n", cheque.Id, cheque.AccountId)
+	return cheque, nil
+}
+
+// RejectCheque marks a cheque as rejected and reverses its ledger entry
+func (ledger *Ledger) RejectCheque(id string, reason string) (*ChequeDeposit, error) {
+	cheque, err := ledger.pendingCheque(id)
+	if err != nil {
+		return nil, err
+	}
+	ledger.releaseChequeHold(cheque)
+	ledger.credit(cheque.AccountId, LedgerHistoryEntry{
+		Type:        ReversalTransaction,
+		Description: fmt.Sprintf("cheque %s rejected: %s", cheque.Id, reason),
+		ParentId:    cheque.TransactionId,
+		Amount:      cheque.Amount * -1,
+	})
+	cheque.Status = ChequeRejected
+	cheque.Reason = reason
+	Logger.Printf("cheque %s rejected for %s: %s\n", cheque.Id, cheque.AccountId, reason)
+	return cheque, nil
+}
+
+func (ledger *Ledger) pendingCheque(id string) (*ChequeDeposit, error) {
+	for _, cheque := range ledger.cheques {
+		if cheque.Id == id {
+			if cheque.Status != ChequePending {
+				return nil, &InvalidInputError{fmt.Sprintf("cheque %s has already been %s", id, cheque.Status)}
+			}
+			return cheque, nil
+		}
+	}
+	return nil, &InvalidInputError{fmt.Sprintf("unknown cheque \"%s\"", id)}
+}
+
+func (ledger *Ledger) releaseChequeHold(cheque *ChequeDeposit) {
+	holds := ledger.holds[cheque.AccountId]
+	for i, hold := range holds {
+		if hold.chequeId == cheque.Id {
+			ledger.holds[cheque.AccountId] = append(holds[:i], holds[i+1:]...)
+			return
+		}
+	}
+}
+
+func isNoteDenomination(denomination int) bool {
+	for _, valid := range noteDenominations {
+		if valid == denomination {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseNotes reads note counts in the form "20x3,100x1" into a map of denomination to count
+func ParseNotes(input string) (map[int]int, error) {
+	notes := map[int]int{}
+	for _, part := range strings.Split(input, ",") {
+		denomination, count, found := strings.Cut(strings.TrimSpace(part), "x")
+		if !found {
+			return nil, &InvalidInputError{fmt.Sprintf("invalid note count \"%s\", expected <denomination>x<count>", part)}
+		}
+		d, err := strconv.Atoi(strings.TrimPrefix(denomination, "$"))
+		if err != nil {
+			return nil, &InvalidInputError{fmt.Sprintf("invalid note denomination \"%s\"", denomination)}
+		}
+		c, err := strconv.Atoi(count)
+		if err != nil {
+			return nil, &InvalidInputError{fmt.Sprintf("invalid note count \"%s\"", count)}
+		}
+		notes[d] += c
+	}
+	return notes, nil
+}
+
+// FormatNotes returns the note counts in the form "20x3,100x1", largest denomination first
+func FormatNotes(notes map[int]int) string {
+	var denominations []int
+	for denomination := range notes {
+		denominations = append(denominations, denomination)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(denominations)))
+	var formatted string
+	for i, denomination := range denominations {
+		if i > 0 {
+			formatted += ","
+		}
+		formatted += fmt.Sprintf("%dx%d", denomination, notes[denomination])
+	}
+	return formatted
+}
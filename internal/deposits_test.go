@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDepositCash(t *testing.T) {
+	tests := []struct {
+		name     string
+		notes    map[int]int
+		expected float64
+		err      error
+	}{
+		{name: "mixed notes", notes: map[int]int{20: 3, 100: 1}, expected: 210.00, err: nil},
+		{name: "invalid denomination", notes: map[int]int{3: 1}, expected: 50.00, err: &InvalidAmountError{message: "$3 is not a valid note"}},
+		{name: "no notes", notes: map[int]int{20: 0}, expected: 50.00, err: &InvalidAmountError{message: "no notes were deposited"}},
+	}
+	InitLogger("", true)
+	for _, test := range tests {
+		const accountId = "jc123"
+		ledger := &Ledger{}
+		ledger.SetInitialBalances(0, map[string]float64{
+			accountId: 50.00,
+		})
+		balance, err := ledger.DepositCash(accountId, test.notes)
+		if balance != test.expected {
+			t.Errorf("%s: incorrect balance after deposit expected %.2f got %.2f\n", test.name, test.expected, balance)
+		}
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: unexpected error %+v\n", test.name, err)
+		}
+	}
+}
+
+func TestParseNotes(t *testing.T) {
+	notes, err := ParseNotes("20x3, $100x1,20x1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notes[20] != 4 || notes[100] != 1 || len(notes) != 2 {
+		t.Errorf("unexpected notes %v", notes)
+	}
+	if FormatNotes(notes) != "100x1,20x4" {
+		t.Errorf("unexpected formatted notes %s", FormatNotes(notes))
+	}
+	if _, err = ParseNotes("20"); err == nil {
+		t.Errorf("expected an error for a note count without a denomination")
+	}
+}
+
+func TestChequeVerification(t *testing.T) {
+	const accountId = "jc123"
+	InitLogger("", true)
+	image := filepath.Join(t.TempDir(), "cheque.png")
+	if err := os.WriteFile(image, []byte("image"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ledger := &Ledger{}
+	ledger.SetInitialBalances(500, map[string]float64{
+		accountId: 50.00,
+	})
+
+	_, err := ledger.DepositCheque(accountId, Cheque{Number: "1001", Payer: "ACME", ImagePath: "missing.png", Amount: 100})
+	if err == nil {
+		t.Errorf("expected an error for a missing cheque image")
+	}
+
+	approved, err := ledger.DepositCheque(accountId, Cheque{Number: "1001", Payer: "ACME", ImagePath: image, Amount: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejected, err := ledger.DepositCheque(accountId, Cheque{Number: "1002", Payer: "ACME", ImagePath: image, Amount: 40})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ledger.GetBalance(accountId) != 190 || ledger.GetAvailableBalance(accountId) != 50 {
+		t.Errorf("cheques should be held until verified, balance %.2f available %.2f", ledger.GetBalance(accountId), ledger.GetAvailableBalance(accountId))
+	}
+	if len(ledger.GetPendingCheques()) != 2 {
+		t.Errorf("expected 2 pending cheques but got %d", len(ledger.GetPendingCheques()))
+	}
+
+	if _, err = ledger.ApproveCheque(approved.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ledger.RejectCheque(rejected.Id, "signature mismatch"); err != nil {
+		t.Fatal(err)
+	}
+	if ledger.GetBalance(accountId) != 150 || ledger.GetAvailableBalance(accountId) != 150 {
+		t.Errorf("unexpected balances after verification, balance %.2f available %.2f", ledger.GetBalance(accountId), ledger.GetAvailableBalance(accountId))
+	}
+	if _, err = ledger.ApproveCheque(rejected.Id); err == nil {
+		t.Errorf("expected an error approving a rejected cheque")
+	}
+	history := ledger.GetHistory(accountId)
+	if len(history) != 3 || history[2].Amount != -40 {
+		t.Errorf("expected the rejected cheque to be reversed in the history %v", history)
+	}
+}
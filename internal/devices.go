@@ -0,0 +1,134 @@
+package internal
+
+// DeviceState is a device's state as reported in its status, after the XFS device states
+type DeviceState string
+
+const (
+	DeviceOnline DeviceState = "online"
+	// DeviceHardwareError is a fault keeping the device out of service until the operator clears it
+	DeviceHardwareError DeviceState = "hardware error"
+	// DeviceMissing is a device the terminal does not have, such as a receipt printer when receipts are disabled
+	DeviceMissing DeviceState = "no device"
+)
+
+// DeviceStatus is a device's state and what it is holding
+type DeviceStatus struct {
+	// Class is the XFS service class of the device: IDC, PIN, CDM, CIM, PTR or TTU
+	Class string
+	State DeviceState
+	// Detail describes the media in the device or its fault
+	Detail string
+}
+
+// Device is a piece of the terminal's hardware
+type Device interface {
+	Status() DeviceStatus
+}
+
+// CardReaderDevice takes in and gives back the customer's card, as the XFS identification card (IDC) service does
+type CardReaderDevice interface {
+	Device
+	// AcceptCard takes the card the customer inserted and reads its PAN
+	AcceptCard(pan string) (string, error)
+	EjectCard() error
+	// RetainCard keeps the card in the machine, such as when the host says it must not be given back
+	RetainCard() error
+}
+
+// PINPadDevice is the keyboard customers enter their PIN and answers on, as the XFS PIN service is
+type PINPadDevice interface {
+	Device
+	// GetPIN reads a PIN and returns it encrypted, bound to pan, so the PIN itself never leaves the PIN pad
+	GetPIN(pan string) (PINBlock, error)
+	// GetData reads a line of clear entry such as an answer or a one-time code
+	GetData() (string, error)
+}
+
+// CashDispenserDevice presents the cash for withdrawals, as the XFS cash dispenser (CDM) service does
+type CashDispenserDevice interface {
+	Device
+	// Dispense picks the notes for amount from a cassette holding cassette and presents them, reporting where they ended up
+	Dispense(amount float64, cassette float64) (*DispenseResult, DispenserFault)
+}
+
+// DepositModuleDevice takes in the notes customers deposit, as the XFS cash-in module (CIM) service does. The notes are
+// held in escrow until the deposit is posted, then stored or given back
+type DepositModuleDevice interface {
+	Device
+	// AcceptNotes counts the notes inserted into escrow, returning those accepted by denomination
+	AcceptNotes(notes map[int]int) (map[int]int, error)
+	// StoreNotes moves the notes in escrow into the cassette
+	StoreNotes() error
+	// ReturnNotes gives the notes in escrow back to the customer
+	ReturnNotes() error
+}
+
+// ReceiptPrinterDevice prints transaction receipts, as the XFS printer (PTR) service does
+type ReceiptPrinterDevice interface {
+	Device
+	// Print prints the receipt, returning the file it was saved to if any
+	Print(receipt *Receipt) (string, error)
+}
+
+// DisplayDevice shows text to the customer, as the XFS text terminal unit (TTU) service does
+type DisplayDevice interface {
+	Device
+	Show(text string)
+}
+
+// Devices is the terminal's hardware. The command flow goes through these so that simulated devices can be
+// swapped for scripted ones
+type Devices struct {
+	CardReader    CardReaderDevice
+	PINPad        PINPadDevice
+	CashDispenser CashDispenserDevice
+	DepositModule DepositModuleDevice
+	// ReceiptPrinter is nil when receipts are disabled
+	ReceiptPrinter ReceiptPrinterDevice
+	Display        DisplayDevice
+}
+
+// NewSimulatedDevices creates the devices simulated on the console, without a receipt printer
+func NewSimulatedDevices() *Devices {
+	return &Devices{
+		CardReader:    &SimulatedCardReader{},
+		PINPad:        &SimulatedPINPad{},
+		CashDispenser: NewSimulatedCashDispenser(),
+		DepositModule: &SimulatedDepositModule{},
+		Display:       &SimulatedDisplay{},
+	}
+}
+
+// the terminal's devices
+var devices = NewSimulatedDevices()
+
+func GetDevices() *Devices {
+	return devices
+}
+
+// SetDevices replaces the terminal's devices, nil goes back to new simulated devices
+func SetDevices(d *Devices) {
+	if d == nil {
+		d = NewSimulatedDevices()
+	}
+	devices = d
+}
+
+// Statuses reports the status of each device
+func (d *Devices) Statuses() []DeviceStatus {
+	statuses := []DeviceStatus{d.CardReader.Status(), d.PINPad.Status(), d.CashDispenser.Status(), d.DepositModule.Status()}
+	if d.ReceiptPrinter == nil {
+		statuses = append(statuses, DeviceStatus{Class: "PTR", State: DeviceMissing})
+	} else {
+		statuses = append(statuses, d.ReceiptPrinter.Status())
+	}
+	return append(statuses, d.Display.Status())
+}
+
+// dispenserReady refuses a withdrawal before it is sent to the bank host while the cash dispenser is out of service
+func dispenserReady() error {
+	if status := devices.CashDispenser.Status(); status.State != DeviceOnline {
+		return &DispenserFaultError{Fault: DispenserFault(status.Detail)}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestDeviceStatuses(t *testing.T) {
+	InitLogger("", true)
+	SetDevices(nil)
+	defer SetDevices(nil)
+	d := GetDevices()
+	expected := []DeviceStatus{
+		{Class: "IDC", State: DeviceOnline, Detail: "no card"},
+		{Class: "PIN", State: DeviceOnline, Detail: "format 0 PIN blocks"},
+		{Class: "CDM", State: DeviceOnline, Detail: "reject bin $0.00, retract bin $0.00"},
+		{Class: "CIM", State: DeviceOnline, Detail: "escrow $0.00, stored $0.00"},
+		{Class: "PTR", State: DeviceMissing},
+		{Class: "TTU", State: DeviceOnline},
+	}
+	for i, status := range d.Statuses() {
+		if status != expected[i] {
+			t.Errorf("expected %+v got %+v", expected[i], status)
+		}
+	}
+
+	if _, err := d.CardReader.AcceptCard("4000001434597308"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.CardReader.AcceptCard("4000001434597308"); !errors.Is(err, &InvalidInputError{"a card is already inserted"}) {
+		t.Errorf("expected a second card to be refused got %v", err)
+	}
+	if status := d.CardReader.Status(); status.Detail != "card ************7308 present" {
+		t.Errorf("expected the card to be present got %+v", status)
+	}
+
+	// a jam keeps the dispenser in a hardware error until it is cleared
+	dispenser := d.CashDispenser.(*SimulatedCashDispenser)
+	if err := dispenser.Inject(DispenserJam, 0); err != nil {
+		t.Fatal(err)
+	}
+	dispenser.Dispense(40, 1000)
+	if status := dispenser.Status(); status.State != DeviceHardwareError || status.Detail != string(DispenserJam) {
+		t.Errorf("expected a hardware error got %+v", status)
+	}
+	if err := dispenserReady(); !errors.Is(err, &DispenserFaultError{}) {
+		t.Errorf("expected the dispenser to be out of service got %v", err)
+	}
+
+	SetReceiptPrinter(&ReceiptPrinter{Mode: FileReceipt})
+	if status := d.Statuses()[4]; status.State != DeviceOnline || status.Detail != "file receipts" {
+		t.Errorf("expected the receipt printer to be online got %+v", status)
+	}
+	SetReceiptPrinter(nil)
+	if d.ReceiptPrinter != nil {
+		t.Errorf("expected receipts to be disabled")
+	}
+}
+
+func TestSimulatedDepositModule(t *testing.T) {
+	module := &SimulatedDepositModule{}
+	if _, err := module.AcceptNotes(map[int]int{20: 2, 50: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := module.AcceptNotes(map[int]int{10: 1}); err == nil {
+		t.Errorf("expected notes to be refused while others are in escrow")
+	}
+	if err := module.StoreNotes(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := module.AcceptNotes(map[int]int{10: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := module.ReturnNotes(); err != nil {
+		t.Fatal(err)
+	}
+	if status := module.Status(); status.Detail != "escrow $0.00, stored $90.00" {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+func TestScriptedPINPad(t *testing.T) {
+	pad := &ScriptedPINPad{Entries: []string{"1234", "12", "yes"}}
+	block, err := pad.GetPIN("4000001434597308")
+	if err != nil || block.PAN != "4000001434597308" || len(block.Block) == 0 {
+		t.Errorf("expected an encrypted PIN got %+v %v", block, err)
+	}
+	if _, err := pad.GetPIN(""); !errors.Is(err, &InvalidInputError{"the pin must be a 4-digit number"}) {
+		t.Errorf("expected a short PIN to be refused got %v", err)
+	}
+	if answer, err := pad.GetData(); answer != "yes" || err != nil {
+		t.Errorf("expected the answer got %s %v", answer, err)
+	}
+	if _, err := pad.GetData(); err != io.EOF {
+		t.Errorf("expected the entries to run out got %v", err)
+	}
+}
+
+func TestConsoleInput(t *testing.T) {
+	SetConsoleInput(strings.NewReader(" 4557 \nrest"))
+	defer SetConsoleInput(nil)
+	pad := &SimulatedPINPad{}
+	if answer, err := pad.GetData(); answer != "4557" || err != nil {
+		t.Errorf("expected the first line got %q %v", answer, err)
+	}
+	if answer, err := pad.GetData(); answer != "rest" || err != nil {
+		t.Errorf("expected the last line got %q %v", answer, err)
+	}
+	if _, err := pad.GetData(); err != io.EOF {
+		t.Errorf("expected the input to end got %v", err)
+	}
+}
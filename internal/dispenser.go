@@ -0,0 +1,221 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// DispenserFault is a failure of the cash dispenser, injected into the simulated dispenser to test how withdrawals recover
+type DispenserFault string
+
+const (
+	// DispenserJam stops the notes in the transport, they are purged to the reject bin when the dispenser is cleared
+	DispenserJam DispenserFault = "jam"
+	// NoteReject diverts a note to the reject bin, such as a double pick, and picks another in its place
+	NoteReject DispenserFault = "note-reject"
+	// CassetteEmpty finds the cassette empty while the terminal's cash count says it still holds notes
+	CassetteEmpty DispenserFault = "cassette-empty"
+	// ShutterFault keeps the shutter from opening so the notes can not be presented
+	ShutterFault DispenserFault = "shutter"
+	// NotesNotTaken leaves the presented notes in the shutter until they are retracted
+	NotesNotTaken DispenserFault = "not-taken"
+)
+
+// DispenserFaults lists the faults that can be injected
+var DispenserFaults = []DispenserFault{DispenserJam, NoteReject, CassetteEmpty, ShutterFault, NotesNotTaken}
+
+// InjectedFault is a fault waiting for the next dispense
+type InjectedFault struct {
+	Fault DispenserFault
+	// AfterNotes is how many notes are picked before a jam, note reject or empty cassette, the last note when there are fewer
+	AfterNotes int
+}
+
+// DispenseResult is where the notes picked for a withdrawal ended up
+type DispenseResult struct {
+	Requested float64
+	// Presented is the cash the customer took
+	Presented float64
+	// Rejected is the cash diverted or purged to the reject bin
+	Rejected float64
+	// Retracted is the cash presented but not taken
+	Retracted float64
+	// Shortage is cash in the terminal's count that was not in the cassette
+	Shortage float64
+	// Reversal gives back the cash that was not presented, nil when all of it was or the reversal failed
+	Reversal *ReversalResult
+}
+
+// DispenserStatus is the state of the cash dispenser and the cash in its bins
+type DispenserStatus struct {
+	// Fault keeps the dispenser out of service until it is cleared, empty when the dispenser is ready
+	Fault      DispenserFault
+	Injected   []InjectedFault
+	Dispensed  float64
+	RejectBin  float64
+	RetractBin float64
+	Shortage   float64
+}
+
+// SimulatedCashDispenser simulates the dispenser that picks notes from the cassette and presents them through the shutter,
+// retracting or purging them when something goes wrong
+type SimulatedCashDispenser struct {
+	lock   sync.Mutex
+	status DispenserStatus
+}
+
+func NewSimulatedCashDispenser() *SimulatedCashDispenser {
+	return &SimulatedCashDispenser{}
+}
+
+// Status reports a hardware error while a fault keeps the dispenser out of service
+func (dispenser *SimulatedCashDispenser) Status() DeviceStatus {
+	dispenser.lock.Lock()
+	defer dispenser.lock.Unlock()
+	if dispenser.status.Fault != "" {
+		return DeviceStatus{Class: "CDM", State: DeviceHardwareError, Detail: string(dispenser.status.Fault)}
+	}
+	return DeviceStatus{Class: "CDM", State: DeviceOnline, Detail: fmt.Sprintf("reject bin $%.2f, retract bin $%.2f",
+		dispenser.status.RejectBin, dispenser.status.RetractBin)}
+}
+
+// Details returns the dispenser's state and bin totals
+func (dispenser *SimulatedCashDispenser) Details() DispenserStatus {
+	dispenser.lock.Lock()
+	defer dispenser.lock.Unlock()
+	status := dispenser.status
+	status.Injected = append([]InjectedFault(nil), dispenser.status.Injected...)
+	return status
+}
+
+// Inject makes the fault happen on the next dispense
+func (dispenser *SimulatedCashDispenser) Inject(fault DispenserFault, afterNotes int) error {
+	known := false
+	for _, each := range DispenserFaults {
+		known = known || each == fault
+	}
+	if !known || afterNotes < 0 {
+		return &InvalidInputError{fmt.Sprintf("unknown dispenser fault \"%s\"", fault)}
+	}
+	dispenser.lock.Lock()
+	defer dispenser.lock.Unlock()
+	dispenser.status.Injected = append(dispenser.status.Injected, InjectedFault{Fault: fault, AfterNotes: afterNotes})
+	return nil
+}
+
+// Clear puts the dispenser back in service and drops the faults that have not happened yet
+func (dispenser *SimulatedCashDispenser) Clear() {
+	dispenser.lock.Lock()
+	defer dispenser.lock.Unlock()
+	dispenser.status.Fault = ""
+	dispenser.status.Injected = nil
+}
+
+// Dispense picks the notes for amount from a cassette holding cassette, presenting them unless an injected fault happens
+func (dispenser *SimulatedCashDispenser) Dispense(amount float64, cassette float64) (*DispenseResult, DispenserFault) {
+	dispenser.lock.Lock()
+	defer dispenser.lock.Unlock()
+	result := &DispenseResult{Requested: amount}
+	fault := dispenser.pick(result, cassette)
+	switch fault {
+	case DispenserJam, ShutterFault:
+		dispenser.status.Fault = fault
+	}
+	dispenser.status.Injected = nil
+	dispenser.status.Dispensed += result.Presented
+	dispenser.status.RejectBin += result.Rejected
+	dispenser.status.RetractBin += result.Retracted
+	dispenser.status.Shortage += result.Shortage
+	return result, fault
+}
+
+func (dispenser *SimulatedCashDispenser) pick(result *DispenseResult, cassette float64) DispenserFault {
+	notes := int(result.Requested / 20)
+	stacked := 0.0
+	for picked := 0; stacked < result.Requested; picked++ {
+		if dispenser.faultAt(DispenserJam, picked, notes) {
+			result.Rejected += stacked
+			return DispenserJam
+		}
+		// notes diverted to the reject bin are picked again, which can run the cassette out
+		if cassette < 20 || dispenser.faultAt(CassetteEmpty, picked, notes) {
+			result.Rejected += stacked
+			result.Shortage = cassette
+			return CassetteEmpty
+		}
+		cassette -= 20
+		if dispenser.faultAt(NoteReject, picked, notes) {
+			result.Rejected += 20
+			continue
+		}
+		stacked += 20
+	}
+	if dispenser.injected(ShutterFault) {
+		result.Rejected += stacked
+		return ShutterFault
+	}
+	if dispenser.injected(NotesNotTaken) {
+		result.Retracted = stacked
+		return NotesNotTaken
+	}
+	result.Presented = stacked
+	return ""
+}
+
+// faultAt tells whether the fault was injected for the note being picked
+func (dispenser *SimulatedCashDispenser) faultAt(fault DispenserFault, picked int, notes int) bool {
+	for _, injected := range dispenser.status.Injected {
+		after := injected.AfterNotes
+		if after > notes-1 {
+			after = notes - 1
+		}
+		if injected.Fault == fault && after == picked {
+			return true
+		}
+	}
+	return false
+}
+
+func (dispenser *SimulatedCashDispenser) injected(fault DispenserFault) bool {
+	for _, injected := range dispenser.status.Injected {
+		if injected.Fault == fault {
+			return true
+		}
+	}
+	return false
+}
+
+// DispenseCash has the cash dispenser present an approved withdrawal. When the dispenser fails the cash that was not
+// presented is reversed, or queued for the host, and the terminal's cash count is corrected for the notes left in the bins
+func DispenseCash(withdrawal *WithdrawResult) (*DispenseResult, error) {
+	result, fault := presentCash(devices.CashDispenser, withdrawal.AmountWithdrawn)
+	if fault == "" {
+		return result, nil
+	}
+	Logger.Printf("dispenser %s on %s: presented %.2f rejected %.2f retracted %.2f\n", fault, withdrawal.TransactionId,
+		result.Presented, result.Rejected, result.Retracted)
+	faultErr := &DispenserFaultError{Fault: fault, Undispensed: withdrawal.AmountWithdrawn - result.Presented}
+	request := ReversalRequest{TerminalId: ledger.terminalId, TransactionId: withdrawal.TransactionId,
+		Amount: faultErr.Undispensed, Reason: "dispenser " + string(fault)}
+	reversal, err := bankHost.Reverse(request)
+	// with stand-in enabled a reversal that can not reach the host is kept and forwarded with the advices
+	if standIn, ok := bankHost.(*StandInHost); ok && errors.Is(err, &HostUnavailableError{}) {
+		reversal, err = standIn.QueueReversal(request)
+	}
+	if err != nil {
+		Logger.Printf("unable to reverse %s after a dispenser fault: %+v\n", withdrawal.TransactionId, err)
+		return result, faultErr
+	}
+	result.Reversal, faultErr.Reversed = reversal, !reversal.Queued
+	return result, faultErr
+}
+
+// presentCash has dispenser present amount, which was taken out of the terminal's cash count when it was approved,
+// and corrects the count for the notes left in the bins
+func presentCash(dispenser CashDispenserDevice, amount float64) (*DispenseResult, DispenserFault) {
+	cassette := ledger.availableCash + amount
+	result, fault := dispenser.Dispense(amount, cassette)
+	ledger.availableCash = cassette - result.Presented - result.Rejected - result.Retracted - result.Shortage
+	return result, fault
+}
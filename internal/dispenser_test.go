@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDispenserFaults(t *testing.T) {
+	tests := []struct {
+		name       string
+		fault      DispenserFault
+		afterNotes int
+		// also are faults injected with the first, reported is the fault expected when it is not the first
+		also       []InjectedFault
+		reported   DispenserFault
+		cash       float64
+		presented  float64
+		rejected   float64
+		retracted  float64
+		shortage   float64
+		balance    float64
+		failed     bool
+		outOfOrder bool
+	}{
+		{name: "no fault", presented: 100, balance: 400},
+		{name: "jam", fault: DispenserJam, afterNotes: 3, rejected: 60, balance: 500, failed: true, outOfOrder: true},
+		{name: "note reject", fault: NoteReject, afterNotes: 1, presented: 100, rejected: 20, balance: 400},
+		{name: "cassette empty", fault: CassetteEmpty, afterNotes: 2, rejected: 40, shortage: 960, balance: 500, failed: true},
+		{name: "shutter", fault: ShutterFault, rejected: 100, balance: 500, failed: true, outOfOrder: true},
+		{name: "not taken", fault: NotesNotTaken, retracted: 100, balance: 500, failed: true},
+		{name: "fault after the last note", fault: DispenserJam, afterNotes: 9, rejected: 80, balance: 500, failed: true, outOfOrder: true},
+		{name: "note reject then jam", fault: DispenserJam, afterNotes: 3, also: []InjectedFault{{NoteReject, 1}},
+			rejected: 60, balance: 500, failed: true, outOfOrder: true},
+		{name: "note reject runs the cassette out", fault: NoteReject, cash: 100, reported: CassetteEmpty,
+			rejected: 100, balance: 500, failed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			InitLogger("", true)
+			SetDevices(nil)
+			defer SetDevices(nil)
+			testLedger := GetLedgerService()
+			if tt.cash == 0 {
+				tt.cash = 1000
+			}
+			if tt.reported == "" {
+				tt.reported = tt.fault
+			}
+			testLedger.SetInitialBalances(tt.cash, map[string]float64{account: 500.00})
+			if tt.fault != "" {
+				for _, injected := range append([]InjectedFault{{tt.fault, tt.afterNotes}}, tt.also...) {
+					if err := GetDevices().CashDispenser.(*SimulatedCashDispenser).Inject(injected.Fault, injected.AfterNotes); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			withdrawal, err := WithdrawCash(account, "100", false, NewIdempotencyKey())
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := DispenseCash(withdrawal)
+			var fault *DispenserFaultError
+			if failed := errors.As(err, &fault); failed != tt.failed || failed && (fault.Fault != tt.reported || !fault.Reversed) {
+				t.Errorf("expected a reversed %s fault %t got %v", tt.reported, tt.failed, err)
+			}
+			if result.Presented != tt.presented || result.Rejected != tt.rejected || result.Retracted != tt.retracted || result.Shortage != tt.shortage {
+				t.Errorf("unexpected dispense %+v", result)
+			}
+			if balance := testLedger.GetBalance(account); balance != tt.balance {
+				t.Errorf("expected the balance to be %.2f got %.2f", tt.balance, balance)
+			}
+			// every note is in the cassette, with the customer or in a bin
+			status := GetDevices().CashDispenser.(*SimulatedCashDispenser).Details()
+			if total := testLedger.GetAvailableCash() + status.Dispensed + status.RejectBin + status.RetractBin + status.Shortage; total != tt.cash {
+				t.Errorf("expected the cash to add up to %.2f got %.2f in %+v", tt.cash, total, status)
+			}
+			if outOfOrder := status.Fault != ""; outOfOrder != tt.outOfOrder {
+				t.Errorf("expected out of service %t got %+v", tt.outOfOrder, status)
+			}
+		})
+	}
+}
+
+func TestDispenserOutOfService(t *testing.T) {
+	InitLogger("", true)
+	SetDevices(nil)
+	defer SetDevices(nil)
+	testLedger := GetLedgerService()
+	testLedger.SetInitialBalances(1000, map[string]float64{account: 500.00})
+	dispenser := GetDevices().CashDispenser.(*SimulatedCashDispenser)
+	if err := dispenser.Inject("smoke", 0); !errors.Is(err, &InvalidInputError{"unknown dispenser fault \"smoke\""}) {
+		t.Errorf("expected an unknown fault to be refused got %v", err)
+	}
+	if err := dispenser.Inject(ShutterFault, 0); err != nil {
+		t.Fatal(err)
+	}
+	withdrawal, err := WithdrawCash(account, "40", false, NewIdempotencyKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DispenseCash(withdrawal); !errors.Is(err, &DispenserFaultError{}) {
+		t.Fatalf("expected a shutter fault got %v", err)
+	}
+
+	// withdrawals are refused before they reach the bank host until the operator clears the fault
+	if _, err := WithdrawCash(account, "40", false, NewIdempotencyKey()); err == nil || err.Error() != "The cash dispenser is out of service." {
+		t.Errorf("expected the withdrawal to be refused got %v", err)
+	}
+	if balance := testLedger.GetBalance(account); balance != 500.00 {
+		t.Errorf("expected only the reversed withdrawal to be posted got %.2f", balance)
+	}
+	dispenser.Clear()
+	withdrawal, err = WithdrawCash(account, "40", false, NewIdempotencyKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, err := DispenseCash(withdrawal); err != nil || result.Presented != 40 {
+		t.Errorf("expected the cash to be dispensed after clearing got %+v %v", result, err)
+	}
+	if cash := testLedger.GetAvailableCash(); cash != 920 {
+		t.Errorf("expected the purged notes to stay out of the cash count got %.2f", cash)
+	}
+}
@@ -0,0 +1,297 @@
+// Package dukpt derives the per-transaction keys of Derived Unique Key Per Transaction key management,
+// the TDES variant of ANSI X9.24-1:2009 and the AES variant of ANSI X9.24-3:2017.
+// A terminal is loaded with an initial key derived from the base derivation key (BDK) for its key serial
+// number (KSN) and never holds the BDK. The host, which holds the BDK, derives the same key from the KSN sent
+// with each transaction.
+package dukpt
+
+import (
+	"crypto/aes"
+	"crypto/des"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+)
+
+const (
+	// TDESKSNLength is the length of a TDES KSN: the initial key id and a 21 bit transaction counter
+	TDESKSNLength = 10
+	// AESKSNLength is the length of an AES KSN: an 8 byte initial key id and a 32 bit transaction counter
+	AESKSNLength = 12
+	// the most 1 bits a transaction counter may have, counters with more are skipped
+	tdesMaxCounterBits = 10
+	aesMaxCounterBits  = 16
+	tdesCounterMask    = 0x1FFFFF
+)
+
+var (
+	keyRegisterMask = []byte{0xC0, 0xC0, 0xC0, 0xC0, 0x00, 0x00, 0x00, 0x00, 0xC0, 0xC0, 0xC0, 0xC0, 0x00, 0x00, 0x00, 0x00}
+	pinVariant      = []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xFF, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xFF}
+)
+
+// KeyUsage is the use an AES DUKPT working key is derived for
+type KeyUsage uint16
+
+const (
+	PINEncryption           KeyUsage = 0x1000
+	MACGeneration           KeyUsage = 0x2000
+	DataEncryptionEncrypt   KeyUsage = 0x3000
+	keyDerivation           KeyUsage = 0x8000
+	keyDerivationInitialKey KeyUsage = 0x8001
+)
+
+// TDESInitialKey derives the initial PIN encryption key (IPEK) for a KSN from a double length TDES BDK
+func TDESInitialKey(bdk []byte, ksn []byte) ([]byte, error) {
+	if len(bdk) != 16 {
+		return nil, fmt.Errorf("a TDES BDK must be 16 bytes, not %d", len(bdk))
+	}
+	if len(ksn) != TDESKSNLength {
+		return nil, fmt.Errorf("a TDES KSN must be %d bytes, not %d", TDESKSNLength, len(ksn))
+	}
+	initialKSN := make([]byte, 8)
+	copy(initialKSN, ksn)
+	initialKSN[7] &= 0xE0
+	left, err := tdesEncrypt(bdk, initialKSN)
+	if err != nil {
+		return nil, err
+	}
+	right, err := tdesEncrypt(xor(bdk, keyRegisterMask), initialKSN)
+	if err != nil {
+		return nil, err
+	}
+	return append(left, right...), nil
+}
+
+// TDESPINKey derives the PIN encryption key for the transaction counter in ksn from the terminal's IPEK
+func TDESPINKey(ipek []byte, ksn []byte) ([]byte, error) {
+	key, err := tdesTransactionKey(ipek, ksn)
+	if err != nil {
+		return nil, err
+	}
+	return xor(key, pinVariant), nil
+}
+
+// tdesTransactionKey runs the non-reversible key generation process once for each 1 bit of the counter, from the highest
+func tdesTransactionKey(ipek []byte, ksn []byte) ([]byte, error) {
+	if len(ipek) != 16 {
+		return nil, fmt.Errorf("a TDES IPEK must be 16 bytes, not %d", len(ipek))
+	}
+	if len(ksn) != TDESKSNLength {
+		return nil, fmt.Errorf("a TDES KSN must be %d bytes, not %d", TDESKSNLength, len(ksn))
+	}
+	counter := tdesCounter(ksn)
+	if bits.OnesCount32(counter) > tdesMaxCounterBits {
+		return nil, fmt.Errorf("transaction counter %d has more than %d 1 bits", counter, tdesMaxCounterBits)
+	}
+	register := binary.BigEndian.Uint64(ksn[2:]) &^ tdesCounterMask
+	key := append([]byte{}, ipek...)
+	for shift := uint32(1 << 20); shift > 0; shift >>= 1 {
+		if counter&shift == 0 {
+			continue
+		}
+		register |= uint64(shift)
+		data := make([]byte, 8)
+		binary.BigEndian.PutUint64(data, register)
+		var err error
+		if key, err = nonReversibleKey(key, data); err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+func nonReversibleKey(key []byte, data []byte) ([]byte, error) {
+	right, err := encryptHalf(key, data)
+	if err != nil {
+		return nil, err
+	}
+	left, err := encryptHalf(xor(key, keyRegisterMask), data)
+	if err != nil {
+		return nil, err
+	}
+	return append(left, right...), nil
+}
+
+// encryptHalf encrypts data with the left half of key, whitened with the right half
+func encryptHalf(key []byte, data []byte) ([]byte, error) {
+	cipher, err := des.NewCipher(key[:8])
+	if err != nil {
+		return nil, err
+	}
+	result := xor(data, key[8:])
+	cipher.Encrypt(result, result)
+	return xor(result, key[8:]), nil
+}
+
+func tdesCounter(ksn []byte) uint32 {
+	return uint32(ksn[7]&0x1F)<<16 | uint32(ksn[8])<<8 | uint32(ksn[9])
+}
+
+// AESInitialKey derives the initial key for the initial key id in the first 8 bytes of ksn from an AES BDK.
+// The initial key is the same length as the BDK
+func AESInitialKey(bdk []byte, ksn []byte) ([]byte, error) {
+	if len(ksn) < 8 {
+		return nil, fmt.Errorf("an AES KSN must be %d bytes, not %d", AESKSNLength, len(ksn))
+	}
+	data, err := derivationData(keyDerivationInitialKey, len(bdk))
+	if err != nil {
+		return nil, err
+	}
+	copy(data[8:], ksn[:8])
+	return deriveAESKey(bdk, data)
+}
+
+// AESWorkingKey derives the key for usage for the transaction counter in ksn from the terminal's initial key.
+// The working key is the same length as the initial key
+func AESWorkingKey(initialKey []byte, ksn []byte, usage KeyUsage) ([]byte, error) {
+	if len(ksn) != AESKSNLength {
+		return nil, fmt.Errorf("an AES KSN must be %d bytes, not %d", AESKSNLength, len(ksn))
+	}
+	counter := binary.BigEndian.Uint32(ksn[8:])
+	if bits.OnesCount32(counter) > aesMaxCounterBits {
+		return nil, fmt.Errorf("transaction counter %d has more than %d 1 bits", counter, aesMaxCounterBits)
+	}
+	key := initialKey
+	var working uint32
+	for mask := uint32(1 << 31); mask > 0; mask >>= 1 {
+		if counter&mask == 0 {
+			continue
+		}
+		working |= mask
+		data, err := derivationData(keyDerivation, len(key))
+		if err != nil {
+			return nil, err
+		}
+		copy(data[8:], ksn[4:8])
+		binary.BigEndian.PutUint32(data[12:], working)
+		if key, err = deriveAESKey(key, data); err != nil {
+			return nil, err
+		}
+	}
+	data, err := derivationData(usage, len(key))
+	if err != nil {
+		return nil, err
+	}
+	copy(data[8:], ksn[4:])
+	return deriveAESKey(key, data)
+}
+
+// derivationData is the block encrypted to derive a key: the version, block counter, key usage,
+// algorithm and length in bits, followed by the 8 bytes identifying the key being derived
+func derivationData(usage KeyUsage, keyLength int) ([]byte, error) {
+	var algorithm uint16
+	switch keyLength {
+	case 16:
+		algorithm = 2
+	case 24:
+		algorithm = 3
+	case 32:
+		algorithm = 4
+	default:
+		return nil, fmt.Errorf("an AES key must be 16, 24 or 32 bytes, not %d", keyLength)
+	}
+	data := make([]byte, aes.BlockSize)
+	data[0], data[1] = 1, 1
+	binary.BigEndian.PutUint16(data[2:], uint16(usage))
+	binary.BigEndian.PutUint16(data[4:], algorithm)
+	binary.BigEndian.PutUint16(data[6:], uint16(keyLength*8))
+	return data, nil
+}
+
+// deriveAESKey encrypts the derivation data once for each block of the key, counting the blocks in the second byte
+func deriveAESKey(key []byte, data []byte) ([]byte, error) {
+	cipher, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	derived := make([]byte, 0, 2*aes.BlockSize)
+	for block := byte(1); len(derived) < len(key); block++ {
+		data[1] = block
+		encrypted := make([]byte, aes.BlockSize)
+		cipher.Encrypt(encrypted, data)
+		derived = append(derived, encrypted...)
+	}
+	return derived[:len(key)], nil
+}
+
+// TerminalKSN returns the first KSN of the terminal deviceId under a key set: a 5 byte key set id for TDES, leaving
+// 19 bits for the device id, or a 4 byte BDK id for AES, where the device id is the 4 byte derivation id
+func TerminalKSN(keySetId []byte, deviceId uint32) ([]byte, error) {
+	switch len(keySetId) {
+	case 5:
+		if deviceId > 0x7FFFF {
+			return nil, fmt.Errorf("a TDES device id must fit in 19 bits")
+		}
+		ksn := make([]byte, TDESKSNLength)
+		copy(ksn, keySetId)
+		binary.BigEndian.PutUint32(ksn[5:9], deviceId<<13)
+		return ksn, nil
+	case 4:
+		ksn := make([]byte, AESKSNLength)
+		copy(ksn, keySetId)
+		binary.BigEndian.PutUint32(ksn[4:], deviceId)
+		return ksn, nil
+	}
+	return nil, fmt.Errorf("a key set id must be 5 bytes for TDES or 4 for AES, not %d", len(keySetId))
+}
+
+// SplitKSN separates the initial key id of a KSN from its transaction counter
+func SplitKSN(ksn []byte) ([]byte, uint32, error) {
+	switch len(ksn) {
+	case TDESKSNLength:
+		initialKeyId := append([]byte{}, ksn[:8]...)
+		initialKeyId[7] &= 0xE0
+		return initialKeyId, tdesCounter(ksn), nil
+	case AESKSNLength:
+		return append([]byte{}, ksn[:8]...), binary.BigEndian.Uint32(ksn[8:]), nil
+	}
+	return nil, 0, fmt.Errorf("a KSN must be %d or %d bytes, not %d", TDESKSNLength, AESKSNLength, len(ksn))
+}
+
+// NextKSN returns the KSN for the next transaction, skipping counters with too many 1 bits.
+// It fails once the counter is exhausted and the terminal must be loaded with a new initial key
+func NextKSN(ksn []byte) ([]byte, error) {
+	next := append([]byte{}, ksn...)
+	switch len(ksn) {
+	case TDESKSNLength:
+		counter := tdesCounter(ksn)
+		for counter++; bits.OnesCount32(counter) > tdesMaxCounterBits; {
+			counter += counter & -counter
+		}
+		if counter > tdesCounterMask {
+			return nil, fmt.Errorf("the transaction counter is exhausted")
+		}
+		next[7] = next[7]&0xE0 | byte(counter>>16)
+		next[8], next[9] = byte(counter>>8), byte(counter)
+	case AESKSNLength:
+		counter := uint64(binary.BigEndian.Uint32(ksn[8:]))
+		for counter++; bits.OnesCount64(counter) > aesMaxCounterBits; {
+			counter += counter & -counter
+		}
+		if counter > 0xFFFFFFFF {
+			return nil, fmt.Errorf("the transaction counter is exhausted")
+		}
+		binary.BigEndian.PutUint32(next[8:], uint32(counter))
+	default:
+		return nil, fmt.Errorf("a KSN must be %d or %d bytes, not %d", TDESKSNLength, AESKSNLength, len(ksn))
+	}
+	return next, nil
+}
+
+func tdesEncrypt(key []byte, data []byte) ([]byte, error) {
+	cipher, err := des.NewTripleDESCipher(append(append([]byte{}, key...), key[:8]...))
+	if err != nil {
+		return nil, err
+	}
+	result := make([]byte, len(data))
+	cipher.Encrypt(result, data)
+	return result, nil
+}
+
+func xor(a []byte, b []byte) []byte {
+	result := make([]byte, len(a))
+	for i := range a {
+		result[i] = a[i] ^ b[i%len(b)]
+	}
+	return result
+}
@@ -0,0 +1,154 @@
+package dukpt
+
+import (
+	"crypto/des"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// the test BDKs and KSNs published with ANSI X9.24-1:2009 and X9.24-3:2017
+const (
+	tdesBDK = "0123456789ABCDEFFEDCBA9876543210"
+	tdesKSN = "FFFF9876543210E00000"
+	aesBDK  = "FEDCBA9876543210F1F1F1F1F1F1F1F1"
+	aesKSN  = "123456789012345600000000"
+)
+
+func decodeHex(t *testing.T, value string) []byte {
+	t.Helper()
+	decoded, err := hex.DecodeString(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+func encodeHex(value []byte) string {
+	return strings.ToUpper(hex.EncodeToString(value))
+}
+
+func TestTDESKeys(t *testing.T) {
+	ipek, err := TDESInitialKey(decodeHex(t, tdesBDK), decodeHex(t, tdesKSN))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encodeHex(ipek) != "6AC292FAA1315B4D858AB3A3D7D5933A" {
+		t.Errorf("unexpected IPEK %X", ipek)
+	}
+	// the PIN 1234 for the PAN 4012345678909 in a format 0 PIN block, encrypted under the PIN key for each counter
+	for _, test := range []struct{ ksn, pinKey, pinBlock string }{
+		{"FFFF9876543210E00001", "042666B49184CF5C68DE9628D0397B36", "1B9C1845EB993A7A"},
+		{"FFFF9876543210E00002", "C46551CEF9FD244FAA9AD834130D3B38", "10A01C8D02C69107"},
+		{"FFFF9876543210E00003", "0DF3D9422ACA561A47676D07AD6BAD05", "18DC07B94797B466"},
+	} {
+		key, err := TDESPINKey(ipek, decodeHex(t, test.ksn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encodeHex(key) != test.pinKey {
+			t.Errorf("expected PIN key %s for %s got %X", test.pinKey, test.ksn, key)
+		}
+		cipher, err := des.NewTripleDESCipher(append(key, key[:8]...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		block := decodeHex(t, "041274EDCBA9876F")
+		cipher.Encrypt(block, block)
+		if encodeHex(block) != test.pinBlock {
+			t.Errorf("expected PIN block %s for %s got %X", test.pinBlock, test.ksn, block)
+		}
+	}
+}
+
+func TestAESKeys(t *testing.T) {
+	initialKey, err := AESInitialKey(decodeHex(t, aesBDK), decodeHex(t, aesKSN))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encodeHex(initialKey) != "1273671EA26AC29AFA4D1084127652A1" {
+		t.Errorf("unexpected initial key %X", initialKey)
+	}
+	key, err := AESWorkingKey(initialKey, decodeHex(t, "123456789012345600000001"), PINEncryption)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encodeHex(key) != "AF8CB133A78F8DC2D1359F18527593FB" {
+		t.Errorf("unexpected PIN encryption key %X", key)
+	}
+	if _, err := AESWorkingKey(initialKey, decodeHex(t, "12345678901234560001FFFF"), PINEncryption); err == nil {
+		t.Errorf("expected a counter with 17 1 bits to be rejected")
+	}
+}
+
+func TestNextKSN(t *testing.T) {
+	for _, test := range []struct{ ksn, next string }{
+		{"FFFF9876543210E00000", "FFFF9876543210E00001"},
+		{"FFFF9876543210E007FE", "FFFF9876543210E00800"},
+		{"FFFF9876543210E0FFC0", "FFFF9876543210E10000"},
+		{"123456789012345600000001", "123456789012345600000002"},
+		{"12345678901234560000FFFF", "123456789012345600010000"},
+	} {
+		next, err := NextKSN(decodeHex(t, test.ksn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encodeHex(next) != test.next {
+			t.Errorf("expected %s after %s got %X", test.next, test.ksn, next)
+		}
+	}
+	if _, err := NextKSN(decodeHex(t, "FFFF9876543210FFFC00")); err == nil {
+		t.Errorf("expected an exhausted counter to be rejected")
+	}
+	if _, err := NextKSN(decodeHex(t, "FFFF98765432")); err == nil {
+		t.Errorf("expected a KSN of the wrong length to be rejected")
+	}
+}
+
+func TestTerminalKSN(t *testing.T) {
+	for _, test := range []struct {
+		keySetId string
+		deviceId uint32
+		ksn      string
+	}{
+		{"FFFF987654", 0x19087, "FFFF9876543210E00000"},
+		{"FFFF987654", 0x7FFFF, "FFFF987654FFFFE00000"},
+		{"12345678", 0x90123456, "123456789012345600000000"},
+	} {
+		ksn, err := TerminalKSN(decodeHex(t, test.keySetId), test.deviceId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encodeHex(ksn) != test.ksn {
+			t.Errorf("expected %s for device %X got %X", test.ksn, test.deviceId, ksn)
+		}
+	}
+	if _, err := TerminalKSN(decodeHex(t, "FFFF987654"), 0x80000); err == nil {
+		t.Errorf("expected a TDES device id over 19 bits to be rejected")
+	}
+	if _, err := TerminalKSN(decodeHex(t, "FFFF98"), 1); err == nil {
+		t.Errorf("expected a key set id of the wrong length to be rejected")
+	}
+}
+
+func TestSplitKSN(t *testing.T) {
+	for _, test := range []struct {
+		ksn, initialKeyId string
+		counter           uint32
+	}{
+		{"FFFF9876543210E00001", "FFFF9876543210E0", 1},
+		{"FFFF9876543210E1FFC0", "FFFF9876543210E0", 0x1FFC0},
+		{"123456789012345600010000", "1234567890123456", 0x10000},
+	} {
+		initialKeyId, counter, err := SplitKSN(decodeHex(t, test.ksn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encodeHex(initialKeyId) != test.initialKeyId || counter != test.counter {
+			t.Errorf("expected %s and %X from %s got %X and %X", test.initialKeyId, test.counter, test.ksn, initialKeyId, counter)
+		}
+	}
+	if _, _, err := SplitKSN(decodeHex(t, "FFFF98765432")); err == nil {
+		t.Errorf("expected a KSN of the wrong length to be rejected")
+	}
+}
@@ -49,6 +49,20 @@ func (e *InsufficientFundsError) Error() string {
 	return "Insufficient funds. Withdrawal amount exceeds account balance"
 }
 
+// FundsOnHoldError is used when a withdrawal would use deposited funds that are not yet available
+type FundsOnHoldError struct {
+	Available float64
+}
+
+func (e *FundsOnHoldError) Is(target error) bool {
+	_, ok := target.(*FundsOnHoldError)
+	return ok
+}
+
+func (e *FundsOnHoldError) Error() string {
+	return fmt.Sprintf("Some of your funds are on hold or reserved. Available balance: $%.2f", e.Available)
+}
+
 // NoMoneyLeftError is used when the machine is empty and a withdrawal is attempted
 type NoMoneyLeftError struct {
 }
@@ -57,6 +71,22 @@ func (e *NoMoneyLeftError) Error() string {
 	return "Unable to process your withdrawal at this time."
 }
 
+// PartialDispenseError is used when the machine cannot dispense the full amount requested.
+// Available is the most that can be dispensed; the customer must consent before it is.
+type PartialDispenseError struct {
+	Requested float64
+	Available float64
+}
+
+func (e *PartialDispenseError) Error() string {
+	return fmt.Sprintf("This machine can only dispense $%.2f of the requested $%.2f.", e.Available, e.Requested)
+}
+
+func (e *PartialDispenseError) Is(target error) bool {
+	_, ok := target.(*PartialDispenseError)
+	return ok
+}
+
 // OverdrawnError is used when an account is already overdrawn and a withdrawal is attempted
 type OverdrawnError struct {
 }
@@ -69,3 +99,206 @@ func (e *OverdrawnError) Is(target error) bool {
 	_, ok := target.(*OverdrawnError)
 	return ok
 }
+
+// InvalidCardError is used when an inserted card can not be read or is not in use
+type InvalidCardError struct {
+}
+
+func (e *InvalidCardError) Error() string {
+	return "This card can not be read."
+}
+
+func (e *InvalidCardError) Is(target error) bool {
+	_, ok := target.(*InvalidCardError)
+	return ok
+}
+
+// UnknownCardError is used when an inserted card was not issued by the bank
+type UnknownCardError struct {
+}
+
+func (e *UnknownCardError) Error() string {
+	return "This card is not recognized."
+}
+
+func (e *UnknownCardError) Is(target error) bool {
+	_, ok := target.(*UnknownCardError)
+	return ok
+}
+
+// ExpiredCardError is used when an inserted card is past its expiry date
+type ExpiredCardError struct {
+}
+
+func (e *ExpiredCardError) Error() string {
+	return "This card has expired."
+}
+
+func (e *ExpiredCardError) Is(target error) bool {
+	_, ok := target.(*ExpiredCardError)
+	return ok
+}
+
+// HotlistedCardError is used when an inserted card has been reported lost or stolen
+type HotlistedCardError struct {
+}
+
+func (e *HotlistedCardError) Error() string {
+	return "This card can not be used. Please contact your bank."
+}
+
+func (e *HotlistedCardError) Is(target error) bool {
+	_, ok := target.(*HotlistedCardError)
+	return ok
+}
+
+// OneTimeCodeReusedError is used when a one-time code that has already been accepted is given again
+type OneTimeCodeReusedError struct {
+}
+
+func (e *OneTimeCodeReusedError) Error() string {
+	return "This one-time code has already been used."
+}
+
+func (e *OneTimeCodeReusedError) Is(target error) bool {
+	_, ok := target.(*OneTimeCodeReusedError)
+	return ok
+}
+
+// OneTimeCodeRequiredError is used when the bank host declines a request that needs a one-time code the customer has not given
+type OneTimeCodeRequiredError struct {
+}
+
+func (e *OneTimeCodeRequiredError) Error() string {
+	return "A one-time code is required. Please try again."
+}
+
+func (e *OneTimeCodeRequiredError) Is(target error) bool {
+	_, ok := target.(*OneTimeCodeRequiredError)
+	return ok
+}
+
+// InvalidWithdrawalCodeError is used when a cardless withdrawal code is unknown, expired or already used
+type InvalidWithdrawalCodeError struct {
+}
+
+func (e *InvalidWithdrawalCodeError) Error() string {
+	return "This withdrawal code is not valid."
+}
+
+func (e *InvalidWithdrawalCodeError) Is(target error) bool {
+	_, ok := target.(*InvalidWithdrawalCodeError)
+	return ok
+}
+
+// WithdrawalCodesLockedError is used when too many wrong cardless withdrawal codes have been entered
+type WithdrawalCodesLockedError struct {
+}
+
+func (e *WithdrawalCodesLockedError) Error() string {
+	return "Too many invalid withdrawal codes. Please try again later."
+}
+
+func (e *WithdrawalCodesLockedError) Is(target error) bool {
+	_, ok := target.(*WithdrawalCodesLockedError)
+	return ok
+}
+
+// LoginLockedError is used when too many wrong PINs have been given for an account over the API
+type LoginLockedError struct {
+}
+
+func (e *LoginLockedError) Error() string {
+	return "Too many failed login attempts. Please try again later."
+}
+
+func (e *LoginLockedError) Is(target error) bool {
+	_, ok := target.(*LoginLockedError)
+	return ok
+}
+
+// PINNotVerifiedError is used when the bank host declines a request because the customer's PIN has not been verified
+type PINNotVerifiedError struct {
+}
+
+func (e *PINNotVerifiedError) Error() string {
+	return "Your PIN has not been verified. Please log in again."
+}
+
+func (e *PINNotVerifiedError) Is(target error) bool {
+	_, ok := target.(*PINNotVerifiedError)
+	return ok
+}
+
+// HostUnavailableError is used when the bank host can not be reached or does not answer in time
+type HostUnavailableError struct {
+	// NotSent is set when the request did not reach the host or the host refused it unprocessed, so nothing was posted.
+	// A request that was not answered in time may still have been posted
+	NotSent bool
+	cause   error
+}
+
+func (e *HostUnavailableError) Error() string {
+	return "Unable to reach the bank at this time."
+}
+
+func (e *HostUnavailableError) Unwrap() error {
+	return e.cause
+}
+
+func (e *HostUnavailableError) Is(target error) bool {
+	_, ok := target.(*HostUnavailableError)
+	return ok
+}
+
+// DuplicateAdviceError is used when an advice the bank host has already posted is sent again
+type DuplicateAdviceError struct {
+	TransactionId string
+}
+
+func (e *DuplicateAdviceError) Error() string {
+	return fmt.Sprintf("The advice was already posted as transaction %s.", e.TransactionId)
+}
+
+func (e *DuplicateAdviceError) Is(target error) bool {
+	_, ok := target.(*DuplicateAdviceError)
+	return ok
+}
+
+// IdempotencyKeyReusedError is used when an idempotency key is sent again with a different request
+type IdempotencyKeyReusedError struct {
+	Key string
+}
+
+func (e *IdempotencyKeyReusedError) Error() string {
+	return fmt.Sprintf("The idempotency key %s was already used for a different request.", e.Key)
+}
+
+func (e *IdempotencyKeyReusedError) Is(target error) bool {
+	_, ok := target.(*IdempotencyKeyReusedError)
+	return ok
+}
+
+// DispenserFaultError is used when the cash dispenser fails or is out of service
+type DispenserFaultError struct {
+	Fault DispenserFault
+	// Undispensed is the cash approved but not presented, zero when the withdrawal was refused before it was sent
+	Undispensed float64
+	// Reversed is set when the cash not presented has been returned to the account
+	Reversed bool
+}
+
+func (e *DispenserFaultError) Error() string {
+	switch {
+	case e.Undispensed == 0:
+		return "The cash dispenser is out of service."
+	case e.Reversed:
+		return fmt.Sprintf("The cash dispenser failed. $%.2f was not dispensed and has been returned to your account.", e.Undispensed)
+	}
+	return fmt.Sprintf("The cash dispenser failed. $%.2f was not dispensed and will be returned to your account.", e.Undispensed)
+}
+
+func (e *DispenserFaultError) Is(target error) bool {
+	_, ok := target.(*DispenserFaultError)
+	return ok
+}
@@ -0,0 +1,205 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// ExportFormat is a file format the ledger history can be exported as
+type ExportFormat string
+
+const (
+	CSVExport        ExportFormat = "csv"
+	JSONLinesExport  ExportFormat = "jsonl"
+	OFXExport        ExportFormat = "ofx"
+	QIFExport        ExportFormat = "qif"
+	exportDateFormat              = time.RFC3339
+	ofxDateFormat                 = "20060102150405"
+	qifDateFormat                 = "01/02/2006"
+)
+
+// ExportFormats lists the supported export formats
+var ExportFormats = []ExportFormat{CSVExport, JSONLinesExport, OFXExport, QIFExport}
+
+// ParseExportFormat validates the name of an export format
+func ParseExportFormat(name string) (ExportFormat, error) {
+	for _, format := range ExportFormats {
+		if string(format) == strings.ToLower(name) {
+			return format, nil
+		}
+	}
+	return "", &InvalidInputError{fmt.Sprintf("unknown export format \"%s\"", name)}
+}
+
+// exportRecord is a history entry as written to a JSON Lines export
+type exportRecord struct {
+	AccountId   string          `json:"account_id"`
+	Id          string          `json:"id"`
+	Date        string          `json:"date"`
+	Type        TransactionType `json:"type"`
+	Description string          `json:"description"`
+	Amount      json.Number     `json:"amount"`
+	Balance     json.Number     `json:"balance"`
+	TerminalId  string          `json:"terminal_id,omitempty"`
+	ParentId    string          `json:"parent_id,omitempty"`
+}
+
+func newExportRecord(accountId string, entry LedgerHistoryEntry) exportRecord {
+	return exportRecord{
+		AccountId:   accountId,
+		Id:          entry.Id,
+		Date:        entry.Date.Format(exportDateFormat),
+		Type:        entry.Type,
+		Description: entry.Description,
+		Amount:      json.Number(formatAmount(entry.Amount)),
+		Balance:     json.Number(formatAmount(entry.Balance)),
+		TerminalId:  entry.TerminalId,
+		ParentId:    entry.ParentId,
+	}
+}
+
+// ExportHistory writes the history entries for an account in the given format.
+// Amounts are signed, debits being negative, and each entry carries the running balance after it was applied
+func ExportHistory(w io.Writer, format ExportFormat, accountId string, entries []LedgerHistoryEntry) error {
+	switch format {
+	case CSVExport:
+		return exportCSV(w, accountId, entries)
+	case JSONLinesExport:
+		return exportJSONLines(w, accountId, entries)
+	case OFXExport:
+		return exportOFX(w, accountId, entries)
+	case QIFExport:
+		return exportQIF(w, entries)
+	}
+	return &InvalidInputError{fmt.Sprintf("unknown export format \"%s\"", format)}
+}
+
+// ExportHistoryFile writes the history entries for an account to a file in the given format
+func ExportHistoryFile(path string, format ExportFormat, accountId string, entries []LedgerHistoryEntry) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	if err = ExportHistory(writer, format, accountId, entries); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err = writer.Flush(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	Logger.Printf("exported %d history entries for %s to %s\n", len(entries), accountId, path)
+	return file.Close()
+}
+
+func formatAmount(amount float64) string {
+	return fmt.Sprintf("%.2f", amount)
+}
+
+func exportCSV(w io.Writer, accountId string, entries []LedgerHistoryEntry) error {
+	writer := csv.NewWriter(w)
+	err := writer.Write([]string{"ACCOUNT_ID", "TRANSACTION_ID", "DATE", "TYPE", "DESCRIPTION", "AMOUNT", "BALANCE", "TERMINAL_ID", "PARENT_ID"})
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		err = writer.Write([]string{accountId, entry.Id, entry.Date.Format(exportDateFormat), string(entry.Type), entry.Description,
+			formatAmount(entry.Amount), formatAmount(entry.Balance), entry.TerminalId, entry.ParentId})
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func exportJSONLines(w io.Writer, accountId string, entries []LedgerHistoryEntry) error {
+	encoder := json.NewEncoder(w)
+	for _, entry := range entries {
+		if err := encoder.Encode(newExportRecord(accountId, entry)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ofxTransactionType maps a transaction on to an OFX TRNTYPE
+func ofxTransactionType(entry LedgerHistoryEntry) string {
+	switch entry.Type {
+	case DepositTransaction:
+		return "DEP"
+	case WithdrawalTransaction:
+		return "ATM"
+	case FeeTransaction:
+		return "FEE"
+	case TransferTransaction:
+		return "XFER"
+	}
+	if entry.Amount < 0 {
+		return "DEBIT"
+	}
+	return "CREDIT"
+}
+
+func ofxDate(date time.Time) string {
+	return date.UTC().Format(ofxDateFormat) + "[0:GMT]"
+}
+
+func ofxEscape(text string) string {
+	var escaped strings.Builder
+	_ = xml.EscapeText(&escaped, []byte(text))
+	return escaped.String()
+}
+
+func exportOFX(w io.Writer, accountId string, entries []LedgerHistoryEntry) error {
+	now := clock.Now()
+	start, end, balance := now, now, 0.0
+	if len(entries) > 0 {
+		start = entries[0].Date
+		end = entries[len(entries)-1].Date
+		balance = entries[len(entries)-1].Balance
+	}
+	var ofx strings.Builder
+	ofx.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="no"?>` + "\n")
+	ofx.WriteString(`<?OFX OFXHEADER="200" VERSION="220" SECURITY="NONE" OLDFILEUID="NONE" NEWFILEUID="NONE"?>` + "\n")
+	ofx.WriteString("<OFX>\n")
+	ofx.WriteString("<SIGNONMSGSRSV1><SONRS><STATUS><CODE>0</CODE><SEVERITY>INFO</SEVERITY></STATUS>")
+	fmt.Fprintf(&ofx, "<DTSERVER>%s</DTSERVER><LANGUAGE>ENG</LANGUAGE></SONRS></SIGNONMSGSRSV1>\n", ofxDate(now))
+	ofx.WriteString("<BANKMSGSRSV1><STMTTRNRS><TRNUID>0</TRNUID><STATUS><CODE>0</CODE><SEVERITY>INFO</SEVERITY></STATUS>\n")
+	ofx.WriteString("<STMTRS><CURDEF>USD</CURDEF>\n")
+	fmt.Fprintf(&ofx, "<BANKACCTFROM><BANKID>ATMSIM</BANKID><ACCTID>%s</ACCTID><ACCTTYPE>CHECKING</ACCTTYPE></BANKACCTFROM>\n", ofxEscape(accountId))
+	fmt.Fprintf(&ofx, "<BANKTRANLIST><DTSTART>%s</DTSTART><DTEND>%s</DTEND>\n", ofxDate(start), ofxDate(end))
+	for _, entry := range entries {
+		fmt.Fprintf(&ofx, "<STMTTRN><TRNTYPE>%s</TRNTYPE><DTPOSTED>%s</DTPOSTED><TRNAMT>%s</TRNAMT><FITID>%s</FITID><NAME>%s</NAME><MEMO>%s</MEMO></STMTTRN>\n",
+			ofxTransactionType(entry), ofxDate(entry.Date), formatAmount(entry.Amount), ofxEscape(entry.Id),
+			ofxEscape(string(entry.Type)), ofxEscape(fmt.Sprintf("%s; balance %s", entry.Description, formatAmount(entry.Balance))))
+	}
+	ofx.WriteString("</BANKTRANLIST>\n")
+	fmt.Fprintf(&ofx, "<LEDGERBAL><BALAMT>%s</BALAMT><DTASOF>%s</DTASOF></LEDGERBAL>\n", formatAmount(balance), ofxDate(end))
+	ofx.WriteString("</STMTRS></STMTTRNRS></BANKMSGSRSV1>\n</OFX>\n")
+	_, err := io.WriteString(w, ofx.String())
+	return err
+}
+
+func exportQIF(w io.Writer, entries []LedgerHistoryEntry) error {
+	var qif strings.Builder
+	qif.WriteString("!Type:Bank\n")
+	for _, entry := range entries {
+		fmt.Fprintf(&qif, "D%s\n", entry.Date.Format(qifDateFormat))
+		fmt.Fprintf(&qif, "T%s\n", formatAmount(entry.Amount))
+		fmt.Fprintf(&qif, "N%s\n", entry.Id)
+		fmt.Fprintf(&qif, "P%s\n", entry.Type)
+		fmt.Fprintf(&qif, "M%s; balance %s\n", entry.Description, formatAmount(entry.Balance))
+		qif.WriteString("^\n")
+	}
+	_, err := io.WriteString(w, qif.String())
+	return err
+}
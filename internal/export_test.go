@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func exportEntries() []LedgerHistoryEntry {
+	date := time.Date(2026, 9, 14, 15, 4, 5, 0, time.UTC)
+	return []LedgerHistoryEntry{
+		{Id: "A1", Type: DepositTransaction, Description: "deposit", TerminalId: "ATM1", Date: date, Amount: 20, Balance: 20},
+		{Id: "B2", Type: WithdrawalTransaction, Description: "cash withdrawal", TerminalId: "ATM1", Date: date, Amount: -40, Balance: -20},
+		{Id: "C3", Type: FeeTransaction, Description: "overdraft fee", TerminalId: "ATM1", ParentId: "B2", Date: date, Amount: -5, Balance: -25},
+	}
+}
+
+func TestExportHistory(t *testing.T) {
+	tests := []struct {
+		format   ExportFormat
+		expected []string
+	}{
+		{format: CSVExport, expected: []string{
+			"ACCOUNT_ID,TRANSACTION_ID,DATE,TYPE,DESCRIPTION,AMOUNT,BALANCE,TERMINAL_ID,PARENT_ID\n",
+			"jc123,C3,2026-09-14T15:04:05Z,fee,overdraft fee,-5.00,-25.00,ATM1,B2\n",
+		}},
+		{format: JSONLinesExport, expected: []string{
+			`{"account_id":"jc123","id":"A1","date":"2026-09-14T15:04:05Z","type":"deposit","description":"deposit","amount":20.00,"balance":20.00,"terminal_id":"ATM1"}` + "\n",
+			`"amount":-5.00,"balance":-25.00,"terminal_id":"ATM1","parent_id":"B2"}` + "\n",
+		}},
+		{format: OFXExport, expected: []string{
+			"<ACCTID>jc123</ACCTID>",
+			"<STMTTRN><TRNTYPE>ATM</TRNTYPE><DTPOSTED>20260914150405[0:GMT]</DTPOSTED><TRNAMT>-40.00</TRNAMT><FITID>B2</FITID>",
+			"<LEDGERBAL><BALAMT>-25.00</BALAMT>",
+		}},
+		{format: QIFExport, expected: []string{
+			"!Type:Bank\n",
+			"D09/14/2026\nT-40.00\nNB2\nPwithdrawal\nMcash withdrawal; balance -20.00\n^\n",
+		}},
+	}
+	for _, test := range tests {
+		var buffer bytes.Buffer
+		if err := ExportHistory(&buffer, test.format, "jc123", exportEntries()); err != nil {
+			t.Fatalf("%s: %v", test.format, err)
+		}
+		for _, expected := range test.expected {
+			if !strings.Contains(buffer.String(), expected) {
+				t.Errorf("%s: expected export to contain %q\n%s", test.format, expected, buffer.String())
+			}
+		}
+		if test.format == OFXExport {
+			decoder := xml.NewDecoder(&buffer)
+			for {
+				if _, err := decoder.Token(); err != nil {
+					if err != io.EOF {
+						t.Errorf("OFX export is not well formed: %v", err)
+					}
+					break
+				}
+			}
+		}
+	}
+	if _, err := ParseExportFormat("pdf"); err == nil {
+		t.Errorf("expected an error for an unknown export format")
+	}
+}
@@ -0,0 +1,750 @@
+package internal
+
+import (
+	"agile-coder.com/atm-sim/internal/bankpb"
+	"agile-coder.com/atm-sim/internal/pinblock"
+	"context"
+	"crypto/tls"
+	"errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"sync"
+	"time"
+)
+
+// DefaultHostTimeout is the deadline for each call a terminal makes to the bank host
+const DefaultHostTimeout = 5 * time.Second
+
+// error codes carried in bankpb.HostError so the terminal can rebuild the host's error
+const (
+	hostInvalidInput      = "invalid_input"
+	hostInvalidAmount     = "invalid_amount"
+	hostInsufficientFunds = "insufficient_funds"
+	hostOverdrawn         = "overdrawn"
+	hostFundsOnHold       = "funds_on_hold"
+	hostPartialDispense   = "partial_dispense"
+	hostNoCash            = "no_cash"
+	hostOneTimeCodeReused = "one_time_code_reused"
+	hostDuplicateAdvice   = "duplicate_advice"
+	hostIdempotencyKey    = "idempotency_key_reused"
+	hostPINNotVerified    = "pin_not_verified"
+	hostOneTimeCode       = "one_time_code_required"
+)
+
+// grpcHostService serves a BankHost to remote terminals over gRPC. Terminals connecting over TLS are identified by
+// the terminal id in their certificate, and only make requests for an account in a session started by verifying its PIN
+type grpcHostService struct {
+	bankpb.UnimplementedBankHostServer
+	host BankHost
+	// the ledger is not safe for concurrent use so calls are handled one at a time
+	lock sync.Mutex
+	// map of session token to the account whose PIN was verified
+	sessions map[string]*grpcSession
+	// the terminal each PIN pad key is used by
+	keys pinPadKeys
+}
+
+// grpcSession lets a terminal make requests for an account until it expires
+type grpcSession struct {
+	accountId  string
+	terminalId string
+	expires    time.Time
+	// set until the one-time code the account needs to log in has been given
+	awaitingCode bool
+	// set when a one-time code has been given for the next withdrawal over the threshold
+	codeVerified bool
+	// the idempotency key of the withdrawal that used the code, which may be sent again
+	codeUsedBy string
+}
+
+// NewBankHostServer creates a gRPC server for the bank host, using TLS when a config is given
+func NewBankHostServer(host BankHost, tlsConfig *tls.Config) *grpc.Server {
+	var options []grpc.ServerOption
+	if tlsConfig != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	server := grpc.NewServer(options...)
+	bankpb.RegisterBankHostServer(server, &grpcHostService{host: host, sessions: map[string]*grpcSession{}})
+	return server
+}
+
+// begin serializes the calls to the host, giving up if the caller's deadline passes while waiting
+func (service *grpcHostService) begin(ctx context.Context) error {
+	service.lock.Lock()
+	if err := ctx.Err(); err != nil {
+		service.lock.Unlock()
+		return status.FromContextError(err).Err()
+	}
+	return nil
+}
+
+// peerTerminal returns the terminal id in the certificate the terminal connected with, empty when it connected without TLS
+func peerTerminal(ctx context.Context) string {
+	client, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	info, ok := client.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.PeerCertificates) == 0 {
+		return ""
+	}
+	return info.State.PeerCertificates[0].Subject.CommonName
+}
+
+// checkTerminal declines a request naming a terminal other than the one in the certificate it was sent with
+func checkTerminal(ctx context.Context, terminalId string) error {
+	if certified := peerTerminal(ctx); certified != "" && certified != terminalId {
+		Logger.Printf("bank host request for terminal %s from terminal %s declined\n", terminalId, certified)
+		return status.Errorf(codes.PermissionDenied, "the terminal certificate is for %s, not %s", certified, terminalId)
+	}
+	return nil
+}
+
+// startSession returns a token the terminal sends with the account's requests until the session expires
+func (service *grpcHostService) startSession(ctx context.Context, accountId string, awaitingCode bool) string {
+	now := clock.Now()
+	for token, session := range service.sessions {
+		if !now.Before(session.expires) {
+			delete(service.sessions, token)
+		}
+	}
+	token := newSessionId()
+	service.sessions[token] = &grpcSession{accountId: accountId, terminalId: peerTerminal(ctx), expires: now.Add(hostSessionLifetime),
+		awaitingCode: awaitingCode}
+	return token
+}
+
+// session returns the session named by a request's token, declining the request unless the session is for the account,
+// was started by the terminal sending it and has not expired
+func (service *grpcHostService) session(ctx context.Context, token string, accountId string) (*grpcSession, error) {
+	session, ok := service.sessions[token]
+	if !ok || session.accountId != accountId || session.terminalId != peerTerminal(ctx) || !clock.Now().Before(session.expires) {
+		Logger.Printf("bank host request for %s from %s without a verified PIN\n", accountId, peerTerminal(ctx))
+		return nil, toHostStatus(&PINNotVerifiedError{})
+	}
+	return session, nil
+}
+
+// loggedIn returns the session named by a request's token once the customer has also given any one-time code
+// needed to log in
+func (service *grpcHostService) loggedIn(ctx context.Context, token string, accountId string) (*grpcSession, error) {
+	session, err := service.session(ctx, token, accountId)
+	if err != nil {
+		return nil, err
+	}
+	if session.awaitingCode {
+		return nil, toHostStatus(&OneTimeCodeRequiredError{})
+	}
+	return session, nil
+}
+
+func (service *grpcHostService) Authenticate(ctx context.Context, request *bankpb.AuthenticateRequest) (*bankpb.AuthenticateResponse, error) {
+	if err := service.begin(ctx); err != nil {
+		return nil, err
+	}
+	defer service.lock.Unlock()
+	pin := fromPinBlockMessage(request.PinBlock)
+	if err := service.keys.check(peerTerminal(ctx), pin); err != nil {
+		return nil, toHostStatus(err)
+	}
+	ok, err := service.host.Authenticate(request.AccountId, pin)
+	if err != nil {
+		return nil, toHostStatus(err)
+	}
+	if !ok {
+		return &bankpb.AuthenticateResponse{}, nil
+	}
+	awaitingCode, err := service.host.SecondFactorRequired(request.AccountId, 0)
+	if err != nil {
+		return nil, toHostStatus(err)
+	}
+	return &bankpb.AuthenticateResponse{Authorized: true, SessionToken: service.startSession(ctx, request.AccountId, awaitingCode)}, nil
+}
+
+func (service *grpcHostService) SecondFactorRequired(ctx context.Context, request *bankpb.SecondFactorRequest) (*bankpb.SecondFactorResponse, error) {
+	if err := service.begin(ctx); err != nil {
+		return nil, err
+	}
+	defer service.lock.Unlock()
+	if _, err := service.session(ctx, request.SessionToken, request.AccountId); err != nil {
+		return nil, err
+	}
+	required, err := service.host.SecondFactorRequired(request.AccountId, request.WithdrawalAmount)
+	if err != nil {
+		return nil, toHostStatus(err)
+	}
+	return &bankpb.SecondFactorResponse{Required: required}, nil
+}
+
+func (service *grpcHostService) VerifyOneTimeCode(ctx context.Context, request *bankpb.VerifyOneTimeCodeRequest) (*bankpb.VerifyOneTimeCodeResponse, error) {
+	if err := service.begin(ctx); err != nil {
+		return nil, err
+	}
+	defer service.lock.Unlock()
+	session, err := service.session(ctx, request.SessionToken, request.AccountId)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := service.host.VerifyOneTimeCode(request.AccountId, request.Code)
+	if err != nil {
+		return nil, toHostStatus(err)
+	}
+	// a code completes the login when one is needed for it, otherwise it is for the next withdrawal
+	if ok && session.awaitingCode {
+		session.awaitingCode = false
+	} else if ok {
+		session.codeVerified = true
+	}
+	return &bankpb.VerifyOneTimeCodeResponse{Valid: ok}, nil
+}
+
+func (service *grpcHostService) GetBalance(ctx context.Context, request *bankpb.BalanceRequest) (*bankpb.BalanceResponse, error) {
+	if err := service.begin(ctx); err != nil {
+		return nil, err
+	}
+	defer service.lock.Unlock()
+	if _, err := service.loggedIn(ctx, request.SessionToken, request.AccountId); err != nil {
+		return nil, err
+	}
+	balance, err := service.host.Balance(request.AccountId)
+	if err != nil {
+		return nil, toHostStatus(err)
+	}
+	return &bankpb.BalanceResponse{Balance: balance.Balance, Available: balance.Available, Pending: balance.Pending}, nil
+}
+
+func (service *grpcHostService) Deposit(ctx context.Context, request *bankpb.DepositRequest) (*bankpb.DepositResponse, error) {
+	if err := service.begin(ctx); err != nil {
+		return nil, err
+	}
+	defer service.lock.Unlock()
+	if _, err := service.loggedIn(ctx, request.SessionToken, request.AccountId); err != nil {
+		return nil, err
+	}
+	if err := checkTerminal(ctx, request.TerminalId); err != nil {
+		return nil, err
+	}
+	result, err := service.host.Deposit(DepositRequest{TerminalId: request.TerminalId, AccountId: request.AccountId,
+		Amount: request.Amount, Description: request.Description, IdempotencyKey: request.IdempotencyKey})
+	if err != nil {
+		return nil, toHostStatus(err)
+	}
+	return &bankpb.DepositResponse{Entry: toHistoryEntryMessage(result.Entry), Available: result.Available, Pending: result.Pending,
+		Replayed: result.Replayed}, nil
+}
+
+func (service *grpcHostService) Withdraw(ctx context.Context, request *bankpb.WithdrawRequest) (*bankpb.WithdrawResponse, error) {
+	if err := service.begin(ctx); err != nil {
+		return nil, err
+	}
+	defer service.lock.Unlock()
+	session, err := service.loggedIn(ctx, request.SessionToken, request.AccountId)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTerminal(ctx, request.TerminalId); err != nil {
+		return nil, err
+	}
+	// withdrawals over the threshold use up a one-time code given in the session, unless one is sent again
+	codeNeeded := false
+	if amount, err := StringToMoney(request.Amount); err == nil {
+		if codeNeeded, err = service.host.SecondFactorRequired(request.AccountId, amount); err != nil {
+			return nil, toHostStatus(err)
+		}
+	}
+	resent := request.IdempotencyKey != "" && request.IdempotencyKey == session.codeUsedBy
+	if codeNeeded && !session.codeVerified && !resent {
+		Logger.Printf("withdrawal of %s for %s declined without a one-time code\n", request.Amount, request.AccountId)
+		return nil, toHostStatus(&OneTimeCodeRequiredError{})
+	}
+	result, err := service.host.Withdraw(WithdrawalRequest{TerminalId: request.TerminalId, AccountId: request.AccountId, Amount: request.Amount,
+		AcceptPartial: request.AcceptPartial, Dispensable: request.Dispensable, Description: request.Description,
+		IdempotencyKey: request.IdempotencyKey})
+	if err != nil {
+		return nil, toHostStatus(err)
+	}
+	if codeNeeded && !resent {
+		session.codeVerified, session.codeUsedBy = false, request.IdempotencyKey
+	}
+	return toWithdrawResponse(result), nil
+}
+
+func (service *grpcHostService) Advise(ctx context.Context, request *bankpb.AdviceRequest) (*bankpb.WithdrawResponse, error) {
+	if err := service.begin(ctx); err != nil {
+		return nil, err
+	}
+	defer service.lock.Unlock()
+	if err := checkTerminal(ctx, request.TerminalId); err != nil {
+		return nil, err
+	}
+	result, err := service.host.Advise(WithdrawalAdvice{AdviceId: request.AdviceId, TerminalId: request.TerminalId, AccountId: request.AccountId,
+		Amount: request.Amount, Description: request.Description, ApprovedAt: request.ApprovedAt.AsTime().Local()})
+	if err != nil {
+		return nil, toHostStatus(err)
+	}
+	return toWithdrawResponse(result), nil
+}
+
+func (service *grpcHostService) Reverse(ctx context.Context, request *bankpb.ReversalRequest) (*bankpb.ReversalResponse, error) {
+	if err := service.begin(ctx); err != nil {
+		return nil, err
+	}
+	defer service.lock.Unlock()
+	if err := checkTerminal(ctx, request.TerminalId); err != nil {
+		return nil, err
+	}
+	result, err := service.host.Reverse(ReversalRequest{ReversalId: request.ReversalId, TerminalId: request.TerminalId,
+		TransactionId: request.TransactionId, Amount: request.Amount, Reason: request.Reason})
+	if err != nil {
+		return nil, toHostStatus(err)
+	}
+	return &bankpb.ReversalResponse{
+		TransactionId:      result.TransactionId,
+		FeeTransactionId:   result.FeeTransactionId,
+		AccountId:          result.AccountId,
+		OriginalType:       string(result.OriginalType),
+		OriginalTerminalId: result.OriginalTerminalId,
+		AmountReversed:     result.AmountReversed,
+		FeeRefunded:        result.FeeRefunded,
+		RemainingBalance:   result.RemainingBalance,
+		Repeated:           result.Repeated,
+	}, nil
+}
+
+func (service *grpcHostService) GetHistory(ctx context.Context, request *bankpb.HistoryRequest) (*bankpb.HistoryResponse, error) {
+	if err := service.begin(ctx); err != nil {
+		return nil, err
+	}
+	defer service.lock.Unlock()
+	if _, err := service.loggedIn(ctx, request.SessionToken, request.AccountId); err != nil {
+		return nil, err
+	}
+	query := HistoryQuery{MinAmount: request.MinAmount, MaxAmount: request.MaxAmount, Descending: request.Descending,
+		Offset: int(request.Offset), Limit: int(request.Limit)}
+	if request.From != nil {
+		query.From = request.From.AsTime()
+	}
+	if request.To != nil {
+		query.To = request.To.AsTime()
+	}
+	for _, name := range request.Types {
+		transactionType, err := ParseTransactionType(name)
+		if err != nil {
+			return nil, toHostStatus(err)
+		}
+		query.Types = append(query.Types, transactionType)
+	}
+	entries, total, err := service.host.History(request.AccountId, query)
+	if err != nil {
+		return nil, toHostStatus(err)
+	}
+	response := &bankpb.HistoryResponse{Total: int32(total)}
+	for _, entry := range entries {
+		response.Entries = append(response.Entries, toHistoryEntryMessage(entry))
+	}
+	return response, nil
+}
+
+// GRPCHostClient is a BankHost reached over gRPC, used by a terminal that shares its accounts with other terminals
+type GRPCHostClient struct {
+	conn   *grpc.ClientConn
+	client bankpb.BankHostClient
+	// Timeout is the deadline for each call
+	Timeout time.Duration
+	lock    sync.Mutex
+	// map of account # to the session token the host returned when it verified the PIN
+	sessions map[string]string
+	// reversals of withdrawals the host did not answer, sent before the next request
+	reversals []ReversalRequest
+}
+
+// DialBankHost connects to a bank host at address, using TLS when a config is given
+func DialBankHost(address string, tlsConfig *tls.Config) (*GRPCHostClient, error) {
+	transport := grpc.WithTransportCredentials(insecure.NewCredentials())
+	if tlsConfig != nil {
+		transport = grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))
+	}
+	conn, err := grpc.Dial(address, transport)
+	if err != nil {
+		return nil, err
+	}
+	Logger.Printf("connected to bank host %s\n", address)
+	return &GRPCHostClient{conn: conn, client: bankpb.NewBankHostClient(conn), Timeout: DefaultHostTimeout}, nil
+}
+
+// Close disconnects from the bank host
+func (host *GRPCHostClient) Close() error {
+	return host.conn.Close()
+}
+
+func (host *GRPCHostClient) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), host.Timeout)
+}
+
+// call returns the context for a call to the host, first sending any reversals still owed to it. A withdrawal the host
+// did not answer may have been posted, so it is reversed by its idempotency key; the host declines the reversal if not
+func (host *GRPCHostClient) call() (context.Context, context.CancelFunc, error) {
+	host.lock.Lock()
+	defer host.lock.Unlock()
+	for len(host.reversals) > 0 {
+		reversal := host.reversals[0]
+		ctx, cancel := host.context()
+		response, err := host.client.Reverse(ctx, toReversalMessage(reversal))
+		cancel()
+		if err != nil {
+			err = fromHostStatus(err)
+			if errors.As(err, new(*HostUnavailableError)) {
+				return nil, nil, &HostUnavailableError{NotSent: true, cause: err}
+			}
+			Logger.Printf("reversal of withdrawal %s declined: %v\n", reversal.TransactionId, err)
+		} else {
+			Logger.Printf("reversed $%.2f of withdrawal %s as %s\n", response.AmountReversed, reversal.TransactionId, response.TransactionId)
+		}
+		host.reversals = host.reversals[1:]
+	}
+	ctx, cancel := host.context()
+	return ctx, cancel, nil
+}
+
+func (host *GRPCHostClient) Authenticate(accountId string, pin PINBlock) (bool, error) {
+	ctx, cancel, err := host.call()
+	if err != nil {
+		return false, err
+	}
+	defer cancel()
+	response, err := host.client.Authenticate(ctx, &bankpb.AuthenticateRequest{AccountId: accountId, PinBlock: toPinBlockMessage(pin)})
+	if err != nil {
+		return false, fromHostStatus(err)
+	}
+	host.setSession(accountId, response.SessionToken)
+	return response.Authorized, nil
+}
+
+// setSession keeps the session token sent with the account's requests, forgetting it when token is empty
+func (host *GRPCHostClient) setSession(accountId string, token string) {
+	host.lock.Lock()
+	defer host.lock.Unlock()
+	if token == "" {
+		delete(host.sessions, accountId)
+		return
+	}
+	if host.sessions == nil {
+		host.sessions = map[string]string{}
+	}
+	host.sessions[accountId] = token
+}
+
+// sessionToken returns the token of the session the host started when it verified the account's PIN
+func (host *GRPCHostClient) sessionToken(accountId string) string {
+	host.lock.Lock()
+	defer host.lock.Unlock()
+	return host.sessions[accountId]
+}
+
+func (host *GRPCHostClient) SecondFactorRequired(accountId string, withdrawal float64) (bool, error) {
+	ctx, cancel, err := host.call()
+	if err != nil {
+		return false, err
+	}
+	defer cancel()
+	response, err := host.client.SecondFactorRequired(ctx, &bankpb.SecondFactorRequest{AccountId: accountId, WithdrawalAmount: withdrawal,
+		SessionToken: host.sessionToken(accountId)})
+	if err != nil {
+		return false, fromHostStatus(err)
+	}
+	return response.Required, nil
+}
+
+func (host *GRPCHostClient) VerifyOneTimeCode(accountId string, code string) (bool, error) {
+	ctx, cancel, err := host.call()
+	if err != nil {
+		return false, err
+	}
+	defer cancel()
+	response, err := host.client.VerifyOneTimeCode(ctx, &bankpb.VerifyOneTimeCodeRequest{AccountId: accountId, Code: code,
+		SessionToken: host.sessionToken(accountId)})
+	if err != nil {
+		return false, fromHostStatus(err)
+	}
+	return response.Valid, nil
+}
+
+func (host *GRPCHostClient) Balance(accountId string) (AccountBalance, error) {
+	ctx, cancel, err := host.call()
+	if err != nil {
+		return AccountBalance{}, err
+	}
+	defer cancel()
+	response, err := host.client.GetBalance(ctx, &bankpb.BalanceRequest{AccountId: accountId, SessionToken: host.sessionToken(accountId)})
+	if err != nil {
+		return AccountBalance{}, fromHostStatus(err)
+	}
+	return AccountBalance{Balance: response.Balance, Available: response.Available, Pending: response.Pending}, nil
+}
+
+func (host *GRPCHostClient) Deposit(request DepositRequest) (*DepositResult, error) {
+	ctx, cancel, err := host.call()
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	response, err := host.client.Deposit(ctx, &bankpb.DepositRequest{TerminalId: request.TerminalId, AccountId: request.AccountId,
+		Amount: request.Amount, Description: request.Description, IdempotencyKey: request.IdempotencyKey,
+		SessionToken: host.sessionToken(request.AccountId)})
+	if err != nil {
+		return nil, fromHostStatus(err)
+	}
+	return &DepositResult{Entry: fromHistoryEntryMessage(response.Entry), Available: response.Available, Pending: response.Pending,
+		Replayed: response.Replayed}, nil
+}
+
+func (host *GRPCHostClient) Withdraw(request WithdrawalRequest) (*WithdrawResult, error) {
+	ctx, cancel, err := host.call()
+	if err != nil {
+		return &WithdrawResult{}, err
+	}
+	defer cancel()
+	response, err := host.client.Withdraw(ctx, &bankpb.WithdrawRequest{TerminalId: request.TerminalId, AccountId: request.AccountId,
+		Amount: request.Amount, AcceptPartial: request.AcceptPartial, Dispensable: request.Dispensable, Description: request.Description,
+		IdempotencyKey: request.IdempotencyKey, SessionToken: host.sessionToken(request.AccountId)})
+	if err != nil {
+		err = fromHostStatus(err)
+		var unavailable *HostUnavailableError
+		if errors.As(err, &unavailable) && !unavailable.NotSent && request.IdempotencyKey != "" {
+			Logger.Printf("no answer to withdrawal %s for %s, queueing its reversal\n", request.IdempotencyKey, request.AccountId)
+			host.lock.Lock()
+			host.reversals = append(host.reversals, ReversalRequest{ReversalId: request.IdempotencyKey, TerminalId: request.TerminalId,
+				TransactionId: request.IdempotencyKey, Reason: "no answer from the bank host"})
+			host.lock.Unlock()
+		}
+		return &WithdrawResult{}, err
+	}
+	return fromWithdrawResponse(response), nil
+}
+
+func (host *GRPCHostClient) Advise(advice WithdrawalAdvice) (*WithdrawResult, error) {
+	ctx, cancel, err := host.call()
+	if err != nil {
+		return &WithdrawResult{}, err
+	}
+	defer cancel()
+	response, err := host.client.Advise(ctx, &bankpb.AdviceRequest{AdviceId: advice.AdviceId, TerminalId: advice.TerminalId,
+		AccountId: advice.AccountId, Amount: advice.Amount, Description: advice.Description, ApprovedAt: timestamppb.New(advice.ApprovedAt)})
+	if err != nil {
+		return &WithdrawResult{}, fromHostStatus(err)
+	}
+	return fromWithdrawResponse(response), nil
+}
+
+func (host *GRPCHostClient) Reverse(request ReversalRequest) (*ReversalResult, error) {
+	ctx, cancel, err := host.call()
+	if err != nil {
+		return &ReversalResult{}, err
+	}
+	defer cancel()
+	response, err := host.client.Reverse(ctx, toReversalMessage(request))
+	if err != nil {
+		return &ReversalResult{}, fromHostStatus(err)
+	}
+	return &ReversalResult{
+		TransactionId:      response.TransactionId,
+		FeeTransactionId:   response.FeeTransactionId,
+		AccountId:          response.AccountId,
+		OriginalType:       TransactionType(response.OriginalType),
+		OriginalTerminalId: response.OriginalTerminalId,
+		AmountReversed:     response.AmountReversed,
+		FeeRefunded:        response.FeeRefunded,
+		RemainingBalance:   response.RemainingBalance,
+		Repeated:           response.Repeated,
+	}, nil
+}
+
+func (host *GRPCHostClient) History(accountId string, query HistoryQuery) ([]LedgerHistoryEntry, int, error) {
+	ctx, cancel, err := host.call()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cancel()
+	request := &bankpb.HistoryRequest{AccountId: accountId, MinAmount: query.MinAmount, MaxAmount: query.MaxAmount,
+		Descending: query.Descending, Offset: int32(query.Offset), Limit: int32(query.Limit), SessionToken: host.sessionToken(accountId)}
+	if !query.From.IsZero() {
+		request.From = timestamppb.New(query.From)
+	}
+	if !query.To.IsZero() {
+		request.To = timestamppb.New(query.To)
+	}
+	for _, transactionType := range query.Types {
+		request.Types = append(request.Types, string(transactionType))
+	}
+	response, err := host.client.GetHistory(ctx, request)
+	if err != nil {
+		return nil, 0, fromHostStatus(err)
+	}
+	var entries []LedgerHistoryEntry
+	for _, entry := range response.Entries {
+		entries = append(entries, fromHistoryEntryMessage(entry))
+	}
+	return entries, int(response.Total), nil
+}
+
+func toReversalMessage(request ReversalRequest) *bankpb.ReversalRequest {
+	return &bankpb.ReversalRequest{ReversalId: request.ReversalId, TerminalId: request.TerminalId, TransactionId: request.TransactionId,
+		Amount: request.Amount, Reason: request.Reason}
+}
+
+func toWithdrawResponse(result *WithdrawResult) *bankpb.WithdrawResponse {
+	return &bankpb.WithdrawResponse{
+		TransactionId:    result.TransactionId,
+		FeeTransactionId: result.FeeTransactionId,
+		AmountWithdrawn:  result.AmountWithdrawn,
+		RemainingBalance: result.RemainingBalance,
+		WasOverdrawn:     result.WasOverdrawn,
+		WasPartial:       result.WasPartial,
+		Replayed:         result.Replayed,
+	}
+}
+
+func fromWithdrawResponse(response *bankpb.WithdrawResponse) *WithdrawResult {
+	return &WithdrawResult{
+		TransactionId:    response.TransactionId,
+		FeeTransactionId: response.FeeTransactionId,
+		AmountWithdrawn:  response.AmountWithdrawn,
+		RemainingBalance: response.RemainingBalance,
+		WasOverdrawn:     response.WasOverdrawn,
+		WasPartial:       response.WasPartial,
+		Replayed:         response.Replayed,
+	}
+}
+
+func toPinBlockMessage(pin PINBlock) *bankpb.PinBlock {
+	return &bankpb.PinBlock{Format: int32(pin.Format), Block: pin.Block, Ksn: pin.KSN, Pan: pin.PAN}
+}
+
+func fromPinBlockMessage(pin *bankpb.PinBlock) PINBlock {
+	return PINBlock{Format: pinblock.Format(pin.GetFormat()), Block: pin.GetBlock(), KSN: pin.GetKsn(), PAN: pin.GetPan()}
+}
+
+func toHistoryEntryMessage(entry LedgerHistoryEntry) *bankpb.HistoryEntry {
+	return &bankpb.HistoryEntry{
+		Id:          entry.Id,
+		Type:        string(entry.Type),
+		Description: entry.Description,
+		TerminalId:  entry.TerminalId,
+		ParentId:    entry.ParentId,
+		Date:        timestamppb.New(entry.Date),
+		Amount:      entry.Amount,
+		Balance:     entry.Balance,
+	}
+}
+
+func fromHistoryEntryMessage(entry *bankpb.HistoryEntry) LedgerHistoryEntry {
+	return LedgerHistoryEntry{
+		Id:          entry.Id,
+		Type:        TransactionType(entry.Type),
+		Description: entry.Description,
+		TerminalId:  entry.TerminalId,
+		ParentId:    entry.ParentId,
+		Date:        entry.Date.AsTime().Local(),
+		Amount:      entry.Amount,
+		Balance:     entry.Balance,
+	}
+}
+
+// toHostStatus converts an error from the ledger or authorization services into a gRPC status carrying the error's details
+func toHostStatus(err error) error {
+	detail := &bankpb.HostError{Message: err.Error()}
+	code := codes.FailedPrecondition
+	var invalidInput *InvalidInputError
+	var invalidAmount *InvalidAmountError
+	var onHold *FundsOnHoldError
+	var partial *PartialDispenseError
+	var duplicate *DuplicateAdviceError
+	var reused *IdempotencyKeyReusedError
+	switch {
+	case errors.As(err, &invalidInput):
+		code, detail.Code, detail.Message = codes.InvalidArgument, hostInvalidInput, invalidInput.message
+	case errors.As(err, &invalidAmount):
+		code, detail.Code, detail.Message = codes.InvalidArgument, hostInvalidAmount, invalidAmount.message
+	case errors.As(err, new(*InsufficientFundsError)):
+		detail.Code = hostInsufficientFunds
+	case errors.As(err, new(*OverdrawnError)):
+		detail.Code = hostOverdrawn
+	case errors.As(err, &onHold):
+		detail.Code, detail.Available = hostFundsOnHold, onHold.Available
+	case errors.As(err, &partial):
+		detail.Code, detail.Requested, detail.Available = hostPartialDispense, partial.Requested, partial.Available
+	case errors.As(err, new(*NoMoneyLeftError)):
+		detail.Code = hostNoCash
+	case errors.As(err, new(*OneTimeCodeReusedError)):
+		code, detail.Code = codes.PermissionDenied, hostOneTimeCodeReused
+	case errors.As(err, &duplicate):
+		code, detail.Code, detail.TransactionId = codes.AlreadyExists, hostDuplicateAdvice, duplicate.TransactionId
+	case errors.As(err, &reused):
+		code, detail.Code, detail.IdempotencyKey = codes.InvalidArgument, hostIdempotencyKey, reused.Key
+	case errors.As(err, new(*PINNotVerifiedError)):
+		code, detail.Code = codes.Unauthenticated, hostPINNotVerified
+	case errors.As(err, new(*OneTimeCodeRequiredError)):
+		code, detail.Code = codes.PermissionDenied, hostOneTimeCode
+	default:
+		Logger.Printf("unexpected bank host error: %+v\n", err)
+		return status.Error(codes.Internal, err.Error())
+	}
+	withDetails, detailErr := status.New(code, err.Error()).WithDetails(detail)
+	if detailErr != nil {
+		return status.Error(code, err.Error())
+	}
+	return withDetails.Err()
+}
+
+// fromHostStatus rebuilds the error the bank host returned, so the terminal can handle it as if the ledger were local
+func fromHostStatus(err error) error {
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	for _, detail := range st.Details() {
+		hostError, ok := detail.(*bankpb.HostError)
+		if !ok {
+			continue
+		}
+		switch hostError.Code {
+		case hostInvalidInput:
+			return &InvalidInputError{hostError.Message}
+		case hostInvalidAmount:
+			return &InvalidAmountError{message: hostError.Message}
+		case hostInsufficientFunds:
+			return &InsufficientFundsError{}
+		case hostOverdrawn:
+			return &OverdrawnError{}
+		case hostFundsOnHold:
+			return &FundsOnHoldError{Available: hostError.Available}
+		case hostPartialDispense:
+			return &PartialDispenseError{Requested: hostError.Requested, Available: hostError.Available}
+		case hostNoCash:
+			return &NoMoneyLeftError{}
+		case hostOneTimeCodeReused:
+			return &OneTimeCodeReusedError{}
+		case hostDuplicateAdvice:
+			return &DuplicateAdviceError{TransactionId: hostError.TransactionId}
+		case hostIdempotencyKey:
+			return &IdempotencyKeyReusedError{Key: hostError.IdempotencyKey}
+		case hostPINNotVerified:
+			return &PINNotVerifiedError{}
+		case hostOneTimeCode:
+			return &OneTimeCodeRequiredError{}
+		}
+	}
+	Logger.Printf("bank host call failed: %+v\n", err)
+	switch st.Code() {
+	case codes.Unavailable:
+		return &HostUnavailableError{NotSent: true, cause: err}
+	case codes.DeadlineExceeded, codes.Canceled:
+		return &HostUnavailableError{cause: err}
+	}
+	return err
+}
@@ -0,0 +1,419 @@
+package internal
+
+import (
+	"agile-coder.com/atm-sim/internal/pinblock"
+	"crypto/sha1"
+	"encoding/base32"
+	"errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startBankHost runs a bank host with TLS on a local port, returning its address and the CA certificate to trust
+func startBankHost(t *testing.T, host BankHost) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := GenerateCertificates(dir, []string{"localhost", "127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := HostTLSConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewBankHostServer(host, tlsConfig)
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	t.Cleanup(server.Stop)
+	return listener.Addr().String(), filepath.Join(dir, CACertificateFile)
+}
+
+// dialBankHost connects to a bank host as a terminal, with a certificate issued for the terminal id
+func dialBankHost(t *testing.T, address string, caFile string, terminalId string) *GRPCHostClient {
+	t.Helper()
+	dir := filepath.Dir(caFile)
+	certFile, keyFile := TerminalCertificateFile, TerminalKeyFile
+	if terminalId != DefaultTerminalId {
+		if err := IssueTerminalCertificate(dir, terminalId); err != nil {
+			t.Fatal(err)
+		}
+		certFile, keyFile = TerminalCertificateFiles(terminalId)
+	}
+	tlsConfig, err := TerminalTLSConfig(caFile, filepath.Join(dir, certFile), filepath.Join(dir, keyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := DialBankHost(address, tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	return client
+}
+
+// hostAuthorization holds the PIN 1234 for the account
+func hostAuthorization(t *testing.T, accountId string) *Authorization {
+	t.Helper()
+	encryptedPin, err := EncryptPin("1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &Authorization{}
+	auth.SetAuthData(map[string]EncryptedPin{accountId: encryptedPin})
+	return auth
+}
+
+// logInAtHost verifies the account's PIN at the bank host, starting a session for the account's requests
+func logInAtHost(t *testing.T, client *GRPCHostClient, accountId string) {
+	t.Helper()
+	if ok, err := client.Authenticate(accountId, encryptTestPIN(t, "1234", "")); !ok || err != nil {
+		t.Fatalf("expected the PIN to be accepted got %t %v", ok, err)
+	}
+}
+
+// terminalPads are the PIN pads of test terminals other than the one GetPINPad returns, kept between tests
+// as the security module remembers the counters they have used
+var terminalPads = map[string]*PINPad{}
+
+// encryptTerminalPIN encrypts a PIN on the terminal's own PIN pad
+func encryptTerminalPIN(t *testing.T, terminalId string, pin string) PINBlock {
+	t.Helper()
+	pad, ok := terminalPads[terminalId]
+	if !ok {
+		pad = NewSimulatorPINPad(terminalId, false)
+		terminalPads[terminalId] = pad
+	}
+	block, err := pad.EncryptPIN(pin, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+func TestBankHostSharedByTerminals(t *testing.T) {
+	const accountId = "jc123"
+	InitLogger("", true)
+	encryptedPin, err := EncryptPin("1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostLedger := &Ledger{}
+	hostLedger.SetInitialBalances(0, map[string]float64{accountId: 100.00})
+	hostAuth := &Authorization{}
+	hostAuth.SetAuthData(map[string]EncryptedPin{accountId: encryptedPin})
+	address, caFile := startBankHost(t, NewLocalHost(hostLedger, hostAuth))
+
+	first := dialBankHost(t, address, caFile, "ATM00001")
+	second := dialBankHost(t, address, caFile, "ATM00002")
+
+	if ok, err := first.Authenticate(accountId, encryptTestPIN(t, "1234", "")); !ok || err != nil {
+		t.Fatalf("expected the PIN to be accepted got %t %v", ok, err)
+	}
+	if ok, err := second.Authenticate(accountId, encryptTerminalPIN(t, "ATM00002", "0000")); ok || err != nil {
+		t.Errorf("expected the PIN to be rejected got %t %v", ok, err)
+	}
+	// a terminal using another terminal's PIN pad key, as when their ids collide, is refused
+	if _, err := second.Authenticate(accountId, encryptTestPIN(t, "1234", "")); !errors.Is(err, &InvalidInputError{"the PIN pad key is used by terminal ATM00001"}) {
+		t.Errorf("expected the first terminal's key to be refused got %v", err)
+	}
+	invalid := PINBlock{Format: pinblock.Format0, Block: []byte{1, 2, 3}, KSN: mustDecodeHex("FFFF9876543210E00000"), PAN: "4111111111111111"}
+	if _, err := second.Authenticate(accountId, invalid); !errors.Is(err, &InvalidInputError{"unable to read the PIN block: a format 0 PIN block must be 8 bytes, not 3"}) {
+		t.Errorf("expected the host's error to reach the terminal got %v", err)
+	}
+
+	deposit, err := first.Deposit(DepositRequest{TerminalId: "ATM00001", AccountId: accountId, Amount: "60.00"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deposit.Entry.Balance != 160.00 || deposit.Entry.TerminalId != "ATM00001" {
+		t.Errorf("unexpected deposit %+v", deposit.Entry)
+	}
+
+	// the second terminal sees the first terminal's deposit
+	if ok, err := second.Authenticate(accountId, encryptTerminalPIN(t, "ATM00002", "1234")); !ok || err != nil {
+		t.Fatalf("expected the PIN to be accepted got %t %v", ok, err)
+	}
+	balance, err := second.Balance(accountId)
+	if err != nil || balance.Balance != 160.00 {
+		t.Fatalf("expected a shared balance of 160.00 got %+v %v", balance, err)
+	}
+	withdrawal, err := second.Withdraw(WithdrawalRequest{TerminalId: "ATM00002", AccountId: accountId, Amount: "100", Dispensable: 1000})
+	if err != nil || withdrawal.AmountWithdrawn != 100.00 || withdrawal.RemainingBalance != 60.00 {
+		t.Fatalf("unexpected withdrawal %+v %v", withdrawal, err)
+	}
+
+	// each terminal dispenses from its own cash
+	_, err = first.Withdraw(WithdrawalRequest{TerminalId: "ATM00001", AccountId: accountId, Amount: "60", Dispensable: 40})
+	var partial *PartialDispenseError
+	if !errors.As(err, &partial) || partial.Requested != 60 || partial.Available != 40 {
+		t.Errorf("expected a partial dispense of 40.00 got %v", err)
+	}
+
+	history, total, err := first.History(accountId, HistoryQuery{Descending: true})
+	if err != nil || total != 2 {
+		t.Fatalf("expected 2 history entries got %d %v", total, err)
+	}
+	if history[0].TerminalId != "ATM00002" || history[0].Type != WithdrawalTransaction || history[1].TerminalId != "ATM00001" {
+		t.Errorf("unexpected history %+v", history)
+	}
+}
+
+func TestBankHostDeadline(t *testing.T) {
+	InitLogger("", true)
+	address, caFile := startBankHost(t, NewLocalHost(&Ledger{}, &Authorization{}))
+	client := dialBankHost(t, address, caFile, DefaultTerminalId)
+	client.Timeout = time.Nanosecond
+	if _, err := client.Balance("jc123"); !errors.Is(err, &HostUnavailableError{}) {
+		t.Errorf("expected the call to time out got %v", err)
+	}
+
+	// a terminal that does not trust the host's certificate can not reach it
+	otherAddress, _ := startBankHost(t, NewLocalHost(&Ledger{}, &Authorization{}))
+	untrusted := dialBankHost(t, otherAddress, caFile, DefaultTerminalId)
+	if _, err := untrusted.Balance("jc123"); !errors.Is(err, &HostUnavailableError{}) {
+		t.Errorf("expected an untrusted host to be unreachable got %v", err)
+	}
+
+	// the host only answers terminals presenting a certificate signed by its CA
+	for name, certDir := range map[string]string{"no certificate": "", "another CA": t.TempDir()} {
+		tlsConfig, err := TerminalTLSConfig(caFile, filepath.Join(filepath.Dir(caFile), TerminalCertificateFile), filepath.Join(filepath.Dir(caFile), TerminalKeyFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tlsConfig.Certificates = nil
+		if certDir != "" {
+			if err := GenerateCertificates(certDir, []string{"localhost"}); err != nil {
+				t.Fatal(err)
+			}
+			other, err := TerminalTLSConfig(filepath.Join(certDir, CACertificateFile), filepath.Join(certDir, TerminalCertificateFile), filepath.Join(certDir, TerminalKeyFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tlsConfig.Certificates = other.Certificates
+		}
+		client, err := DialBankHost(address, tlsConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Balance("jc123"); err == nil {
+			t.Errorf("%s: expected the terminal to be refused", name)
+		}
+		_ = client.Close()
+	}
+}
+
+func TestBankHostAdvice(t *testing.T) {
+	const accountId = "jc123"
+	InitLogger("", true)
+	hostLedger := &Ledger{}
+	hostLedger.SetInitialBalances(0, map[string]float64{accountId: 100.00})
+	address, caFile := startBankHost(t, NewLocalHost(hostLedger, &Authorization{}))
+	client := dialBankHost(t, address, caFile, "ATM00002")
+
+	advice := WithdrawalAdvice{AdviceId: "0A1B2C3D4E5F", TerminalId: "ATM00002", AccountId: accountId, Amount: 60,
+		ApprovedAt: time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)}
+	result, err := client.Advise(advice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.AmountWithdrawn != 60 || result.RemainingBalance != 40 || result.WasOverdrawn {
+		t.Errorf("unexpected advice result %+v", result)
+	}
+	_, err = client.Advise(advice)
+	var duplicate *DuplicateAdviceError
+	if !errors.As(err, &duplicate) || duplicate.TransactionId != result.TransactionId {
+		t.Errorf("expected a duplicate advice error got %v", err)
+	}
+	if _, err := client.Advise(WithdrawalAdvice{AdviceId: "A2", TerminalId: "ATM00002", AccountId: "xx999", Amount: 20}); !errors.Is(err, &InvalidInputError{"unknown account \"xx999\""}) {
+		t.Errorf("expected an unknown account to be rejected got %v", err)
+	}
+	if history := hostLedger.GetHistory(accountId); len(history) != 1 || history[0].TerminalId != "ATM00002" || history[0].Description != "cash withdrawal (offline)" {
+		t.Errorf("expected the advice to be posted once got %+v", history)
+	}
+}
+
+func TestBankHostReversal(t *testing.T) {
+	const accountId = "jc123"
+	InitLogger("", true)
+	hostLedger := &Ledger{}
+	hostLedger.SetInitialBalances(0, map[string]float64{accountId: 40.00})
+	address, caFile := startBankHost(t, NewLocalHost(hostLedger, hostAuthorization(t, accountId)))
+	client := dialBankHost(t, address, caFile, "ATM00002")
+	logInAtHost(t, client, accountId)
+
+	withdrawal, err := client.Withdraw(WithdrawalRequest{TerminalId: "ATM00002", AccountId: accountId, Amount: "60", Dispensable: 500})
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := ReversalRequest{TerminalId: "ATM00002", TransactionId: withdrawal.TransactionId, Reason: "dispense fault"}
+	result, err := client.Reverse(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.AmountReversed != 60 || result.FeeRefunded != OverdraftFee || result.RemainingBalance != 40.00 || result.AccountId != accountId ||
+		result.OriginalType != WithdrawalTransaction || result.OriginalTerminalId != "ATM00002" || result.Repeated {
+		t.Errorf("unexpected reversal %+v", result)
+	}
+	if repeated, err := client.Reverse(request); err != nil || !repeated.Repeated || repeated.TransactionId != result.TransactionId {
+		t.Errorf("expected the repeated reversal to return the first got %+v %v", repeated, err)
+	}
+	if _, err := client.Reverse(ReversalRequest{TerminalId: "ATM00002", TransactionId: "000000000000"}); !errors.Is(err, &InvalidInputError{"unknown transaction \"000000000000\""}) {
+		t.Errorf("expected an unknown transaction to be refused got %v", err)
+	}
+}
+
+func TestBankHostIdempotencyKey(t *testing.T) {
+	const accountId = "jc123"
+	InitLogger("", true)
+	hostLedger := &Ledger{}
+	hostLedger.SetInitialBalances(0, map[string]float64{accountId: 100.00})
+	address, caFile := startBankHost(t, NewLocalHost(hostLedger, hostAuthorization(t, accountId)))
+	client := dialBankHost(t, address, caFile, "ATM00002")
+	logInAtHost(t, client, accountId)
+
+	request := WithdrawalRequest{TerminalId: "ATM00002", AccountId: accountId, Amount: "60", Dispensable: 500, IdempotencyKey: "K1"}
+	first, err := client.Withdraw(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retried, err := client.Withdraw(request); err != nil || !retried.Replayed || retried.TransactionId != first.TransactionId {
+		t.Errorf("expected the first withdrawal to be returned got %+v %v", retried, err)
+	}
+	deposit := DepositRequest{TerminalId: "ATM00002", AccountId: accountId, Amount: "20", IdempotencyKey: "K1"}
+	if _, err := client.Deposit(deposit); !errors.Is(err, &IdempotencyKeyReusedError{Key: "K1"}) {
+		t.Errorf("expected the reused key to be refused got %v", err)
+	}
+	if balance := hostLedger.GetBalance(accountId); balance != 40.00 {
+		t.Errorf("expected the withdrawal to be posted once got %.2f", balance)
+	}
+}
+
+func TestBankHostSessions(t *testing.T) {
+	const accountId = "jc123"
+	InitLogger("", true)
+	hostLedger := &Ledger{}
+	hostLedger.SetInitialBalances(0, map[string]float64{accountId: 1000.00})
+	hostAuth := hostAuthorization(t, accountId)
+	address, caFile := startBankHost(t, NewLocalHost(hostLedger, hostAuth))
+	first := dialBankHost(t, address, caFile, "ATM00001")
+	second := dialBankHost(t, address, caFile, "ATM00002")
+
+	// requests for an account need a session started by verifying its PIN, at the same terminal
+	if _, err := first.Balance(accountId); !errors.Is(err, &PINNotVerifiedError{}) {
+		t.Errorf("expected the request to need a verified PIN got %v", err)
+	}
+	logInAtHost(t, first, accountId)
+	second.setSession(accountId, first.sessionToken(accountId))
+	if _, err := second.Balance(accountId); !errors.Is(err, &PINNotVerifiedError{}) {
+		t.Errorf("expected another terminal's session to be refused got %v", err)
+	}
+	// and a terminal can only make requests as the terminal in its certificate
+	_, err := first.Deposit(DepositRequest{TerminalId: "ATM00002", AccountId: accountId, Amount: "20"})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected a request for another terminal to be refused got %v", err)
+	}
+
+	// withdrawals over the threshold need a one-time code verified at the host, used up by the withdrawal
+	hostAuth.SetSecondFactorPolicy(SecondFactorPolicy{WithdrawalThreshold: 100})
+	encoded, err := hostAuth.EnrollTOTP(accountId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := WithdrawalRequest{TerminalId: "ATM00001", AccountId: accountId, Amount: "120", Dispensable: 1000, IdempotencyKey: "K1"}
+	if _, err := first.Withdraw(request); !errors.Is(err, &OneTimeCodeRequiredError{}) {
+		t.Errorf("expected the withdrawal to need a one-time code got %v", err)
+	}
+	if ok, err := first.VerifyOneTimeCode(accountId, TOTPCode(secret, clock.Now(), 6, sha1.New)); !ok || err != nil {
+		t.Fatalf("expected the code to be accepted got %t %v", ok, err)
+	}
+	if _, err := first.Withdraw(request); err != nil {
+		t.Fatal(err)
+	}
+	if replayed, err := first.Withdraw(request); err != nil || !replayed.Replayed {
+		t.Errorf("expected the withdrawal sent again to be replayed got %+v %v", replayed, err)
+	}
+	request.IdempotencyKey = "K2"
+	if _, err := first.Withdraw(request); !errors.Is(err, &OneTimeCodeRequiredError{}) {
+		t.Errorf("expected the code to be used up got %v", err)
+	}
+
+	// an account that needs a code to log in can not make requests until it is given
+	hostAuth.SetSecondFactorPolicy(SecondFactorPolicy{OnLogin: true})
+	if ok, err := second.Authenticate(accountId, encryptTerminalPIN(t, "ATM00002", "1234")); !ok || err != nil {
+		t.Fatalf("expected the PIN to be accepted got %t %v", ok, err)
+	}
+	if _, err := second.Balance(accountId); !errors.Is(err, &OneTimeCodeRequiredError{}) {
+		t.Errorf("expected the login to need a one-time code got %v", err)
+	}
+	if ok, err := second.VerifyOneTimeCode(accountId, TOTPCode(secret, clock.Now().Add(30*time.Second), 6, sha1.New)); !ok || err != nil {
+		t.Fatalf("expected the code to be accepted got %t %v", ok, err)
+	}
+	if balance, err := second.Balance(accountId); err != nil || balance.Balance != 880.00 {
+		t.Errorf("unexpected balance %+v %v", balance, err)
+	}
+}
+
+// slowHost answers withdrawals only after the terminal has stopped waiting for them
+type slowHost struct {
+	BankHost
+	delay time.Duration
+}
+
+func (host *slowHost) Withdraw(request WithdrawalRequest) (*WithdrawResult, error) {
+	result, err := host.BankHost.Withdraw(request)
+	time.Sleep(host.delay)
+	return result, err
+}
+
+func TestBankHostUnansweredWithdrawal(t *testing.T) {
+	const accountId = "jc123"
+	InitLogger("", true)
+	hostLedger := &Ledger{}
+	hostLedger.SetInitialBalances(0, map[string]float64{accountId: 100.00})
+	host := &slowHost{BankHost: NewLocalHost(hostLedger, hostAuthorization(t, accountId))}
+	address, caFile := startBankHost(t, host)
+	client := dialBankHost(t, address, caFile, "ATM00002")
+	logInAtHost(t, client, accountId)
+
+	// a withdrawal posted after the terminal gave up waiting is reversed before the next request
+	host.delay = 200 * time.Millisecond
+	client.Timeout = 50 * time.Millisecond
+	_, err := client.Withdraw(WithdrawalRequest{TerminalId: "ATM00002", AccountId: accountId, Amount: "60", Dispensable: 500, IdempotencyKey: "K1"})
+	var unavailable *HostUnavailableError
+	if !errors.As(err, &unavailable) || unavailable.NotSent {
+		t.Fatalf("expected the withdrawal to go unanswered got %v", err)
+	}
+	client.Timeout = DefaultHostTimeout
+	balance, err := client.Balance(accountId)
+	if err != nil || balance.Balance != 100.00 {
+		t.Errorf("expected the withdrawal to be reversed got %+v %v", balance, err)
+	}
+	if history := hostLedger.GetHistory(accountId); len(history) != 2 || history[1].Type != ReversalTransaction || history[1].ParentId != history[0].Id {
+		t.Errorf("unexpected history %+v", history)
+	}
+
+	// one that never reached the host has nothing to reverse
+	client.Timeout = time.Nanosecond
+	if _, err := client.Withdraw(WithdrawalRequest{TerminalId: "ATM00002", AccountId: accountId, Amount: "20", Dispensable: 500, IdempotencyKey: "K2"}); err == nil {
+		t.Fatal("expected the withdrawal to go unanswered")
+	}
+	client.Timeout = DefaultHostTimeout
+	if balance, err := client.Balance(accountId); err != nil || balance.Balance != 100.00 {
+		t.Errorf("expected the balance to be unchanged got %+v %v", balance, err)
+	}
+	if len(client.reversals) != 0 {
+		t.Errorf("expected no reversals to be left got %+v", client.reversals)
+	}
+}
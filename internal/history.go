@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"math"
+	"time"
+)
+
+// HistoryQuery filters, sorts and pages an account's ledger history. Zero values do not filter
+type HistoryQuery struct {
+	// From is the earliest date to include
+	From time.Time
+	// To is the date to include entries up to, exclusive
+	To time.Time
+	// Types limits the entries to the given transaction types
+	Types []TransactionType
+	// MinAmount and MaxAmount limit the entries by the size of the amount, regardless of sign
+	MinAmount *float64
+	MaxAmount *float64
+	// Descending returns the newest entries first
+	Descending bool
+	// Offset is the number of matching entries to skip
+	Offset int
+	// Limit is the maximum number of entries to return
+	Limit int
+}
+
+// QueryHistory returns the entries in the transaction history for a given account that match the query,
+// along with the total number of matching entries before the offset and limit were applied
+func (ledger *Ledger) QueryHistory(accountId string, query HistoryQuery) ([]LedgerHistoryEntry, int) {
+	var matches []LedgerHistoryEntry
+	for _, entry := range ledger.histories[accountId] {
+		if query.matches(entry) {
+			matches = append(matches, entry)
+		}
+	}
+	// the history is kept in the order the transactions happened
+	if query.Descending {
+		for i, j := 0, len(matches)-1; i < j; i, j = i+1, j-1 {
+			matches[i], matches[j] = matches[j], matches[i]
+		}
+	}
+	total := len(matches)
+	if query.Offset >= total {
+		return nil, total
+	}
+	if query.Offset > 0 {
+		matches = matches[query.Offset:]
+	}
+	if query.Limit > 0 && query.Limit < len(matches) {
+		matches = matches[:query.Limit]
+	}
+	Logger.Printf("returning %d of %d matching histories\n", len(matches), total)
+	return matches, total
+}
+
+func (query HistoryQuery) matches(entry LedgerHistoryEntry) bool {
+	if !query.From.IsZero() && entry.Date.Before(query.From) {
+		return false
+	}
+	if !query.To.IsZero() && !entry.Date.Before(query.To) {
+		return false
+	}
+	if len(query.Types) > 0 {
+		found := false
+		for _, t := range query.Types {
+			if entry.Type == t {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	amount := math.Abs(entry.Amount)
+	if query.MinAmount != nil && amount < *query.MinAmount {
+		return false
+	}
+	if query.MaxAmount != nil && amount > *query.MaxAmount {
+		return false
+	}
+	return true
+}
+
+// ParseTransactionType validates the name of a transaction type
+func ParseTransactionType(name string) (TransactionType, error) {
+	switch t := TransactionType(name); t {
+	case DepositTransaction, WithdrawalTransaction, FeeTransaction, TransferTransaction, ReversalTransaction, AdjustmentTransaction:
+		return t, nil
+	}
+	return "", &InvalidInputError{"unknown transaction type \"" + name + "\""}
+}
@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueryHistory(t *testing.T) {
+	const accountId = "jc123"
+	InitLogger("", true)
+	ledger := &Ledger{}
+	ledger.SetInitialBalances(5000, map[string]float64{
+		accountId: 100,
+	})
+	for _, amount := range []string{"10.00", "20.00", "30.00", "40.00"} {
+		if _, err := ledger.Deposit(accountId, amount); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// overdraws the account, adding a fee
+	if _, err := ledger.Withdraw(accountId, "220.00"); err != nil {
+		t.Fatal(err)
+	}
+	history := ledger.GetHistory(accountId)
+	// spread the entries over consecutive days
+	start := time.Date(2026, 9, 1, 12, 0, 0, 0, time.UTC)
+	for i := range history {
+		history[i].Date = start.AddDate(0, 0, i)
+	}
+
+	minAmount := 20.0
+	maxAmount := 40.0
+	tests := []struct {
+		name     string
+		query    HistoryQuery
+		expected []float64
+		total    int
+	}{
+		{name: "everything", query: HistoryQuery{}, expected: []float64{10, 20, 30, 40, -220, -5}, total: 6},
+		{name: "date range", query: HistoryQuery{From: start.AddDate(0, 0, 1), To: start.AddDate(0, 0, 3)}, expected: []float64{20, 30}, total: 2},
+		{name: "type", query: HistoryQuery{Types: []TransactionType{WithdrawalTransaction, FeeTransaction}}, expected: []float64{-220, -5}, total: 2},
+		{name: "amount range", query: HistoryQuery{MinAmount: &minAmount, MaxAmount: &maxAmount}, expected: []float64{20, 30, 40}, total: 3},
+		{name: "descending", query: HistoryQuery{Descending: true, Limit: 2}, expected: []float64{-5, -220}, total: 6},
+		{name: "offset and limit", query: HistoryQuery{Offset: 1, Limit: 2}, expected: []float64{20, 30}, total: 6},
+		{name: "offset past the end", query: HistoryQuery{Offset: 10}, expected: nil, total: 6},
+	}
+	for _, test := range tests {
+		entries, total := ledger.QueryHistory(accountId, test.query)
+		if total != test.total {
+			t.Errorf("%s: expected a total of %d but got %d", test.name, test.total, total)
+		}
+		if len(entries) != len(test.expected) {
+			t.Errorf("%s: expected %d entries but got %d", test.name, len(test.expected), len(entries))
+			continue
+		}
+		for i, entry := range entries {
+			if entry.Amount != test.expected[i] {
+				t.Errorf("%s: entry %d expected %.2f but got %.2f", test.name, i, test.expected[i], entry.Amount)
+			}
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package internal
+
+import "time"
+
+// hostSessionLifetime is how long a terminal can send requests for an account after the bank host verified its PIN
+const hostSessionLifetime = 15 * time.Minute
+
+// BankHost is the bank's side of a transaction: it authorizes customers, keeps the account balances and
+// posts the transactions made at the terminals. Terminals keep track of the cash they hold themselves
+type BankHost interface {
+	// Authenticate checks a PIN block encrypted at the terminal's PIN pad, the PIN is only decrypted by the host
+	Authenticate(accountId string, pin PINBlock) (bool, error)
+	// SecondFactorRequired tells whether a one-time code is needed to log in or, when withdrawal is above zero,
+	// for a withdrawal of that amount
+	SecondFactorRequired(accountId string, withdrawal float64) (bool, error)
+	VerifyOneTimeCode(accountId string, code string) (bool, error)
+	Balance(accountId string) (AccountBalance, error)
+	Deposit(request DepositRequest) (*DepositResult, error)
+	Withdraw(request WithdrawalRequest) (*WithdrawResult, error)
+	// Advise posts a withdrawal the terminal approved in stand-in while it could not reach the host
+	Advise(advice WithdrawalAdvice) (*WithdrawResult, error)
+	// Reverse undoes all or part of a posted transaction, once for each reversal id from a terminal
+	Reverse(request ReversalRequest) (*ReversalResult, error)
+	History(accountId string, query HistoryQuery) ([]LedgerHistoryEntry, int, error)
+}
+
+// AccountBalance is the state of an account as reported by the bank host
+type AccountBalance struct {
+	Balance float64
+	// Available is the amount that may be withdrawn
+	Available float64
+	// Pending is deposited funds on hold
+	Pending float64
+}
+
+// DepositRequest is a deposit sent from a terminal to the bank host
+type DepositRequest struct {
+	TerminalId string
+	AccountId  string
+	// Amount as entered by the customer
+	Amount string
+	// Description overrides the default history description
+	Description string
+	// IdempotencyKey identifies the request so that one sent again returns the first outcome instead of posting again
+	IdempotencyKey string
+}
+
+// DepositResult is the posted deposit and the account's funds afterwards
+type DepositResult struct {
+	Entry     LedgerHistoryEntry
+	Available float64
+	Pending   float64
+	// Replayed is set when the deposit had already been posted for the request's idempotency key
+	Replayed bool
+}
+
+// WithdrawalRequest is a withdrawal sent from a terminal to the bank host
+type WithdrawalRequest struct {
+	TerminalId string
+	AccountId  string
+	// Amount as entered by the customer
+	Amount        string
+	AcceptPartial bool
+	// Dispensable is the most the terminal is able to dispense
+	Dispensable float64
+	// Description overrides the default history description
+	Description string
+	// IdempotencyKey identifies the request so that one sent again returns the first outcome instead of posting again
+	IdempotencyKey string
+}
+
+// LocalHost is a BankHost backed by a Ledger and Authorization in this process
+type LocalHost struct {
+	ledger *Ledger
+	auth   *Authorization
+}
+
+func NewLocalHost(ledger *Ledger, auth *Authorization) *LocalHost {
+	return &LocalHost{ledger: ledger, auth: auth}
+}
+
+func (host *LocalHost) Authenticate(accountId string, pin PINBlock) (bool, error) {
+	return host.auth.VerifyPINBlock(accountId, pin)
+}
+
+func (host *LocalHost) SecondFactorRequired(accountId string, withdrawal float64) (bool, error) {
+	if withdrawal > 0 {
+		return host.auth.RequiresSecondFactorForWithdrawal(accountId, withdrawal), nil
+	}
+	return host.auth.RequiresSecondFactorForLogin(accountId), nil
+}
+
+func (host *LocalHost) VerifyOneTimeCode(accountId string, code string) (bool, error) {
+	return host.auth.VerifyTOTP(accountId, code)
+}
+
+func (host *LocalHost) Balance(accountId string) (AccountBalance, error) {
+	return AccountBalance{
+		Balance:   host.ledger.GetBalance(accountId),
+		Available: host.ledger.GetAvailableBalance(accountId),
+		Pending:   host.ledger.GetPendingFunds(accountId),
+	}, nil
+}
+
+func (host *LocalHost) Deposit(request DepositRequest) (*DepositResult, error) {
+	return host.ledger.PostDeposit(request)
+}
+
+func (host *LocalHost) Withdraw(request WithdrawalRequest) (*WithdrawResult, error) {
+	return host.ledger.PostWithdrawal(request)
+}
+
+func (host *LocalHost) Advise(advice WithdrawalAdvice) (*WithdrawResult, error) {
+	return host.ledger.PostAdvice(advice)
+}
+
+func (host *LocalHost) Reverse(request ReversalRequest) (*ReversalResult, error) {
+	return host.ledger.PostReversal(request)
+}
+
+func (host *LocalHost) History(accountId string, query HistoryQuery) ([]LedgerHistoryEntry, int, error) {
+	entries, total := host.ledger.QueryHistory(accountId, query)
+	return entries, total, nil
+}
+
+// the bank host transactions are sent to, this process's ledger unless connected to a remote host
+var bankHost BankHost = NewLocalHost(ledger, authorization)
+
+func GetBankHost() BankHost {
+	return bankHost
+}
+
+// SetBankHost connects the terminal to a bank host, nil goes back to the local ledger
+func SetBankHost(host BankHost) {
+	if host == nil {
+		host = NewLocalHost(ledger, authorization)
+	}
+	bankHost = host
+}
+
+// IsRemoteHost tells whether transactions are being sent to a remote bank host
+func IsRemoteHost() bool {
+	_, local := bankHost.(*LocalHost)
+	return !local
+}
+
+// NewIdempotencyKey generates the key a terminal sends with every request it makes for one customer transaction
+func NewIdempotencyKey() string {
+	return newTransactionId()
+}
+
+// DepositFunds sends a deposit made at this terminal to the bank host. key is the customer transaction's idempotency key
+func DepositFunds(accountId string, amount string, key string) (*DepositResult, error) {
+	return bankHost.Deposit(DepositRequest{TerminalId: ledger.terminalId, AccountId: accountId, Amount: amount, IdempotencyKey: key})
+}
+
+// DepositNotes sends a cash deposit made at this terminal to the bank host. notes maps the note denomination to the number of notes
+// and key is the customer transaction's idempotency key
+func DepositNotes(accountId string, notes map[int]int, key string) (*DepositResult, error) {
+	request, err := cashDepositRequest(accountId, notes)
+	if err != nil {
+		return nil, err
+	}
+	request.TerminalId = ledger.terminalId
+	request.IdempotencyKey = key
+	return bankHost.Deposit(request)
+}
+
+// WithdrawCash sends a withdrawal to the bank host and takes the amount the host approves out of this terminal's cash.
+// key is the customer transaction's idempotency key, kept when the customer accepts a partial dispense and used as the
+// advice id when the withdrawal is approved offline.
+// The withdrawal is refused while the cash dispenser is out of service
+func WithdrawCash(accountId string, amount string, acceptPartial bool, key string) (*WithdrawResult, error) {
+	if err := dispenserReady(); err != nil {
+		return &WithdrawResult{}, err
+	}
+	request := WithdrawalRequest{TerminalId: ledger.terminalId, AccountId: accountId, Amount: amount,
+		AcceptPartial: acceptPartial, Dispensable: ledger.MaxDispensable(), IdempotencyKey: key}
+	result, err := bankHost.Withdraw(request)
+	if err != nil {
+		return result, err
+	}
+	if !result.Replayed {
+		ledger.availableCash = ledger.availableCash - result.AmountWithdrawn
+	}
+	return result, nil
+}
+
+// ReverseTransaction sends a reversal made at this terminal to the bank host. Cash from a withdrawal made at this
+// terminal that was not dispensed goes back into this terminal's cash
+func ReverseTransaction(request ReversalRequest) (*ReversalResult, error) {
+	request.TerminalId = ledger.terminalId
+	result, err := bankHost.Reverse(request)
+	if err != nil {
+		return result, err
+	}
+	if !result.Repeated && result.OriginalType == WithdrawalTransaction && result.OriginalTerminalId == ledger.terminalId {
+		ledger.availableCash = ledger.availableCash + result.AmountReversed
+	}
+	return result, nil
+}
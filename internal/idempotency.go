@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"fmt"
+	"time"
+)
+
+// DefaultIdempotencyWindow is how long the outcome of a request sent with an idempotency key is kept
+const DefaultIdempotencyWindow = 24 * time.Hour
+
+// idempotentOutcome is the result of a request sent with an idempotency key
+type idempotentOutcome struct {
+	// fingerprint describes the request so that a key sent again with a different request is refused
+	fingerprint string
+	result      any
+	expires     time.Time
+}
+
+// SetIdempotencyWindow sets how long the outcome of a request with an idempotency key is kept, the default window when zero
+func (ledger *Ledger) SetIdempotencyWindow(window time.Duration) {
+	ledger.idempotencyWindow = window
+}
+
+// replay returns the outcome stored for the account's idempotency key, if the key has been used within the window
+func (ledger *Ledger) replay(accountId string, key string, fingerprint string) (any, bool, error) {
+	ledger.expireOutcomes()
+	outcome, ok := ledger.outcomes[accountId+"/"+key]
+	if !ok {
+		return nil, false, nil
+	}
+	if outcome.fingerprint != fingerprint {
+		return nil, false, &IdempotencyKeyReusedError{Key: key}
+	}
+	Logger.Printf("replaying the outcome of %s for %s\n", key, accountId)
+	return outcome.result, true, nil
+}
+
+// remembered reports whether an outcome is stored for the account's idempotency key
+func (ledger *Ledger) remembered(accountId string, key string) bool {
+	if key == "" {
+		return false
+	}
+	ledger.expireOutcomes()
+	_, ok := ledger.outcomes[accountId+"/"+key]
+	return ok
+}
+
+// remember stores the outcome of a request sent with an idempotency key. Declined requests are not stored so they can be retried
+func (ledger *Ledger) remember(accountId string, key string, fingerprint string, result any) {
+	window := ledger.idempotencyWindow
+	if window == 0 {
+		window = DefaultIdempotencyWindow
+	}
+	if ledger.outcomes == nil {
+		ledger.outcomes = map[string]idempotentOutcome{}
+	}
+	ledger.outcomes[accountId+"/"+key] = idempotentOutcome{fingerprint: fingerprint, result: result, expires: clock.Now().Add(window)}
+}
+
+// expireOutcomes drops the outcomes whose window has passed
+func (ledger *Ledger) expireOutcomes() {
+	now := clock.Now()
+	for key, outcome := range ledger.outcomes {
+		if !now.Before(outcome.expires) {
+			delete(ledger.outcomes, key)
+		}
+	}
+}
+
+// depositFingerprint and withdrawalFingerprint leave out what may change when a request is retried, such as the cash the terminal holds
+func depositFingerprint(request DepositRequest) string {
+	return fmt.Sprintf("deposit %s %s %s %s", request.TerminalId, request.AccountId, request.Amount, request.Description)
+}
+
+func withdrawalFingerprint(request WithdrawalRequest) string {
+	return fmt.Sprintf("withdrawal %s %s %s %t %s", request.TerminalId, request.AccountId, request.Amount, request.AcceptPartial, request.Description)
+}
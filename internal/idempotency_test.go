@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdempotentWithdrawal(t *testing.T) {
+	InitLogger("", true)
+	fakeClock := NewFakeClock(time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC))
+	SetClock(fakeClock)
+	defer SetClock(nil)
+	testLedger := &Ledger{}
+	testLedger.SetInitialBalances(500, map[string]float64{account: 100.00})
+	testLedger.SetIdempotencyWindow(time.Hour)
+
+	request := WithdrawalRequest{AccountId: account, Amount: "60", Description: "cash withdrawal", IdempotencyKey: "K1"}
+	first, err := testLedger.withdraw(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the terminal timed out waiting for the answer and sends the withdrawal again
+	retried, err := testLedger.withdraw(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !retried.Replayed || first.Replayed || retried.TransactionId != first.TransactionId || retried.RemainingBalance != 40.00 {
+		t.Errorf("expected the first withdrawal to be returned got %+v", retried)
+	}
+	if balance, cash := testLedger.GetBalance(account), testLedger.GetAvailableCash(); balance != 40.00 || cash != 440 {
+		t.Errorf("expected the withdrawal to be posted once got balance %.2f cash %.2f", balance, cash)
+	}
+
+	request.Amount = "80"
+	if _, err := testLedger.withdraw(request); !errors.Is(err, &IdempotencyKeyReusedError{}) {
+		t.Errorf("expected a different request with the same key to be refused got %v", err)
+	}
+
+	fakeClock.Advance(time.Hour)
+	if again, err := testLedger.withdraw(request); err != nil || again.Replayed || again.TransactionId == first.TransactionId {
+		t.Errorf("expected the key to be forgotten after the window got %+v %v", again, err)
+	}
+}
+
+func TestIdempotentDeposit(t *testing.T) {
+	InitLogger("", true)
+	testLedger := &Ledger{}
+	testLedger.SetInitialBalances(0, map[string]float64{account: 100.00, "xy456": 0})
+	testLedger.SetHoldPolicy(HoldPolicy{ImmediatelyAvailable: 100, HoldDays: 2, DayLength: time.Hour})
+
+	request := DepositRequest{AccountId: account, Amount: "300", IdempotencyKey: "K1"}
+	first, err := testLedger.PostDeposit(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	retried, err := testLedger.PostDeposit(request)
+	if err != nil || !retried.Replayed || retried.Entry.Id != first.Entry.Id || retried.Available != 200.00 || retried.Pending != 200.00 {
+		t.Errorf("expected the first deposit to be returned got %+v %v", retried, err)
+	}
+	if balance, pending := testLedger.GetBalance(account), testLedger.GetPendingFunds(account); balance != 400.00 || pending != 200.00 {
+		t.Errorf("expected the deposit and its hold to be posted once got %.2f %.2f", balance, pending)
+	}
+	// the same key from another account is a different request
+	other, err := testLedger.PostDeposit(DepositRequest{AccountId: "xy456", Amount: "20", IdempotencyKey: "K1"})
+	if err != nil || other.Replayed {
+		t.Errorf("expected keys to be scoped by account got %+v %v", other, err)
+	}
+	// a declined deposit is not remembered so it can be corrected and sent again
+	if _, err := testLedger.PostDeposit(DepositRequest{AccountId: account, Amount: "abc", IdempotencyKey: "K2"}); err == nil {
+		t.Fatal("expected an invalid amount to be refused")
+	}
+	if result, err := testLedger.PostDeposit(DepositRequest{AccountId: account, Amount: "10", IdempotencyKey: "K2"}); err != nil || result.Replayed {
+		t.Errorf("expected the corrected deposit to be posted got %+v %v", result, err)
+	}
+}
+
+func TestAPIIdempotencyKey(t *testing.T) {
+	server := setUpAPIServer(t)
+	var login loginResponse
+	if status := apiCall(t, server, http.MethodPost, "/v1/sessions", "", `{"account_id":"jc123","pin":"1234"}`, &login); status != http.StatusCreated {
+		t.Fatalf("login failed with %d", status)
+	}
+	defer GetSessionManager().End(login.Token, SessionLoggedOut)
+	post := func(path string, key string, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		request.Header.Set("Authorization", "Bearer "+login.Token)
+		request.Header.Set("Idempotency-Key", key)
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	first := post("/v1/withdrawals", "W1", `{"amount":"40"}`)
+	retried := post("/v1/withdrawals", "W1", `{"amount":"40"}`)
+	if first.Code != http.StatusCreated || retried.Code != http.StatusCreated || first.Body.String() != retried.Body.String() {
+		t.Errorf("expected the same response got %d %s and %d %s", first.Code, first.Body, retried.Code, retried.Body)
+	}
+	if first.Header().Get("Idempotent-Replayed") != "" || retried.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("expected only the retried response to be marked as replayed")
+	}
+	if balance := GetLedgerService().GetBalance("jc123"); balance != 60.00 {
+		t.Errorf("expected the withdrawal to be posted once got %.2f", balance)
+	}
+
+	reused := post("/v1/deposits", "W1", `{"amount":"40.00"}`)
+	var failure apiError
+	if err := json.Unmarshal(reused.Body.Bytes(), &failure); err != nil || reused.Code != http.StatusUnprocessableEntity ||
+		failure.Error.Code != "idempotency_key_reused" {
+		t.Errorf("expected the reused key to be refused got %d %s", reused.Code, reused.Body)
+	}
+	deposit := post("/v1/deposits", "D1", `{"amount":"40.00"}`)
+	if again := post("/v1/deposits", "D1", `{"amount":"40.00"}`); deposit.Code != http.StatusCreated || again.Body.String() != deposit.Body.String() {
+		t.Errorf("expected the same deposit response got %s and %s", deposit.Body, again.Body)
+	}
+	if balance := GetLedgerService().GetBalance("jc123"); balance != 100.00 {
+		t.Errorf("expected the deposit to be posted once got %.2f", balance)
+	}
+}
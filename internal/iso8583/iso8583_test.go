@@ -0,0 +1,135 @@
+package iso8583
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestPackUnpack(t *testing.T) {
+	spec := DefaultSpec()
+	message := NewMessage(FinancialRequest).Set(3, "010000").Set(4, "6000").Set(11, "000123").Set(41, "ATM1").
+		Set(48, "dispensable=100.00").Set(52, "\x14\x12\x34\xff\x00\x01\x02\x03").Set(102, "jc123")
+	packed, err := message.Pack(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(packed, []byte("0200")) {
+		t.Errorf("expected the MTI first got %q", packed[:4])
+	}
+	// bit 1 marks the secondary bitmap, needed for field 102
+	if got := hex.EncodeToString(packed[4:20]); got != "b020000000811000"+"0000000004000000" {
+		t.Errorf("unexpected bitmaps %s", got)
+	}
+	if !bytes.Contains(packed, []byte("000000006000000123ATM1    018dispensable=100.00")) {
+		t.Errorf("expected padded fixed fields and a length prefixed field in %q", packed)
+	}
+
+	unpacked, err := Unpack(spec, packed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unpacked.MTI != FinancialRequest {
+		t.Errorf("expected MTI 0200 got %s", unpacked.MTI)
+	}
+	expected := map[int]string{3: "010000", 4: "000000006000", 11: "000123", 41: "ATM1    ", 48: "dispensable=100.00",
+		52: "\x14\x12\x34\xff\x00\x01\x02\x03", 102: "jc123"}
+	if len(unpacked.Fields()) != len(expected) {
+		t.Errorf("expected fields %v got %v", expected, unpacked.Fields())
+	}
+	for field, value := range expected {
+		if unpacked.Get(field) != value {
+			t.Errorf("field %d: expected %q got %q", field, value, unpacked.Get(field))
+		}
+	}
+}
+
+func TestPackErrors(t *testing.T) {
+	spec := DefaultSpec()
+	tests := []struct {
+		message  *Message
+		expected string
+	}{
+		{NewMessage("02x0"), "invalid MTI"},
+		{NewMessage(FinancialRequest).Set(4, "12.50"), "field 4: invalid character '.'"},
+		{NewMessage(FinancialRequest).Set(39, "000"), "field 39: value is longer than 2"},
+		{NewMessage(FinancialRequest).Set(52, strings.Repeat("\x00", 17)), "field 52: value is longer than 16"},
+		{NewMessage(FinancialRequest).Set(5, "1"), "field 5 is not in the spec"},
+		{NewMessage(FinancialRequest).Set(1, "1"), "invalid field number 1"},
+	}
+	for _, test := range tests {
+		if _, err := test.message.Pack(spec); err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("expected %q got %v", test.expected, err)
+		}
+	}
+	// ISO 8583:1987 has fixed length 8 byte PIN data
+	spec.Fields[52] = FieldSpec{Type: Binary, Length: 8}
+	if _, err := NewMessage(FinancialRequest).Set(52, "1234").Pack(spec); err == nil || !strings.Contains(err.Error(), "field 52: binary value must be 8 bytes") {
+		t.Errorf("expected a short fixed length binary value to be rejected got %v", err)
+	}
+}
+
+func TestUnpackErrors(t *testing.T) {
+	spec := DefaultSpec()
+	packed, err := NewMessage(NetworkManagementRequest).Set(11, "000001").Set(70, "301").Pack(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Unpack(spec, packed[:len(packed)-1]); err == nil || !strings.Contains(err.Error(), "field 70: message too short") {
+		t.Errorf("expected a truncated message to be rejected got %v", err)
+	}
+	if _, err := Unpack(spec, append(packed, '0')); err == nil || !strings.Contains(err.Error(), "1 unexpected bytes") {
+		t.Errorf("expected trailing bytes to be rejected got %v", err)
+	}
+	if _, err := Unpack(&Spec{Fields: map[int]FieldSpec{11: spec.Fields[11]}}, packed); err == nil || !strings.Contains(err.Error(), "field 70 is not in the spec") {
+		t.Errorf("expected an unknown field to be rejected got %v", err)
+	}
+}
+
+func TestLoadSpec(t *testing.T) {
+	spec, err := LoadSpec(strings.NewReader(`{"41": {"type": "ans", "length": 16, "prefix": 2}, "125": {"type": "b", "length": 4}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if field := spec.Fields[41]; field.Length != 16 || field.Prefix != 2 {
+		t.Errorf("expected field 41 to be replaced got %+v", field)
+	}
+	if _, ok := spec.Fields[125]; !ok {
+		t.Error("expected field 125 to be added")
+	}
+	if _, ok := spec.Fields[4]; !ok {
+		t.Error("expected the default fields to be kept")
+	}
+	packed, err := NewMessage(AuthorizationRequest).Set(41, "TERMINAL-0000001").Pack(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(packed, []byte("16TERMINAL-0000001")) {
+		t.Errorf("expected the loaded spec to be used got %q", packed)
+	}
+
+	for _, invalid := range []string{`{"1": {"type": "n", "length": 2}}`, `{"4": {"type": "x", "length": 2}}`,
+		`{"4": {"type": "n", "length": 200, "prefix": 2}}`, `{"4": {"type": "n", "length": 2, "prefix": 1}}`, `[]`} {
+		if _, err := LoadSpec(strings.NewReader(invalid)); err == nil {
+			t.Errorf("expected %s to be rejected", invalid)
+		}
+	}
+}
+
+func TestFrames(t *testing.T) {
+	var buffer bytes.Buffer
+	if err := WriteFrame(&buffer, []byte("0800")); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buffer.Bytes(), []byte{0, 4, '0', '8', '0', '0'}) {
+		t.Errorf("unexpected frame %v", buffer.Bytes())
+	}
+	frame, err := ReadFrame(&buffer)
+	if err != nil || string(frame) != "0800" {
+		t.Errorf("expected 0800 got %q %v", frame, err)
+	}
+	if ResponseMTI(ReversalRequest) != ReversalResponse {
+		t.Errorf("expected the response to 0400 to be 0410")
+	}
+}
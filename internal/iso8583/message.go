@@ -0,0 +1,247 @@
+package iso8583
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// message type indicators used between the terminal and the host
+const (
+	AuthorizationRequest         = "0100"
+	AuthorizationResponse        = "0110"
+	FinancialRequest             = "0200"
+	FinancialResponse            = "0210"
+	FinancialAdvice              = "0220"
+	FinancialAdviceResponse      = "0230"
+	ReversalRequest              = "0400"
+	ReversalResponse             = "0410"
+	NetworkManagementRequest     = "0800"
+	NetworkManagementResponse    = "0810"
+	maxFrameLength               = 0xffff
+	bitmapLength                 = 8
+	secondaryBitmapPresentMarker = 0x80
+)
+
+// Message is an ISO 8583 message: its message type indicator and the values of its fields.
+// Binary fields hold their raw bytes
+type Message struct {
+	MTI    string
+	fields map[int]string
+}
+
+// NewMessage creates an empty message of the given type
+func NewMessage(mti string) *Message {
+	return &Message{MTI: mti, fields: map[int]string{}}
+}
+
+// Set sets a field's value
+func (m *Message) Set(field int, value string) *Message {
+	m.fields[field] = value
+	return m
+}
+
+// Get returns a field's value, empty if it is not present
+func (m *Message) Get(field int) string {
+	return m.fields[field]
+}
+
+// Has tells whether a field is present
+func (m *Message) Has(field int) bool {
+	_, ok := m.fields[field]
+	return ok
+}
+
+// Fields returns the numbers of the fields present, in order
+func (m *Message) Fields() []int {
+	var numbers []int
+	for number := range m.fields {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+	return numbers
+}
+
+// ResponseMTI returns the message type of the response to a request, e.g. 0210 for 0200
+func ResponseMTI(mti string) string {
+	if len(mti) != 4 {
+		return mti
+	}
+	function, err := strconv.Atoi(mti[2:3])
+	if err != nil {
+		return mti
+	}
+	return mti[:2] + strconv.Itoa(function+1) + mti[3:]
+}
+
+// Pack encodes the message using the spec
+func (m *Message) Pack(spec *Spec) ([]byte, error) {
+	if len(m.MTI) != 4 || !isDigits(m.MTI) {
+		return nil, fmt.Errorf("invalid MTI \"%s\"", m.MTI)
+	}
+	bitmap := make([]byte, bitmapLength)
+	var body []byte
+	for _, number := range m.Fields() {
+		if number < 2 || number > 128 {
+			return nil, fmt.Errorf("invalid field number %d", number)
+		}
+		field, ok := spec.Fields[number]
+		if !ok {
+			return nil, fmt.Errorf("field %d is not in the spec", number)
+		}
+		encoded, err := field.encode(m.fields[number])
+		if err != nil {
+			return nil, fmt.Errorf("field %d: %w", number, err)
+		}
+		if number > 64 && len(bitmap) == bitmapLength {
+			bitmap = append(bitmap, make([]byte, bitmapLength)...)
+			bitmap[0] |= secondaryBitmapPresentMarker
+		}
+		bitmap[(number-1)/8] |= 0x80 >> ((number - 1) % 8)
+		body = append(body, encoded...)
+	}
+	packed := append([]byte(m.MTI), bitmap...)
+	return append(packed, body...), nil
+}
+
+// Unpack decodes a message using the spec
+func Unpack(spec *Spec, data []byte) (*Message, error) {
+	if len(data) < 4+bitmapLength {
+		return nil, fmt.Errorf("message too short")
+	}
+	message := NewMessage(string(data[:4]))
+	if !isDigits(message.MTI) {
+		return nil, fmt.Errorf("invalid MTI \"%s\"", message.MTI)
+	}
+	bitmap := data[4 : 4+bitmapLength]
+	position := 4 + bitmapLength
+	if bitmap[0]&secondaryBitmapPresentMarker != 0 {
+		if len(data) < position+bitmapLength {
+			return nil, fmt.Errorf("message too short for the secondary bitmap")
+		}
+		bitmap = data[4 : 4+2*bitmapLength]
+		position += bitmapLength
+	}
+	for number := 2; number <= len(bitmap)*8; number++ {
+		if bitmap[(number-1)/8]&(0x80>>((number-1)%8)) == 0 {
+			continue
+		}
+		field, ok := spec.Fields[number]
+		if !ok {
+			return nil, fmt.Errorf("field %d is not in the spec", number)
+		}
+		value, read, err := field.decode(data[position:])
+		if err != nil {
+			return nil, fmt.Errorf("field %d: %w", number, err)
+		}
+		message.fields[number] = value
+		position += read
+	}
+	if position != len(data) {
+		return nil, fmt.Errorf("%d unexpected bytes after the last field", len(data)-position)
+	}
+	return message, nil
+}
+
+func (field FieldSpec) encode(value string) ([]byte, error) {
+	if err := field.checkCharacters(value); err != nil {
+		return nil, err
+	}
+	if len(value) > field.Length {
+		return nil, fmt.Errorf("value is longer than %d", field.Length)
+	}
+	if field.Prefix > 0 {
+		return []byte(fmt.Sprintf("%0*d%s", field.Prefix, len(value), value)), nil
+	}
+	switch {
+	case len(value) == field.Length:
+		return []byte(value), nil
+	case field.Type == Numeric:
+		return []byte(strings.Repeat("0", field.Length-len(value)) + value), nil
+	case field.Type == Binary:
+		return nil, fmt.Errorf("binary value must be %d bytes", field.Length)
+	default:
+		return []byte(value + strings.Repeat(" ", field.Length-len(value))), nil
+	}
+}
+
+func (field FieldSpec) decode(data []byte) (string, int, error) {
+	length, read := field.Length, 0
+	if field.Prefix > 0 {
+		if len(data) < field.Prefix || !isDigits(string(data[:field.Prefix])) {
+			return "", 0, fmt.Errorf("invalid length prefix")
+		}
+		length, _ = strconv.Atoi(string(data[:field.Prefix]))
+		read = field.Prefix
+		if length > field.Length {
+			return "", 0, fmt.Errorf("length %d is longer than %d", length, field.Length)
+		}
+	}
+	if len(data) < read+length {
+		return "", 0, fmt.Errorf("message too short")
+	}
+	value := string(data[read : read+length])
+	if err := field.checkCharacters(value); err != nil {
+		return "", 0, err
+	}
+	return value, read + length, nil
+}
+
+func (field FieldSpec) checkCharacters(value string) error {
+	for _, c := range []byte(value) {
+		var ok bool
+		switch field.Type {
+		case Numeric:
+			ok = c >= '0' && c <= '9'
+		case Alpha:
+			ok = c == ' ' || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')
+		case AlphaNumeric:
+			ok = c == ' ' || (c >= '0' && c <= '9') || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')
+		case AlphaNumericSpecial:
+			ok = c >= ' ' && c <= '~'
+		case Binary:
+			ok = true
+		}
+		if !ok {
+			return fmt.Errorf("invalid character %q for a %s field", c, field.Type)
+		}
+	}
+	return nil
+}
+
+func isDigits(value string) bool {
+	for _, c := range value {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return value != ""
+}
+
+// WriteFrame writes a packed message preceded by its length as two bytes, big endian
+func WriteFrame(w io.Writer, packed []byte) error {
+	if len(packed) > maxFrameLength {
+		return fmt.Errorf("message of %d bytes is too long", len(packed))
+	}
+	frame := make([]byte, 2+len(packed))
+	binary.BigEndian.PutUint16(frame, uint16(len(packed)))
+	copy(frame[2:], packed)
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadFrame reads a packed message written by WriteFrame
+func ReadFrame(r io.Reader) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	packed := make([]byte, binary.BigEndian.Uint16(header))
+	if _, err := io.ReadFull(r, packed); err != nil {
+		return nil, err
+	}
+	return packed, nil
+}
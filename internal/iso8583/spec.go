@@ -0,0 +1,117 @@
+// Package iso8583 encodes and decodes ISO 8583 messages with ASCII MTIs and lengths and binary bitmaps
+package iso8583
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// FieldType is the kind of data a field holds
+type FieldType string
+
+const (
+	// Numeric fields hold digits and are padded with leading zeros
+	Numeric FieldType = "n"
+	// Alpha fields hold letters and are padded with trailing spaces
+	Alpha FieldType = "a"
+	// AlphaNumeric fields hold letters and digits and are padded with trailing spaces
+	AlphaNumeric FieldType = "an"
+	// AlphaNumericSpecial fields hold any printable characters and are padded with trailing spaces
+	AlphaNumericSpecial FieldType = "ans"
+	// Binary fields hold raw bytes, their length is in bytes
+	Binary FieldType = "b"
+)
+
+// FieldSpec describes how a field is encoded
+type FieldSpec struct {
+	Type FieldType `json:"type"`
+	// Length is the length of a fixed field or the maximum length of a variable one
+	Length int `json:"length"`
+	// Prefix is the number of digits in the length of a variable field: 2 for LLVAR, 3 for LLLVAR, 0 for a fixed field
+	Prefix      int    `json:"prefix,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// Spec maps the field numbers, 2 to 128, to how they are encoded
+type Spec struct {
+	Fields map[int]FieldSpec
+}
+
+// DefaultSpec has the ISO 8583:1987 fields used between the terminal and the host
+func DefaultSpec() *Spec {
+	return &Spec{Fields: map[int]FieldSpec{
+		2:   {Type: Numeric, Length: 19, Prefix: 2, Description: "primary account number"},
+		3:   {Type: Numeric, Length: 6, Description: "processing code"},
+		4:   {Type: Numeric, Length: 12, Description: "transaction amount"},
+		7:   {Type: Numeric, Length: 10, Description: "transmission date and time MMDDhhmmss"},
+		11:  {Type: Numeric, Length: 6, Description: "system trace audit number"},
+		12:  {Type: Numeric, Length: 6, Description: "local transaction time hhmmss"},
+		13:  {Type: Numeric, Length: 4, Description: "local transaction date MMDD"},
+		32:  {Type: Numeric, Length: 11, Prefix: 2, Description: "acquiring institution id"},
+		37:  {Type: AlphaNumeric, Length: 12, Description: "retrieval reference number"},
+		38:  {Type: AlphaNumeric, Length: 6, Description: "authorization id response"},
+		39:  {Type: AlphaNumeric, Length: 2, Description: "response code"},
+		41:  {Type: AlphaNumericSpecial, Length: 8, Description: "card acceptor terminal id"},
+		44:  {Type: AlphaNumericSpecial, Length: 25, Prefix: 2, Description: "additional response data"},
+		48:  {Type: AlphaNumericSpecial, Length: 999, Prefix: 3, Description: "additional data - private"},
+		49:  {Type: Numeric, Length: 3, Description: "transaction currency code"},
+		52:  {Type: Binary, Length: 16, Prefix: 2, Description: "PIN data, 8 byte TDES or 16 byte AES PIN blocks"},
+		53:  {Type: Binary, Length: 48, Prefix: 2, Description: "security related control information"},
+		54:  {Type: AlphaNumeric, Length: 120, Prefix: 3, Description: "additional amounts"},
+		70:  {Type: Numeric, Length: 3, Description: "network management information code"},
+		90:  {Type: Numeric, Length: 42, Description: "original data elements"},
+		102: {Type: AlphaNumericSpecial, Length: 28, Prefix: 2, Description: "account identification 1"},
+	}}
+}
+
+// LoadSpec reads a field spec in JSON, a map of field number to field spec such as
+//
+//	{"4": {"type": "n", "length": 12}, "102": {"type": "ans", "length": 28, "prefix": 2}}
+//
+// The fields read replace those in the default spec
+func LoadSpec(r io.Reader) (*Spec, error) {
+	var fields map[string]FieldSpec
+	if err := json.NewDecoder(r).Decode(&fields); err != nil {
+		return nil, fmt.Errorf("invalid ISO 8583 spec: %w", err)
+	}
+	spec := DefaultSpec()
+	for name, field := range fields {
+		number, err := strconv.Atoi(name)
+		if err != nil || number < 2 || number > 128 {
+			return nil, fmt.Errorf("invalid ISO 8583 field number \"%s\"", name)
+		}
+		if err := field.validate(); err != nil {
+			return nil, fmt.Errorf("field %d: %w", number, err)
+		}
+		spec.Fields[number] = field
+	}
+	return spec, nil
+}
+
+// LoadSpecFile reads a field spec from a JSON file, see LoadSpec
+func LoadSpecFile(path string) (*Spec, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return LoadSpec(file)
+}
+
+func (field FieldSpec) validate() error {
+	switch field.Type {
+	case Numeric, Alpha, AlphaNumeric, AlphaNumericSpecial, Binary:
+	default:
+		return fmt.Errorf("unknown field type \"%s\"", field.Type)
+	}
+	if field.Prefix != 0 && field.Prefix != 2 && field.Prefix != 3 {
+		return fmt.Errorf("the length prefix must be 0, 2 or 3 digits")
+	}
+	if field.Length <= 0 || (field.Prefix == 2 && field.Length > 99) || (field.Prefix == 3 && field.Length > 999) {
+		return fmt.Errorf("invalid length %d", field.Length)
+	}
+	return nil
+}
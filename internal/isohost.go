@@ -0,0 +1,1035 @@
+package internal
+
+import (
+	"agile-coder.com/atm-sim/internal/iso8583"
+	"agile-coder.com/atm-sim/internal/pinblock"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ISO 8583 processing codes, the transaction type followed by the from and to account types
+const (
+	isoWithdrawal     = "010000"
+	isoDeposit        = "210000"
+	isoPinVerify      = "300000"
+	isoBalanceInquiry = "310000"
+	// private use codes asking whether a one-time code is needed and verifying one
+	isoSecondFactorInquiry = "900000"
+	isoOneTimeCode         = "910000"
+)
+
+// ISO 8583 network management information codes
+const (
+	isoSignOn   = "001"
+	isoSignOff  = "002"
+	isoEchoTest = "301"
+)
+
+// ISO 8583 response codes. The reason for a decline is carried in the private data, field 48,
+// using the same codes as the gRPC bank host
+const (
+	isoApproved            = "00"
+	isoPartialApproval     = "10"
+	isoInvalidTransaction  = "12"
+	isoInvalidAmount       = "13"
+	isoOriginalNotFound    = "25"
+	isoInsufficientFunds   = "51"
+	isoIncorrectPin        = "55"
+	isoExceedsAmountLimit  = "61"
+	isoSecurityViolation   = "63"
+	isoIssuerUnavailable   = "91"
+	isoDuplicateAdvice     = "94"
+	isoSystemMalfunction   = "96"
+	isoCurrencyUSD         = "840"
+	isoAcquirerId          = "00000000001"
+	isoLedgerBalance       = "01"
+	isoAvailableBalance    = "02"
+	isoPendingAmount       = "90"
+	isoAdditionalAmountLen = 20
+)
+
+// ISOHostServer is a bank host for terminals that send ISO 8583 messages over TCP, backed by a Ledger.
+// Each message is framed by its length, see iso8583.WriteFrame
+type ISOHostServer struct {
+	ledger *Ledger
+	auth   *Authorization
+	spec   *iso8583.Spec
+	// the ledger is not safe for concurrent use so messages are handled one at a time
+	lock sync.Mutex
+	// map of terminal id and original data elements to the withdrawals posted, so they can be reversed
+	withdrawals map[string]*postedWithdrawal
+	// map of session token to the account whose PIN was verified
+	sessions map[string]*isoSession
+	// the terminal each PIN pad key is used by
+	keys pinPadKeys
+}
+
+// isoSession lets a terminal send requests for an account without the PIN block until it expires
+type isoSession struct {
+	accountId string
+	expires   time.Time
+	// set until the one-time code the account needs to log in has been given
+	awaitingCode bool
+	// set when a one-time code has been given for the next withdrawal over the threshold
+	codeVerified bool
+	// the idempotency key of the withdrawal that used the code, which may be sent again
+	codeUsedBy string
+}
+
+type postedWithdrawal struct {
+	accountId     string
+	transactionId string
+}
+
+// NewISOHostServer creates an ISO 8583 host for the accounts in ledger and auth, using the default field spec when spec is nil
+func NewISOHostServer(ledger *Ledger, auth *Authorization, spec *iso8583.Spec) *ISOHostServer {
+	if spec == nil {
+		spec = iso8583.DefaultSpec()
+	}
+	return &ISOHostServer{ledger: ledger, auth: auth, spec: spec, withdrawals: map[string]*postedWithdrawal{}, sessions: map[string]*isoSession{}}
+}
+
+// Serve handles the terminals connecting to listener until it is closed
+func (server *ISOHostServer) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go server.serveConn(conn)
+	}
+}
+
+func (server *ISOHostServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packed, err := iso8583.ReadFrame(conn)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				Logger.Printf("ISO 8583 connection from %s closed: %+v\n", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		request, err := iso8583.Unpack(server.spec, packed)
+		if err != nil {
+			Logger.Printf("invalid ISO 8583 message from %s: %+v\n", conn.RemoteAddr(), err)
+			return
+		}
+		response, err := server.handle(request).Pack(server.spec)
+		if err == nil {
+			err = iso8583.WriteFrame(conn, response)
+		}
+		if err != nil {
+			Logger.Printf("unable to respond to %s: %+v\n", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// handle answers a request, echoing the fields that identify it
+func (server *ISOHostServer) handle(request *iso8583.Message) *iso8583.Message {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	response := iso8583.NewMessage(iso8583.ResponseMTI(request.MTI))
+	for _, field := range []int{2, 3, 4, 7, 11, 12, 13, 32, 41, 49, 70, 90, 102} {
+		if request.Has(field) {
+			response.Set(field, request.Get(field))
+		}
+	}
+	accountId := request.Get(102)
+	switch {
+	case request.MTI == iso8583.NetworkManagementRequest:
+		Logger.Printf("ISO 8583 network management %s from %s\n", request.Get(70), request.Get(41))
+		response.Set(39, isoApproved)
+	case request.MTI == iso8583.AuthorizationRequest && request.Get(3) == isoPinVerify:
+		if server.verifyPin(request, response) {
+			server.startSession(accountId, response)
+		}
+	case request.MTI == iso8583.AuthorizationRequest && request.Get(3) == isoSecondFactorInquiry:
+		if server.session(request, response) != nil {
+			server.secondFactorInquiry(request, response)
+		}
+	case request.MTI == iso8583.AuthorizationRequest && request.Get(3) == isoOneTimeCode:
+		if session := server.session(request, response); session != nil {
+			server.verifyOneTimeCode(session, request, response)
+		}
+	case request.MTI == iso8583.AuthorizationRequest && request.Get(3) == isoBalanceInquiry:
+		if server.authorized(request, response) == nil {
+			return response
+		}
+		response.Set(54, formatAdditionalAmounts(AccountBalance{Balance: server.ledger.GetBalance(accountId),
+			Available: server.ledger.GetAvailableBalance(accountId), Pending: server.ledger.GetPendingFunds(accountId)}))
+	case request.MTI == iso8583.FinancialRequest && request.Get(3) == isoWithdrawal:
+		if session := server.authorized(request, response); session != nil {
+			server.withdraw(session, request, response)
+		}
+	case request.MTI == iso8583.FinancialRequest && request.Get(3) == isoDeposit:
+		if server.authorized(request, response) != nil {
+			server.deposit(request, response)
+		}
+	case request.MTI == iso8583.FinancialAdvice && request.Get(3) == isoWithdrawal:
+		server.advise(request, response)
+	case request.MTI == iso8583.ReversalRequest && !request.Has(90) && request.Has(37):
+		server.reverseTransaction(request, response)
+	case request.MTI == iso8583.ReversalRequest:
+		server.reverse(request, response)
+	default:
+		setISOError(response, &InvalidInputError{fmt.Sprintf("unsupported message %s with processing code %s", request.MTI, request.Get(3))})
+	}
+	return response
+}
+
+// verifyPin checks the PIN block, declining the request if there is none or the PIN is wrong
+func (server *ISOHostServer) verifyPin(request *iso8583.Message, response *iso8583.Message) bool {
+	if !request.Has(52) {
+		setISOError(response, &InvalidInputError{"the PIN block is required"})
+		return false
+	}
+	pin := fromISOPINData(request)
+	if err := server.keys.check(strings.TrimSpace(request.Get(41)), pin); err != nil {
+		setISOError(response, err)
+		return false
+	}
+	ok, err := server.auth.VerifyPINBlock(request.Get(102), pin)
+	if err != nil {
+		setISOError(response, err)
+		return false
+	}
+	if !ok {
+		response.Set(39, isoIncorrectPin)
+		return false
+	}
+	response.Set(39, isoApproved)
+	return true
+}
+
+// startSession returns a session token in the private data, which the terminal sends instead of the PIN block
+// with the account's requests until the session expires. An account that must give a one-time code to log in
+// can not use the session until it has been given
+func (server *ISOHostServer) startSession(accountId string, response *iso8583.Message) {
+	now := clock.Now()
+	for token, session := range server.sessions {
+		if !now.Before(session.expires) {
+			delete(server.sessions, token)
+		}
+	}
+	token := newSessionId()
+	server.sessions[token] = &isoSession{accountId: accountId, expires: now.Add(hostSessionLifetime),
+		awaitingCode: server.auth.RequiresSecondFactorForLogin(accountId)}
+	response.Set(48, url.Values{"session": {token}}.Encode())
+}
+
+// session returns the session named by the token in a request's private data, declining the request unless
+// the session is for the account and has not expired
+func (server *ISOHostServer) session(request *iso8583.Message, response *iso8583.Message) *isoSession {
+	data, _ := url.ParseQuery(request.Get(48))
+	session, ok := server.sessions[data.Get("session")]
+	if ok && session.accountId == request.Get(102) && clock.Now().Before(session.expires) {
+		response.Set(39, isoApproved)
+		return session
+	}
+	Logger.Printf("ISO 8583 %s %s for %s from %s without a verified PIN\n", request.MTI, request.Get(3), request.Get(102), request.Get(41))
+	response.Set(39, isoSecurityViolation)
+	response.Set(48, url.Values{"message": {"the PIN has not been verified"}}.Encode())
+	return nil
+}
+
+// authorized checks that a request carries the account's PIN block or the token of a session started for the account,
+// declining it when it has neither or the customer has not given the one-time code needed to log in.
+// A request authorized by its PIN block gets a session of its own, without a one-time code
+func (server *ISOHostServer) authorized(request *iso8583.Message, response *iso8583.Message) *isoSession {
+	if request.Has(52) {
+		if !server.verifyPin(request, response) {
+			return nil
+		}
+		session := &isoSession{accountId: request.Get(102), awaitingCode: server.auth.RequiresSecondFactorForLogin(request.Get(102))}
+		if session.awaitingCode {
+			setISOError(response, &OneTimeCodeRequiredError{})
+			return nil
+		}
+		return session
+	}
+	session := server.session(request, response)
+	if session != nil && session.awaitingCode {
+		setISOError(response, &OneTimeCodeRequiredError{})
+		return nil
+	}
+	return session
+}
+
+// secondFactorInquiry answers whether the account must give a one-time code to withdraw the amount,
+// or to log in when there is no amount
+func (server *ISOHostServer) secondFactorInquiry(request *iso8583.Message, response *iso8583.Message) {
+	amount, err := fromISOAmount(request.Get(4))
+	if err != nil {
+		setISOError(response, err)
+		return
+	}
+	accountId := request.Get(102)
+	required := server.auth.RequiresSecondFactorForLogin(accountId)
+	if amount > 0 {
+		required = server.auth.RequiresSecondFactorForWithdrawal(accountId, amount)
+	}
+	response.Set(48, url.Values{"required": {strconv.FormatBool(required)}}.Encode())
+}
+
+// verifyOneTimeCode checks the one-time code in the private data. A code completes the login when one is needed
+// for it, otherwise it is for the next withdrawal over the threshold
+func (server *ISOHostServer) verifyOneTimeCode(session *isoSession, request *iso8583.Message, response *iso8583.Message) {
+	data, _ := url.ParseQuery(request.Get(48))
+	ok, err := server.auth.VerifyTOTP(request.Get(102), data.Get("code"))
+	if err != nil {
+		setISOError(response, err)
+		return
+	}
+	if ok && session.awaitingCode {
+		session.awaitingCode = false
+	} else if ok {
+		session.codeVerified = true
+	}
+	response.Set(48, url.Values{"valid": {strconv.FormatBool(ok)}}.Encode())
+}
+
+// withdraw posts a withdrawal, those over the threshold using up a one-time code given in the session unless one is sent again
+func (server *ISOHostServer) withdraw(session *isoSession, request *iso8583.Message, response *iso8583.Message) {
+	amount, err := fromISOAmount(request.Get(4))
+	if err != nil {
+		setISOError(response, err)
+		return
+	}
+	data, _ := url.ParseQuery(request.Get(48))
+	key := data.Get("idempotency_key")
+	codeNeeded := server.auth.RequiresSecondFactorForWithdrawal(request.Get(102), amount)
+	resent := key != "" && key == session.codeUsedBy
+	if codeNeeded && !session.codeVerified && !resent {
+		Logger.Printf("ISO 8583 withdrawal of %.2f for %s declined without a one-time code\n", amount, request.Get(102))
+		setISOError(response, &OneTimeCodeRequiredError{})
+		return
+	}
+	dispensable, _ := strconv.ParseFloat(data.Get("dispensable"), 64)
+	terminalId := strings.TrimSpace(request.Get(41))
+	result, err := server.ledger.PostWithdrawal(WithdrawalRequest{TerminalId: terminalId, AccountId: request.Get(102),
+		Amount: fmt.Sprintf("%.2f", amount), AcceptPartial: data.Get("accept_partial") == "true", Dispensable: dispensable,
+		Description: data.Get("description"), IdempotencyKey: key})
+	if err != nil {
+		setISOError(response, err)
+		return
+	}
+	if codeNeeded && !resent {
+		session.codeVerified, session.codeUsedBy = false, key
+	}
+	server.withdrawals[isoOriginalKey(terminalId, request.MTI+request.Get(11)+request.Get(7))] = &postedWithdrawal{
+		accountId: request.Get(102), transactionId: result.TransactionId}
+	response.Set(39, isoApproved)
+	if result.WasPartial {
+		response.Set(39, isoPartialApproval)
+	}
+	response.Set(4, toISOAmount(result.AmountWithdrawn))
+	response.Set(37, result.TransactionId)
+	response.Set(38, result.TransactionId[len(result.TransactionId)-6:])
+	response.Set(54, formatAdditionalAmounts(AccountBalance{Balance: result.RemainingBalance,
+		Available: server.ledger.GetAvailableBalance(request.Get(102)), Pending: server.ledger.GetPendingFunds(request.Get(102))}))
+	setWithdrawalData(response, result)
+}
+
+// setWithdrawalData adds the overdraft fee charged and whether the withdrawal was replayed to the response
+func setWithdrawalData(response *iso8583.Message, result *WithdrawResult) {
+	data := url.Values{}
+	if result.FeeTransactionId != "" {
+		data.Set("fee_id", result.FeeTransactionId)
+		data.Set("overdrawn", "true")
+	}
+	if result.Replayed {
+		data.Set("replayed", "true")
+	}
+	if len(data) > 0 {
+		response.Set(48, data.Encode())
+	}
+}
+
+func (server *ISOHostServer) deposit(request *iso8583.Message, response *iso8583.Message) {
+	amount, err := fromISOAmount(request.Get(4))
+	if err != nil {
+		setISOError(response, err)
+		return
+	}
+	data, _ := url.ParseQuery(request.Get(48))
+	result, err := server.ledger.PostDeposit(DepositRequest{TerminalId: strings.TrimSpace(request.Get(41)), AccountId: request.Get(102),
+		Amount: fmt.Sprintf("%.2f", amount), Description: data.Get("description"), IdempotencyKey: data.Get("idempotency_key")})
+	if err != nil {
+		setISOError(response, err)
+		return
+	}
+	entry := result.Entry
+	additional := url.Values{"description": {entry.Description}}
+	if result.Replayed {
+		additional.Set("replayed", "true")
+	}
+	response.Set(39, isoApproved)
+	response.Set(37, entry.Id)
+	response.Set(38, entry.Id[len(entry.Id)-6:])
+	response.Set(48, additional.Encode())
+	response.Set(54, formatAdditionalAmounts(AccountBalance{Balance: entry.Balance, Available: result.Available, Pending: result.Pending}))
+}
+
+// advise posts a withdrawal the terminal approved in stand-in, the advice id is the retrieval reference number
+func (server *ISOHostServer) advise(request *iso8583.Message, response *iso8583.Message) {
+	amount, err := fromISOAmount(request.Get(4))
+	if err != nil {
+		setISOError(response, err)
+		return
+	}
+	data, _ := url.ParseQuery(request.Get(48))
+	approvedAt, _ := time.Parse(time.RFC3339, data.Get("approved_at"))
+	result, err := server.ledger.PostAdvice(WithdrawalAdvice{AdviceId: strings.TrimSpace(request.Get(37)), TerminalId: strings.TrimSpace(request.Get(41)),
+		AccountId: request.Get(102), Amount: amount, Description: data.Get("description"), ApprovedAt: approvedAt})
+	if err != nil {
+		setISOError(response, err)
+		return
+	}
+	response.Set(39, isoApproved)
+	response.Set(37, result.TransactionId)
+	response.Set(54, formatAdditionalAmounts(AccountBalance{Balance: result.RemainingBalance,
+		Available: server.ledger.GetAvailableBalance(request.Get(102)), Pending: server.ledger.GetPendingFunds(request.Get(102))}))
+	setWithdrawalData(response, result)
+}
+
+// reverse credits back a withdrawal the terminal did not dispense. Reversals may be repeated,
+// one already applied is approved again
+func (server *ISOHostServer) reverse(request *iso8583.Message, response *iso8583.Message) {
+	original := request.Get(90)
+	if len(original) < 20 {
+		response.Set(39, isoOriginalNotFound)
+		return
+	}
+	terminalId := strings.TrimSpace(request.Get(41))
+	withdrawal, ok := server.withdrawals[isoOriginalKey(terminalId, original[:20])]
+	if !ok {
+		Logger.Printf("ISO 8583 reversal from %s for unknown original %s\n", terminalId, original)
+		response.Set(39, isoOriginalNotFound)
+		return
+	}
+	_, err := server.ledger.PostReversal(ReversalRequest{ReversalId: original[:20], TerminalId: terminalId, TransactionId: withdrawal.transactionId})
+	if err != nil {
+		setISOError(response, err)
+		return
+	}
+	response.Set(39, isoApproved)
+	response.Set(37, withdrawal.transactionId)
+}
+
+// reverseTransaction reverses all or part of the transaction in the retrieval reference number,
+// the amount to reverse is in the transaction amount when it is not the whole transaction
+func (server *ISOHostServer) reverseTransaction(request *iso8583.Message, response *iso8583.Message) {
+	amount := 0.0
+	if request.Has(4) {
+		var err error
+		if amount, err = fromISOAmount(request.Get(4)); err != nil {
+			setISOError(response, err)
+			return
+		}
+	}
+	data, _ := url.ParseQuery(request.Get(48))
+	result, err := server.ledger.PostReversal(ReversalRequest{ReversalId: data.Get("reversal_id"), TerminalId: strings.TrimSpace(request.Get(41)),
+		TransactionId: strings.TrimSpace(request.Get(37)), Amount: amount, Reason: data.Get("reason")})
+	if err != nil {
+		setISOError(response, err)
+		return
+	}
+	response.Set(39, isoApproved)
+	response.Set(4, toISOAmount(result.AmountReversed))
+	response.Set(37, result.TransactionId)
+	response.Set(54, formatAdditionalAmounts(AccountBalance{Balance: result.RemainingBalance,
+		Available: server.ledger.GetAvailableBalance(result.AccountId), Pending: server.ledger.GetPendingFunds(result.AccountId)}))
+	reply := url.Values{"account_id": {result.AccountId}, "original_type": {string(result.OriginalType)},
+		"original_terminal_id": {result.OriginalTerminalId}}
+	if result.FeeTransactionId != "" {
+		reply.Set("fee_id", result.FeeTransactionId)
+		reply.Set("fee_refunded", fmt.Sprintf("%.2f", result.FeeRefunded))
+	}
+	if result.Repeated {
+		reply.Set("repeated", "true")
+	}
+	response.Set(48, reply.Encode())
+}
+
+// isoOriginalKey identifies a financial request by its terminal and its MTI, STAN and transmission date and time
+func isoOriginalKey(terminalId string, original string) string {
+	return terminalId + "/" + original
+}
+
+// setISOError declines a request, recording the reason in the private data so the terminal can rebuild the error
+func setISOError(response *iso8583.Message, err error) {
+	data := url.Values{"message": {err.Error()}}
+	code := isoInvalidTransaction
+	var invalidInput *InvalidInputError
+	var invalidAmount *InvalidAmountError
+	var onHold *FundsOnHoldError
+	var partial *PartialDispenseError
+	var duplicate *DuplicateAdviceError
+	var reused *IdempotencyKeyReusedError
+	switch {
+	case errors.As(err, &invalidInput):
+		data.Set("reason", hostInvalidInput)
+		data.Set("message", invalidInput.message)
+	case errors.As(err, &invalidAmount):
+		code = isoInvalidAmount
+		data.Set("reason", hostInvalidAmount)
+		data.Set("message", invalidAmount.message)
+	case errors.As(err, new(*InsufficientFundsError)):
+		code = isoInsufficientFunds
+		data.Set("reason", hostInsufficientFunds)
+	case errors.As(err, new(*OverdrawnError)):
+		code = isoInsufficientFunds
+		data.Set("reason", hostOverdrawn)
+	case errors.As(err, &onHold):
+		code = isoInsufficientFunds
+		data.Set("reason", hostFundsOnHold)
+		data.Set("available", fmt.Sprintf("%.2f", onHold.Available))
+	case errors.As(err, &partial):
+		code = isoExceedsAmountLimit
+		data.Set("reason", hostPartialDispense)
+		data.Set("requested", fmt.Sprintf("%.2f", partial.Requested))
+		data.Set("available", fmt.Sprintf("%.2f", partial.Available))
+	case errors.As(err, new(*NoMoneyLeftError)):
+		code = isoExceedsAmountLimit
+		data.Set("reason", hostNoCash)
+	case errors.As(err, &duplicate):
+		code = isoDuplicateAdvice
+		data.Set("reason", hostDuplicateAdvice)
+		data.Set("transaction_id", duplicate.TransactionId)
+	case errors.As(err, &reused):
+		data.Set("reason", hostIdempotencyKey)
+		data.Set("idempotency_key", reused.Key)
+	case errors.As(err, new(*OneTimeCodeRequiredError)):
+		code = isoSecurityViolation
+		data.Set("reason", hostOneTimeCode)
+	case errors.As(err, new(*OneTimeCodeReusedError)):
+		code = isoSecurityViolation
+		data.Set("reason", hostOneTimeCodeReused)
+	default:
+		Logger.Printf("unexpected ISO 8583 host error: %+v\n", err)
+		code = isoSystemMalfunction
+	}
+	response.Set(39, code)
+	response.Set(48, data.Encode())
+}
+
+// fromISOResponse rebuilds the error the host declined a request with, nil when it was approved
+func fromISOResponse(response *iso8583.Message) error {
+	code := response.Get(39)
+	if code == isoApproved || code == isoPartialApproval {
+		return nil
+	}
+	data, _ := url.ParseQuery(response.Get(48))
+	available, _ := strconv.ParseFloat(data.Get("available"), 64)
+	requested, _ := strconv.ParseFloat(data.Get("requested"), 64)
+	switch data.Get("reason") {
+	case hostInvalidInput:
+		return &InvalidInputError{data.Get("message")}
+	case hostInvalidAmount:
+		return &InvalidAmountError{message: data.Get("message")}
+	case hostInsufficientFunds:
+		return &InsufficientFundsError{}
+	case hostOverdrawn:
+		return &OverdrawnError{}
+	case hostFundsOnHold:
+		return &FundsOnHoldError{Available: available}
+	case hostPartialDispense:
+		return &PartialDispenseError{Requested: requested, Available: available}
+	case hostNoCash:
+		return &NoMoneyLeftError{}
+	case hostDuplicateAdvice:
+		return &DuplicateAdviceError{TransactionId: data.Get("transaction_id")}
+	case hostIdempotencyKey:
+		return &IdempotencyKeyReusedError{Key: data.Get("idempotency_key")}
+	case hostOneTimeCode:
+		return &OneTimeCodeRequiredError{}
+	case hostOneTimeCodeReused:
+		return &OneTimeCodeReusedError{}
+	}
+	if code == isoSecurityViolation {
+		return &PINNotVerifiedError{}
+	}
+	if code == isoIssuerUnavailable {
+		return &HostUnavailableError{NotSent: true, cause: fmt.Errorf("response code %s", code)}
+	}
+	return fmt.Errorf("declined by the bank host with response code %s", code)
+}
+
+// ISOHostClient is a BankHost reached with ISO 8583 messages over TCP. It does not support transaction history
+type ISOHostClient struct {
+	address string
+	spec    *iso8583.Spec
+	// Timeout is the deadline for each exchange with the host
+	Timeout time.Duration
+	lock    sync.Mutex
+	conn    net.Conn
+	stan    int
+	// reversals of withdrawals the host did not answer, sent before the next request
+	reversals []*iso8583.Message
+	// map of account # to the session token the host returned when it verified the PIN
+	sessions map[string]string
+}
+
+// DialISOHost connects to an ISO 8583 host at address and signs on, using the default field spec when spec is nil
+func DialISOHost(address string, spec *iso8583.Spec) (*ISOHostClient, error) {
+	if spec == nil {
+		spec = iso8583.DefaultSpec()
+	}
+	host := &ISOHostClient{address: address, spec: spec, Timeout: DefaultHostTimeout}
+	if err := host.networkManagement(isoSignOn); err != nil {
+		_ = host.Close()
+		return nil, err
+	}
+	Logger.Printf("connected to ISO 8583 host %s\n", address)
+	return host, nil
+}
+
+// Close signs off and disconnects from the host
+func (host *ISOHostClient) Close() error {
+	if host.conn != nil {
+		if err := host.networkManagement(isoSignOff); err != nil {
+			Logger.Printf("ISO 8583 sign off failed: %+v\n", err)
+		}
+	}
+	host.lock.Lock()
+	defer host.lock.Unlock()
+	if host.conn == nil {
+		return nil
+	}
+	err := host.conn.Close()
+	host.conn = nil
+	return err
+}
+
+// Echo sends an echo test to check the host is answering
+func (host *ISOHostClient) Echo() error {
+	return host.networkManagement(isoEchoTest)
+}
+
+func (host *ISOHostClient) networkManagement(code string) error {
+	response, err := host.send(iso8583.NewMessage(iso8583.NetworkManagementRequest).Set(70, code))
+	if err != nil {
+		return err
+	}
+	return fromISOResponse(response)
+}
+
+func (host *ISOHostClient) Authenticate(accountId string, pin PINBlock) (bool, error) {
+	request := iso8583.NewMessage(iso8583.AuthorizationRequest).Set(3, isoPinVerify).Set(4, toISOAmount(0)).Set(102, accountId)
+	if ledger.terminalId != "" {
+		request.Set(41, ledger.terminalId)
+	}
+	response, err := host.send(setISOPINData(request, pin))
+	if err != nil {
+		return false, err
+	}
+	host.setSession(accountId, "")
+	if response.Get(39) == isoIncorrectPin {
+		return false, nil
+	}
+	if err := fromISOResponse(response); err != nil {
+		return false, err
+	}
+	data, _ := url.ParseQuery(response.Get(48))
+	host.setSession(accountId, data.Get("session"))
+	return true, nil
+}
+
+// setSession keeps the session token sent with the account's requests, forgetting it when token is empty
+func (host *ISOHostClient) setSession(accountId string, token string) {
+	host.lock.Lock()
+	defer host.lock.Unlock()
+	if token == "" {
+		delete(host.sessions, accountId)
+		return
+	}
+	if host.sessions == nil {
+		host.sessions = map[string]string{}
+	}
+	host.sessions[accountId] = token
+}
+
+// privateData returns the private data for a request for the account, holding its session token
+func (host *ISOHostClient) privateData(accountId string) url.Values {
+	host.lock.Lock()
+	defer host.lock.Unlock()
+	data := url.Values{}
+	if token := host.sessions[accountId]; token != "" {
+		data.Set("session", token)
+	}
+	return data
+}
+
+func (host *ISOHostClient) SecondFactorRequired(accountId string, withdrawal float64) (bool, error) {
+	message := iso8583.NewMessage(iso8583.AuthorizationRequest).Set(3, isoSecondFactorInquiry).Set(4, toISOAmount(withdrawal)).Set(102, accountId)
+	if data := host.privateData(accountId); len(data) > 0 {
+		message.Set(48, data.Encode())
+	}
+	response, err := host.send(message)
+	if err != nil {
+		return false, err
+	}
+	if err := fromISOResponse(response); err != nil {
+		return false, err
+	}
+	data, _ := url.ParseQuery(response.Get(48))
+	return data.Get("required") == "true", nil
+}
+
+// VerifyOneTimeCode sends the code to the host in the private data, where it is checked against the account's enrollment
+func (host *ISOHostClient) VerifyOneTimeCode(accountId string, code string) (bool, error) {
+	data := host.privateData(accountId)
+	data.Set("code", code)
+	message := iso8583.NewMessage(iso8583.AuthorizationRequest).Set(3, isoOneTimeCode).Set(4, toISOAmount(0)).
+		Set(48, data.Encode()).Set(102, accountId)
+	response, err := host.send(message)
+	if err != nil {
+		return false, err
+	}
+	if err := fromISOResponse(response); err != nil {
+		return false, err
+	}
+	result, _ := url.ParseQuery(response.Get(48))
+	return result.Get("valid") == "true", nil
+}
+
+func (host *ISOHostClient) Balance(accountId string) (AccountBalance, error) {
+	message := iso8583.NewMessage(iso8583.AuthorizationRequest).Set(3, isoBalanceInquiry).Set(4, toISOAmount(0)).Set(102, accountId)
+	if data := host.privateData(accountId); len(data) > 0 {
+		message.Set(48, data.Encode())
+	}
+	response, err := host.send(message)
+	if err != nil {
+		return AccountBalance{}, err
+	}
+	if err := fromISOResponse(response); err != nil {
+		return AccountBalance{}, err
+	}
+	return parseAdditionalAmounts(response.Get(54))
+}
+
+func (host *ISOHostClient) Deposit(request DepositRequest) (*DepositResult, error) {
+	amount, err := StringToMoney(request.Amount)
+	if err != nil {
+		return nil, err
+	}
+	message := iso8583.NewMessage(iso8583.FinancialRequest).Set(3, isoDeposit).Set(4, toISOAmount(amount)).
+		Set(41, request.TerminalId).Set(102, request.AccountId)
+	data := host.privateData(request.AccountId)
+	if request.Description != "" {
+		data.Set("description", request.Description)
+	}
+	if request.IdempotencyKey != "" {
+		data.Set("idempotency_key", request.IdempotencyKey)
+	}
+	if len(data) > 0 {
+		message.Set(48, data.Encode())
+	}
+	response, err := host.send(message)
+	if err != nil {
+		return nil, err
+	}
+	if err := fromISOResponse(response); err != nil {
+		return nil, err
+	}
+	balance, err := parseAdditionalAmounts(response.Get(54))
+	if err != nil {
+		return nil, err
+	}
+	result, _ := url.ParseQuery(response.Get(48))
+	entry := LedgerHistoryEntry{Id: response.Get(37), Type: DepositTransaction, Description: result.Get("description"),
+		TerminalId: request.TerminalId, Date: clock.Now(), Amount: amount, Balance: balance.Balance}
+	return &DepositResult{Entry: entry, Available: balance.Available, Pending: balance.Pending, Replayed: result.Get("replayed") == "true"}, nil
+}
+
+func (host *ISOHostClient) Withdraw(request WithdrawalRequest) (*WithdrawResult, error) {
+	amount, err := StringToMoney(request.Amount)
+	if err != nil {
+		return &WithdrawResult{}, err
+	}
+	data := host.privateData(request.AccountId)
+	data.Set("dispensable", fmt.Sprintf("%.2f", request.Dispensable))
+	data.Set("accept_partial", strconv.FormatBool(request.AcceptPartial))
+	if request.Description != "" {
+		data.Set("description", request.Description)
+	}
+	if request.IdempotencyKey != "" {
+		data.Set("idempotency_key", request.IdempotencyKey)
+	}
+	response, err := host.send(iso8583.NewMessage(iso8583.FinancialRequest).Set(3, isoWithdrawal).Set(4, toISOAmount(amount)).
+		Set(41, request.TerminalId).Set(48, data.Encode()).Set(102, request.AccountId))
+	if err != nil {
+		return &WithdrawResult{}, err
+	}
+	if err := fromISOResponse(response); err != nil {
+		var overdrawn *OverdrawnError
+		return &WithdrawResult{WasOverdrawn: errors.As(err, &overdrawn)}, err
+	}
+	withdrawn, err := fromISOAmount(response.Get(4))
+	if err != nil {
+		return &WithdrawResult{}, err
+	}
+	balance, err := parseAdditionalAmounts(response.Get(54))
+	if err != nil {
+		return &WithdrawResult{}, err
+	}
+	result, _ := url.ParseQuery(response.Get(48))
+	return &WithdrawResult{
+		TransactionId:    response.Get(37),
+		FeeTransactionId: result.Get("fee_id"),
+		AmountWithdrawn:  withdrawn,
+		RemainingBalance: balance.Balance,
+		WasOverdrawn:     result.Get("overdrawn") == "true",
+		WasPartial:       response.Get(39) == isoPartialApproval,
+		Replayed:         result.Get("replayed") == "true",
+	}, nil
+}
+
+// Advise sends a withdrawal approved in stand-in as a financial advice
+func (host *ISOHostClient) Advise(advice WithdrawalAdvice) (*WithdrawResult, error) {
+	data := url.Values{"approved_at": {advice.ApprovedAt.Format(time.RFC3339)}}
+	if advice.Description != "" {
+		data.Set("description", advice.Description)
+	}
+	response, err := host.send(iso8583.NewMessage(iso8583.FinancialAdvice).Set(3, isoWithdrawal).Set(4, toISOAmount(advice.Amount)).
+		Set(37, advice.AdviceId).Set(41, advice.TerminalId).Set(48, data.Encode()).Set(102, advice.AccountId))
+	if err != nil {
+		return &WithdrawResult{}, err
+	}
+	if err := fromISOResponse(response); err != nil {
+		return &WithdrawResult{}, err
+	}
+	balance, err := parseAdditionalAmounts(response.Get(54))
+	if err != nil {
+		return &WithdrawResult{}, err
+	}
+	result, _ := url.ParseQuery(response.Get(48))
+	return &WithdrawResult{
+		TransactionId:    response.Get(37),
+		FeeTransactionId: result.Get("fee_id"),
+		AmountWithdrawn:  advice.Amount,
+		RemainingBalance: balance.Balance,
+		WasOverdrawn:     result.Get("overdrawn") == "true",
+	}, nil
+}
+
+// Reverse sends a reversal identifying the transaction by its retrieval reference number
+func (host *ISOHostClient) Reverse(request ReversalRequest) (*ReversalResult, error) {
+	data := url.Values{}
+	if request.ReversalId != "" {
+		data.Set("reversal_id", request.ReversalId)
+	}
+	if request.Reason != "" {
+		data.Set("reason", request.Reason)
+	}
+	message := iso8583.NewMessage(iso8583.ReversalRequest).Set(37, request.TransactionId).Set(41, request.TerminalId)
+	if request.Amount != 0 {
+		message.Set(4, toISOAmount(request.Amount))
+	}
+	if len(data) > 0 {
+		message.Set(48, data.Encode())
+	}
+	response, err := host.send(message)
+	if err != nil {
+		return &ReversalResult{}, err
+	}
+	if err := fromISOResponse(response); err != nil {
+		return &ReversalResult{}, err
+	}
+	amount, err := fromISOAmount(response.Get(4))
+	if err != nil {
+		return &ReversalResult{}, err
+	}
+	balance, err := parseAdditionalAmounts(response.Get(54))
+	if err != nil {
+		return &ReversalResult{}, err
+	}
+	result, _ := url.ParseQuery(response.Get(48))
+	feeRefunded, _ := strconv.ParseFloat(result.Get("fee_refunded"), 64)
+	return &ReversalResult{
+		TransactionId:      response.Get(37),
+		FeeTransactionId:   result.Get("fee_id"),
+		AccountId:          result.Get("account_id"),
+		OriginalType:       TransactionType(result.Get("original_type")),
+		OriginalTerminalId: result.Get("original_terminal_id"),
+		AmountReversed:     amount,
+		FeeRefunded:        feeRefunded,
+		RemainingBalance:   balance.Balance,
+		Repeated:           result.Get("repeated") == "true",
+	}, nil
+}
+
+func (host *ISOHostClient) History(accountId string, query HistoryQuery) ([]LedgerHistoryEntry, int, error) {
+	return nil, 0, &InvalidInputError{"transaction history is not available from an ISO 8583 host"}
+}
+
+// send exchanges a request for its response, first sending any reversals still owed to the host.
+// A withdrawal that is not answered is reversed in case the host posted it
+func (host *ISOHostClient) send(request *iso8583.Message) (*iso8583.Message, error) {
+	host.lock.Lock()
+	defer host.lock.Unlock()
+	for len(host.reversals) > 0 {
+		response, err := host.exchange(host.reversals[0])
+		if err != nil {
+			return nil, &HostUnavailableError{NotSent: true, cause: err}
+		}
+		Logger.Printf("reversal of %s answered with %s\n", host.reversals[0].Get(90), response.Get(39))
+		host.reversals = host.reversals[1:]
+	}
+	response, err := host.exchange(request)
+	if err != nil {
+		if request.MTI == iso8583.FinancialRequest && request.Get(3) == isoWithdrawal && errors.As(err, new(*HostUnavailableError)) {
+			host.reversals = append(host.reversals, isoReversal(request))
+		}
+		return nil, err
+	}
+	return response, nil
+}
+
+// exchange stamps the request with a new trace number and the time, sends it and waits for its response
+func (host *ISOHostClient) exchange(request *iso8583.Message) (*iso8583.Message, error) {
+	host.stan = host.stan%999999 + 1
+	now := clock.Now()
+	request.Set(7, now.UTC().Format("0102150405")).Set(11, fmt.Sprintf("%06d", host.stan)).
+		Set(12, now.Format("150405")).Set(13, now.Format("0102")).Set(32, isoAcquirerId)
+	if !request.Has(41) {
+		request.Set(41, ledger.terminalId)
+	}
+	if request.Has(4) {
+		request.Set(49, isoCurrencyUSD)
+	}
+	packed, err := request.Pack(host.spec)
+	if err != nil {
+		return nil, err
+	}
+	if host.conn == nil {
+		if host.conn, err = net.DialTimeout("tcp", host.address, host.Timeout); err != nil {
+			host.conn = nil
+			return nil, &HostUnavailableError{NotSent: true, cause: err}
+		}
+	}
+	// network deadlines are in real time, the clock only moves simulated time
+	_ = host.conn.SetDeadline(time.Now().Add(host.Timeout))
+	response, err := host.roundTrip(packed, request)
+	if err != nil {
+		Logger.Printf("ISO 8583 exchange with %s failed: %+v\n", host.address, err)
+		_ = host.conn.Close()
+		host.conn = nil
+		return nil, &HostUnavailableError{cause: err}
+	}
+	return response, nil
+}
+
+func (host *ISOHostClient) roundTrip(packed []byte, request *iso8583.Message) (*iso8583.Message, error) {
+	if err := iso8583.WriteFrame(host.conn, packed); err != nil {
+		return nil, err
+	}
+	for {
+		frame, err := iso8583.ReadFrame(host.conn)
+		if err != nil {
+			return nil, err
+		}
+		response, err := iso8583.Unpack(host.spec, frame)
+		if err != nil {
+			return nil, err
+		}
+		// a late response to an earlier request is skipped
+		if response.MTI == iso8583.ResponseMTI(request.MTI) && response.Get(11) == request.Get(11) {
+			return response, nil
+		}
+		Logger.Printf("skipping ISO 8583 response %s %s\n", response.MTI, response.Get(11))
+	}
+}
+
+// isoReversal builds the reversal of a financial request, identifying it in the original data elements
+func isoReversal(original *iso8583.Message) *iso8583.Message {
+	reversal := iso8583.NewMessage(iso8583.ReversalRequest)
+	for _, field := range []int{2, 3, 4, 41, 102} {
+		if original.Has(field) {
+			reversal.Set(field, original.Get(field))
+		}
+	}
+	return reversal.Set(90, original.MTI+original.Get(11)+original.Get(7)+original.Get(32)+"00000000000")
+}
+
+func toISOAmount(amount float64) string {
+	return fmt.Sprintf("%012d", int64(math.Round(amount*100)))
+}
+
+func fromISOAmount(amount string) (float64, error) {
+	cents, err := strconv.ParseInt(amount, 10, 64)
+	if err != nil {
+		return 0, &InvalidAmountError{message: fmt.Sprintf("invalid ISO 8583 amount %s", amount)}
+	}
+	return float64(cents) / 100, nil
+}
+
+// formatAdditionalAmounts encodes balances as field 54 amounts: account type, amount type, currency, sign and amount.
+// The pending amount uses the private amount type 90
+func formatAdditionalAmounts(balance AccountBalance) string {
+	var amounts strings.Builder
+	for _, amount := range []struct {
+		amountType string
+		value      float64
+	}{{isoLedgerBalance, balance.Balance}, {isoAvailableBalance, balance.Available}, {isoPendingAmount, balance.Pending}} {
+		sign := "C"
+		if amount.value < 0 {
+			sign = "D"
+		}
+		amounts.WriteString("00" + amount.amountType + isoCurrencyUSD + sign + toISOAmount(math.Abs(amount.value)))
+	}
+	return amounts.String()
+}
+
+func parseAdditionalAmounts(amounts string) (AccountBalance, error) {
+	var balance AccountBalance
+	if len(amounts)%isoAdditionalAmountLen != 0 {
+		return balance, fmt.Errorf("invalid additional amounts \"%s\"", amounts)
+	}
+	for i := 0; i < len(amounts); i += isoAdditionalAmountLen {
+		amount := amounts[i : i+isoAdditionalAmountLen]
+		value, err := fromISOAmount(amount[8:])
+		if err != nil {
+			return balance, err
+		}
+		if amount[7] == 'D' {
+			value = value * -1
+		}
+		switch amount[2:4] {
+		case isoLedgerBalance:
+			balance.Balance = value
+		case isoAvailableBalance:
+			balance.Available = value
+		case isoPendingAmount:
+			balance.Pending = value
+		}
+	}
+	return balance, nil
+}
+
+// setISOPINData sends the PIN block in field 52, the card number it is bound to in field 2 and
+// its format followed by the KSN in field 53
+func setISOPINData(request *iso8583.Message, pin PINBlock) *iso8583.Message {
+	if pin.PAN != "" {
+		request.Set(2, pin.PAN)
+	}
+	return request.Set(52, string(pin.Block)).Set(53, string(append([]byte{byte(pin.Format)}, pin.KSN...)))
+}
+
+func fromISOPINData(request *iso8583.Message) PINBlock {
+	pin := PINBlock{Block: []byte(request.Get(52)), PAN: request.Get(2)}
+	if control := []byte(request.Get(53)); len(control) > 0 {
+		pin.Format, pin.KSN = pinblock.Format(control[0]), control[1:]
+	}
+	return pin
+}
@@ -0,0 +1,382 @@
+package internal
+
+import (
+	"agile-coder.com/atm-sim/internal/iso8583"
+	"agile-coder.com/atm-sim/internal/pinblock"
+	"crypto/sha1"
+	"encoding/base32"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// startISOHost runs an ISO 8583 host on a local port for the account, returning its address and ledger
+func startISOHost(t *testing.T, accountId string, balance float64) (string, *Ledger) {
+	t.Helper()
+	encryptedPin, err := EncryptPin("1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostLedger := &Ledger{}
+	hostLedger.SetInitialBalances(0, map[string]float64{accountId: balance})
+	hostAuth := &Authorization{}
+	hostAuth.SetAuthData(map[string]EncryptedPin{accountId: encryptedPin})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = NewISOHostServer(hostLedger, hostAuth, nil).Serve(listener)
+	}()
+	t.Cleanup(func() { _ = listener.Close() })
+	return listener.Addr().String(), hostLedger
+}
+
+// dialISOHost connects to the ISO 8583 host and verifies the account's PIN, so that its requests are authorized
+func dialISOHost(t *testing.T, address string, accountId string) *ISOHostClient {
+	t.Helper()
+	client, err := DialISOHost(address, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	if ok, err := client.Authenticate(accountId, encryptTestPIN(t, "1234", "")); !ok || err != nil {
+		t.Fatalf("expected the PIN to be accepted got %t %v", ok, err)
+	}
+	return client
+}
+
+func TestISOHost(t *testing.T) {
+	const accountId = "jc123"
+	InitLogger("", true)
+	address, hostLedger := startISOHost(t, accountId, 100.00)
+	client, err := DialISOHost(address, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := client.Echo(); err != nil {
+		t.Errorf("expected the echo test to be answered got %v", err)
+	}
+	if ok, err := client.Authenticate(accountId, encryptTestPIN(t, "4321", "4111111111111111")); ok || err != nil {
+		t.Errorf("expected the PIN to be rejected got %t %v", ok, err)
+	}
+	invalid := PINBlock{Format: pinblock.Format0, Block: []byte{1, 2, 3}, KSN: mustDecodeHex("FFFF9876543210E00000"), PAN: "4111111111111111"}
+	if _, err := client.Authenticate(accountId, invalid); !errors.Is(err, &InvalidInputError{"unable to read the PIN block: a format 0 PIN block must be 8 bytes, not 3"}) {
+		t.Errorf("expected an invalid PIN block to be rejected got %v", err)
+	}
+
+	// nothing is posted for an account until its PIN has been verified
+	if _, err := client.Deposit(DepositRequest{TerminalId: "ATM00001", AccountId: accountId, Amount: "60.00"}); !errors.Is(err, &PINNotVerifiedError{}) {
+		t.Errorf("expected a deposit without a verified PIN to be declined")
+	}
+	if _, err := client.Withdraw(WithdrawalRequest{TerminalId: "ATM00001", AccountId: accountId, Amount: "20", Dispensable: 500}); !errors.Is(err, &PINNotVerifiedError{}) {
+		t.Errorf("expected a withdrawal without a verified PIN to be declined")
+	}
+	if _, err := client.Balance(accountId); !errors.Is(err, &PINNotVerifiedError{}) {
+		t.Errorf("expected a balance inquiry without a verified PIN to be declined")
+	}
+	response, err := client.send(iso8583.NewMessage(iso8583.AuthorizationRequest).Set(3, isoPinVerify).Set(4, toISOAmount(0)).Set(102, accountId))
+	if err != nil || response.Get(39) == isoApproved {
+		t.Errorf("expected a PIN verification without a PIN block to be declined got %v %v", response, err)
+	}
+	if balance := hostLedger.GetBalance(accountId); balance != 100.00 || len(hostLedger.GetHistory(accountId)) != 0 {
+		t.Errorf("expected nothing to be posted got %.2f", balance)
+	}
+	if ok, err := client.Authenticate(accountId, encryptTestPIN(t, "1234", "")); !ok || err != nil {
+		t.Errorf("expected the PIN to be accepted got %t %v", ok, err)
+	}
+
+	deposit, err := client.Deposit(DepositRequest{TerminalId: "ATM00001", AccountId: accountId, Amount: "60.00"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deposit.Entry.Balance != 160.00 || deposit.Entry.Amount != 60.00 || deposit.Entry.Description != "deposit" || deposit.Available != 160.00 {
+		t.Errorf("unexpected deposit %+v", deposit)
+	}
+	if history := hostLedger.GetHistory(accountId); len(history) != 1 || history[0].Id != deposit.Entry.Id || history[0].TerminalId != "ATM00001" {
+		t.Errorf("expected the deposit to be posted on the host got %+v", history)
+	}
+
+	result, err := client.Withdraw(WithdrawalRequest{TerminalId: "ATM00001", AccountId: accountId, Amount: "200", Dispensable: 500})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.AmountWithdrawn != 200 || result.RemainingBalance != -45.00 || !result.WasOverdrawn || result.FeeTransactionId == "" {
+		t.Errorf("unexpected overdrawn withdrawal %+v", result)
+	}
+	if _, err := client.Withdraw(WithdrawalRequest{TerminalId: "ATM00001", AccountId: accountId, Amount: "20", Dispensable: 500}); !errors.Is(err, &OverdrawnError{}) {
+		t.Errorf("expected an overdrawn error got %v", err)
+	}
+	balance, err := client.Balance(accountId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance.Balance != -45.00 || balance.Available != -45.00 || balance.Pending != 0 {
+		t.Errorf("unexpected balance %+v", balance)
+	}
+	if _, _, err := client.History(accountId, HistoryQuery{}); err == nil {
+		t.Error("expected history to be unavailable")
+	}
+}
+
+func TestISOHostPartialDispense(t *testing.T) {
+	const accountId = "jc123"
+	InitLogger("", true)
+	address, _ := startISOHost(t, accountId, 500.00)
+	client := dialISOHost(t, address, accountId)
+
+	_, err := client.Withdraw(WithdrawalRequest{TerminalId: "ATM00001", AccountId: accountId, Amount: "100", Dispensable: 70})
+	var partial *PartialDispenseError
+	if !errors.As(err, &partial) || partial.Requested != 100 || partial.Available != 60 {
+		t.Fatalf("expected a partial dispense error got %v", err)
+	}
+	result, err := client.Withdraw(WithdrawalRequest{TerminalId: "ATM00001", AccountId: accountId, Amount: "100", Dispensable: 70, AcceptPartial: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.WasPartial || result.AmountWithdrawn != 60 || result.RemainingBalance != 440 {
+		t.Errorf("unexpected partial withdrawal %+v", result)
+	}
+	if _, err := client.Withdraw(WithdrawalRequest{TerminalId: "ATM00001", AccountId: accountId, Amount: "30", Dispensable: 70}); !errors.Is(err, &InvalidAmountError{message: "Withdrawals must be in units of $20."}) {
+		t.Errorf("expected an invalid amount error got %v", err)
+	}
+}
+
+func TestISOHostReversal(t *testing.T) {
+	const accountId = "jc123"
+	InitLogger("", true)
+	address, hostLedger := startISOHost(t, accountId, 100.00)
+	client := dialISOHost(t, address, accountId)
+	request := iso8583.NewMessage(iso8583.FinancialRequest).Set(3, isoWithdrawal).Set(4, toISOAmount(120)).Set(41, "ATM00001").
+		Set(48, "dispensable=500&session="+client.sessions[accountId]).Set(102, accountId)
+	response, err := client.send(request)
+	if err != nil || response.Get(39) != isoApproved {
+		t.Fatalf("expected the withdrawal to be approved got %v %v", response, err)
+	}
+	transactionId := response.Get(37)
+
+	// the terminal sends the reversal before its next request, as it would had it not received the response
+	client.reversals = append(client.reversals, isoReversal(request))
+	balance, err := client.Balance(accountId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance.Balance != 100.00 || len(client.reversals) != 0 {
+		t.Errorf("expected the withdrawal and its fee to be reversed got %+v", balance)
+	}
+	history := hostLedger.GetHistory(accountId)
+	if len(history) != 4 || history[2].Type != ReversalTransaction || history[2].ParentId != transactionId ||
+		history[3].ParentId != history[1].Id || history[3].Amount != OverdraftFee {
+		t.Errorf("unexpected history after the reversal %+v", history)
+	}
+
+	// a repeated reversal is approved without reversing again
+	response, err = client.send(isoReversal(request))
+	if err != nil || response.Get(39) != isoApproved {
+		t.Errorf("expected the repeated reversal to be approved got %v %v", response, err)
+	}
+	if balance := hostLedger.GetBalance(accountId); balance != 100.00 {
+		t.Errorf("expected the reversal to be applied once got %.2f", balance)
+	}
+	unknown := iso8583.NewMessage(iso8583.ReversalRequest).Set(41, "ATM00001").Set(90, "0200999999"+"0101000000"+isoAcquirerId+"00000000000")
+	response, err = client.send(unknown)
+	if err != nil || response.Get(39) != isoOriginalNotFound {
+		t.Errorf("expected an unknown original to be reported got %v %v", response, err)
+	}
+}
+
+func TestISOHostUnavailable(t *testing.T) {
+	InitLogger("", true)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// accepts connections but never answers
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	client := &ISOHostClient{address: listener.Addr().String(), spec: iso8583.DefaultSpec(), Timeout: 50 * time.Millisecond}
+	_, err = client.Withdraw(WithdrawalRequest{TerminalId: "ATM00001", AccountId: "jc123", Amount: "20", Dispensable: 500})
+	if !errors.Is(err, &HostUnavailableError{}) {
+		t.Errorf("expected the host to be unavailable got %v", err)
+	}
+	if len(client.reversals) != 1 || client.reversals[0].MTI != iso8583.ReversalRequest || len(client.reversals[0].Get(90)) != 42 {
+		t.Errorf("expected the unanswered withdrawal to be queued for reversal got %+v", client.reversals)
+	}
+}
+
+func TestISOHostAdvice(t *testing.T) {
+	const accountId = "jc123"
+	InitLogger("", true)
+	address, hostLedger := startISOHost(t, accountId, 100.00)
+	client, err := DialISOHost(address, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	advice := WithdrawalAdvice{AdviceId: "0A1B2C3D4E5F", TerminalId: "ATM00001", AccountId: accountId, Amount: 120,
+		Description: "cash withdrawal (offline)", ApprovedAt: time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)}
+	result, err := client.Advise(advice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.AmountWithdrawn != 120 || result.RemainingBalance != -25.00 || !result.WasOverdrawn || result.FeeTransactionId == "" {
+		t.Errorf("unexpected advice result %+v", result)
+	}
+	history := hostLedger.GetHistory(accountId)
+	if len(history) != 2 || history[0].Id != result.TransactionId || history[0].Description != advice.Description {
+		t.Errorf("expected the advice to be posted on the host got %+v", history)
+	}
+	_, err = client.Advise(advice)
+	var duplicate *DuplicateAdviceError
+	if !errors.As(err, &duplicate) || duplicate.TransactionId != result.TransactionId {
+		t.Errorf("expected a duplicate advice error got %v", err)
+	}
+	if balance := hostLedger.GetBalance(accountId); balance != -25.00 {
+		t.Errorf("expected the advice to be posted once got %.2f", balance)
+	}
+}
+
+func TestISOHostReverseTransaction(t *testing.T) {
+	const accountId = "jc123"
+	InitLogger("", true)
+	address, hostLedger := startISOHost(t, accountId, 40.00)
+	client := dialISOHost(t, address, accountId)
+
+	withdrawal, err := client.Withdraw(WithdrawalRequest{TerminalId: "ATM00001", AccountId: accountId, Amount: "100", Dispensable: 500})
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := ReversalRequest{ReversalId: "R1", TerminalId: "ATM00001", TransactionId: withdrawal.TransactionId, Amount: 40}
+	result, err := client.Reverse(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.AmountReversed != 40 || result.RemainingBalance != -25.00 || result.FeeTransactionId != "" || result.AccountId != accountId ||
+		result.OriginalType != WithdrawalTransaction || result.OriginalTerminalId != "ATM00001" {
+		t.Errorf("unexpected partial reversal %+v", result)
+	}
+	if repeated, err := client.Reverse(request); err != nil || !repeated.Repeated || repeated.TransactionId != result.TransactionId {
+		t.Errorf("expected the repeated reversal to return the first got %+v %v", repeated, err)
+	}
+	result, err = client.Reverse(ReversalRequest{TerminalId: "ATM00001", TransactionId: withdrawal.TransactionId, Reason: "dispense fault"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.AmountReversed != 60 || result.FeeRefunded != OverdraftFee || result.RemainingBalance != 40.00 {
+		t.Errorf("unexpected reversal %+v", result)
+	}
+	if _, err := client.Reverse(ReversalRequest{ReversalId: "R3", TerminalId: "ATM00001", TransactionId: withdrawal.TransactionId, Amount: 20}); !errors.Is(err,
+		&InvalidInputError{"transaction " + withdrawal.TransactionId + " has already been reversed"}) {
+		t.Errorf("expected a reversed withdrawal to be refused got %v", err)
+	}
+	if balance := hostLedger.GetBalance(accountId); balance != 40.00 {
+		t.Errorf("expected the withdrawal and fee to be reversed once got %.2f", balance)
+	}
+}
+
+func TestISOHostIdempotencyKey(t *testing.T) {
+	const accountId = "jc123"
+	InitLogger("", true)
+	address, hostLedger := startISOHost(t, accountId, 100.00)
+	client := dialISOHost(t, address, accountId)
+
+	request := DepositRequest{TerminalId: "ATM00001", AccountId: accountId, Amount: "50.00", IdempotencyKey: "K1"}
+	first, err := client.Deposit(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retried, err := client.Deposit(request); err != nil || !retried.Replayed || retried.Entry.Id != first.Entry.Id || retried.Entry.Balance != 150.00 {
+		t.Errorf("expected the first deposit to be returned got %+v %v", retried, err)
+	}
+	request.Amount = "60.00"
+	var reused *IdempotencyKeyReusedError
+	if _, err := client.Deposit(request); !errors.As(err, &reused) || reused.Key != "K1" {
+		t.Errorf("expected the reused key to be refused got %v", err)
+	}
+	if balance := hostLedger.GetBalance(accountId); balance != 150.00 {
+		t.Errorf("expected the deposit to be posted once got %.2f", balance)
+	}
+}
+
+func TestISOHostSecondFactor(t *testing.T) {
+	const accountId = "jc123"
+	InitLogger("", true)
+	hostLedger := &Ledger{}
+	hostLedger.SetInitialBalances(0, map[string]float64{accountId: 1000.00})
+	hostAuth := hostAuthorization(t, accountId)
+	hostAuth.SetSecondFactorPolicy(SecondFactorPolicy{WithdrawalThreshold: 100})
+	encoded, err := hostAuth.EnrollTOTP(accountId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = NewISOHostServer(hostLedger, hostAuth, nil).Serve(listener)
+	}()
+	t.Cleanup(func() { _ = listener.Close() })
+	client := dialISOHost(t, listener.Addr().String(), accountId)
+
+	// withdrawals over the threshold need a one-time code verified at the host, used up by the withdrawal
+	if required, err := client.SecondFactorRequired(accountId, 120); !required || err != nil {
+		t.Errorf("expected the withdrawal to need a one-time code got %t %v", required, err)
+	}
+	if required, err := client.SecondFactorRequired(accountId, 80); required || err != nil {
+		t.Errorf("expected the withdrawal not to need a one-time code got %t %v", required, err)
+	}
+	request := WithdrawalRequest{TerminalId: "ATM00001", AccountId: accountId, Amount: "120", Dispensable: 1000, IdempotencyKey: "K1"}
+	if _, err := client.Withdraw(request); !errors.Is(err, &OneTimeCodeRequiredError{}) {
+		t.Errorf("expected the withdrawal to need a one-time code got %v", err)
+	}
+	if ok, err := client.VerifyOneTimeCode(accountId, "000000"); ok || err != nil {
+		t.Errorf("expected the code to be rejected got %t %v", ok, err)
+	}
+	code := TOTPCode(secret, clock.Now(), 6, sha1.New)
+	if ok, err := client.VerifyOneTimeCode(accountId, code); !ok || err != nil {
+		t.Fatalf("expected the code to be accepted got %t %v", ok, err)
+	}
+	if _, err := client.VerifyOneTimeCode(accountId, code); !errors.Is(err, &OneTimeCodeReusedError{}) {
+		t.Errorf("expected the code to be refused again got %v", err)
+	}
+	if _, err := client.Withdraw(request); err != nil {
+		t.Fatal(err)
+	}
+	if replayed, err := client.Withdraw(request); err != nil || !replayed.Replayed {
+		t.Errorf("expected the withdrawal sent again to be replayed got %+v %v", replayed, err)
+	}
+	request.IdempotencyKey = "K2"
+	if _, err := client.Withdraw(request); !errors.Is(err, &OneTimeCodeRequiredError{}) {
+		t.Errorf("expected the code to be used up got %v", err)
+	}
+
+	// an account that needs a code to log in can not make requests until it is given
+	hostAuth.SetSecondFactorPolicy(SecondFactorPolicy{OnLogin: true})
+	client = dialISOHost(t, listener.Addr().String(), accountId)
+	if _, err := client.Balance(accountId); !errors.Is(err, &OneTimeCodeRequiredError{}) {
+		t.Errorf("expected the login to need a one-time code got %v", err)
+	}
+	if ok, err := client.VerifyOneTimeCode(accountId, TOTPCode(secret, clock.Now().Add(30*time.Second), 6, sha1.New)); !ok || err != nil {
+		t.Fatalf("expected the code to be accepted got %t %v", ok, err)
+	}
+	if balance, err := client.Balance(accountId); err != nil || balance.Balance != 880.00 {
+		t.Errorf("unexpected balance %+v %v", balance, err)
+	}
+}
@@ -0,0 +1,220 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	journalTimeFormat = "2006-01-02 15:04:05.000"
+	journalFileFormat = "20060102"
+)
+
+// JournalRecordType classifies the records in the electronic journal
+type JournalRecordType string
+
+const (
+	// JournalCommand is a command entered by the customer or operator
+	JournalCommand JournalRecordType = "CMD"
+	// JournalAuth is the result of a PIN verification or a logout
+	JournalAuth JournalRecordType = "AUTH"
+	// JournalCard is a card being inserted, rejected or ejected
+	JournalCard JournalRecordType = "CARD"
+	// JournalCash is cash being dispensed or accepted
+	JournalCash JournalRecordType = "CASH"
+	// JournalTransaction is a financial transaction posted to the ledger
+	JournalTransaction JournalRecordType = "TXN"
+	// JournalError is an error shown to the customer
+	JournalError JournalRecordType = "ERROR"
+)
+
+// JournalRecord is a single line in the electronic journal. Records are written in a fixed format:
+// time (23) | terminal (8) | type (5) | transaction id (12) | account (16) | detail
+type JournalRecord struct {
+	Time          time.Time
+	TerminalId    string
+	Type          JournalRecordType
+	TransactionId string
+	AccountId     string
+	Detail        string
+}
+
+// JournalQuery selects records from the electronic journal. Zero values do not filter
+type JournalQuery struct {
+	TransactionId string
+	AccountId     string
+	From          time.Time
+	To            time.Time
+}
+
+// ElectronicJournal records all terminal activity to a file per business day
+type ElectronicJournal struct {
+	dir        string
+	terminalId string
+	lock       sync.Mutex
+}
+
+// the shared electronic journal, nothing is journaled when it is nil
+var journal *ElectronicJournal
+
+// GetJournal returns the electronic journal or nil if journaling is disabled
+func GetJournal() *ElectronicJournal {
+	return journal
+}
+
+// SetJournal enables journaling, or disables it when ej is nil
+func SetJournal(ej *ElectronicJournal) {
+	journal = ej
+}
+
+// NewElectronicJournal creates a journal writing to files in dir for the given terminal
+func NewElectronicJournal(dir string, terminalId string) *ElectronicJournal {
+	return &ElectronicJournal{dir: dir, terminalId: terminalId}
+}
+
+// Journal writes a record to the shared electronic journal, if there is one.
+// Failures are logged rather than interrupting the customer
+func Journal(recordType JournalRecordType, transactionId string, accountId string, detail string) {
+	if journal == nil {
+		return
+	}
+	err := journal.Record(JournalRecord{Type: recordType, TransactionId: transactionId, AccountId: accountId, Detail: detail})
+	if err != nil {
+		Logger.Printf("failed to write to the electronic journal: %+v\n", err)
+	}
+}
+
+// Format returns the record as a line in the fixed journal format
+func (record JournalRecord) Format() string {
+	detail := strings.NewReplacer("\n", " ", "\r", " ").Replace(record.Detail)
+	return fmt.Sprintf("%-23s|%-8s|%-5s|%-12s|%-16s|%s", record.Time.Format(journalTimeFormat), record.TerminalId, record.Type,
+		record.TransactionId, record.AccountId, detail)
+}
+
+// ParseJournalRecord reads a line in the fixed journal format
+func ParseJournalRecord(line string) (JournalRecord, error) {
+	fields := strings.SplitN(line, "|", 6)
+	if len(fields) != 6 {
+		return JournalRecord{}, &InvalidInputError{fmt.Sprintf("invalid journal record \"%s\"", line)}
+	}
+	recordTime, err := time.ParseInLocation(journalTimeFormat, strings.TrimSpace(fields[0]), time.Local)
+	if err != nil {
+		return JournalRecord{}, &InvalidInputError{fmt.Sprintf("invalid journal record time \"%s\"", fields[0])}
+	}
+	return JournalRecord{
+		Time:          recordTime,
+		TerminalId:    strings.TrimSpace(fields[1]),
+		Type:          JournalRecordType(strings.TrimSpace(fields[2])),
+		TransactionId: strings.TrimSpace(fields[3]),
+		AccountId:     strings.TrimSpace(fields[4]),
+		Detail:        fields[5],
+	}, nil
+}
+
+// Record appends a record to the journal file for the record's business day,
+// filling in the time and terminal when they are not set
+func (ej *ElectronicJournal) Record(record JournalRecord) error {
+	if record.Time.IsZero() {
+		record.Time = clock.Now()
+	}
+	if record.TerminalId == "" {
+		record.TerminalId = ej.terminalId
+	}
+	ej.lock.Lock()
+	defer ej.lock.Unlock()
+	if err := os.MkdirAll(ej.dir, 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(ej.fileName(record.Time), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintln(file, record.Format()); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Search returns the journal records matching the query, oldest first
+func (ej *ElectronicJournal) Search(query JournalQuery) ([]JournalRecord, error) {
+	files, err := filepath.Glob(filepath.Join(ej.dir, "ej-*.log"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	var records []JournalRecord
+	for _, file := range files {
+		if !query.includesDay(file) {
+			continue
+		}
+		fileRecords, err := readJournalFile(file, query)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, fileRecords...)
+	}
+	return records, nil
+}
+
+func (ej *ElectronicJournal) fileName(day time.Time) string {
+	return filepath.Join(ej.dir, fmt.Sprintf("ej-%s.log", day.Format(journalFileFormat)))
+}
+
+// includesDay checks whether the business day of a journal file overlaps the query's time range
+func (query JournalQuery) includesDay(file string) bool {
+	day, err := time.ParseInLocation(journalFileFormat, strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file), "ej-"), ".log"), time.Local)
+	if err != nil {
+		return false
+	}
+	if !query.From.IsZero() && !day.AddDate(0, 0, 1).After(query.From) {
+		return false
+	}
+	if !query.To.IsZero() && !day.Before(query.To) {
+		return false
+	}
+	return true
+}
+
+func (query JournalQuery) matches(record JournalRecord) bool {
+	if query.TransactionId != "" && record.TransactionId != query.TransactionId {
+		return false
+	}
+	if query.AccountId != "" && record.AccountId != query.AccountId {
+		return false
+	}
+	if !query.From.IsZero() && record.Time.Before(query.From) {
+		return false
+	}
+	if !query.To.IsZero() && !record.Time.Before(query.To) {
+		return false
+	}
+	return true
+}
+
+func readJournalFile(path string, query JournalQuery) ([]JournalRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+	var records []JournalRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		record, err := ParseJournalRecord(scanner.Text())
+		if err != nil {
+			Logger.Printf("skipping journal record in %s: %+v\n", path, err)
+			continue
+		}
+		if query.matches(record) {
+			records = append(records, record)
+		}
+	}
+	return records, scanner.Err()
+}
@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJournalRecordFormat(t *testing.T) {
+	record := JournalRecord{
+		Time:          time.Date(2026, 9, 14, 15, 4, 5, 0, time.Local),
+		TerminalId:    "ATM00001",
+		Type:          JournalCash,
+		TransactionId: "0A1B2C3D4E5F",
+		AccountId:     "1434597300",
+		Detail:        "dispensed 20x3\nand more",
+	}
+	expected := "2026-09-14 15:04:05.000|ATM00001|CASH |0A1B2C3D4E5F|1434597300      |dispensed 20x3 and more"
+	if record.Format() != expected {
+		t.Errorf("unexpected journal record\n%s\n%s", record.Format(), expected)
+	}
+	parsed, err := ParseJournalRecord(record.Format())
+	if err != nil {
+		t.Fatal(err)
+	}
+	record.Detail = "dispensed 20x3 and more"
+	if parsed != record {
+		t.Errorf("record was not read back correctly %+v", parsed)
+	}
+	if _, err = ParseJournalRecord("not a record"); err == nil {
+		t.Errorf("expected an error for an invalid record")
+	}
+}
+
+func TestJournalSearch(t *testing.T) {
+	InitLogger("", true)
+	dir := t.TempDir()
+	ej := NewElectronicJournal(dir, "ATM00001")
+	day1 := time.Date(2026, 9, 14, 9, 0, 0, 0, time.Local)
+	day2 := time.Date(2026, 9, 15, 9, 0, 0, 0, time.Local)
+	records := []JournalRecord{
+		{Time: day1, Type: JournalCommand, AccountId: "111", Detail: "withdraw 20.00"},
+		{Time: day1.Add(time.Second), Type: JournalTransaction, TransactionId: "AAA", AccountId: "111", Detail: "withdrawal"},
+		{Time: day2, Type: JournalTransaction, TransactionId: "BBB", AccountId: "222", Detail: "deposit"},
+		{Time: day2.Add(time.Hour), Type: JournalError, AccountId: "111", Detail: "Insufficient funds"},
+	}
+	for _, record := range records {
+		if err := ej.Record(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"ej-20260914.log", "ej-20260915.log"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("expected journal file %s", name)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		query    JournalQuery
+		expected []string
+	}{
+		{name: "everything", query: JournalQuery{}, expected: []string{"withdraw 20.00", "withdrawal", "deposit", "Insufficient funds"}},
+		{name: "transaction", query: JournalQuery{TransactionId: "BBB"}, expected: []string{"deposit"}},
+		{name: "account", query: JournalQuery{AccountId: "111"}, expected: []string{"withdraw 20.00", "withdrawal", "Insufficient funds"}},
+		{name: "time range", query: JournalQuery{From: day1.Add(time.Second), To: day2.Add(time.Minute)}, expected: []string{"withdrawal", "deposit"}},
+	}
+	for _, test := range tests {
+		found, err := ej.Search(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(found) != len(test.expected) {
+			t.Errorf("%s: expected %d records but got %d", test.name, len(test.expected), len(found))
+			continue
+		}
+		for i, record := range found {
+			if record.Detail != test.expected[i] || record.TerminalId != "ATM00001" {
+				t.Errorf("%s: unexpected record %+v", test.name, record)
+			}
+		}
+	}
+}
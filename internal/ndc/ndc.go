@@ -0,0 +1,278 @@
+// Package ndc encodes and decodes NDC-style messages exchanged between a terminal and its host.
+// Fields are separated by the FS character and the first field holds the message class
+package ndc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// FS separates the fields of a message
+const FS = "\x1c"
+
+// message classes, the first field of each message
+const (
+	classTerminalCommand    = "1"
+	classTransactionRequest = "11"
+	classSolicitedStatus    = "22"
+	classCustomizationData  = "3"
+	classTransactionReply   = "4"
+)
+
+// terminal command codes
+const (
+	GoInService    = "1"
+	GoOutOfService = "2"
+)
+
+// customization data identifiers
+const (
+	screenData = "1"
+	stateData  = "2"
+)
+
+// status descriptors sent by the terminal in reply to the host
+const (
+	Ready         = "9"
+	DeviceFault   = "8"
+	CommandReject = "A"
+)
+
+// transaction reply function identifiers
+const (
+	DepositAndPrint           = "1"
+	DispenseAndPrint          = "2"
+	PrintImmediate            = "4"
+	SetNextStateAndPrint      = "5"
+	EjectCardDispenseAndPrint = "A"
+)
+
+// printer flags in a transaction reply
+const (
+	PrintNone              = "0"
+	PrintJournal           = "1"
+	PrintReceipt           = "2"
+	PrintReceiptAndJournal = "3"
+)
+
+// CashHandler is the device id reported in the status of a dispense fault
+const CashHandler = "E"
+
+// Message is a message in either direction
+type Message interface {
+	Encode() []byte
+}
+
+// TerminalCommand tells the terminal to go in or out of service
+type TerminalCommand struct {
+	LUNO string
+	Code string
+}
+
+// ScreenData downloads screens to the terminal, by screen number
+type ScreenData struct {
+	LUNO    string
+	Screens map[string]string
+}
+
+// State is an entry in the state tables: a number, a type and eight 3-digit parameters whose meaning depends on the type
+type State struct {
+	Number  string
+	Type    string
+	Entries [8]string
+}
+
+// StateTables downloads states to the terminal
+type StateTables struct {
+	LUNO   string
+	States []State
+}
+
+// TransactionRequest is sent by the terminal with the buffers collected from the customer
+type TransactionRequest struct {
+	LUNO         string
+	TimeVariant  string
+	Coordination string
+	Track2       string
+	// OperationCode holds the function keys pressed, one per position
+	OperationCode string
+	// Amount is in cents, 12 digits
+	Amount    string
+	PINBuffer string
+	BufferB   string
+	BufferC   string
+}
+
+// TransactionReply tells the terminal what to do with a transaction request
+type TransactionReply struct {
+	LUNO        string
+	TimeVariant string
+	NextState   string
+	// Notes is the number of notes to dispense from each of the four cassettes, 2 digits each
+	Notes        string
+	SerialNumber string
+	Function     string
+	Screen       string
+	// ScreenUpdate is text shown after the screen
+	ScreenUpdate string
+	Coordination string
+	// RetainCard keeps the card instead of returning it
+	RetainCard  bool
+	PrinterFlag string
+	PrinterData string
+}
+
+// SolicitedStatus is the terminal's answer to a command, customization data or transaction reply
+type SolicitedStatus struct {
+	LUNO       string
+	Descriptor string
+	// Status is the device id and its status for a fault, or the reason for a rejected command
+	Status string
+}
+
+func (m *TerminalCommand) Encode() []byte {
+	return join(classTerminalCommand, m.LUNO, "", m.Code)
+}
+
+func (m *ScreenData) Encode() []byte {
+	fields := []string{classCustomizationData, m.LUNO, "", screenData}
+	for _, number := range sortedKeys(m.Screens) {
+		fields = append(fields, number+m.Screens[number])
+	}
+	return join(fields...)
+}
+
+func (m *StateTables) Encode() []byte {
+	fields := []string{classCustomizationData, m.LUNO, "", stateData}
+	for _, state := range m.States {
+		fields = append(fields, state.Number+state.Type+strings.Join(state.Entries[:], ""))
+	}
+	return join(fields...)
+}
+
+func (m *TransactionRequest) Encode() []byte {
+	return join(classTransactionRequest, m.LUNO, "", m.TimeVariant, m.Coordination, m.Track2, "", m.OperationCode,
+		m.Amount, m.PINBuffer, m.BufferB, m.BufferC)
+}
+
+func (m *TransactionReply) Encode() []byte {
+	cardFlag := "0"
+	if m.RetainCard {
+		cardFlag = "1"
+	}
+	return join(classTransactionReply, m.LUNO, "", m.TimeVariant, m.NextState, m.Notes,
+		m.SerialNumber+m.Function+m.Screen+m.ScreenUpdate, m.Coordination+cardFlag+m.PrinterFlag+m.PrinterData)
+}
+
+func (m *SolicitedStatus) Encode() []byte {
+	return join(classSolicitedStatus, m.LUNO, "", m.Descriptor, m.Status)
+}
+
+// Parse decodes a message, returning one of the message types in this package
+func Parse(data []byte) (Message, error) {
+	fields := strings.Split(string(data), FS)
+	field := func(i int) string {
+		if i < len(fields) {
+			return fields[i]
+		}
+		return ""
+	}
+	switch field(0) {
+	case classTerminalCommand:
+		return &TerminalCommand{LUNO: field(1), Code: field(3)}, nil
+	case classCustomizationData:
+		return parseCustomizationData(fields)
+	case classTransactionRequest:
+		return &TransactionRequest{LUNO: field(1), TimeVariant: field(3), Coordination: field(4), Track2: field(5),
+			OperationCode: field(7), Amount: field(8), PINBuffer: field(9), BufferB: field(10), BufferC: field(11)}, nil
+	case classTransactionReply:
+		reply := &TransactionReply{LUNO: field(1), TimeVariant: field(3), NextState: field(4), Notes: field(5)}
+		if function := field(6); len(function) >= 8 {
+			reply.SerialNumber, reply.Function, reply.Screen, reply.ScreenUpdate = function[:4], function[4:5], function[5:8], function[8:]
+		} else {
+			return nil, fmt.Errorf("invalid transaction reply function \"%s\"", function)
+		}
+		if printer := field(7); len(printer) >= 3 {
+			reply.Coordination, reply.RetainCard, reply.PrinterFlag, reply.PrinterData = printer[:1], printer[1:2] == "1", printer[2:3], printer[3:]
+		} else {
+			return nil, fmt.Errorf("invalid transaction reply printer data \"%s\"", printer)
+		}
+		return reply, nil
+	case classSolicitedStatus:
+		return &SolicitedStatus{LUNO: field(1), Descriptor: field(3), Status: field(4)}, nil
+	}
+	return nil, fmt.Errorf("unknown message class \"%s\"", field(0))
+}
+
+func parseCustomizationData(fields []string) (Message, error) {
+	if len(fields) < 4 {
+		return nil, fmt.Errorf("customization data too short")
+	}
+	switch fields[3] {
+	case screenData:
+		screens := &ScreenData{LUNO: fields[1], Screens: map[string]string{}}
+		for _, entry := range fields[4:] {
+			if len(entry) < 3 {
+				return nil, fmt.Errorf("invalid screen \"%s\"", entry)
+			}
+			screens.Screens[entry[:3]] = entry[3:]
+		}
+		return screens, nil
+	case stateData:
+		tables := &StateTables{LUNO: fields[1]}
+		for _, entry := range fields[4:] {
+			if len(entry) != 28 {
+				return nil, fmt.Errorf("invalid state \"%s\"", entry)
+			}
+			state := State{Number: entry[:3], Type: entry[3:4]}
+			for i := range state.Entries {
+				state.Entries[i] = entry[4+i*3 : 7+i*3]
+			}
+			tables.States = append(tables.States, state)
+		}
+		return tables, nil
+	}
+	return nil, fmt.Errorf("unknown customization data \"%s\"", fields[3])
+}
+
+func join(fields ...string) []byte {
+	return []byte(strings.Join(fields, FS))
+}
+
+func sortedKeys(screens map[string]string) []string {
+	var keys []string
+	for key := range screens {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// WriteMessage writes an encoded message preceded by its length as two bytes, big endian
+func WriteMessage(w io.Writer, message Message) error {
+	encoded := message.Encode()
+	if len(encoded) > 0xffff {
+		return fmt.Errorf("message of %d bytes is too long", len(encoded))
+	}
+	frame := make([]byte, 2+len(encoded))
+	binary.BigEndian.PutUint16(frame, uint16(len(encoded)))
+	copy(frame[2:], encoded)
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadMessage reads and parses a message written by WriteMessage
+func ReadMessage(r io.Reader) (Message, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint16(header))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
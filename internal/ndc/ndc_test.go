@@ -0,0 +1,69 @@
+package ndc
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestEncodeParse(t *testing.T) {
+	messages := []Message{
+		&TerminalCommand{LUNO: "001", Code: GoInService},
+		&ScreenData{LUNO: "001", Screens: map[string]string{"001": "Welcome.", "002": "Please enter your PIN."}},
+		&StateTables{LUNO: "001", States: []State{{Number: "000", Type: "A", Entries: [8]string{"001", "001", "000", "000", "000", "000", "000", "000"}}}},
+		&TransactionRequest{LUNO: "001", TimeVariant: "120000", Coordination: "1", Track2: "4111111111111111=", OperationCode: "A       ",
+			Amount: "000000006000", PINBuffer: "141234FFFFFFFFFF"},
+		&TransactionReply{LUNO: "001", TimeVariant: "120000", NextState: "010", Notes: "03000000", SerialNumber: "0001", Function: DispenseAndPrint,
+			Screen: "009", Coordination: "1", PrinterFlag: PrintReceipt, PrinterData: "WITHDRAWAL $60.00"},
+		&TransactionReply{LUNO: "001", NextState: "010", Notes: "00000000", SerialNumber: "0002", Function: SetNextStateAndPrint,
+			Screen: "008", ScreenUpdate: "Insufficient funds.", Coordination: "2", RetainCard: true, PrinterFlag: PrintNone},
+		&SolicitedStatus{LUNO: "001", Descriptor: DeviceFault, Status: CashHandler},
+	}
+	for _, message := range messages {
+		parsed, err := Parse(message.Encode())
+		if err != nil {
+			t.Errorf("unable to parse %T: %v", message, err)
+			continue
+		}
+		if !reflect.DeepEqual(message, parsed) {
+			t.Errorf("expected %+v got %+v", message, parsed)
+		}
+	}
+}
+
+func TestEncodedFields(t *testing.T) {
+	encoded := (&TransactionRequest{LUNO: "001", TimeVariant: "120000", Coordination: "1", Track2: "4111=", OperationCode: "C       "}).Encode()
+	expected := "11\x1c001\x1c\x1c120000\x1c1\x1c4111=\x1c\x1cC       \x1c\x1c\x1c\x1c"
+	if string(encoded) != expected {
+		t.Errorf("expected %q got %q", expected, encoded)
+	}
+	encoded = (&StateTables{LUNO: "001", States: []State{{Number: "004", Type: "I", Entries: [8]string{"005", "010", "001", "001", "001", "001", "000", "000"}}}}).Encode()
+	if string(encoded) != "3\x1c001\x1c\x1c2\x1c004I005010001001001001000000" {
+		t.Errorf("unexpected state tables %q", encoded)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, invalid := range []string{"9\x1c001", "3\x1c001\x1c\x1c2\x1c000A001", "3\x1c001\x1c\x1c7", "4\x1c001\x1c\x1c\x1c010\x1c00\x1c0001", "4\x1c001\x1c\x1c\x1c010\x1c00\x1c00012009\x1c1"} {
+		if _, err := Parse([]byte(invalid)); err == nil {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestFramedMessages(t *testing.T) {
+	var buffer bytes.Buffer
+	if err := WriteMessage(&buffer, &SolicitedStatus{LUNO: "001", Descriptor: Ready}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(buffer.Bytes(), []byte{0, 10, '2', '2'}) {
+		t.Errorf("expected a 2 byte length header got %v", buffer.Bytes())
+	}
+	message, err := ReadMessage(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, ok := message.(*SolicitedStatus); !ok || status.Descriptor != Ready {
+		t.Errorf("unexpected message %+v", message)
+	}
+}
@@ -0,0 +1,280 @@
+package internal
+
+import (
+	"agile-coder.com/atm-sim/internal/dukpt"
+	"agile-coder.com/atm-sim/internal/ndc"
+	"agile-coder.com/atm-sim/internal/pinblock"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"sync"
+)
+
+// operation codes, the function key pressed at the first position of the operation code buffer
+const (
+	ndcWithdrawalKey = 'A'
+	ndcDepositKey    = 'B'
+	ndcBalanceKey    = 'C'
+)
+
+// states and screens in the default tables the host replies with
+const (
+	ndcPINEntryState  = "001"
+	ndcCloseState     = "010"
+	ndcIncorrectPIN   = "007"
+	ndcDeclinedScreen = "008"
+	ndcTakeCashScreen = "009"
+	ndcDepositScreen  = "011"
+	ndcBalanceScreen  = "012"
+	ndcMaxNotes       = 99
+)
+
+// DefaultNDCStates is a withdrawal, deposit and balance inquiry flow: read the card, take the PIN,
+// choose the transaction with key A, B or C, enter an amount and send the request
+func DefaultNDCStates() []ndc.State {
+	return []ndc.State{
+		{Number: "000", Type: ndcCardRead, Entries: [8]string{"001", "001", "000", "000", "000", "000", "000", "000"}},
+		{Number: "001", Type: ndcPINEntry, Entries: [8]string{"002", "010", "010", "002", "000", "000", "000", "000"}},
+		{Number: "002", Type: ndcFDKSelection, Entries: [8]string{"003", "010", "010", "003", "003", "004", "010", "000"}},
+		{Number: "003", Type: ndcAmountEntry, Entries: [8]string{"004", "010", "010", "004", "000", "000", "000", "000"}},
+		{Number: "004", Type: ndcTransactionRequest, Entries: [8]string{"005", "010", "001", "001", "001", "001", "000", "000"}},
+		{Number: "010", Type: ndcClose, Entries: [8]string{"006", "000", "000", "000", "000", "000", "000", "000"}},
+	}
+}
+
+// DefaultNDCScreens are the screens for DefaultNDCStates
+func DefaultNDCScreens() map[string]string {
+	return map[string]string{
+		"001": "Welcome. Please insert your card (enter the card number).",
+		"002": "Please enter your PIN.",
+		"003": "Select a transaction: A) Withdrawal B) Deposit C) Balance D) Cancel",
+		"004": "Please enter the amount.",
+		"005": "Please wait.",
+		"006": "Thank you.",
+		"007": "Incorrect PIN, please try again.",
+		"008": "Unable to complete your transaction.",
+		"009": "Please take your cash.",
+		"011": "Your deposit has been accepted.",
+		"012": "Your balance:",
+	}
+}
+
+// NDCHost is a host for NDC-style terminals backed by a Ledger. It downloads its screens and states to each terminal,
+// puts it in service and answers its transaction requests
+type NDCHost struct {
+	ledger  *Ledger
+	auth    *Authorization
+	cards   *CardReader
+	States  []ndc.State
+	Screens map[string]string
+	// PINFormat is the format the terminals' PIN pads use for TDES PIN blocks, AES PIN blocks are always format 4
+	PINFormat pinblock.Format
+	// the ledger is not safe for concurrent use so requests are handled one at a time
+	lock   sync.Mutex
+	serial int
+	// the terminal each PIN pad key is used by
+	keys pinPadKeys
+}
+
+// NewNDCHost creates a host with the default tables for the accounts in ledger and auth, reading cards with cards
+func NewNDCHost(ledger *Ledger, auth *Authorization, cards *CardReader) *NDCHost {
+	return &NDCHost{ledger: ledger, auth: auth, cards: cards, States: DefaultNDCStates(), Screens: DefaultNDCScreens()}
+}
+
+// Serve handles the terminals connecting to listener until it is closed
+func (host *NDCHost) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			if err := host.ServeConn(conn); err != nil {
+				Logger.Printf("NDC terminal %s disconnected: %+v\n", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// ServeConn downloads the tables to a terminal, puts it in service and answers its transaction requests until it disconnects
+func (host *NDCHost) ServeConn(conn io.ReadWriter) error {
+	for _, message := range []ndc.Message{&ndc.ScreenData{Screens: host.Screens}, &ndc.StateTables{States: host.States},
+		&ndc.TerminalCommand{Code: ndc.GoInService}} {
+		if _, err := host.exchange(conn, message); err != nil {
+			return err
+		}
+	}
+	for {
+		message, err := ndc.ReadMessage(conn)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		request, ok := message.(*ndc.TransactionRequest)
+		if !ok {
+			Logger.Printf("unexpected NDC message %T\n", message)
+			continue
+		}
+		reply, withdrawal := host.authorize(request)
+		status, err := host.exchange(conn, reply)
+		if err != nil {
+			return err
+		}
+		if status.Descriptor != ndc.Ready && withdrawal != nil {
+			host.reverse(request.LUNO, withdrawal)
+		}
+	}
+}
+
+// exchange sends a message to the terminal and reads its solicited status
+func (host *NDCHost) exchange(conn io.ReadWriter, message ndc.Message) (*ndc.SolicitedStatus, error) {
+	if err := ndc.WriteMessage(conn, message); err != nil {
+		return nil, err
+	}
+	reply, err := ndc.ReadMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+	status, ok := reply.(*ndc.SolicitedStatus)
+	if !ok {
+		return nil, fmt.Errorf("expected a solicited status from the terminal, got %T", reply)
+	}
+	if _, ok := message.(*ndc.TransactionReply); !ok && status.Descriptor != ndc.Ready {
+		return nil, fmt.Errorf("the terminal rejected %T with status %s %s", message, status.Descriptor, status.Status)
+	}
+	return status, nil
+}
+
+// authorize carries out a transaction request, returning the reply and the withdrawal posted, if any
+func (host *NDCHost) authorize(request *ndc.TransactionRequest) (*ndc.TransactionReply, *postedWithdrawal) {
+	host.lock.Lock()
+	defer host.lock.Unlock()
+	host.serial = host.serial%9999 + 1
+	reply := &ndc.TransactionReply{LUNO: request.LUNO, TimeVariant: request.TimeVariant, NextState: ndcCloseState,
+		Notes: "00000000", SerialNumber: fmt.Sprintf("%04d", host.serial), Function: ndc.SetNextStateAndPrint,
+		Coordination: request.Coordination, PrinterFlag: ndc.PrintNone}
+	card, err := host.cards.ReadCard(strings.SplitN(request.Track2, "=", 2)[0])
+	if err != nil {
+		var hotlisted *HotlistedCardError
+		reply.RetainCard = errors.As(err, &hotlisted)
+		return host.decline(reply, err), nil
+	}
+	accountId := card.Accounts[0]
+	block, err := hex.DecodeString(request.PINBuffer)
+	ksn, ksnErr := hex.DecodeString(request.BufferB)
+	if err != nil || ksnErr != nil {
+		return host.decline(reply, &InvalidInputError{"invalid PIN buffer"}), nil
+	}
+	pin := PINBlock{Format: host.PINFormat, Block: block, KSN: ksn, PAN: card.PAN}
+	if len(ksn) == dukpt.AESKSNLength {
+		pin.Format = pinblock.Format4
+	}
+	if err := host.keys.check(strings.TrimSpace(request.LUNO), pin); err != nil {
+		return host.decline(reply, err), nil
+	}
+	// as the acquirer, the host translates the block from the terminal's key to the zone PIN key before it is verified,
+	// so the terminal's key is only used inside the security module
+	translated, err := securityModule.TranslatePIN(pin)
+	if err != nil {
+		return host.decline(reply, err), nil
+	}
+	ok, err := host.auth.verifyTranslatedPIN(accountId, translated)
+	if err != nil {
+		return host.decline(reply, err), nil
+	}
+	if !ok {
+		Journal(JournalAuth, "", accountId, "NDC PIN verification failed")
+		reply.NextState, reply.Screen = ndcPINEntryState, ndcIncorrectPIN
+		return reply, nil
+	}
+	// NDC terminals can not take a one-time code, so accounts that need one are declined
+	if host.auth.RequiresSecondFactorForLogin(accountId) {
+		return host.decline(reply, &OneTimeCodeRequiredError{}), nil
+	}
+	amount, _ := fromISOAmount(request.Amount)
+	terminalId := strings.TrimSpace(request.LUNO)
+	switch operation := request.OperationCode + " "; operation[0] {
+	case ndcWithdrawalKey:
+		notes := int(math.Round(amount)) / ndcNoteValue
+		if notes > ndcMaxNotes {
+			return host.decline(reply, &InvalidAmountError{message: fmt.Sprintf("The most that can be withdrawn at once is $%d.", ndcMaxNotes*ndcNoteValue)}), nil
+		}
+		if host.auth.RequiresSecondFactorForWithdrawal(accountId, amount) {
+			return host.decline(reply, &OneTimeCodeRequiredError{}), nil
+		}
+		result, err := host.ledger.PostWithdrawal(WithdrawalRequest{TerminalId: terminalId, AccountId: accountId,
+			Amount: fmt.Sprintf("%.2f", amount), Dispensable: ndcDispensable(request), IdempotencyKey: ndcIdempotencyKey(request)})
+		if err != nil {
+			return host.decline(reply, err), nil
+		}
+		reply.Function, reply.Screen, reply.Notes = ndc.DispenseAndPrint, ndcTakeCashScreen, fmt.Sprintf("%02d000000", notes)
+		reply.PrinterFlag = ndc.PrintReceiptAndJournal
+		reply.PrinterData = fmt.Sprintf("WITHDRAWAL $%.2f TXN %s BALANCE $%.2f", result.AmountWithdrawn, result.TransactionId, result.RemainingBalance)
+		return reply, &postedWithdrawal{accountId: accountId, transactionId: result.TransactionId}
+	case ndcDepositKey:
+		result, err := host.ledger.PostDeposit(DepositRequest{TerminalId: terminalId, AccountId: accountId, Amount: fmt.Sprintf("%.2f", amount)})
+		if err != nil {
+			return host.decline(reply, err), nil
+		}
+		entry := result.Entry
+		reply.Function, reply.Screen = ndc.DepositAndPrint, ndcDepositScreen
+		reply.PrinterFlag = ndc.PrintReceiptAndJournal
+		reply.PrinterData = fmt.Sprintf("DEPOSIT $%.2f TXN %s BALANCE $%.2f", entry.Amount, entry.Id, entry.Balance)
+	case ndcBalanceKey:
+		reply.Screen = ndcBalanceScreen
+		reply.ScreenUpdate = fmt.Sprintf("$%.2f, available $%.2f", host.ledger.GetBalance(accountId), host.ledger.GetAvailableBalance(accountId))
+	default:
+		return host.decline(reply, &InvalidInputError{fmt.Sprintf("unknown operation \"%s\"", strings.TrimSpace(request.OperationCode))}), nil
+	}
+	return reply, nil
+}
+
+// ndcDispensable is the cash the terminal says it can dispense in general buffer C, up to the most one reply can dispense.
+// A terminal that does not say is limited to the most one reply can dispense
+func ndcDispensable(request *ndc.TransactionRequest) float64 {
+	dispensable := float64(ndcMaxNotes * ndcNoteValue)
+	if request.BufferC == "" {
+		return dispensable
+	}
+	cash, err := fromISOAmount(request.BufferC)
+	if err != nil {
+		Logger.Printf("invalid dispensable cash \"%s\" from NDC terminal %s\n", request.BufferC, request.LUNO)
+		return 0
+	}
+	return math.Min(cash, dispensable)
+}
+
+// ndcIdempotencyKey identifies a transaction request sent again by the terminal by its LUNO, time variant number and
+// coordination number, with the date as the time variant number is the time of day
+func ndcIdempotencyKey(request *ndc.TransactionRequest) string {
+	if request.TimeVariant == "" {
+		return ""
+	}
+	return fmt.Sprintf("NDC-%s-%s-%s-%s", strings.TrimSpace(request.LUNO), clock.Now().Format("20060102"), request.TimeVariant, request.Coordination)
+}
+
+// decline shows the reason for the decline and closes the transaction
+func (host *NDCHost) decline(reply *ndc.TransactionReply, err error) *ndc.TransactionReply {
+	Logger.Printf("NDC transaction declined: %+v\n", err)
+	reply.Function, reply.NextState, reply.Screen, reply.ScreenUpdate = ndc.SetNextStateAndPrint, ndcCloseState, ndcDeclinedScreen, err.Error()
+	return reply
+}
+
+// reverse credits back a withdrawal the terminal failed to dispense
+func (host *NDCHost) reverse(terminalId string, withdrawal *postedWithdrawal) {
+	host.lock.Lock()
+	defer host.lock.Unlock()
+	if _, err := host.ledger.PostReversal(ReversalRequest{TerminalId: strings.TrimSpace(terminalId), TransactionId: withdrawal.transactionId,
+		Reason: "dispense fault"}); err != nil {
+		Logger.Printf("unable to reverse withdrawal %s: %+v\n", withdrawal.transactionId, err)
+		return
+	}
+	Logger.Printf("reversed withdrawal %s for %s after a dispense fault\n", withdrawal.transactionId, withdrawal.accountId)
+}
@@ -0,0 +1,348 @@
+package internal
+
+import (
+	"agile-coder.com/atm-sim/internal/ndc"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// NDC state types run by the terminal. The entries of each state are:
+//
+//	A card read: screen, next state
+//	B PIN entry: screen, timeout next state, cancel next state, next state
+//	E four FDK selection: screen, timeout next state, cancel next state, next states for keys A to D, operation code buffer position
+//	F amount entry: screen, timeout next state, cancel next state, next state
+//	I transaction request: screen, timeout next state, then 001 to send the track 2, operation code, amount and PIN buffers.
+//	  The KSN the PIN buffer is encrypted under is sent in general buffer B, and the cash the terminal can dispense
+//	  in general buffer C with the amount
+//	J close: screen, next state
+//
+// A key whose next state is 255 is not active
+const (
+	ndcCardRead           = "A"
+	ndcPINEntry           = "B"
+	ndcFDKSelection       = "E"
+	ndcAmountEntry        = "F"
+	ndcTransactionRequest = "I"
+	ndcClose              = "J"
+	ndcInactiveKey        = "255"
+	ndcFirstState         = "000"
+	ndcNoteValue          = 20
+	ndcExit               = "exit"
+)
+
+// NDCTerminal runs the customer flow from the state and screen tables an NDC host downloads, sending
+// transaction requests built from the customer's entries on the PIN pad and acting on the host's replies on
+// the terminal's devices. Cash is dispensed from this machine's cash
+type NDCTerminal struct {
+	LUNO    string
+	conn    io.ReadWriter
+	devices *Devices
+	states  map[string]ndc.State
+	screens map[string]string
+	// set by the host with the go in-service command
+	inService    bool
+	coordination int
+	// the buffers filled in by the customer for the next transaction request
+	track2        string
+	operationCode []byte
+	amount        string
+	pinBuffer     string
+	ksn           string
+	cardInserted  bool
+}
+
+// NewNDCTerminal creates a terminal talking to the host over conn, taking cards in its devices' card reader, reading the
+// customer's entries from their PIN pad, dispensing through their cash dispenser and showing screens and receipts on their display
+func NewNDCTerminal(conn io.ReadWriter, luno string, devices *Devices) *NDCTerminal {
+	return &NDCTerminal{LUNO: luno, conn: conn, devices: devices, states: map[string]ndc.State{},
+		screens: map[string]string{}, operationCode: []byte(strings.Repeat(" ", 8))}
+}
+
+// Run takes the tables and commands from the host until it puts the terminal in service, then runs the states
+// from state 000 until the input ends or exit is entered when a card is asked for
+func (terminal *NDCTerminal) Run() error {
+	for !terminal.inService {
+		message, err := ndc.ReadMessage(terminal.conn)
+		if err != nil {
+			return err
+		}
+		if err := terminal.handleHostMessage(message); err != nil {
+			return err
+		}
+	}
+	Logger.Printf("NDC terminal %s in service\n", terminal.LUNO)
+	state := ndcFirstState
+	for {
+		next, err := terminal.runState(state)
+		if err == io.EOF || (err == nil && next == "") {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		state = next
+	}
+}
+
+// handleHostMessage acts on customization data and terminal commands, answering with a solicited status
+func (terminal *NDCTerminal) handleHostMessage(message ndc.Message) error {
+	status := &ndc.SolicitedStatus{LUNO: terminal.LUNO, Descriptor: ndc.Ready}
+	switch message := message.(type) {
+	case *ndc.ScreenData:
+		for number, screen := range message.Screens {
+			terminal.screens[number] = screen
+		}
+		Logger.Printf("NDC terminal %s loaded %d screens\n", terminal.LUNO, len(message.Screens))
+	case *ndc.StateTables:
+		for _, state := range message.States {
+			terminal.states[state.Number] = state
+		}
+		Logger.Printf("NDC terminal %s loaded %d states\n", terminal.LUNO, len(message.States))
+	case *ndc.TerminalCommand:
+		switch message.Code {
+		case ndc.GoInService:
+			terminal.inService = true
+		case ndc.GoOutOfService:
+			terminal.inService = false
+		default:
+			status = &ndc.SolicitedStatus{LUNO: terminal.LUNO, Descriptor: ndc.CommandReject, Status: message.Code}
+		}
+	default:
+		status = &ndc.SolicitedStatus{LUNO: terminal.LUNO, Descriptor: ndc.CommandReject}
+	}
+	return ndc.WriteMessage(terminal.conn, status)
+}
+
+// runState runs a state, returning the next state or an empty one when the customer leaves
+func (terminal *NDCTerminal) runState(number string) (string, error) {
+	state, ok := terminal.states[number]
+	if !ok {
+		return "", fmt.Errorf("NDC state %s is not in the state tables", number)
+	}
+	entries := state.Entries
+	switch state.Type {
+	case ndcCardRead:
+		terminal.showScreen(entries[0], "")
+		pan, err := terminal.devices.PINPad.GetData()
+		if err != nil || pan == ndcExit {
+			return "", err
+		}
+		if pan == "" {
+			return number, nil
+		}
+		if pan, err = terminal.devices.CardReader.AcceptCard(pan); err != nil {
+			terminal.show(err.Error())
+			return number, nil
+		}
+		terminal.track2 = pan + "="
+		terminal.cardInserted = true
+		Journal(JournalCard, "", "", "card inserted "+MaskAccount(pan))
+		return entries[1], nil
+	case ndcPINEntry:
+		terminal.showScreen(entries[0], "")
+		block, err := terminal.devices.PINPad.GetPIN(strings.TrimSuffix(terminal.track2, "="))
+		var invalid *InvalidInputError
+		if errors.As(err, &invalid) {
+			terminal.show(err.Error())
+			return number, nil
+		}
+		if err != nil {
+			return entries[2], err
+		}
+		terminal.pinBuffer = strings.ToUpper(hex.EncodeToString(block.Block))
+		terminal.ksn = strings.ToUpper(hex.EncodeToString(block.KSN))
+		return entries[3], nil
+	case ndcFDKSelection:
+		terminal.showScreen(entries[0], "")
+		key, err := terminal.devices.PINPad.GetData()
+		if err != nil || key == "" {
+			return entries[2], err
+		}
+		key = strings.ToUpper(key)
+		index := strings.Index("ABCD", key)
+		if len(key) != 1 || index < 0 || entries[3+index] == ndcInactiveKey {
+			return number, nil
+		}
+		if position, err := strconv.Atoi(entries[7]); err == nil && position < len(terminal.operationCode) {
+			terminal.operationCode[position] = key[0]
+		}
+		return entries[3+index], nil
+	case ndcAmountEntry:
+		terminal.showScreen(entries[0], "")
+		line, err := terminal.devices.PINPad.GetData()
+		if err != nil || line == "" {
+			return entries[2], err
+		}
+		amount, err := StringToMoney(line)
+		if err != nil {
+			terminal.show(err.Error())
+			return number, nil
+		}
+		terminal.amount = toISOAmount(amount)
+		return entries[3], nil
+	case ndcTransactionRequest:
+		terminal.showScreen(entries[0], "")
+		return terminal.sendTransactionRequest(entries)
+	case ndcClose:
+		terminal.showScreen(entries[0], "")
+		terminal.ejectCard()
+		terminal.endTransaction()
+		return entries[1], nil
+	}
+	return "", fmt.Errorf("NDC state %s has unsupported type %s", number, state.Type)
+}
+
+// sendTransactionRequest sends the buffers the state asks for, then carries out the host's reply
+func (terminal *NDCTerminal) sendTransactionRequest(entries [8]string) (string, error) {
+	terminal.coordination = terminal.coordination%9 + 1
+	request := &ndc.TransactionRequest{LUNO: terminal.LUNO, TimeVariant: clock.Now().Format("150405"),
+		Coordination: strconv.Itoa(terminal.coordination)}
+	if entries[2] == "001" {
+		request.Track2 = terminal.track2
+	}
+	if entries[3] == "001" {
+		request.OperationCode = string(terminal.operationCode)
+	}
+	if entries[4] == "001" {
+		request.Amount, request.BufferC = terminal.amount, toISOAmount(terminal.dispensable())
+	}
+	if entries[5] == "001" {
+		request.PINBuffer, request.BufferB = terminal.pinBuffer, terminal.ksn
+	}
+	if err := ndc.WriteMessage(terminal.conn, request); err != nil {
+		return "", err
+	}
+	for {
+		message, err := ndc.ReadMessage(terminal.conn)
+		if err != nil {
+			return "", err
+		}
+		reply, ok := message.(*ndc.TransactionReply)
+		if !ok {
+			if err := terminal.handleHostMessage(message); err != nil {
+				return "", err
+			}
+			continue
+		}
+		return reply.NextState, terminal.carryOut(reply)
+	}
+}
+
+// dispensable is the cash this machine can dispense, none while its dispenser is out of service
+func (terminal *NDCTerminal) dispensable() float64 {
+	if terminal.devices.CashDispenser.Status().State != DeviceOnline {
+		return 0
+	}
+	return ledger.MaxDispensable()
+}
+
+// carryOut acts on the function in a transaction reply and tells the host whether it succeeded
+func (terminal *NDCTerminal) carryOut(reply *ndc.TransactionReply) error {
+	status := &ndc.SolicitedStatus{LUNO: terminal.LUNO, Descriptor: ndc.Ready}
+	terminal.showScreen(reply.Screen, reply.ScreenUpdate)
+	switch reply.Function {
+	case ndc.DispenseAndPrint, ndc.EjectCardDispenseAndPrint:
+		if reply.Function == ndc.EjectCardDispenseAndPrint {
+			terminal.ejectCard()
+		}
+		if err := terminal.dispense(reply.Notes); err != nil {
+			Logger.Printf("NDC terminal %s dispense failed: %+v\n", terminal.LUNO, err)
+			terminal.show("Unable to dispense your cash.")
+			status = &ndc.SolicitedStatus{LUNO: terminal.LUNO, Descriptor: ndc.DeviceFault, Status: ndc.CashHandler}
+		}
+	case ndc.DepositAndPrint:
+		Journal(JournalCash, "", "", fmt.Sprintf("accepted deposit of $%s", formatNDCAmount(terminal.amount)))
+	}
+	if reply.RetainCard && terminal.cardInserted {
+		if err := terminal.devices.CardReader.RetainCard(); err != nil {
+			Logger.Printf("NDC terminal %s unable to retain the card: %+v\n", terminal.LUNO, err)
+		}
+		terminal.show("Your card has been retained. Please contact your bank.")
+		Journal(JournalCard, "", "", "card retained")
+		terminal.cardInserted = false
+	}
+	if reply.PrinterFlag == ndc.PrintReceipt || reply.PrinterFlag == ndc.PrintReceiptAndJournal {
+		terminal.show(reply.PrinterData)
+	}
+	if reply.PrinterFlag == ndc.PrintJournal || reply.PrinterFlag == ndc.PrintReceiptAndJournal {
+		Journal(JournalTransaction, "", "", reply.PrinterData)
+	}
+	return ndc.WriteMessage(terminal.conn, status)
+}
+
+// dispense has the cash dispenser present the notes from each cassette, 2 digits per cassette, taking them out of this
+// machine's cash. A withdrawal that is not presented is reversed by the host when the terminal reports the fault
+func (terminal *NDCTerminal) dispense(notes string) error {
+	count := 0
+	for i := 0; i+2 <= len(notes); i += 2 {
+		cassette, err := strconv.Atoi(notes[i : i+2])
+		if err != nil {
+			return fmt.Errorf("invalid note count \"%s\"", notes)
+		}
+		count += cassette
+	}
+	amount := float64(count * ndcNoteValue)
+	dispenser := terminal.devices.CashDispenser
+	if status := dispenser.Status(); status.State != DeviceOnline {
+		return &DispenserFaultError{Fault: DispenserFault(status.Detail)}
+	}
+	if amount > ledger.availableCash {
+		return &NoMoneyLeftError{}
+	}
+	ledger.availableCash = ledger.availableCash - amount
+	result, fault := presentCash(dispenser, amount)
+	if fault != "" {
+		Journal(JournalCash, "", "", fmt.Sprintf("dispenser %s presented $%.2f rejected $%.2f retracted $%.2f",
+			fault, result.Presented, result.Rejected, result.Retracted))
+		return &DispenserFaultError{Fault: fault, Undispensed: amount - result.Presented}
+	}
+	Journal(JournalCash, "", "", "dispensed "+FormatNotes(map[int]int{ndcNoteValue: count}))
+	return nil
+}
+
+// ejectCard gives the customer's card back, if it is still in the reader
+func (terminal *NDCTerminal) ejectCard() {
+	if !terminal.cardInserted {
+		return
+	}
+	if err := terminal.devices.CardReader.EjectCard(); err != nil {
+		Logger.Printf("NDC terminal %s unable to eject the card: %+v\n", terminal.LUNO, err)
+	}
+	terminal.show("Please take your card.")
+	Journal(JournalCard, "", "", "card ejected")
+	terminal.cardInserted = false
+}
+
+func (terminal *NDCTerminal) endTransaction() {
+	terminal.track2, terminal.amount, terminal.pinBuffer, terminal.ksn = "", "", "", ""
+	terminal.operationCode = []byte(strings.Repeat(" ", 8))
+	terminal.cardInserted = false
+}
+
+func (terminal *NDCTerminal) showScreen(number string, update string) {
+	screen := terminal.screens[number]
+	if update != "" {
+		screen = strings.TrimSpace(screen + " " + update)
+	}
+	if screen != "" {
+		terminal.show(screen)
+	}
+}
+
+// show puts a line of text on the display
+func (terminal *NDCTerminal) show(text string) {
+	terminal.devices.Display.Show(text + "\n")
+}
+
+func formatNDCAmount(amount string) string {
+	value, err := fromISOAmount(amount)
+	if err != nil {
+		return amount
+	}
+	return fmt.Sprintf("%.2f", value)
+}
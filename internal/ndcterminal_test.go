@@ -0,0 +1,265 @@
+package internal
+
+import (
+	"agile-coder.com/atm-sim/internal/ndc"
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+)
+
+const ndcTestPAN = "4111111111111111"
+
+// runNDCTerminal runs a terminal against an NDC host for the account until the customer's entries, one per line, run out,
+// returning what was displayed
+func runNDCTerminal(t *testing.T, host *NDCHost, customer string) string {
+	t.Helper()
+	devices := NewScriptedDevices(strings.Split(strings.TrimSuffix(customer, "\n"), "\n")...)
+	runNDCTerminalOn(t, host, devices)
+	return devices.Display.(*ScriptedDisplay).Text()
+}
+
+// runNDCTerminalOn runs a terminal on devices against an NDC host until the entries on their PIN pad run out
+func runNDCTerminalOn(t *testing.T, host *NDCHost, devices *Devices) {
+	t.Helper()
+	terminalConn, hostConn := net.Pipe()
+	served := make(chan error, 1)
+	go func() {
+		served <- host.ServeConn(hostConn)
+		hostConn.Close()
+	}()
+	err := NewNDCTerminal(terminalConn, "001", devices).Run()
+	terminalConn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newNDCTestHost(t *testing.T, accountId string, balance float64) (*NDCHost, *Ledger) {
+	t.Helper()
+	encryptedPin, err := EncryptPin("1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostLedger := &Ledger{}
+	hostLedger.SetInitialBalances(0, map[string]float64{accountId: balance})
+	hostAuth := &Authorization{}
+	hostAuth.SetAuthData(map[string]EncryptedPin{accountId: encryptedPin})
+	cards := testCardReader(t, ndcTestPAN, accountId)
+	hostAuth.SetCardReader(cards)
+	return NewNDCHost(hostLedger, hostAuth, cards), hostLedger
+}
+
+func TestNDCTerminalTransactions(t *testing.T) {
+	const accountId = "jc123"
+	InitLogger("", true)
+	host, hostLedger := newNDCTestHost(t, accountId, 300.00)
+	ledger.SetInitialBalances(1000, map[string]float64{})
+
+	// a withdrawal, a wrong PIN followed by a balance inquiry, then a deposit
+	displayed := runNDCTerminal(t, host, ndcTestPAN+"\n1234\nA\n60\n"+
+		ndcTestPAN+"\n0000\nC\n1234\nC\n"+
+		ndcTestPAN+"\n1234\nB\n25.50\nexit\n")
+
+	if balance := hostLedger.GetBalance(accountId); balance != 265.50 {
+		t.Errorf("expected the host to post the withdrawal and deposit got %.2f", balance)
+	}
+	if cash := ledger.GetAvailableCash(); cash != 940 {
+		t.Errorf("expected 3 notes to be dispensed got %.2f left", cash)
+	}
+	for _, expected := range []string{
+		"Please take your cash.\nWITHDRAWAL $60.00 TXN ",
+		"Incorrect PIN, please try again.\nPlease enter your PIN.\n",
+		"Your balance: $240.00, available $240.00\n",
+		"Your deposit has been accepted.\nDEPOSIT $25.50 TXN ",
+		"Thank you.\nPlease take your card.\n",
+	} {
+		if !strings.Contains(displayed, expected) {
+			t.Errorf("expected %q to be displayed in\n%s", expected, displayed)
+		}
+	}
+}
+
+func TestNDCTerminalDeclined(t *testing.T) {
+	const accountId = "jc123"
+	InitLogger("", true)
+	host, hostLedger := newNDCTestHost(t, accountId, 40.00)
+	ledger.SetInitialBalances(1000, map[string]float64{})
+
+	displayed := runNDCTerminal(t, host, ndcTestPAN+"\n1234\nA\n30\n"+"4111111111111112\n1234\nA\n20\nexit\n")
+	if !strings.Contains(displayed, "Unable to complete your transaction. invalid input: Withdrawals must be in units of $20.\n") {
+		t.Errorf("expected the decline reason to be displayed in\n%s", displayed)
+	}
+	if !strings.Contains(displayed, "Unable to complete your transaction. This card can not be read.\n") {
+		t.Errorf("expected an invalid card to be declined in\n%s", displayed)
+	}
+	if balance := hostLedger.GetBalance(accountId); balance != 40.00 || ledger.GetAvailableCash() != 1000 {
+		t.Errorf("expected nothing to be withdrawn got balance %.2f cash %.2f", balance, ledger.GetAvailableCash())
+	}
+}
+
+func TestNDCTerminalNotEnoughCash(t *testing.T) {
+	const accountId = "jc123"
+	InitLogger("", true)
+	host, hostLedger := newNDCTestHost(t, accountId, 300.00)
+	// the terminal tells the host it does not hold enough cash for the withdrawal
+	ledger.SetInitialBalances(40, map[string]float64{})
+
+	displayed := runNDCTerminal(t, host, ndcTestPAN+"\n1234\nA\n100\nexit\n")
+	if !strings.Contains(displayed, "Unable to complete your transaction. This machine can only dispense $40.00 of the requested $100.00.\n") {
+		t.Errorf("expected the withdrawal to be declined in\n%s", displayed)
+	}
+	if history := hostLedger.GetHistory(accountId); len(history) != 0 {
+		t.Errorf("expected nothing to be posted got %+v", history)
+	}
+	if cash := ledger.GetAvailableCash(); cash != 40 {
+		t.Errorf("expected the terminal's cash to be untouched got %.2f", cash)
+	}
+}
+
+func TestNDCTerminalDevices(t *testing.T) {
+	const accountId = "jc123"
+	InitLogger("", true)
+	host, hostLedger := newNDCTestHost(t, accountId, 300.00)
+	ledger.SetInitialBalances(1000, map[string]float64{})
+	devices := NewScriptedDevices(ndcTestPAN, "1234", "A", "60", ndcTestPAN, "1234", "A", "40", "exit")
+	dispenser := devices.CashDispenser.(*SimulatedCashDispenser)
+	if err := dispenser.Inject(DispenserJam, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// the jammed withdrawal is reversed, and the jam keeps the dispenser out of service so the second is declined
+	runNDCTerminalOn(t, host, devices)
+	displayed := devices.Display.(*ScriptedDisplay).Text()
+	if !strings.Contains(displayed, "Unable to dispense your cash.\n") || !strings.Contains(displayed, "Unable to complete your transaction.") {
+		t.Errorf("expected both withdrawals to fail in\n%s", displayed)
+	}
+	if balance := hostLedger.GetBalance(accountId); balance != 300.00 {
+		t.Errorf("expected the host to reverse the withdrawal got %.2f", balance)
+	}
+	history := hostLedger.GetHistory(accountId)
+	if len(history) != 2 || history[1].Type != ReversalTransaction || history[1].ParentId != history[0].Id || history[1].TerminalId != "001" {
+		t.Errorf("unexpected history %+v", history)
+	}
+	status := dispenser.Details()
+	if status.Fault != DispenserJam || status.RejectBin != 20 || ledger.GetAvailableCash() != 980 {
+		t.Errorf("expected the jammed note to be in the reject bin got %+v cash %.2f", status, ledger.GetAvailableCash())
+	}
+	if reader := devices.CardReader.(*ScriptedCardReader); reader.Ejected != 2 || reader.Card != "" {
+		t.Errorf("expected both cards to be ejected got %+v", reader)
+	}
+}
+
+func TestNDCTerminalAESPINPad(t *testing.T) {
+	const accountId = "jc123"
+	InitLogger("", true)
+	host, hostLedger := newNDCTestHost(t, accountId, 300.00)
+	ledger.SetInitialBalances(1000, map[string]float64{})
+	useTestSecurityModule(t)
+	previous := GetPINPad()
+	SetPINPad(NewSimulatorPINPad("", true))
+	defer SetPINPad(previous)
+
+	displayed := runNDCTerminal(t, host, ndcTestPAN+"\n1234\nA\n40\n"+ndcTestPAN+"\n4321\nC\nexit\n")
+	if balance := hostLedger.GetBalance(accountId); balance != 260.00 {
+		t.Errorf("expected the host to accept the AES PIN block got balance %.2f", balance)
+	}
+	if !strings.Contains(displayed, "Incorrect PIN, please try again.") {
+		t.Errorf("expected the wrong PIN to be rejected in\n%s", displayed)
+	}
+}
+
+// pinEntryRecorder is a scripted PIN pad recording the entries read as PINs
+type pinEntryRecorder struct {
+	ScriptedPINPad
+	pins []string
+}
+
+func (pad *pinEntryRecorder) GetPIN(pan string) (PINBlock, error) {
+	if len(pad.Entries) > 0 {
+		pad.pins = append(pad.pins, pad.Entries[0])
+	}
+	return pad.ScriptedPINPad.GetPIN(pan)
+}
+
+func TestNDCTerminalPINEntry(t *testing.T) {
+	const accountId = "jc123"
+	InitLogger("", true)
+	host, hostLedger := newNDCTestHost(t, accountId, 300.00)
+	ledger.SetInitialBalances(1000, map[string]float64{})
+	terminalConn, hostConn := net.Pipe()
+	go func() {
+		_ = host.ServeConn(hostConn)
+		hostConn.Close()
+	}()
+	devices := NewScriptedDevices()
+	pad := &pinEntryRecorder{ScriptedPINPad: ScriptedPINPad{Entries: []string{ndcTestPAN, "12", "1234", "A", "40", "exit"}}}
+	devices.PINPad = pad
+
+	if err := NewNDCTerminal(terminalConn, "001", devices).Run(); err != nil {
+		t.Fatal(err)
+	}
+	terminalConn.Close()
+	if len(pad.pins) != 2 || pad.pins[0] != "12" || pad.pins[1] != "1234" {
+		t.Errorf("expected the PINs to be entered on the PIN pad got %v", pad.pins)
+	}
+	displayed := devices.Display.(*ScriptedDisplay).Text()
+	if strings.Contains(displayed, "1234") || !strings.Contains(displayed, "the pin must be a 4-digit number\nPlease enter your PIN.\n") {
+		t.Errorf("expected the short PIN to be asked for again without showing the PIN in\n%s", displayed)
+	}
+	if balance := hostLedger.GetBalance(accountId); balance != 260.00 {
+		t.Errorf("expected the withdrawal to be posted got %.2f", balance)
+	}
+}
+
+func TestNDCHostSecondFactor(t *testing.T) {
+	const accountId = "jc123"
+	InitLogger("", true)
+	host, hostLedger := newNDCTestHost(t, accountId, 300.00)
+	ledger.SetInitialBalances(1000, map[string]float64{})
+	if _, err := host.auth.EnrollTOTP(accountId); err != nil {
+		t.Fatal(err)
+	}
+
+	// NDC terminals can not take a one-time code, so withdrawals that need one are declined
+	host.auth.SetSecondFactorPolicy(SecondFactorPolicy{WithdrawalThreshold: 100})
+	displayed := runNDCTerminal(t, host, ndcTestPAN+"\n1234\nA\n120\n"+ndcTestPAN+"\n1234\nA\n60\nexit\n")
+	if !strings.Contains(displayed, "Unable to complete your transaction. A one-time code is required. Please try again.\n") {
+		t.Errorf("expected the withdrawal over the threshold to be declined in\n%s", displayed)
+	}
+	if balance := hostLedger.GetBalance(accountId); balance != 240.00 {
+		t.Errorf("expected only the withdrawal under the threshold to be posted got %.2f", balance)
+	}
+
+	// as are accounts that need one to log in
+	host.auth.SetSecondFactorPolicy(SecondFactorPolicy{OnLogin: true})
+	displayed = runNDCTerminal(t, host, ndcTestPAN+"\n1234\nC\nexit\n")
+	if !strings.Contains(displayed, "Unable to complete your transaction. A one-time code is required. Please try again.\n") {
+		t.Errorf("expected the balance inquiry to be declined in\n%s", displayed)
+	}
+}
+
+func TestNDCHostRequestSentAgain(t *testing.T) {
+	const accountId = "jc123"
+	InitLogger("", true)
+	host, hostLedger := newNDCTestHost(t, accountId, 300.00)
+	request := func() *ndc.TransactionRequest {
+		pin := encryptTestPIN(t, "1234", ndcTestPAN)
+		return &ndc.TransactionRequest{LUNO: "001", TimeVariant: "101500", Coordination: "1", Track2: ndcTestPAN + "=4912101",
+			OperationCode: "A       ", Amount: toISOAmount(60), PINBuffer: hex.EncodeToString(pin.Block), BufferB: hex.EncodeToString(pin.KSN),
+			BufferC: toISOAmount(1000)}
+	}
+
+	// a withdrawal sent again is posted once
+	first, posted := host.authorize(request())
+	again, _ := host.authorize(request())
+	if posted == nil || first.Function != ndc.DispenseAndPrint || again.Function != ndc.DispenseAndPrint {
+		t.Fatalf("expected the withdrawal to be approved got %+v %+v", first, again)
+	}
+	if balance := hostLedger.GetBalance(accountId); balance != 240.00 {
+		t.Errorf("expected the withdrawal to be posted once got %.2f", balance)
+	}
+}
@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultOperatorTimeout is how long an operator stays signed on without running an operator command
+const DefaultOperatorTimeout = 5 * time.Minute
+
+// Operators holds the passcodes of the machine operators and which of them is signed on at the terminal
+type Operators struct {
+	lock      sync.Mutex
+	passcodes map[string]EncryptedPin
+	timeout   time.Duration
+	signedOn  string
+	lastUsed  time.Time
+}
+
+// the shared operators object
+var operators = &Operators{}
+
+func GetOperators() *Operators {
+	return operators
+}
+
+// SetOperators sets the operators with a map of operator id to the encrypted passcode, signing off the current one
+func (ops *Operators) SetOperators(passcodes map[string]EncryptedPin) {
+	ops.lock.Lock()
+	defer ops.lock.Unlock()
+	ops.passcodes = passcodes
+	ops.signedOn = ""
+}
+
+// SetTimeout sets how long an operator stays signed on while idle, 0 for the default
+func (ops *Operators) SetTimeout(timeout time.Duration) {
+	ops.lock.Lock()
+	defer ops.lock.Unlock()
+	ops.timeout = timeout
+}
+
+// SignOn signs the operator on when the passcode matches, reporting whether it did
+func (ops *Operators) SignOn(operatorId string, passcode string) bool {
+	ops.lock.Lock()
+	defer ops.lock.Unlock()
+	stored, ok := ops.passcodes[operatorId]
+	if !ok || passcode == "" || !comparePins(passcode, stored.encryptedPin, stored.salt) {
+		return false
+	}
+	ops.signedOn = operatorId
+	ops.lastUsed = clock.Now()
+	return true
+}
+
+// SignOff signs off the operator, returning who was signed on
+func (ops *Operators) SignOff() string {
+	ops.lock.Lock()
+	defer ops.lock.Unlock()
+	operatorId := ops.signedOn
+	ops.signedOn = ""
+	return operatorId
+}
+
+// SignedOn returns the operator signed on at the terminal, extending their sign on, or "" when there is none
+// or they have been idle for longer than the timeout
+func (ops *Operators) SignedOn() string {
+	ops.lock.Lock()
+	defer ops.lock.Unlock()
+	timeout := ops.timeout
+	if timeout == 0 {
+		timeout = DefaultOperatorTimeout
+	}
+	now := clock.Now()
+	if ops.signedOn != "" && now.Sub(ops.lastUsed) >= timeout {
+		Logger.Printf("operator %s signed off after %s idle\n", ops.signedOn, timeout)
+		ops.signedOn = ""
+	}
+	if ops.signedOn != "" {
+		ops.lastUsed = now
+	}
+	return ops.signedOn
+}
@@ -0,0 +1,258 @@
+// Package pinblock builds and reads the ISO 9564-1 PIN block formats 0, 1, 3 and 4 and encrypts them:
+// formats 0, 1 and 3 are 8 byte blocks encrypted with TDES, format 4 is a 16 byte block encrypted with AES.
+// Formats 0, 3 and 4 bind the PIN to the card's PAN so that a block can not be replayed for another card
+package pinblock
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Format is the ISO 9564-1 PIN block format
+type Format int
+
+const (
+	// Format0 is the PIN filled with F, XOR'd with the PAN
+	Format0 Format = 0
+	// Format1 is the PIN with random fill, for when there is no PAN
+	Format1 Format = 1
+	// Format3 is the PIN with random fill from A to F, XOR'd with the PAN
+	Format3 Format = 3
+	// Format4 is the AES block of the PIN with random fill, enciphered together with the PAN
+	Format4 Format = 4
+)
+
+const (
+	minPINLength = 4
+	maxPINLength = 12
+)
+
+// BlockSize is the length of a PIN block of the format
+func (format Format) BlockSize() int {
+	if format == Format4 {
+		return aes.BlockSize
+	}
+	return des.BlockSize
+}
+
+// UsesPAN tells whether the format binds the PIN to the PAN
+func (format Format) UsesPAN() bool {
+	return format != Format1
+}
+
+// Encode builds the clear PIN block of format 0, 1 or 3
+func Encode(format Format, pin string, pan string) ([]byte, error) {
+	if err := checkPIN(pin); err != nil {
+		return nil, err
+	}
+	var fill string
+	switch format {
+	case Format0:
+		fill = strings.Repeat("F", 14)
+	case Format1:
+		fill = randomHex(14, "0123456789ABCDEF")
+	case Format3:
+		fill = randomHex(14, "ABCDEF")
+	default:
+		return nil, fmt.Errorf("format %d is not an 8 byte PIN block format", format)
+	}
+	block, _ := hex.DecodeString(fmt.Sprintf("%d%X%s%s", format, len(pin), pin, fill)[:16])
+	if !format.UsesPAN() {
+		return block, nil
+	}
+	panField, err := panBlock(pan)
+	if err != nil {
+		return nil, err
+	}
+	return xor(block, panField), nil
+}
+
+// Decode reads the PIN from a clear PIN block of format 0, 1 or 3
+func Decode(format Format, block []byte, pan string) (string, error) {
+	if len(block) != des.BlockSize {
+		return "", fmt.Errorf("a format %d PIN block must be %d bytes, not %d", format, des.BlockSize, len(block))
+	}
+	if format.UsesPAN() {
+		panField, err := panBlock(pan)
+		if err != nil {
+			return "", err
+		}
+		block = xor(block, panField)
+	}
+	digits := strings.ToUpper(hex.EncodeToString(block))
+	var fill string
+	switch format {
+	case Format0:
+		fill = "F"
+	case Format1:
+		fill = "0123456789ABCDEF"
+	case Format3:
+		fill = "ABCDEF"
+	default:
+		return "", fmt.Errorf("format %d is not an 8 byte PIN block format", format)
+	}
+	return readPINField(format, digits, fill)
+}
+
+// Encrypt builds a PIN block and encrypts it with key: a double or triple length TDES key for formats 0, 1 and 3,
+// an AES key for format 4
+func Encrypt(format Format, key []byte, pin string, pan string) ([]byte, error) {
+	if format == Format4 {
+		return encryptFormat4(key, pin, pan)
+	}
+	block, err := Encode(format, pin, pan)
+	if err != nil {
+		return nil, err
+	}
+	cipher, err := tdesCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	cipher.Encrypt(block, block)
+	return block, nil
+}
+
+// Decrypt reads the PIN from a PIN block encrypted with key
+func Decrypt(format Format, key []byte, block []byte, pan string) (string, error) {
+	if len(block) != format.BlockSize() {
+		return "", fmt.Errorf("a format %d PIN block must be %d bytes, not %d", format, format.BlockSize(), len(block))
+	}
+	if format == Format4 {
+		return decryptFormat4(key, block, pan)
+	}
+	cipher, err := tdesCipher(key)
+	if err != nil {
+		return "", err
+	}
+	clear := make([]byte, len(block))
+	cipher.Decrypt(clear, block)
+	return Decode(format, clear, pan)
+}
+
+// encryptFormat4 enciphers the PIN field, XORs it with the PAN field and enciphers the result again.
+// The PIN field is 4, the PIN length, the PIN, A fill to 16 digits then 16 digits of random fill
+func encryptFormat4(key []byte, pin string, pan string) ([]byte, error) {
+	if err := checkPIN(pin); err != nil {
+		return nil, err
+	}
+	panField, err := format4PANField(pan)
+	if err != nil {
+		return nil, err
+	}
+	cipher, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	pinField := fmt.Sprintf("4%X%s%s", len(pin), pin, strings.Repeat("A", 14))[:16] + randomHex(16, "0123456789ABCDEF")
+	block, _ := hex.DecodeString(pinField)
+	cipher.Encrypt(block, block)
+	block = xor(block, panField)
+	cipher.Encrypt(block, block)
+	return block, nil
+}
+
+func decryptFormat4(key []byte, block []byte, pan string) (string, error) {
+	panField, err := format4PANField(pan)
+	if err != nil {
+		return "", err
+	}
+	cipher, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	clear := make([]byte, len(block))
+	cipher.Decrypt(clear, block)
+	clear = xor(clear, panField)
+	cipher.Decrypt(clear, clear)
+	digits := strings.ToUpper(hex.EncodeToString(clear))
+	return readPINField(Format4, digits[:16], "A")
+}
+
+// readPINField reads the format, PIN length and PIN, checking the fill after the PIN is made up of fill characters
+func readPINField(format Format, digits string, fill string) (string, error) {
+	if digits[0] != strconv.Itoa(int(format))[0] {
+		return "", fmt.Errorf("not a format %d PIN block", format)
+	}
+	length, err := strconv.ParseInt(digits[1:2], 16, 64)
+	if err != nil || length < minPINLength || length > maxPINLength {
+		return "", fmt.Errorf("invalid PIN length in the PIN block")
+	}
+	pin := digits[2 : 2+length]
+	if strings.Trim(pin, "0123456789") != "" || strings.Trim(digits[2+length:], fill) != "" {
+		return "", fmt.Errorf("invalid PIN block")
+	}
+	return pin, nil
+}
+
+// panBlock is 0000 and the 12 rightmost digits of the PAN without its check digit
+func panBlock(pan string) ([]byte, error) {
+	if err := checkPAN(pan); err != nil {
+		return nil, err
+	}
+	digits := strings.Repeat("0", 12) + pan[:len(pan)-1]
+	return hex.DecodeString("0000" + digits[len(digits)-12:])
+}
+
+// format4PANField is the PAN length less 12, then the PAN, left filled with zeros to 12 digits
+// when shorter, followed by zeros to 32 digits
+func format4PANField(pan string) ([]byte, error) {
+	if err := checkPAN(pan); err != nil {
+		return nil, err
+	}
+	length := 0
+	if len(pan) > 12 {
+		length = len(pan) - 12
+	} else {
+		pan = strings.Repeat("0", 12-len(pan)) + pan
+	}
+	field := fmt.Sprintf("%d%s", length, pan)
+	return hex.DecodeString(field + strings.Repeat("0", 32-len(field)))
+}
+
+func checkPIN(pin string) error {
+	if len(pin) < minPINLength || len(pin) > maxPINLength || strings.Trim(pin, "0123456789") != "" {
+		return fmt.Errorf("a PIN must be %d to %d digits", minPINLength, maxPINLength)
+	}
+	return nil
+}
+
+func checkPAN(pan string) error {
+	if len(pan) < 2 || len(pan) > 19 || strings.Trim(pan, "0123456789") != "" {
+		return fmt.Errorf("a PAN is needed for the PIN block and must be up to 19 digits")
+	}
+	return nil
+}
+
+func tdesCipher(key []byte) (cipher.Block, error) {
+	if len(key) == 16 {
+		key = append(append([]byte{}, key...), key[:8]...)
+	}
+	return des.NewTripleDESCipher(key)
+}
+
+// randomHex is count random characters from characters, which has up to 16 of them
+func randomHex(count int, characters string) string {
+	random := make([]byte, count)
+	if _, err := io.ReadFull(rand.Reader, random); err != nil {
+		panic(fmt.Sprintf("unable to generate the PIN block fill: %v", err))
+	}
+	for i := range random {
+		random[i] = characters[int(random[i])%len(characters)]
+	}
+	return string(random)
+}
+
+func xor(a []byte, b []byte) []byte {
+	result := make([]byte, len(a))
+	for i := range a {
+		result[i] = a[i] ^ b[i]
+	}
+	return result
+}
@@ -0,0 +1,111 @@
+package pinblock
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestEncodeFormat0(t *testing.T) {
+	// the examples from ISO 9564-1 and ANSI X9.24-1
+	for _, test := range []struct{ pin, pan, block string }{
+		{"1234", "43219876543210987", "0412AC89ABCDEF67"},
+		{"1234", "4012345678909", "041274EDCBA9876F"},
+	} {
+		block, err := Encode(Format0, test.pin, test.pan)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.ToUpper(hex.EncodeToString(block)) != test.block {
+			t.Errorf("expected %s for %s got %X", test.block, test.pan, block)
+		}
+		pin, err := Decode(Format0, block, test.pan)
+		if err != nil || pin != test.pin {
+			t.Errorf("expected %s got %s %v", test.pin, pin, err)
+		}
+	}
+}
+
+func TestEncodeRandomFill(t *testing.T) {
+	for _, format := range []Format{Format1, Format3} {
+		block, err := Encode(format, "123456", "4012345678909")
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, _ := Encode(format, "123456", "4012345678909")
+		if bytes.Equal(block, again) {
+			t.Errorf("expected format %d blocks to differ in their fill", format)
+		}
+		pin, err := Decode(format, block, "4012345678909")
+		if err != nil || pin != "123456" {
+			t.Errorf("expected 123456 from format %d got %s %v", format, pin, err)
+		}
+	}
+	// format 3 is bound to the PAN, format 1 is not
+	block, _ := Encode(Format3, "1234", "4012345678909")
+	if _, err := Decode(Format3, block, "4111111111111111"); err == nil {
+		t.Errorf("expected a format 3 block to be rejected for another PAN")
+	}
+	block, _ = Encode(Format1, "1234", "")
+	if pin, err := Decode(Format1, block, ""); err != nil || pin != "1234" {
+		t.Errorf("expected a format 1 block without a PAN got %s %v", pin, err)
+	}
+}
+
+func TestEncrypt(t *testing.T) {
+	// the PIN key for the first transaction of the ANSI X9.24-1 test KSN
+	tdesKey, _ := hex.DecodeString("042666B49184CF5C68DE9628D0397B36")
+	block, err := Encrypt(Format0, tdesKey, "1234", "4012345678909")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.ToUpper(hex.EncodeToString(block)) != "1B9C1845EB993A7A" {
+		t.Errorf("unexpected encrypted PIN block %X", block)
+	}
+	if pin, err := Decrypt(Format0, tdesKey, block, "4012345678909"); err != nil || pin != "1234" {
+		t.Errorf("expected 1234 got %s %v", pin, err)
+	}
+
+	aesKey, _ := hex.DecodeString("AF8CB133A78F8DC2D1359F18527593FB")
+	block, err = Encrypt(Format4, aesKey, "1234", "432198765432109870")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(block) != aes.BlockSize {
+		t.Fatalf("expected a 16 byte format 4 block got %d", len(block))
+	}
+	if pin, err := Decrypt(Format4, aesKey, block, "432198765432109870"); err != nil || pin != "1234" {
+		t.Errorf("expected 1234 got %s %v", pin, err)
+	}
+	// undo the second encipherment and the PAN by hand to check the PIN field
+	cipher, _ := aes.NewCipher(aesKey)
+	clear := make([]byte, len(block))
+	cipher.Decrypt(clear, block)
+	panField, _ := hex.DecodeString("64321987654321098700000000000000")
+	cipher.Decrypt(clear, xor(clear, panField))
+	if field := strings.ToUpper(hex.EncodeToString(clear)); !strings.HasPrefix(field, "441234AAAAAAAAAA") {
+		t.Errorf("unexpected format 4 PIN field %s", field)
+	}
+	if _, err := Decrypt(Format4, aesKey, block, "4321987654321098"); err == nil {
+		t.Errorf("expected a format 4 block to be rejected for another PAN")
+	}
+}
+
+func TestInvalidPINs(t *testing.T) {
+	for _, pin := range []string{"", "123", "1234567890123", "12a4"} {
+		if _, err := Encode(Format0, pin, "4012345678909"); err == nil {
+			t.Errorf("expected PIN %q to be rejected", pin)
+		}
+	}
+	if _, err := Encode(Format0, "1234", ""); err == nil {
+		t.Errorf("expected a format 0 block without a PAN to be rejected")
+	}
+	if _, err := Encode(Format4, "1234", "4012345678909"); err == nil {
+		t.Errorf("expected Encode to reject format 4, which is only encrypted")
+	}
+	if _, err := Decode(Format0, []byte{0, 1, 2}, "4012345678909"); err == nil {
+		t.Errorf("expected a short block to be rejected")
+	}
+}
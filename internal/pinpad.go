@@ -0,0 +1,420 @@
+package internal
+
+import (
+	"agile-coder.com/atm-sim/internal/dukpt"
+	"agile-coder.com/atm-sim/internal/pinblock"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strings"
+	"sync"
+)
+
+// the simulator's keys are the test keys published with ANSI X9.24 so that its PIN blocks can be checked with other tools.
+// A real host keeps its BDKs in a hardware security module and terminals are only loaded with their initial keys.
+// Each terminal's KSN is the key set id followed by a device id derived from its terminal id
+var (
+	simulatorTDESBDK      = mustDecodeHex("0123456789ABCDEFFEDCBA9876543210")
+	simulatorTDESKeySetId = mustDecodeHex("FFFF987654")
+	simulatorAESBDK       = mustDecodeHex("FEDCBA9876543210F1F1F1F1F1F1F1F1")
+	simulatorAESKeySetId  = mustDecodeHex("12345678")
+	simulatorZonePINKey   = mustDecodeHex("A1B2C3D4E5F60718293A4B5C6D7E8F90")
+)
+
+// noPAN binds a format 4 PIN block when the customer logs in with an account number instead of a card
+const noPAN = "000000000000"
+
+// PINBlock is a customer's PIN as it travels from the PIN pad to the host: an ISO 9564 PIN block
+// encrypted under the DUKPT key for its key serial number
+type PINBlock struct {
+	Format pinblock.Format
+	Block  []byte
+	// KSN identifies the terminal's key and transaction counter, 10 bytes for TDES and 12 for AES.
+	// A block without one is encrypted under the zone PIN key shared between hosts, and is only accepted from TranslatePIN
+	KSN []byte
+	// PAN is the card number formats 0, 3 and 4 are bound to
+	PAN string
+}
+
+// PINPad encrypts the PINs entered at the terminal, each under a new key derived from the initial key it was loaded with
+type PINPad struct {
+	lock       sync.Mutex
+	initialKey []byte
+	ksn        []byte
+	// ksnPath is where the KSN of the last PIN encrypted is kept, if anywhere
+	ksnPath string
+	// Format is used for PINs entered with a card, format 1 is used without one for TDES
+	Format pinblock.Format
+}
+
+// NewTDESPINPad loads a PIN pad with the IPEK derived for its KSN, encrypting format 0 PIN blocks
+func NewTDESPINPad(ipek []byte, ksn []byte) (*PINPad, error) {
+	if len(ipek) != 16 || len(ksn) != dukpt.TDESKSNLength {
+		return nil, &InvalidInputError{"a TDES PIN pad needs a 16 byte IPEK and a 10 byte KSN"}
+	}
+	return &PINPad{initialKey: ipek, ksn: ksn, Format: pinblock.Format0}, nil
+}
+
+// NewAESPINPad loads a PIN pad with the initial key derived for its KSN, encrypting format 4 PIN blocks
+func NewAESPINPad(initialKey []byte, ksn []byte) (*PINPad, error) {
+	if len(ksn) != dukpt.AESKSNLength {
+		return nil, &InvalidInputError{"an AES PIN pad needs a 12 byte KSN"}
+	}
+	return &PINPad{initialKey: initialKey, ksn: ksn, Format: pinblock.Format4}, nil
+}
+
+// NewSimulatorPINPad loads a PIN pad with the initial key for the terminal's KSN under the simulator's BDK,
+// as a key injection facility would
+func NewSimulatorPINPad(terminalId string, useAES bool) *PINPad {
+	hash := fnv.New32a()
+	hash.Write([]byte(terminalId))
+	if useAES {
+		ksn, err := dukpt.TerminalKSN(simulatorAESKeySetId, hash.Sum32())
+		if err != nil {
+			panic(fmt.Sprintf("unable to create the simulator's KSN: %v", err))
+		}
+		initialKey, err := dukpt.AESInitialKey(simulatorAESBDK, ksn)
+		if err != nil {
+			panic(fmt.Sprintf("unable to derive the simulator's initial key: %v", err))
+		}
+		pad, _ := NewAESPINPad(initialKey, ksn)
+		return pad
+	}
+	ksn, err := dukpt.TerminalKSN(simulatorTDESKeySetId, hash.Sum32()&0x7FFFF)
+	if err != nil {
+		panic(fmt.Sprintf("unable to create the simulator's KSN: %v", err))
+	}
+	ipek, err := dukpt.TDESInitialKey(simulatorTDESBDK, ksn)
+	if err != nil {
+		panic(fmt.Sprintf("unable to derive the simulator's initial key: %v", err))
+	}
+	pad, _ := NewTDESPINPad(ipek, ksn)
+	return pad
+}
+
+// pinPadState is what is kept of a PIN pad between runs
+type pinPadState struct {
+	KSN string `json:"ksn"`
+}
+
+// OpenKSNFile carries on from the KSN kept in path when it is for the PIN pad's initial key, then keeps the KSN of
+// each PIN encrypted there, so that the transaction counter is not reused after a restart
+func (pad *PINPad) OpenKSNFile(path string) error {
+	pad.lock.Lock()
+	defer pad.lock.Unlock()
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		var state pinPadState
+		if err := json.Unmarshal(data, &state); err != nil {
+			return err
+		}
+		saved, err := hex.DecodeString(state.KSN)
+		if err != nil {
+			return err
+		}
+		savedKeyId, savedCounter, err := dukpt.SplitKSN(saved)
+		if err != nil {
+			return err
+		}
+		keyId, counter, _ := dukpt.SplitKSN(pad.ksn)
+		if bytes.Equal(savedKeyId, keyId) && savedCounter > counter {
+			pad.ksn = saved
+		}
+	}
+	pad.ksnPath = path
+	return nil
+}
+
+// EncryptPIN advances the transaction counter and encrypts the PIN under its key, bound to pan when there is one
+func (pad *PINPad) EncryptPIN(pin string, pan string) (PINBlock, error) {
+	if err := validatePin(pin); err != nil {
+		return PINBlock{}, err
+	}
+	pad.lock.Lock()
+	defer pad.lock.Unlock()
+	format := pad.Format
+	if pan == "" && format == pinblock.Format4 {
+		pan = noPAN
+	} else if pan == "" && format.UsesPAN() {
+		format = pinblock.Format1
+	}
+	ksn, err := dukpt.NextKSN(pad.ksn)
+	if err != nil {
+		return PINBlock{}, err
+	}
+	if pad.ksnPath != "" {
+		if err := writeJSONFile(pad.ksnPath, pinPadState{KSN: strings.ToUpper(hex.EncodeToString(ksn))}); err != nil {
+			return PINBlock{}, err
+		}
+	}
+	pad.ksn = ksn
+	var key []byte
+	if len(ksn) == dukpt.AESKSNLength {
+		key, err = dukpt.AESWorkingKey(pad.initialKey, ksn, dukpt.PINEncryption)
+	} else {
+		key, err = dukpt.TDESPINKey(pad.initialKey, ksn)
+	}
+	if err != nil {
+		return PINBlock{}, err
+	}
+	block, err := pinblock.Encrypt(format, key, pin, pan)
+	if err != nil {
+		return PINBlock{}, &InvalidInputError{err.Error()}
+	}
+	return PINBlock{Format: format, Block: block, KSN: ksn, PAN: pan}, nil
+}
+
+// the shared PIN pad of this terminal
+var pinPad = NewSimulatorPINPad("", false)
+
+func GetPINPad() *PINPad {
+	return pinPad
+}
+
+func SetPINPad(pad *PINPad) {
+	pinPad = pad
+}
+
+// SecurityModule holds the host's base derivation keys. PIN blocks are decrypted and re-encrypted inside it so that
+// the host only sees a PIN in the clear to check it
+type SecurityModule struct {
+	tdesBDK []byte
+	aesBDK  []byte
+	// zonePINKey encrypts PIN blocks translated for another host
+	zonePINKey []byte
+	lock       sync.Mutex
+	// map of initial key id to the last transaction counter a PIN block was decrypted for, so that blocks can not be replayed
+	counters map[string]uint32
+	// countersPath is where the counters are kept, if anywhere
+	countersPath string
+}
+
+// securityModuleState is what is kept of a security module between runs
+type securityModuleState struct {
+	Counters map[string]uint32 `json:"counters"`
+}
+
+func NewSecurityModule(tdesBDK []byte, aesBDK []byte, zonePINKey []byte) *SecurityModule {
+	return &SecurityModule{tdesBDK: tdesBDK, aesBDK: aesBDK, zonePINKey: zonePINKey, counters: map[string]uint32{}}
+}
+
+// the shared security module of this host
+var securityModule = NewSecurityModule(simulatorTDESBDK, simulatorAESBDK, simulatorZonePINKey)
+
+func GetSecurityModule() *SecurityModule {
+	return securityModule
+}
+
+func SetSecurityModule(module *SecurityModule) {
+	securityModule = module
+}
+
+// OpenCounterFile carries on from the transaction counters kept in path, then keeps the counters there as PIN blocks
+// are decrypted, so that a block can not be replayed after a restart. Counters kept by other hosts sharing the file
+// are merged in rather than overwritten
+func (module *SecurityModule) OpenCounterFile(path string) error {
+	module.lock.Lock()
+	defer module.lock.Unlock()
+	saved, err := readCounterFile(path)
+	if err != nil {
+		return err
+	}
+	mergeCounters(module.counters, saved)
+	module.countersPath = path
+	return nil
+}
+
+func readCounterFile(path string) (map[string]uint32, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return map[string]uint32{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state securityModuleState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return state.Counters, nil
+}
+
+// mergeCounters keeps the later of each counter
+func mergeCounters(counters map[string]uint32, saved map[string]uint32) {
+	for id, counter := range saved {
+		if last, ok := counters[id]; !ok || counter > last {
+			counters[id] = counter
+		}
+	}
+}
+
+// TranslatePIN re-encrypts a PIN block from the terminal's DUKPT key to the zone PIN key, as format 0 when
+// it is bound to a card and format 1 otherwise
+func (module *SecurityModule) TranslatePIN(block PINBlock) (PINBlock, error) {
+	pin, err := module.decryptPIN(block)
+	if err != nil {
+		return PINBlock{}, err
+	}
+	pan, format := block.PAN, pinblock.Format0
+	if pan == "" || pan == noPAN {
+		pan, format = "", pinblock.Format1
+	}
+	translated, err := pinblock.Encrypt(format, module.zonePINKey, pin, pan)
+	if err != nil {
+		return PINBlock{}, &InvalidInputError{err.Error()}
+	}
+	return PINBlock{Format: format, Block: translated, PAN: pan}, nil
+}
+
+// decryptPIN derives the key for a block from a terminal from its KSN. A block without one is refused, as one under
+// the zone PIN key could be replayed
+func (module *SecurityModule) decryptPIN(block PINBlock) (string, error) {
+	var key []byte
+	var err error
+	switch len(block.KSN) {
+	case 0:
+		Logger.Printf("PIN block refused: it has no KSN\n")
+		return "", &InvalidInputError{"the PIN block has no KSN"}
+	case dukpt.TDESKSNLength:
+		var ipek []byte
+		if ipek, err = dukpt.TDESInitialKey(module.tdesBDK, block.KSN); err == nil {
+			key, err = dukpt.TDESPINKey(ipek, block.KSN)
+		}
+	case dukpt.AESKSNLength:
+		var initialKey []byte
+		if initialKey, err = dukpt.AESInitialKey(module.aesBDK, block.KSN); err == nil {
+			key, err = dukpt.AESWorkingKey(initialKey, block.KSN, dukpt.PINEncryption)
+		}
+	default:
+		err = fmt.Errorf("a KSN must be %d or %d bytes", dukpt.TDESKSNLength, dukpt.AESKSNLength)
+	}
+	if err != nil {
+		return "", &InvalidInputError{"unable to derive the PIN key: " + err.Error()}
+	}
+	pin, err := pinblock.Decrypt(block.Format, key, block.Block, block.PAN)
+	if err != nil {
+		return "", &InvalidInputError{"unable to read the PIN block: " + err.Error()}
+	}
+	if err := module.useKSN(block.KSN); err != nil {
+		return "", err
+	}
+	return pin, nil
+}
+
+// decryptTranslatedPIN decrypts a block TranslatePIN re-encrypted under the zone PIN key
+func (module *SecurityModule) decryptTranslatedPIN(block PINBlock) (string, error) {
+	if len(block.KSN) > 0 {
+		return "", &InvalidInputError{"the PIN block is not under the zone PIN key"}
+	}
+	pin, err := pinblock.Decrypt(block.Format, module.zonePINKey, block.Block, block.PAN)
+	if err != nil {
+		return "", &InvalidInputError{"unable to read the PIN block: " + err.Error()}
+	}
+	return pin, nil
+}
+
+// useKSN records the transaction counter of a KSN, refusing one that is not past the last counter seen for its initial key
+func (module *SecurityModule) useKSN(ksn []byte) error {
+	initialKeyId, counter, err := dukpt.SplitKSN(ksn)
+	if err != nil {
+		return &InvalidInputError{err.Error()}
+	}
+	module.lock.Lock()
+	defer module.lock.Unlock()
+	id := hex.EncodeToString(initialKeyId)
+	if last, ok := module.counters[id]; ok && counter <= last {
+		Logger.Printf("PIN block refused: KSN %X has already been used\n", ksn)
+		return &InvalidInputError{"the PIN block's KSN has already been used"}
+	}
+	if module.countersPath == "" {
+		module.counters[id] = counter
+		return nil
+	}
+	// another host sharing the file may have seen the counter since it was opened
+	saved, err := readCounterFile(module.countersPath)
+	if err != nil {
+		return err
+	}
+	if last, ok := saved[id]; ok && counter <= last {
+		mergeCounters(module.counters, saved)
+		Logger.Printf("PIN block refused: KSN %X has already been used\n", ksn)
+		return &InvalidInputError{"the PIN block's KSN has already been used"}
+	}
+	saved[id] = counter
+	mergeCounters(module.counters, saved)
+	return writeJSONFile(module.countersPath, securityModuleState{Counters: module.counters})
+}
+
+// pinPadKeys remembers the terminal each PIN pad key was used by. Terminals whose device ids collide, such as two left
+// with the default terminal id or two whose ids hash to the same TDES device id, share a key and its transaction counter,
+// so a key used by a second terminal is refused
+type pinPadKeys struct {
+	lock sync.Mutex
+	// map of initial key id to the terminal that used it
+	terminals map[string]string
+}
+
+// check records the terminal a PIN block with a KSN came from, refusing it when another terminal has used its key.
+// Blocks from an unknown terminal are not checked
+func (keys *pinPadKeys) check(terminalId string, block PINBlock) error {
+	if terminalId == "" || len(block.KSN) == 0 {
+		return nil
+	}
+	initialKeyId, _, err := dukpt.SplitKSN(block.KSN)
+	if err != nil {
+		return &InvalidInputError{err.Error()}
+	}
+	keys.lock.Lock()
+	defer keys.lock.Unlock()
+	if keys.terminals == nil {
+		keys.terminals = map[string]string{}
+	}
+	id := hex.EncodeToString(initialKeyId)
+	if owner, ok := keys.terminals[id]; ok && owner != terminalId {
+		Logger.Printf("PIN block from %s refused: its PIN pad key %X is used by %s, the terminals need distinct ids\n", terminalId, initialKeyId, owner)
+		return &InvalidInputError{fmt.Sprintf("the PIN pad key is used by terminal %s", owner)}
+	}
+	keys.terminals[id] = terminalId
+	return nil
+}
+
+// VerifyPINBlock decrypts the PIN block from a terminal in the security module and checks the PIN against the account's.
+// A block bound to a card is only accepted for the accounts the card is linked to
+func (auth *Authorization) VerifyPINBlock(accountId string, block PINBlock) (bool, error) {
+	pin, err := securityModule.decryptPIN(block)
+	if err != nil {
+		return false, err
+	}
+	return auth.verifyPIN(accountId, block, pin)
+}
+
+// verifyTranslatedPIN checks a PIN block the security module translated to the zone PIN key with TranslatePIN
+func (auth *Authorization) verifyTranslatedPIN(accountId string, block PINBlock) (bool, error) {
+	pin, err := securityModule.decryptTranslatedPIN(block)
+	if err != nil {
+		return false, err
+	}
+	return auth.verifyPIN(accountId, block, pin)
+}
+
+func (auth *Authorization) verifyPIN(accountId string, block PINBlock, pin string) (bool, error) {
+	if block.PAN != "" && block.PAN != noPAN && !auth.cardReader().LinksAccount(block.PAN, accountId) {
+		Logger.Printf("PIN block for %s refused: card %s is not linked to it\n", accountId, MaskAccount(block.PAN))
+		return false, nil
+	}
+	return auth.Authenticate(accountId, pin)
+}
+
+func mustDecodeHex(value string) []byte {
+	decoded, err := hex.DecodeString(value)
+	if err != nil {
+		panic(err)
+	}
+	return decoded
+}
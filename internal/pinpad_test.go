@@ -0,0 +1,255 @@
+package internal
+
+import (
+	"agile-coder.com/atm-sim/internal/dukpt"
+	"agile-coder.com/atm-sim/internal/pinblock"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// encryptTestPIN encrypts a PIN at the terminal's PIN pad as a customer entering it would
+func encryptTestPIN(t *testing.T, pin string, pan string) PINBlock {
+	t.Helper()
+	block, err := GetPINPad().EncryptPIN(pin, pan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+// useTestSecurityModule gives the test a security module that has not seen any KSN, so that new PIN pads can be used
+func useTestSecurityModule(t *testing.T) {
+	t.Helper()
+	previous := GetSecurityModule()
+	SetSecurityModule(NewSecurityModule(simulatorTDESBDK, simulatorAESBDK, simulatorZonePINKey))
+	t.Cleanup(func() { SetSecurityModule(previous) })
+}
+
+// testCardReader links the card to the account
+func testCardReader(t *testing.T, pan string, accountId string) *CardReader {
+	t.Helper()
+	card, err := NewCard(pan, "12/49", "101", accountId, "active")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cards := &CardReader{}
+	cards.SetCards(map[string]Card{pan: card})
+	return cards
+}
+
+func TestSecurityModuleDecryptsPublishedBlock(t *testing.T) {
+	// the ANSI X9.24-1 PIN block for 1234 at the first transaction of the test KSN, the simulator uses the test BDK
+	block := PINBlock{Format: pinblock.Format0, Block: mustDecodeHex("1B9C1845EB993A7A"), KSN: mustDecodeHex("FFFF9876543210E00001"),
+		PAN: "4012345678909"}
+	module := NewSecurityModule(simulatorTDESBDK, simulatorAESBDK, simulatorZonePINKey)
+	pin, err := module.decryptPIN(block)
+	if err != nil || pin != "1234" {
+		t.Errorf("expected 1234 got %s %v", pin, err)
+	}
+	if _, err := module.decryptPIN(block); !errors.Is(err, &InvalidInputError{"the PIN block's KSN has already been used"}) {
+		t.Errorf("expected the block to be refused when it is sent again got %v", err)
+	}
+}
+
+func TestSecurityModuleCounterFile(t *testing.T) {
+	InitLogger("", true)
+	path := filepath.Join(t.TempDir(), "security-module-ksn.json")
+	pad := NewSimulatorPINPad("ATM00009", false)
+	first, err := pad.EncryptPIN("1234", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := pad.EncryptPIN("1234", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	module := NewSecurityModule(simulatorTDESBDK, simulatorAESBDK, simulatorZonePINKey)
+	if err := module.OpenCounterFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := module.decryptPIN(first); err != nil {
+		t.Fatal(err)
+	}
+
+	// a block is still refused after a restart, and by another host sharing the file
+	restarted := NewSecurityModule(simulatorTDESBDK, simulatorAESBDK, simulatorZonePINKey)
+	if err := restarted.OpenCounterFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restarted.decryptPIN(first); !errors.Is(err, &InvalidInputError{"the PIN block's KSN has already been used"}) {
+		t.Errorf("expected the block to be refused after a restart got %v", err)
+	}
+	if _, err := restarted.decryptPIN(second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := module.decryptPIN(second); !errors.Is(err, &InvalidInputError{"the PIN block's KSN has already been used"}) {
+		t.Errorf("expected the block another host decrypted to be refused got %v", err)
+	}
+	if err := os.WriteFile(path, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewSecurityModule(simulatorTDESBDK, simulatorAESBDK, simulatorZonePINKey).OpenCounterFile(path); err == nil {
+		t.Errorf("expected an unreadable counter file to be refused")
+	}
+}
+
+func TestPINPad(t *testing.T) {
+	const accountId = "jc123"
+	const pan = "4111111111111111"
+	encryptedPin, err := EncryptPin("1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &Authorization{}
+	auth.SetAuthData(map[string]EncryptedPin{accountId: encryptedPin})
+	auth.SetCardReader(testCardReader(t, pan, accountId))
+	useTestSecurityModule(t)
+
+	for _, test := range []struct {
+		name    string
+		pad     *PINPad
+		card    pinblock.Format
+		noCard  pinblock.Format
+		ksnSize int
+	}{
+		{"TDES", NewSimulatorPINPad("", false), pinblock.Format0, pinblock.Format1, 10},
+		{"AES", NewSimulatorPINPad("", true), pinblock.Format4, pinblock.Format4, 12},
+	} {
+		first, err := test.pad.EncryptPIN("1234", pan)
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := test.pad.EncryptPIN("1234", pan)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first.Format != test.card || len(first.KSN) != test.ksnSize || bytes.Equal(first.KSN, second.KSN) || bytes.Equal(first.Block, second.Block) {
+			t.Errorf("%s: expected a new key for each PIN got %+v and %+v", test.name, first, second)
+		}
+		if ok, err := auth.VerifyPINBlock(accountId, second); !ok || err != nil {
+			t.Errorf("%s: expected the PIN to be accepted got %t %v", test.name, ok, err)
+		}
+		wrong, _ := test.pad.EncryptPIN("4321", pan)
+		if ok, err := auth.VerifyPINBlock(accountId, wrong); ok || err != nil {
+			t.Errorf("%s: expected the wrong PIN to be rejected got %t %v", test.name, ok, err)
+		}
+		// a block bound to one card does not give the PIN for another, and a block can not be sent again
+		moved, _ := test.pad.EncryptPIN("1234", pan)
+		moved.PAN = "4000000000000002"
+		if ok, _ := auth.VerifyPINBlock(accountId, moved); ok {
+			t.Errorf("%s: expected a block presented with another card to be rejected", test.name)
+		}
+		otherCard, _ := test.pad.EncryptPIN("1234", "4000000000000002")
+		if ok, err := auth.VerifyPINBlock(accountId, otherCard); ok || err != nil {
+			t.Errorf("%s: expected a card not linked to the account to be rejected got %t %v", test.name, ok, err)
+		}
+		if ok, err := auth.VerifyPINBlock(accountId, second); ok || !errors.Is(err, &InvalidInputError{"the PIN block's KSN has already been used"}) {
+			t.Errorf("%s: expected a replayed block to be rejected got %t %v", test.name, ok, err)
+		}
+		withoutCard, err := test.pad.EncryptPIN("1234", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := auth.VerifyPINBlock(accountId, withoutCard); withoutCard.Format != test.noCard || !ok || err != nil {
+			t.Errorf("%s: expected a format %d block to be accepted got %+v %t %v", test.name, test.noCard, withoutCard, ok, err)
+		}
+	}
+	if _, err := GetPINPad().EncryptPIN("12", pan); !errors.Is(err, &InvalidInputError{"the pin must be a 4-digit number"}) {
+		t.Errorf("expected an invalid PIN to be rejected at the PIN pad got %v", err)
+	}
+}
+
+func TestTranslatePIN(t *testing.T) {
+	const accountId = "jc123"
+	encryptedPin, err := EncryptPin("1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &Authorization{}
+	auth.SetAuthData(map[string]EncryptedPin{accountId: encryptedPin})
+	auth.SetCardReader(testCardReader(t, "4111111111111111", accountId))
+	useTestSecurityModule(t)
+
+	for _, pan := range []string{"4111111111111111", ""} {
+		translated, err := GetSecurityModule().TranslatePIN(encryptTestPIN(t, "1234", pan))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if translated.KSN != nil || len(translated.Block) != 8 {
+			t.Errorf("expected a block under the zone PIN key got %+v", translated)
+		}
+		if ok, err := auth.verifyTranslatedPIN(accountId, translated); !ok || err != nil {
+			t.Errorf("expected the translated PIN to be accepted got %t %v", ok, err)
+		}
+		// a block under the zone PIN key is not accepted from a terminal, as it could be replayed
+		if ok, err := auth.VerifyPINBlock(accountId, translated); ok || !errors.Is(err, &InvalidInputError{"the PIN block has no KSN"}) {
+			t.Errorf("expected a block without a KSN to be refused got %t %v", ok, err)
+		}
+	}
+	aesBlock, err := NewSimulatorPINPad("", true).EncryptPIN("1234", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	translated, err := GetSecurityModule().TranslatePIN(aesBlock)
+	if err != nil || translated.Format != pinblock.Format1 {
+		t.Errorf("expected an AES block to be translated to format 1 got %+v %v", translated, err)
+	}
+	invalid := PINBlock{Format: pinblock.Format0, Block: []byte{1, 2, 3}, KSN: mustDecodeHex("FFFF9876543210E00000"), PAN: "4111111111111111"}
+	if _, err := GetSecurityModule().TranslatePIN(invalid); !errors.Is(err, &InvalidInputError{"unable to read the PIN block: a format 0 PIN block must be 8 bytes, not 3"}) {
+		t.Errorf("expected an invalid block to be rejected got %v", err)
+	}
+}
+
+func TestPINPadKSN(t *testing.T) {
+	first, err := NewSimulatorPINPad("ATM00001", false).EncryptPIN("1234", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewSimulatorPINPad("ATM00002", false).EncryptPIN("1234", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first.KSN[:5], simulatorTDESKeySetId) || bytes.Equal(first.KSN, other.KSN) {
+		t.Errorf("expected each terminal to have its own KSN got %X and %X", first.KSN, other.KSN)
+	}
+
+	// a PIN pad started again carries on from the last KSN it used
+	path := filepath.Join(t.TempDir(), "pinpad-ksn.json")
+	pad := NewSimulatorPINPad("ATM00001", false)
+	if err := pad.OpenKSNFile(path); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if first, err = pad.EncryptPIN("1234", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	restarted := NewSimulatorPINPad("ATM00001", false)
+	if err := restarted.OpenKSNFile(path); err != nil {
+		t.Fatal(err)
+	}
+	next, err := restarted.EncryptPIN("1234", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, counter, _ := dukpt.SplitKSN(next.KSN); counter != 4 {
+		t.Errorf("expected the counter to carry on from %X got %X", first.KSN, next.KSN)
+	}
+	// the KSN kept for another terminal's key is not used
+	another := NewSimulatorPINPad("ATM00002", false)
+	if err := another.OpenKSNFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if block, _ := another.EncryptPIN("1234", ""); !bytes.Equal(block.KSN, other.KSN) {
+		t.Errorf("expected the other terminal to start from its own KSN got %X", block.KSN)
+	}
+	if err := os.WriteFile(path, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewSimulatorPINPad("ATM00001", false).OpenKSNFile(path); err == nil {
+		t.Errorf("expected an unreadable KSN file to be refused")
+	}
+}
@@ -0,0 +1,216 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const receiptWidth = 32
+
+// ReceiptMode is how receipts are produced
+type ReceiptMode string
+
+const (
+	// ConsoleReceipt prints receipts to the console
+	ConsoleReceipt ReceiptMode = "console"
+	// FileReceipt writes each receipt to a text file
+	FileReceipt ReceiptMode = "file"
+	// EscPosReceipt writes each receipt as the ESC/POS byte stream sent to a thermal printer
+	EscPosReceipt ReceiptMode = "escpos"
+)
+
+// ParseReceiptMode reads a receipt mode: console, file or escpos
+func ParseReceiptMode(mode string) (ReceiptMode, error) {
+	switch ReceiptMode(mode) {
+	case ConsoleReceipt, FileReceipt, EscPosReceipt:
+		return ReceiptMode(mode), nil
+	}
+	return "", &InvalidInputError{fmt.Sprintf("unknown receipt mode \"%s\", expected console, file or escpos", mode)}
+}
+
+// ESC/POS commands used when printing receipts
+var (
+	escPosInitialize  = []byte{0x1b, 0x40}
+	escPosAlignLeft   = []byte{0x1b, 0x61, 0x00}
+	escPosAlignCenter = []byte{0x1b, 0x61, 0x01}
+	escPosBoldOn      = []byte{0x1b, 0x45, 0x01}
+	escPosBoldOff     = []byte{0x1b, 0x45, 0x00}
+	escPosFeedAndCut  = []byte{0x1d, 0x56, 0x42, 0x00}
+)
+
+// Receipt holds the details printed on a transaction receipt
+type Receipt struct {
+	TerminalId    string
+	AccountId     string
+	Date          time.Time
+	TransactionId string
+	Type          TransactionType
+	Amount        float64
+	Fee           float64
+	Balance       float64
+}
+
+// ReceiptPrinter produces receipts in the configured mode
+type ReceiptPrinter struct {
+	Mode ReceiptMode
+	// Dir is where file and ESC/POS receipts are written
+	Dir string
+	// Output is where console receipts are printed, defaults to stdout
+	Output io.Writer
+}
+
+// SetReceiptPrinter enables receipts on the terminal's devices, or disables them when printer is nil
+func SetReceiptPrinter(printer *ReceiptPrinter) {
+	if printer == nil {
+		devices.ReceiptPrinter = nil
+		return
+	}
+	devices.ReceiptPrinter = printer
+}
+
+// Status reports where receipts are printed
+func (printer *ReceiptPrinter) Status() DeviceStatus {
+	return DeviceStatus{Class: "PTR", State: DeviceOnline, Detail: string(printer.Mode) + " receipts"}
+}
+
+// NewReceipt creates a receipt for a transaction in the ledger history
+func NewReceipt(accountId string, entry LedgerHistoryEntry, fee float64, balance float64) *Receipt {
+	return &Receipt{
+		TerminalId:    entry.TerminalId,
+		AccountId:     accountId,
+		Date:          entry.Date,
+		TransactionId: entry.Id,
+		Type:          entry.Type,
+		Amount:        entry.Amount,
+		Fee:           fee,
+		Balance:       balance,
+	}
+}
+
+// NewWithdrawalReceipt creates a receipt for a withdrawal from the bank host's response, charging the overdraft fee
+// when the withdrawal overdrew the account
+func NewWithdrawalReceipt(accountId string, result *WithdrawResult) *Receipt {
+	fee := 0.0
+	if result.WasOverdrawn {
+		fee = OverdraftFee
+	}
+	entry := LedgerHistoryEntry{Id: result.TransactionId, Type: WithdrawalTransaction, TerminalId: ledger.terminalId,
+		Date: clock.Now(), Amount: -result.AmountWithdrawn}
+	return NewReceipt(accountId, entry, fee, result.RemainingBalance)
+}
+
+// NewDepositReceipt creates a receipt for a deposit from the bank host's response
+func NewDepositReceipt(accountId string, result *DepositResult) *Receipt {
+	return NewReceipt(accountId, result.Entry, 0, result.Entry.Balance)
+}
+
+// MaskAccount hides all but the last 4 characters of an account id
+func MaskAccount(accountId string) string {
+	if len(accountId) <= 4 {
+		return strings.Repeat("*", len(accountId))
+	}
+	return strings.Repeat("*", len(accountId)-4) + accountId[len(accountId)-4:]
+}
+
+// formatReceiptMoney formats an amount with the sign before the dollar sign
+func formatReceiptMoney(amount float64) string {
+	if amount < 0 {
+		return fmt.Sprintf("-$%.2f", -amount)
+	}
+	return fmt.Sprintf("$%.2f", amount)
+}
+
+// receiptLine left aligns the label and right aligns the value on a line of the receipt
+func receiptLine(label string, value string) string {
+	padding := receiptWidth - len(label) - len(value)
+	if padding < 1 {
+		padding = 1
+	}
+	return label + strings.Repeat(" ", padding) + value + "\n"
+}
+
+func centerReceiptLine(text string) string {
+	padding := (receiptWidth - len(text)) / 2
+	if padding < 0 {
+		padding = 0
+	}
+	return strings.Repeat(" ", padding) + text + "\n"
+}
+
+// body returns the lines of the receipt between the header and footer
+func (receipt *Receipt) body() string {
+	var body strings.Builder
+	body.WriteString(receiptLine("TERMINAL", receipt.TerminalId))
+	body.WriteString(receiptLine("DATE", receipt.Date.Format("2006-01-02 15:04:05")))
+	body.WriteString(receiptLine("ACCOUNT", MaskAccount(receipt.AccountId)))
+	body.WriteString(receiptLine("TRANSACTION", receipt.TransactionId))
+	amount := receipt.Amount
+	if amount < 0 {
+		amount = -amount
+	}
+	body.WriteString(receiptLine(strings.ToUpper(string(receipt.Type)), formatReceiptMoney(amount)))
+	if receipt.Fee != 0 {
+		body.WriteString(receiptLine("FEE", formatReceiptMoney(receipt.Fee)))
+	}
+	body.WriteString(receiptLine("BALANCE", formatReceiptMoney(receipt.Balance)))
+	return body.String()
+}
+
+// Text formats the receipt as plain text
+func (receipt *Receipt) Text() string {
+	separator := strings.Repeat("-", receiptWidth) + "\n"
+	return centerReceiptLine("ATM SIMULATOR") + separator + receipt.body() + separator + centerReceiptLine("THANK YOU")
+}
+
+// EscPos formats the receipt as the ESC/POS commands that print it on a thermal printer
+func (receipt *Receipt) EscPos() []byte {
+	var data bytes.Buffer
+	data.Write(escPosInitialize)
+	data.Write(escPosAlignCenter)
+	data.Write(escPosBoldOn)
+	data.WriteString("ATM SIMULATOR\n")
+	data.Write(escPosBoldOff)
+	data.Write(escPosAlignLeft)
+	data.WriteString(strings.Repeat("-", receiptWidth) + "\n")
+	data.WriteString(receipt.body())
+	data.WriteString(strings.Repeat("-", receiptWidth) + "\n")
+	data.Write(escPosAlignCenter)
+	data.WriteString("THANK YOU\n\n\n")
+	data.Write(escPosFeedAndCut)
+	return data.Bytes()
+}
+
+// Print produces the receipt, returning the path of the file written for file and ESC/POS receipts
+func (printer *ReceiptPrinter) Print(receipt *Receipt) (string, error) {
+	switch printer.Mode {
+	case ConsoleReceipt:
+		output := printer.Output
+		if output == nil {
+			output = os.Stdout
+		}
+		_, err := io.WriteString(output, receipt.Text())
+		return "", err
+	case FileReceipt:
+		return printer.writeFile(receipt, "txt", []byte(receipt.Text()))
+	case EscPosReceipt:
+		return printer.writeFile(receipt, "bin", receipt.EscPos())
+	}
+	return "", &InvalidInputError{fmt.Sprintf("unknown receipt mode \"%s\"", printer.Mode)}
+}
+
+func (printer *ReceiptPrinter) writeFile(receipt *Receipt, extension string, data []byte) (string, error) {
+	if err := os.MkdirAll(printer.Dir, 0755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(printer.Dir, fmt.Sprintf("receipt-%s.%s", receipt.TransactionId, extension))
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return "", err
+	}
+	Logger.Printf("receipt for %s written to %s\n", receipt.TransactionId, path)
+	return path, nil
+}
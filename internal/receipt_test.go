@@ -0,0 +1,119 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testReceipt() *Receipt {
+	entry := LedgerHistoryEntry{
+		Id:         "0A1B2C3D4E5F",
+		Type:       WithdrawalTransaction,
+		TerminalId: "ATM00001",
+		Date:       time.Date(2026, 9, 14, 15, 4, 5, 0, time.UTC),
+		Amount:     -40,
+		Balance:    -20,
+	}
+	return NewReceipt("1434597300", entry, 5, -25)
+}
+
+func TestMaskAccount(t *testing.T) {
+	tests := map[string]string{
+		"1434597300": "******7300",
+		"jc123":      "*c123",
+		"123":        "***",
+	}
+	for account, expected := range tests {
+		if masked := MaskAccount(account); masked != expected {
+			t.Errorf("expected %s to be masked as %s but got %s", account, expected, masked)
+		}
+	}
+}
+
+func TestReceiptText(t *testing.T) {
+	expected := "         ATM SIMULATOR\n" +
+		"--------------------------------\n" +
+		"TERMINAL                ATM00001\n" +
+		"DATE         2026-09-14 15:04:05\n" +
+		"ACCOUNT               ******7300\n" +
+		"TRANSACTION         0A1B2C3D4E5F\n" +
+		"WITHDRAWAL                $40.00\n" +
+		"FEE                        $5.00\n" +
+		"BALANCE                  -$25.00\n" +
+		"--------------------------------\n" +
+		"           THANK YOU\n"
+	if text := testReceipt().Text(); text != expected {
+		t.Errorf("unexpected receipt text:\n%s", text)
+	}
+}
+
+func TestNewWithdrawalReceipt(t *testing.T) {
+	SetClock(NewFakeClock(time.Date(2026, 9, 14, 15, 4, 5, 0, time.UTC)))
+	defer SetClock(nil)
+	terminalId := GetLedgerService().GetTerminalId()
+	GetLedgerService().SetTerminalId("ATM00001")
+	defer GetLedgerService().SetTerminalId(terminalId)
+	result := &WithdrawResult{TransactionId: "0A1B2C3D4E5F", AmountWithdrawn: 40, RemainingBalance: -25, WasOverdrawn: true}
+	if text := NewWithdrawalReceipt("1434597300", result).Text(); text != testReceipt().Text() {
+		t.Errorf("unexpected receipt text:\n%s", text)
+	}
+}
+
+func TestReceiptEscPos(t *testing.T) {
+	data := testReceipt().EscPos()
+	if !bytes.HasPrefix(data, escPosInitialize) {
+		t.Errorf("expected the receipt to start by initializing the printer")
+	}
+	if !bytes.HasSuffix(data, escPosFeedAndCut) {
+		t.Errorf("expected the receipt to end by cutting the paper")
+	}
+	if !bytes.Contains(data, []byte("ACCOUNT               ******7300\n")) {
+		t.Errorf("expected the receipt to contain the masked account")
+	}
+}
+
+func TestReceiptPrinter(t *testing.T) {
+	InitLogger("", true)
+	var console bytes.Buffer
+	path, err := (&ReceiptPrinter{Mode: ConsoleReceipt, Output: &console}).Print(testReceipt())
+	if err != nil || path != "" {
+		t.Fatalf("unexpected result printing to the console %s %v", path, err)
+	}
+	if console.String() != testReceipt().Text() {
+		t.Errorf("unexpected console receipt %s", console.String())
+	}
+
+	dir := t.TempDir()
+	for mode, extension := range map[ReceiptMode]string{FileReceipt: "txt", EscPosReceipt: "bin"} {
+		path, err = (&ReceiptPrinter{Mode: mode, Dir: dir}).Print(testReceipt())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if path != filepath.Join(dir, "receipt-0A1B2C3D4E5F."+extension) {
+			t.Errorf("%s: unexpected receipt path %s", mode, path)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), "TRANSACTION         0A1B2C3D4E5F\n") {
+			t.Errorf("%s: receipt file is missing the transaction", mode)
+		}
+	}
+}
+
+func TestParseReceiptMode(t *testing.T) {
+	for _, mode := range []ReceiptMode{ConsoleReceipt, FileReceipt, EscPosReceipt} {
+		if parsed, err := ParseReceiptMode(string(mode)); parsed != mode || err != nil {
+			t.Errorf("expected %s got %s %v", mode, parsed, err)
+		}
+	}
+	if _, err := ParseReceiptMode("pdf"); !errors.Is(err, &InvalidInputError{"unknown receipt mode \"pdf\", expected console, file or escpos"}) {
+		t.Errorf("expected an unknown mode to be refused got %v", err)
+	}
+}
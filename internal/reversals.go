@@ -0,0 +1,178 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+)
+
+// ReversalRequest undoes all or part of a posted transaction, such as a withdrawal the terminal failed to dispense
+type ReversalRequest struct {
+	// ReversalId identifies the reversal at its terminal so that one sent again is only applied once.
+	// When empty the transaction id is used, so a transaction is reversed once unless each reversal is given an id
+	ReversalId string `json:"reversal_id,omitempty"`
+	TerminalId string `json:"terminal_id"`
+	// TransactionId is the transaction to reverse, or the idempotency key of a withdrawal its terminal got no answer for
+	TransactionId string `json:"transaction_id"`
+	// Amount is how much of the transaction to reverse, all that has not already been reversed when zero
+	Amount float64 `json:"amount,omitempty"`
+	Reason string  `json:"reason,omitempty"`
+}
+
+// ReversalResult is the posted reversal and the account's balance afterwards
+type ReversalResult struct {
+	TransactionId string
+	// FeeTransactionId is set when the overdraft fee charged for a reversed withdrawal was refunded
+	FeeTransactionId   string
+	AccountId          string
+	OriginalType       TransactionType
+	OriginalTerminalId string
+	AmountReversed     float64
+	FeeRefunded        float64
+	RemainingBalance   float64
+	// Repeated is set when the reversal had already been applied and nothing more was posted
+	Repeated bool
+	// Queued is set when the host has not posted the reversal yet: the terminal reduced the advice of a withdrawal it
+	// approved offline, or queued the reversal to be forwarded with the advices
+	Queued bool
+}
+
+// PostReversal credits back all or part of a withdrawal or fee, or takes back a deposit, posting a reversal entry
+// linked to the original. The overdraft fee charged for a withdrawal is refunded once the reversals bring the
+// withdrawal's balance back to zero or more
+func (ledger *Ledger) PostReversal(request ReversalRequest) (*ReversalResult, error) {
+	reversalId := request.ReversalId
+	if reversalId == "" {
+		reversalId = request.TransactionId
+	}
+	key := request.TerminalId + "/" + reversalId
+	if posted, ok := ledger.reversals[key]; ok {
+		repeated := *posted
+		repeated.Repeated = true
+		return &repeated, nil
+	}
+	transactionId := request.TransactionId
+	// a withdrawal approved in stand-in is known to its terminal by the advice id, and one the terminal
+	// got no answer for by its idempotency key
+	if advice, ok := ledger.advices[request.TerminalId+"/"+transactionId]; ok {
+		transactionId = advice.TransactionId
+	} else if withdrawal, ok := ledger.withdrawalKeys[request.TerminalId+"/"+transactionId]; ok {
+		transactionId = withdrawal
+	}
+	accountId, original, ok := ledger.findTransaction(transactionId)
+	if !ok {
+		return &ReversalResult{}, &InvalidInputError{fmt.Sprintf("unknown transaction \"%s\"", request.TransactionId)}
+	}
+	switch original.Type {
+	case WithdrawalTransaction, DepositTransaction, FeeTransaction:
+	default:
+		return &ReversalResult{}, &InvalidInputError{fmt.Sprintf("a %s can not be reversed", original.Type)}
+	}
+	for _, cheque := range ledger.cheques {
+		if cheque.TransactionId == original.Id && cheque.Status == ChequePending {
+			return &ReversalResult{}, &InvalidInputError{fmt.Sprintf("cheque %s is reversed by rejecting it", cheque.Id)}
+		}
+	}
+	remaining := math.Abs(original.Amount) - ledger.reversedAmount(accountId, original.Id)
+	if remaining <= 0 {
+		return &ReversalResult{}, &InvalidInputError{fmt.Sprintf("transaction %s has already been reversed", original.Id)}
+	}
+	amount := request.Amount
+	if amount == 0 {
+		amount = remaining
+	}
+	if amount < 0 || amount > remaining {
+		return &ReversalResult{}, &InvalidAmountError{message: fmt.Sprintf("$%.2f of transaction %s can be reversed, not $%.2f", remaining, original.Id, amount)}
+	}
+	if original.Type == WithdrawalTransaction && math.Mod(amount, 20) != 0 {
+		return &ReversalResult{}, &InvalidAmountError{message: "Withdrawals are reversed in units of $20."}
+	}
+
+	description := "reversal: " + original.Description
+	if request.Reason != "" {
+		description += " (" + request.Reason + ")"
+	}
+	// the reversal moves the balance the opposite way to the original
+	credit := amount
+	if original.Amount > 0 {
+		credit = -amount
+	}
+	entry := ledger.credit(accountId, LedgerHistoryEntry{Type: ReversalTransaction, Description: description,
+		TerminalId: request.TerminalId, ParentId: original.Id, Amount: credit})
+	result := &ReversalResult{TransactionId: entry.Id, AccountId: accountId, OriginalType: original.Type,
+		OriginalTerminalId: original.TerminalId, AmountReversed: amount}
+	switch original.Type {
+	case WithdrawalTransaction:
+		ledger.refundOverdraftFee(result, accountId, original, request.TerminalId)
+	case DepositTransaction:
+		ledger.reduceHolds(accountId, amount)
+	}
+	result.RemainingBalance = ledger.balances[accountId]
+	if ledger.reversals == nil {
+		ledger.reversals = map[string]*ReversalResult{}
+	}
+	ledger.reversals[key] = result
+	Logger.Printf("reversed %.2f of %s %s for %s as %s\n", amount, original.Type, original.Id, accountId, entry.Id)
+	return result, nil
+}
+
+// refundOverdraftFee reverses the fee charged for a withdrawal once the withdrawal no longer overdraws the account
+func (ledger *Ledger) refundOverdraftFee(result *ReversalResult, accountId string, withdrawal LedgerHistoryEntry, terminalId string) {
+	if withdrawal.Balance+ledger.reversedAmount(accountId, withdrawal.Id) < 0 {
+		return
+	}
+	for _, fee := range ledger.histories[accountId] {
+		if fee.Type != FeeTransaction || fee.ParentId != withdrawal.Id || ledger.reversedAmount(accountId, fee.Id) > 0 {
+			continue
+		}
+		refund := ledger.credit(accountId, LedgerHistoryEntry{Type: ReversalTransaction, Description: "reversal: " + fee.Description,
+			TerminalId: terminalId, ParentId: fee.Id, Amount: fee.Amount * -1})
+		result.FeeTransactionId, result.FeeRefunded = refund.Id, fee.Amount*-1
+	}
+}
+
+// reduceHolds takes a reversed deposit out of the account's deposit holds, newest first, leaving cheque holds alone
+func (ledger *Ledger) reduceHolds(accountId string, amount float64) {
+	holds := ledger.holds[accountId]
+	for i := len(holds) - 1; i >= 0 && amount > 0; i-- {
+		if holds[i].chequeId != "" {
+			continue
+		}
+		reduced := math.Min(holds[i].amount, amount)
+		holds[i].amount -= reduced
+		amount -= reduced
+	}
+	var remaining []depositHold
+	for _, hold := range holds {
+		if hold.amount > 0 {
+			remaining = append(remaining, hold)
+		}
+	}
+	if len(remaining) == 0 {
+		delete(ledger.holds, accountId)
+	} else {
+		ledger.holds[accountId] = remaining
+	}
+}
+
+// findTransaction looks up a transaction by id in every account's history
+func (ledger *Ledger) findTransaction(transactionId string) (string, LedgerHistoryEntry, bool) {
+	for accountId, history := range ledger.histories {
+		for _, entry := range history {
+			if entry.Id == transactionId {
+				return accountId, entry, true
+			}
+		}
+	}
+	return "", LedgerHistoryEntry{}, false
+}
+
+// reversedAmount is how much of a transaction has been reversed so far
+func (ledger *Ledger) reversedAmount(accountId string, transactionId string) float64 {
+	reversed := 0.0
+	for _, entry := range ledger.histories[accountId] {
+		if entry.Type == ReversalTransaction && entry.ParentId == transactionId {
+			reversed += math.Abs(entry.Amount)
+		}
+	}
+	return reversed
+}
@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReverseWithdrawal(t *testing.T) {
+	InitLogger("", true)
+	testLedger := GetLedgerService()
+	testLedger.SetInitialBalances(500, map[string]float64{account: 40.00})
+	testLedger.SetTerminalId("ATM00001")
+	defer testLedger.SetTerminalId("")
+	withdrawal, err := WithdrawCash(account, "100", false, NewIdempotencyKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if withdrawal.RemainingBalance != -65.00 || testLedger.GetAvailableCash() != 400 {
+		t.Fatalf("unexpected withdrawal %+v", withdrawal)
+	}
+
+	// only $40 was dispensed, the fee stays while the account is still overdrawn
+	result, err := ReverseTransaction(ReversalRequest{ReversalId: "R1", TransactionId: withdrawal.TransactionId, Amount: 40, Reason: "dispense fault"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.AmountReversed != 40 || result.FeeTransactionId != "" || result.RemainingBalance != -25.00 || result.OriginalType != WithdrawalTransaction {
+		t.Errorf("unexpected partial reversal %+v", result)
+	}
+	if cash := testLedger.GetAvailableCash(); cash != 440 {
+		t.Errorf("expected the cash not dispensed to be restored got %.2f", cash)
+	}
+	history := testLedger.GetHistory(account)
+	last := history[len(history)-1]
+	if last.Type != ReversalTransaction || last.ParentId != withdrawal.TransactionId || last.Amount != 40 ||
+		last.Description != "reversal: cash withdrawal (dispense fault)" || last.TerminalId != "ATM00001" {
+		t.Errorf("unexpected reversal entry %+v", last)
+	}
+
+	// a retried reversal is not applied again
+	repeated, err := ReverseTransaction(ReversalRequest{ReversalId: "R1", TransactionId: withdrawal.TransactionId, Amount: 40})
+	if err != nil || !repeated.Repeated || repeated.TransactionId != result.TransactionId {
+		t.Errorf("expected the repeated reversal to return the first got %+v %v", repeated, err)
+	}
+	if balance, cash := testLedger.GetBalance(account), testLedger.GetAvailableCash(); balance != -25.00 || cash != 440 {
+		t.Errorf("expected the reversal to be applied once got %.2f %.2f", balance, cash)
+	}
+
+	// reversing the rest no longer overdraws the account so the fee is refunded
+	result, err = ReverseTransaction(ReversalRequest{TransactionId: withdrawal.TransactionId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.AmountReversed != 60 || result.FeeRefunded != OverdraftFee || result.FeeTransactionId == "" || result.RemainingBalance != 40.00 {
+		t.Errorf("unexpected reversal %+v", result)
+	}
+	if cash := testLedger.GetAvailableCash(); cash != 500 {
+		t.Errorf("expected all the cash to be restored got %.2f", cash)
+	}
+	if _, err := ReverseTransaction(ReversalRequest{ReversalId: "R3", TransactionId: withdrawal.TransactionId}); !errors.Is(err,
+		&InvalidInputError{"transaction " + withdrawal.TransactionId + " has already been reversed"}) {
+		t.Errorf("expected the reversed withdrawal to be refused got %v", err)
+	}
+}
+
+func TestReversalErrors(t *testing.T) {
+	InitLogger("", true)
+	testLedger := &Ledger{}
+	testLedger.SetInitialBalances(500, map[string]float64{account: 100.00})
+	withdrawal, err := testLedger.Withdraw(account, "60")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		request ReversalRequest
+		err     error
+	}{
+		{"unknown transaction", ReversalRequest{TransactionId: "000000000000"}, &InvalidInputError{"unknown transaction \"000000000000\""}},
+		{"more than the transaction", ReversalRequest{ReversalId: "R1", TransactionId: withdrawal.TransactionId, Amount: 80},
+			&InvalidAmountError{message: "$60.00 of transaction " + withdrawal.TransactionId + " can be reversed, not $80.00"}},
+		{"not in units of $20", ReversalRequest{ReversalId: "R2", TransactionId: withdrawal.TransactionId, Amount: 30},
+			&InvalidAmountError{message: "Withdrawals are reversed in units of $20."}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := testLedger.PostReversal(tt.request); !errors.Is(err, tt.err) {
+				t.Errorf("expected %v got %v", tt.err, err)
+			}
+		})
+	}
+	reversal, err := testLedger.PostReversal(ReversalRequest{TransactionId: withdrawal.TransactionId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testLedger.PostReversal(ReversalRequest{TransactionId: reversal.TransactionId}); !errors.Is(err, &InvalidInputError{"a reversal can not be reversed"}) {
+		t.Errorf("expected a reversal to be refused got %v", err)
+	}
+	if balance := testLedger.GetBalance(account); balance != 100.00 {
+		t.Errorf("expected the withdrawal to be reversed once got %.2f", balance)
+	}
+}
+
+func TestReverseDeposit(t *testing.T) {
+	InitLogger("", true)
+	testLedger := &Ledger{}
+	testLedger.SetInitialBalances(0, map[string]float64{account: 50.00})
+	testLedger.SetHoldPolicy(HoldPolicy{ImmediatelyAvailable: 100, HoldDays: 2, DayLength: time.Hour})
+	deposit, err := testLedger.PostDeposit(DepositRequest{AccountId: account, Amount: "300"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := testLedger.PostReversal(ReversalRequest{TransactionId: deposit.Entry.Id, Amount: 250, Reason: "counterfeit notes"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RemainingBalance != 100.00 || result.OriginalType != DepositTransaction {
+		t.Errorf("unexpected deposit reversal %+v", result)
+	}
+	if pending, available := testLedger.GetPendingFunds(account), testLedger.GetAvailableBalance(account); pending != 0 || available != 100.00 {
+		t.Errorf("expected the held funds to be reversed first got pending %.2f available %.2f", pending, available)
+	}
+
+	image := filepath.Join(t.TempDir(), "cheque.png")
+	if err := os.WriteFile(image, []byte("image"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cheque, err := testLedger.DepositCheque(account, Cheque{Number: "1001", Payer: "ACME Corp", ImagePath: image, Amount: 25})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testLedger.PostReversal(ReversalRequest{TransactionId: cheque.TransactionId}); !errors.Is(err, &InvalidInputError{"cheque CHQ0001 is reversed by rejecting it"}) {
+		t.Errorf("expected a pending cheque to be refused got %v", err)
+	}
+}
+
+func TestReverseAdvice(t *testing.T) {
+	InitLogger("", true)
+	testLedger := &Ledger{}
+	testLedger.SetInitialBalances(0, map[string]float64{account: 100.00})
+	if _, err := testLedger.PostAdvice(WithdrawalAdvice{AdviceId: "A1", TerminalId: "ATM00001", AccountId: account, Amount: 60}); err != nil {
+		t.Fatal(err)
+	}
+	// the terminal only knows an offline withdrawal by its advice id
+	result, err := testLedger.PostReversal(ReversalRequest{TerminalId: "ATM00001", TransactionId: "A1", Amount: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.AmountReversed != 20 || result.RemainingBalance != 60.00 || result.OriginalTerminalId != "ATM00001" {
+		t.Errorf("unexpected reversal of an advice %+v", result)
+	}
+}
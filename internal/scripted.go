@@ -0,0 +1,170 @@
+package internal
+
+import (
+	"io"
+	"strings"
+	"sync"
+)
+
+// ScriptedDisplay records the text shown to the customer
+type ScriptedDisplay struct {
+	lock sync.Mutex
+	text strings.Builder
+}
+
+func (display *ScriptedDisplay) Status() DeviceStatus {
+	return DeviceStatus{Class: "TTU", State: DeviceOnline, Detail: "scripted"}
+}
+
+func (display *ScriptedDisplay) Show(text string) {
+	display.lock.Lock()
+	defer display.lock.Unlock()
+	display.text.WriteString(text)
+}
+
+// Text returns everything shown so far
+func (display *ScriptedDisplay) Text() string {
+	display.lock.Lock()
+	defer display.lock.Unlock()
+	return display.text.String()
+}
+
+// ScriptedPINPad answers each PIN and data entry with the next of its entries, failing with io.EOF when there are none left
+type ScriptedPINPad struct {
+	Entries []string
+}
+
+func (pad *ScriptedPINPad) Status() DeviceStatus {
+	return DeviceStatus{Class: "PIN", State: DeviceOnline, Detail: "scripted"}
+}
+
+func (pad *ScriptedPINPad) GetPIN(pan string) (PINBlock, error) {
+	pin, err := pad.GetData()
+	if err != nil {
+		return PINBlock{}, err
+	}
+	return GetPINPad().EncryptPIN(pin, pan)
+}
+
+func (pad *ScriptedPINPad) GetData() (string, error) {
+	if len(pad.Entries) == 0 {
+		return "", io.EOF
+	}
+	entry := pad.Entries[0]
+	pad.Entries = pad.Entries[1:]
+	return entry, nil
+}
+
+// ScriptedCardReader accepts any card unless AcceptError is set, counting the cards it ejects and retains
+type ScriptedCardReader struct {
+	AcceptError error
+	EjectError  error
+	Card        string
+	Ejected     int
+	Retained    int
+}
+
+func (reader *ScriptedCardReader) Status() DeviceStatus {
+	if reader.Card != "" {
+		return DeviceStatus{Class: "IDC", State: DeviceOnline, Detail: "card " + MaskAccount(reader.Card) + " present"}
+	}
+	return DeviceStatus{Class: "IDC", State: DeviceOnline, Detail: "no card"}
+}
+
+func (reader *ScriptedCardReader) AcceptCard(pan string) (string, error) {
+	if reader.AcceptError != nil {
+		return "", reader.AcceptError
+	}
+	reader.Card = pan
+	return pan, nil
+}
+
+func (reader *ScriptedCardReader) EjectCard() error {
+	if reader.EjectError != nil {
+		return reader.EjectError
+	}
+	reader.Card = ""
+	reader.Ejected++
+	return nil
+}
+
+func (reader *ScriptedCardReader) RetainCard() error {
+	reader.Card = ""
+	reader.Retained++
+	return nil
+}
+
+// ScriptedDepositModule refuses the denominations in Reject, keeping count of the notes stored and returned
+type ScriptedDepositModule struct {
+	Reject   []int
+	escrow   map[int]int
+	Stored   map[int]int
+	Returned map[int]int
+}
+
+func (module *ScriptedDepositModule) Status() DeviceStatus {
+	return DeviceStatus{Class: "CIM", State: DeviceOnline, Detail: "scripted"}
+}
+
+func (module *ScriptedDepositModule) AcceptNotes(notes map[int]int) (map[int]int, error) {
+	module.escrow = map[int]int{}
+	for denomination, count := range notes {
+		rejected := false
+		for _, reject := range module.Reject {
+			rejected = rejected || reject == denomination
+		}
+		if !rejected {
+			module.escrow[denomination] = count
+		}
+	}
+	return module.escrow, nil
+}
+
+func (module *ScriptedDepositModule) StoreNotes() error {
+	module.Stored = addNotes(module.Stored, module.escrow)
+	module.escrow = nil
+	return nil
+}
+
+func (module *ScriptedDepositModule) ReturnNotes() error {
+	module.Returned = addNotes(module.Returned, module.escrow)
+	module.escrow = nil
+	return nil
+}
+
+func addNotes(total map[int]int, notes map[int]int) map[int]int {
+	if total == nil {
+		total = map[int]int{}
+	}
+	for denomination, count := range notes {
+		total[denomination] += count
+	}
+	return total
+}
+
+// ScriptedReceiptPrinter keeps the receipts it is asked to print
+type ScriptedReceiptPrinter struct {
+	Receipts []*Receipt
+}
+
+func (printer *ScriptedReceiptPrinter) Status() DeviceStatus {
+	return DeviceStatus{Class: "PTR", State: DeviceOnline, Detail: "scripted"}
+}
+
+func (printer *ScriptedReceiptPrinter) Print(receipt *Receipt) (string, error) {
+	printer.Receipts = append(printer.Receipts, receipt)
+	return "", nil
+}
+
+// NewScriptedDevices creates devices that answer the PIN pad with entries and record what the customer is shown,
+// the cash dispenser is simulated so faults can still be injected
+func NewScriptedDevices(entries ...string) *Devices {
+	return &Devices{
+		CardReader:     &ScriptedCardReader{},
+		PINPad:         &ScriptedPINPad{Entries: entries},
+		CashDispenser:  NewSimulatedCashDispenser(),
+		DepositModule:  &ScriptedDepositModule{},
+		ReceiptPrinter: &ScriptedReceiptPrinter{},
+		Display:        &ScriptedDisplay{},
+	}
+}
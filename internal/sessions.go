@@ -0,0 +1,232 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// SessionEndReason records why a session ended
+type SessionEndReason string
+
+const (
+	SessionLoggedOut       SessionEndReason = "logged out"
+	SessionIdleTimeout     SessionEndReason = "idle timeout"
+	SessionAbsoluteTimeout SessionEndReason = "absolute timeout"
+)
+
+// SessionPolicy controls how long sessions last. A zero duration turns that limit off
+type SessionPolicy struct {
+	// IdleTimeout ends a session with no activity for this long
+	IdleTimeout time.Duration
+	// AbsoluteTimeout ends a session this long after it started, whatever the activity
+	AbsoluteTimeout time.Duration
+	// WarningBefore is how long before an idle timeout the warning hooks are called
+	WarningBefore time.Duration
+}
+
+// DefaultSessionPolicy is used until SetPolicy is called
+var DefaultSessionPolicy = SessionPolicy{IdleTimeout: 2 * time.Minute, AbsoluteTimeout: 15 * time.Minute, WarningBefore: 30 * time.Second}
+
+// SessionWarningHook is called when a session is about to expire from inactivity
+type SessionWarningHook func(session UserSession, remaining time.Duration)
+
+// SessionEndHook is called when a session ends, with the session as it was before it ended
+type SessionEndHook func(session UserSession, reason SessionEndReason)
+
+// trackedSession is an active session and the timers that will end it
+type trackedSession struct {
+	session *UserSession
+	// incremented on activity so stale idle timers can tell they were superseded
+	generation int
+	warning    Timer
+	idle       Timer
+	absolute   Timer
+}
+
+// SessionManager tracks authorized sessions by id and ends them when they time out
+type SessionManager struct {
+	lock         sync.Mutex
+	policy       SessionPolicy
+	sessions     map[string]*trackedSession
+	warningHooks []SessionWarningHook
+	endHooks     []SessionEndHook
+}
+
+// the shared session manager
+var sessionManager = &SessionManager{policy: DefaultSessionPolicy}
+
+func GetSessionManager() *SessionManager {
+	return sessionManager
+}
+
+// SetPolicy sets the timeouts used for sessions started afterwards
+func (manager *SessionManager) SetPolicy(policy SessionPolicy) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	manager.policy = policy
+}
+
+// Policy returns the timeouts in use
+func (manager *SessionManager) Policy() SessionPolicy {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	return manager.policy
+}
+
+// OnWarning registers a hook called shortly before a session expires from inactivity
+func (manager *SessionManager) OnWarning(hook SessionWarningHook) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	manager.warningHooks = append(manager.warningHooks, hook)
+}
+
+// OnEnd registers a hook called whenever a session ends, by logging out or timing out
+func (manager *SessionManager) OnEnd(hook SessionEndHook) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	manager.endHooks = append(manager.endHooks, hook)
+}
+
+// Start begins tracking an authorized session, giving it a new id
+func (manager *SessionManager) Start(session *UserSession) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	if tracked, ok := manager.sessions[session.Id]; ok && tracked.session == session {
+		tracked.stop()
+		delete(manager.sessions, session.Id)
+	}
+	if manager.sessions == nil {
+		manager.sessions = map[string]*trackedSession{}
+	}
+	now := clock.Now()
+	session.Id = newSessionId()
+	session.Started = now
+	session.LastActivityTime = now
+	tracked := &trackedSession{session: session}
+	manager.sessions[session.Id] = tracked
+	if manager.policy.AbsoluteTimeout > 0 {
+		id := session.Id
+		tracked.absolute = clock.AfterFunc(manager.policy.AbsoluteTimeout, func() {
+			manager.expire(id, -1, SessionAbsoluteTimeout)
+		})
+	}
+	manager.armIdleTimers(tracked)
+	Logger.Printf("session started for %s\n", session.AccountId)
+}
+
+// Lookup returns the active session with the id, or nil if there is none
+func (manager *SessionManager) Lookup(id string) *UserSession {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	if tracked, ok := manager.sessions[id]; ok {
+		return tracked.session
+	}
+	return nil
+}
+
+// Touch records activity on a session, restarting its idle timeout. It returns false if the session is not active
+func (manager *SessionManager) Touch(id string) bool {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	tracked, ok := manager.sessions[id]
+	if !ok {
+		return false
+	}
+	tracked.session.LastActivityTime = clock.Now()
+	tracked.generation++
+	manager.armIdleTimers(tracked)
+	return true
+}
+
+// End ends an active session and calls the end hooks
+func (manager *SessionManager) End(id string, reason SessionEndReason) {
+	manager.expire(id, -1, reason)
+}
+
+// Count returns the number of active sessions
+func (manager *SessionManager) Count() int {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	return len(manager.sessions)
+}
+
+// armIdleTimers (re)starts the warning and idle timers for a session, the lock must be held
+func (manager *SessionManager) armIdleTimers(tracked *trackedSession) {
+	stopTimer(tracked.warning)
+	stopTimer(tracked.idle)
+	if manager.policy.IdleTimeout <= 0 {
+		return
+	}
+	id, generation := tracked.session.Id, tracked.generation
+	if warning := manager.policy.WarningBefore; warning > 0 && warning < manager.policy.IdleTimeout {
+		tracked.warning = clock.AfterFunc(manager.policy.IdleTimeout-warning, func() {
+			manager.warn(id, generation, warning)
+		})
+	}
+	tracked.idle = clock.AfterFunc(manager.policy.IdleTimeout, func() {
+		manager.expire(id, generation, SessionIdleTimeout)
+	})
+}
+
+// warn calls the warning hooks unless there has been activity since the timer was started
+func (manager *SessionManager) warn(id string, generation int, remaining time.Duration) {
+	manager.lock.Lock()
+	tracked, ok := manager.sessions[id]
+	if !ok || tracked.generation != generation {
+		manager.lock.Unlock()
+		return
+	}
+	snapshot := *tracked.session
+	hooks := manager.warningHooks
+	manager.lock.Unlock()
+	for _, hook := range hooks {
+		hook(snapshot, remaining)
+	}
+}
+
+// expire ends a session, clearing its state. A generation of -1 ends it regardless of activity
+func (manager *SessionManager) expire(id string, generation int, reason SessionEndReason) {
+	manager.lock.Lock()
+	tracked, ok := manager.sessions[id]
+	if !ok || (generation >= 0 && tracked.generation != generation) {
+		manager.lock.Unlock()
+		return
+	}
+	tracked.stop()
+	delete(manager.sessions, id)
+	snapshot := *tracked.session
+	tracked.session.IsAuthenticated = false
+	tracked.session.AccountId = ""
+	tracked.session.CardPAN = ""
+	hooks := manager.endHooks
+	manager.lock.Unlock()
+	Logger.Printf("session ended for %s: %s\n", snapshot.AccountId, reason)
+	for _, hook := range hooks {
+		hook(snapshot, reason)
+	}
+}
+
+func (tracked *trackedSession) stop() {
+	stopTimer(tracked.warning)
+	stopTimer(tracked.idle)
+	stopTimer(tracked.absolute)
+}
+
+func stopTimer(timer Timer) {
+	if timer != nil {
+		timer.Stop()
+	}
+}
+
+// newSessionId generates a random, opaque session id
+func newSessionId() string {
+	id := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		panic(fmt.Sprintf("unable to generate a session id: %v", err))
+	}
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+// sessionEvents collects the hook calls made by a SessionManager
+type sessionEvents struct {
+	warnings []time.Duration
+	ends     []SessionEndReason
+	accounts []string
+}
+
+func (events *sessionEvents) register(manager *SessionManager) {
+	manager.OnWarning(func(session UserSession, remaining time.Duration) {
+		events.warnings = append(events.warnings, remaining)
+	})
+	manager.OnEnd(func(session UserSession, reason SessionEndReason) {
+		events.ends = append(events.ends, reason)
+		events.accounts = append(events.accounts, session.AccountId)
+	})
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+	InitLogger("", true)
+	fakeClock := NewFakeClock(time.Date(2023, 5, 1, 9, 0, 0, 0, time.UTC))
+	SetClock(fakeClock)
+	defer SetClock(nil)
+	manager := &SessionManager{policy: SessionPolicy{IdleTimeout: 2 * time.Minute, WarningBefore: 30 * time.Second}}
+	events := &sessionEvents{}
+	events.register(manager)
+
+	session := &UserSession{IsAuthenticated: true, AccountId: "jc123"}
+	manager.Start(session)
+	if session.Id == "" || manager.Lookup(session.Id) != session {
+		t.Fatalf("expected the session to be tracked, got id %q", session.Id)
+	}
+
+	// activity before the warning keeps the session alive
+	fakeClock.Advance(80 * time.Second)
+	if !manager.Touch(session.Id) {
+		t.Fatal("expected the session to be active")
+	}
+	fakeClock.Advance(89 * time.Second)
+	if len(events.warnings) != 0 {
+		t.Errorf("expected no warning yet, got %v", events.warnings)
+	}
+	fakeClock.Advance(time.Second)
+	if len(events.warnings) != 1 || events.warnings[0] != 30*time.Second || len(events.ends) != 0 {
+		t.Errorf("expected a warning and no expiry, got %v and %v", events.warnings, events.ends)
+	}
+	fakeClock.Advance(30 * time.Second)
+	if len(events.ends) != 1 || events.ends[0] != SessionIdleTimeout {
+		t.Fatalf("expected an idle timeout, got %v", events.ends)
+	}
+	if events.accounts[0] != "jc123" {
+		t.Errorf("expected the hook to see the account, got %q", events.accounts[0])
+	}
+	if session.IsAuthenticated || session.AccountId != "" || manager.Lookup(session.Id) != nil {
+		t.Errorf("expected the session to be cleared, got %+v", session)
+	}
+	if manager.Touch(session.Id) {
+		t.Error("expected an expired session to stay expired")
+	}
+}
+
+func TestSessionAbsoluteTimeout(t *testing.T) {
+	InitLogger("", true)
+	fakeClock := NewFakeClock(time.Date(2023, 5, 1, 9, 0, 0, 0, time.UTC))
+	SetClock(fakeClock)
+	defer SetClock(nil)
+	manager := &SessionManager{policy: SessionPolicy{IdleTimeout: 2 * time.Minute, AbsoluteTimeout: 15 * time.Minute}}
+	events := &sessionEvents{}
+	events.register(manager)
+
+	session := &UserSession{IsAuthenticated: true, AccountId: "jc123"}
+	manager.Start(session)
+	for i := 0; i < 14; i++ {
+		fakeClock.Advance(time.Minute)
+		manager.Touch(session.Id)
+	}
+	if len(events.ends) != 0 {
+		t.Fatalf("expected the session to be active, got %v", events.ends)
+	}
+	fakeClock.Advance(time.Minute)
+	if len(events.ends) != 1 || events.ends[0] != SessionAbsoluteTimeout {
+		t.Fatalf("expected an absolute timeout despite activity, got %v", events.ends)
+	}
+	if session.IsAuthenticated {
+		t.Error("expected the session to be logged out")
+	}
+}
+
+func TestMultipleSessions(t *testing.T) {
+	InitLogger("", true)
+	manager := &SessionManager{policy: SessionPolicy{IdleTimeout: time.Minute}}
+	events := &sessionEvents{}
+	events.register(manager)
+
+	first := &UserSession{IsAuthenticated: true, AccountId: "jc123"}
+	second := &UserSession{IsAuthenticated: true, AccountId: "pq456"}
+	manager.Start(first)
+	manager.Start(second)
+	if first.Id == second.Id || manager.Count() != 2 {
+		t.Fatalf("expected two distinct sessions, got %q and %q", first.Id, second.Id)
+	}
+
+	// authorizing again replaces the session id
+	oldId := first.Id
+	manager.Start(first)
+	if first.Id == oldId || manager.Lookup(oldId) != nil || manager.Count() != 2 {
+		t.Errorf("expected a new id for the restarted session")
+	}
+
+	manager.End(first.Id, SessionLoggedOut)
+	if len(events.ends) != 1 || events.ends[0] != SessionLoggedOut {
+		t.Errorf("expected a logout, got %v", events.ends)
+	}
+	if first.IsAuthenticated || !second.IsAuthenticated || manager.Count() != 1 {
+		t.Errorf("expected only the first session to end")
+	}
+	manager.End(second.Id, SessionLoggedOut)
+}
@@ -0,0 +1,235 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/term"
+)
+
+// key codes handled while reading a PIN in raw mode
+const (
+	keyInterrupt = 0x03
+	keyBackspace = 0x08
+	keyEnter     = '\r'
+	keyNewline   = '\n'
+	keyDelete    = 0x7f
+)
+
+// consoleInput is where the simulated devices read the customer's entries. Tests may replace it
+var consoleInput io.Reader = os.Stdin
+
+// ConsoleInput returns where the customer's entries are read from
+func ConsoleInput() io.Reader {
+	return consoleInput
+}
+
+// SetConsoleInput replaces where the customer's entries are read from, nil goes back to stdin
+func SetConsoleInput(input io.Reader) {
+	if input == nil {
+		input = os.Stdin
+	}
+	consoleInput = input
+}
+
+// readConsoleLine reads a single line of input one byte at a time so that nothing beyond
+// the end of the line is consumed before the prompt takes back control of stdin
+func readConsoleLine() (string, error) {
+	var line strings.Builder
+	buf := make([]byte, 1)
+	for {
+		n, err := consoleInput.Read(buf)
+		if n == 1 {
+			if buf[0] == '\n' {
+				break
+			}
+			line.WriteByte(buf[0])
+		}
+		if err != nil {
+			if err == io.EOF && line.Len() > 0 {
+				break
+			}
+			return "", err
+		}
+	}
+	return strings.TrimSpace(line.String()), nil
+}
+
+// SimulatedDisplay shows text on the console
+type SimulatedDisplay struct {
+	// Output is where the text is written, defaults to stdout
+	Output io.Writer
+}
+
+func (display *SimulatedDisplay) Status() DeviceStatus {
+	return DeviceStatus{Class: "TTU", State: DeviceOnline}
+}
+
+func (display *SimulatedDisplay) Show(text string) {
+	output := display.Output
+	if output == nil {
+		output = os.Stdout
+	}
+	fmt.Fprint(output, text)
+}
+
+// SimulatedPINPad reads entries from the console and encrypts PINs with the terminal's PIN pad keys
+type SimulatedPINPad struct{}
+
+func (pad *SimulatedPINPad) Status() DeviceStatus {
+	return DeviceStatus{Class: "PIN", State: DeviceOnline, Detail: fmt.Sprintf("format %d PIN blocks", GetPINPad().Format)}
+}
+
+// GetPIN reads a PIN without echoing it, showing a '*' for each digit entered. The PIN is read directly from the
+// terminal so it never reaches the prompt's history
+func (pad *SimulatedPINPad) GetPIN(pan string) (PINBlock, error) {
+	pin, err := readConsolePIN()
+	if err != nil {
+		return PINBlock{}, err
+	}
+	return GetPINPad().EncryptPIN(pin, pan)
+}
+
+func (pad *SimulatedPINPad) GetData() (string, error) {
+	return readConsoleLine()
+}
+
+// ReadConsoleSecret reads a passcode from the console without echoing it, showing a '*' for each character entered
+func ReadConsoleSecret() (string, error) {
+	return readConsolePIN()
+}
+
+func readConsolePIN() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if consoleInput != os.Stdin || !term.IsTerminal(fd) {
+		return readConsoleLine()
+	}
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = term.Restore(fd, state) }()
+
+	var pin strings.Builder
+	key := make([]byte, 1)
+	for {
+		if _, err = os.Stdin.Read(key); err != nil {
+			return "", err
+		}
+		switch key[0] {
+		case keyEnter, keyNewline:
+			return pin.String(), nil
+		case keyInterrupt:
+			return "", fmt.Errorf("PIN entry cancelled.\n")
+		case keyBackspace, keyDelete:
+			if pin.Len() > 0 {
+				current := pin.String()
+				pin.Reset()
+				pin.WriteString(current[:len(current)-1])
+				fmt.Print("\b \b")
+			}
+		default:
+			if key[0] >= ' ' {
+				pin.WriteByte(key[0])
+				fmt.Print("*")
+			}
+		}
+	}
+}
+
+// SimulatedCardReader holds the card the customer inserted with the insert-card command
+type SimulatedCardReader struct {
+	pan string
+}
+
+func (reader *SimulatedCardReader) Status() DeviceStatus {
+	if reader.pan != "" {
+		return DeviceStatus{Class: "IDC", State: DeviceOnline, Detail: "card " + MaskAccount(reader.pan) + " present"}
+	}
+	return DeviceStatus{Class: "IDC", State: DeviceOnline, Detail: "no card"}
+}
+
+func (reader *SimulatedCardReader) AcceptCard(pan string) (string, error) {
+	if reader.pan != "" {
+		return "", &InvalidInputError{"a card is already inserted"}
+	}
+	reader.pan = pan
+	return pan, nil
+}
+
+// EjectCard gives back the card, doing nothing when there is none
+func (reader *SimulatedCardReader) EjectCard() error {
+	reader.pan = ""
+	return nil
+}
+
+// RetainCard keeps the card, the reader is empty for the next customer
+func (reader *SimulatedCardReader) RetainCard() error {
+	reader.pan = ""
+	return nil
+}
+
+// SimulatedDepositModule accepts every note it is given, keeping a count of the notes it has stored
+type SimulatedDepositModule struct {
+	lock   sync.Mutex
+	escrow map[int]int
+	stored map[int]int
+}
+
+func (module *SimulatedDepositModule) Status() DeviceStatus {
+	module.lock.Lock()
+	defer module.lock.Unlock()
+	return DeviceStatus{Class: "CIM", State: DeviceOnline,
+		Detail: fmt.Sprintf("escrow $%.2f, stored $%.2f", notesTotal(module.escrow), notesTotal(module.stored))}
+}
+
+func (module *SimulatedDepositModule) AcceptNotes(notes map[int]int) (map[int]int, error) {
+	module.lock.Lock()
+	defer module.lock.Unlock()
+	if len(module.escrow) > 0 {
+		return nil, &InvalidInputError{"there are notes in escrow"}
+	}
+	module.escrow = map[int]int{}
+	for denomination, count := range notes {
+		module.escrow[denomination] = count
+	}
+	return notes, nil
+}
+
+func (module *SimulatedDepositModule) StoreNotes() error {
+	module.lock.Lock()
+	defer module.lock.Unlock()
+	if module.stored == nil {
+		module.stored = map[int]int{}
+	}
+	for denomination, count := range module.escrow {
+		module.stored[denomination] += count
+	}
+	module.escrow = nil
+	return nil
+}
+
+func (module *SimulatedDepositModule) ReturnNotes() error {
+	module.lock.Lock()
+	defer module.lock.Unlock()
+	module.escrow = nil
+	return nil
+}
+
+// notesTotal is the value of the notes by denomination
+func notesTotal(notes map[int]int) float64 {
+	denominations := make([]int, 0, len(notes))
+	for denomination := range notes {
+		denominations = append(denominations, denomination)
+	}
+	sort.Ints(denominations)
+	total := 0.0
+	for _, denomination := range denominations {
+		total += float64(denomination * notes[denomination])
+	}
+	return total
+}
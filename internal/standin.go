@@ -0,0 +1,489 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// WithdrawalAdvice tells the bank host about a withdrawal the terminal approved and dispensed while it could not reach the host
+type WithdrawalAdvice struct {
+	// AdviceId identifies the advice at its terminal so that one sent again is only posted once
+	AdviceId    string    `json:"advice_id"`
+	TerminalId  string    `json:"terminal_id"`
+	AccountId   string    `json:"account_id"`
+	Amount      float64   `json:"amount"`
+	Description string    `json:"description,omitempty"`
+	ApprovedAt  time.Time `json:"approved_at"`
+}
+
+// RejectedAdvice is an advice the bank host refused to post. The cash has already been dispensed so it is kept for the operator
+type RejectedAdvice struct {
+	Advice     WithdrawalAdvice `json:"advice"`
+	Reason     string           `json:"reason"`
+	RejectedAt time.Time        `json:"rejected_at"`
+}
+
+// StandInPolicy limits the withdrawals the terminal approves on its own while the bank host can not be reached.
+// Nothing is approved offline unless MaxWithdrawal is set, the other limits are not applied when zero
+type StandInPolicy struct {
+	// MaxWithdrawal is the most a single offline withdrawal may be
+	MaxWithdrawal float64
+	// MaxPerAccount is the most an account may withdraw offline until its advices are posted
+	MaxPerAccount float64
+	// MaxTotal is the most the terminal approves offline until its advices are posted
+	MaxTotal float64
+}
+
+// allows checks an offline withdrawal against the limits given the amounts already approved offline
+func (policy StandInPolicy) allows(amount float64, accountTotal float64, total float64) bool {
+	return amount <= policy.MaxWithdrawal &&
+		(policy.MaxPerAccount <= 0 || accountTotal+amount <= policy.MaxPerAccount) &&
+		(policy.MaxTotal <= 0 || total+amount <= policy.MaxTotal)
+}
+
+// AdviceQueue holds the advices for withdrawals approved in stand-in, and the reversals of cash the dispenser did not
+// present, until the bank host has posted them. It is saved to a file after each change so that none is lost if the terminal stops
+type AdviceQueue struct {
+	path  string
+	lock  sync.Mutex
+	state adviceQueueState
+}
+
+type adviceQueueState struct {
+	Pending   []WithdrawalAdvice `json:"pending"`
+	Rejected  []RejectedAdvice   `json:"rejected"`
+	Reversals []ReversalRequest  `json:"reversals,omitempty"`
+}
+
+// OpenAdviceQueue reads the queue saved in path, starting an empty one if there is no file. An empty path keeps the queue in memory
+func OpenAdviceQueue(path string) (*AdviceQueue, error) {
+	queue := &AdviceQueue{path: path}
+	if path == "" {
+		return queue, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return queue, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &queue.state); err != nil {
+		return nil, fmt.Errorf("unable to read the advice queue %s: %w", path, err)
+	}
+	return queue, nil
+}
+
+// Add queues an advice, returning once it has been saved
+func (queue *AdviceQueue) Add(advice WithdrawalAdvice) error {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	queue.state.Pending = append(queue.state.Pending, advice)
+	if err := queue.save(); err != nil {
+		queue.state.Pending = queue.state.Pending[:len(queue.state.Pending)-1]
+		return err
+	}
+	return nil
+}
+
+// Pending returns the advices waiting to be posted, oldest first
+func (queue *AdviceQueue) Pending() []WithdrawalAdvice {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	return append([]WithdrawalAdvice{}, queue.state.Pending...)
+}
+
+// Rejected returns the advices the bank host refused to post
+func (queue *AdviceQueue) Rejected() []RejectedAdvice {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	return append([]RejectedAdvice{}, queue.state.Rejected...)
+}
+
+// AddReversal queues a reversal the bank host could not be sent, returning once it has been saved
+func (queue *AdviceQueue) AddReversal(request ReversalRequest) error {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	queue.state.Reversals = append(queue.state.Reversals, request)
+	if err := queue.save(); err != nil {
+		queue.state.Reversals = queue.state.Reversals[:len(queue.state.Reversals)-1]
+		return err
+	}
+	return nil
+}
+
+// Reversals returns the reversals waiting to be posted, oldest first
+func (queue *AdviceQueue) Reversals() []ReversalRequest {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	return append([]ReversalRequest{}, queue.state.Reversals...)
+}
+
+// completeReversal takes the oldest reversal off the queue once the host has answered it
+func (queue *AdviceQueue) completeReversal() error {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	queue.state.Reversals = queue.state.Reversals[1:]
+	return queue.save()
+}
+
+// reduce reverses a withdrawal whose advice is still queued by taking the amount off the advice, dropping the advice
+// when nothing is left. It tells whether the withdrawal was one of the queued advices
+func (queue *AdviceQueue) reduce(request ReversalRequest) (*ReversalResult, bool, error) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	for i, advice := range queue.state.Pending {
+		if advice.AdviceId != request.TransactionId || advice.TerminalId != request.TerminalId {
+			continue
+		}
+		amount := request.Amount
+		if amount == 0 {
+			amount = advice.Amount
+		}
+		if amount < 0 || amount > advice.Amount || math.Mod(amount, 20) != 0 {
+			return &ReversalResult{}, true, &InvalidAmountError{message: fmt.Sprintf("$%.2f of withdrawal %s can be reversed, not $%.2f",
+				advice.Amount, advice.AdviceId, amount)}
+		}
+		previous := queue.state.Pending
+		queue.state.Pending = append([]WithdrawalAdvice{}, previous...)
+		if amount == advice.Amount {
+			queue.state.Pending = append(queue.state.Pending[:i], queue.state.Pending[i+1:]...)
+		} else {
+			queue.state.Pending[i].Amount -= amount
+		}
+		if err := queue.save(); err != nil {
+			queue.state.Pending = previous
+			return &ReversalResult{}, true, err
+		}
+		return &ReversalResult{TransactionId: advice.AdviceId, AccountId: advice.AccountId, OriginalType: WithdrawalTransaction,
+			OriginalTerminalId: advice.TerminalId, AmountReversed: amount, Queued: true}, true, nil
+	}
+	return nil, false, nil
+}
+
+// complete takes an advice off the queue, keeping it with the rejected advices when the host refused it
+func (queue *AdviceQueue) complete(adviceId string, rejected *RejectedAdvice) error {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	var pending []WithdrawalAdvice
+	for _, advice := range queue.state.Pending {
+		if advice.AdviceId != adviceId {
+			pending = append(pending, advice)
+		}
+	}
+	queue.state.Pending = pending
+	if rejected != nil {
+		queue.state.Rejected = append(queue.state.Rejected, *rejected)
+	}
+	return queue.save()
+}
+
+// totals returns the amount approved offline for the account and for the terminal
+func (queue *AdviceQueue) totals(accountId string) (float64, float64) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	account, total := 0.0, 0.0
+	for _, advice := range queue.state.Pending {
+		if advice.AccountId == accountId {
+			account += advice.Amount
+		}
+		total += advice.Amount
+	}
+	return account, total
+}
+
+// save writes the queue to its file
+func (queue *AdviceQueue) save() error {
+	if queue.path == "" {
+		return nil
+	}
+	return writeJSONFile(queue.path, queue.state)
+}
+
+// writeJSONFile writes v to a temporary file and renames it over path so that a crash leaves the old or new file whole
+func writeJSONFile(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// ForwardReport is the outcome of forwarding the queued advices to the bank host
+type ForwardReport struct {
+	Posted int
+	// Duplicates are advices the host had already posted, sent again after their response was lost
+	Duplicates int
+	Rejected   []RejectedAdvice
+	// Reversed is the number of queued reversals the host posted
+	Reversed int
+	// Remaining is the number of advices and reversals still queued because the host could not be reached
+	Remaining int
+}
+
+// StandInHost is a BankHost that approves small withdrawals itself when the bank host it wraps can not be reached,
+// queueing an advice for each. The advices are forwarded to the host before each call once it can be reached again
+type StandInHost struct {
+	host   BankHost
+	policy StandInPolicy
+	queue  *AdviceQueue
+}
+
+// NewStandInHost wraps host, approving withdrawals within policy while it is unreachable and recording them in queue
+func NewStandInHost(host BankHost, policy StandInPolicy, queue *AdviceQueue) *StandInHost {
+	return &StandInHost{host: host, policy: policy, queue: queue}
+}
+
+// Queue returns the advices waiting for the bank host
+func (standIn *StandInHost) Queue() *AdviceQueue {
+	return standIn.queue
+}
+
+// Close closes the connection to the bank host, if it holds one
+func (standIn *StandInHost) Close() error {
+	if closer, ok := standIn.host.(interface{ Close() error }); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Forward sends the queued advices and then the queued reversals to the bank host, oldest first, stopping if it can not be reached.
+// Advices the host refuses are kept with the rejected advices for the operator, reversals it refuses are journaled
+func (standIn *StandInHost) Forward() (ForwardReport, error) {
+	report := ForwardReport{}
+	for _, advice := range standIn.queue.Pending() {
+		result, err := standIn.host.Advise(advice)
+		var duplicate *DuplicateAdviceError
+		var rejected *RejectedAdvice
+		switch {
+		case err == nil:
+			report.Posted++
+			Journal(JournalTransaction, result.TransactionId, advice.AccountId,
+				fmt.Sprintf("offline withdrawal %s $%.2f posted", advice.AdviceId, advice.Amount))
+		case errors.As(err, &duplicate):
+			report.Duplicates++
+			Logger.Printf("advice %s was already posted as %s\n", advice.AdviceId, duplicate.TransactionId)
+		case errors.Is(err, &HostUnavailableError{}):
+			report.Remaining = standIn.queued()
+			return report, err
+		default:
+			rejected = &RejectedAdvice{Advice: advice, Reason: err.Error(), RejectedAt: clock.Now()}
+			report.Rejected = append(report.Rejected, *rejected)
+			Logger.Printf("advice %s rejected by the bank host: %+v\n", advice.AdviceId, err)
+			Journal(JournalError, advice.AdviceId, advice.AccountId, fmt.Sprintf("offline withdrawal $%.2f rejected: %s", advice.Amount, err.Error()))
+		}
+		if err := standIn.queue.complete(advice.AdviceId, rejected); err != nil {
+			report.Remaining = standIn.queued()
+			return report, err
+		}
+	}
+	// a reversal sent again is only applied once, so one the host posted without answering is not reversed twice
+	for _, reversal := range standIn.queue.Reversals() {
+		result, err := standIn.host.Reverse(reversal)
+		switch {
+		case err == nil:
+			report.Reversed++
+			Journal(JournalTransaction, result.TransactionId, result.AccountId,
+				fmt.Sprintf("reversed $%.2f of withdrawal %s", result.AmountReversed, reversal.TransactionId))
+		case errors.Is(err, &HostUnavailableError{}):
+			report.Remaining = standIn.queued()
+			return report, err
+		default:
+			Logger.Printf("reversal of %s rejected by the bank host: %+v\n", reversal.TransactionId, err)
+			Journal(JournalError, reversal.TransactionId, "", fmt.Sprintf("queued reversal of $%.2f rejected: %s", reversal.Amount, err.Error()))
+		}
+		if err := standIn.queue.completeReversal(); err != nil {
+			report.Remaining = standIn.queued()
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// queued is the number of advices and reversals waiting for the bank host
+func (standIn *StandInHost) queued() int {
+	return len(standIn.queue.Pending()) + len(standIn.queue.Reversals())
+}
+
+// forward sends any queued advices before a call to the bank host
+func (standIn *StandInHost) forward() {
+	if standIn.queued() == 0 {
+		return
+	}
+	report, err := standIn.Forward()
+	if err != nil {
+		Logger.Printf("unable to forward advices, %d remain: %+v\n", report.Remaining, err)
+		return
+	}
+	Logger.Printf("forwarded advices: %d posted, %d duplicates, %d rejected, %d reversals\n", report.Posted, report.Duplicates,
+		len(report.Rejected), report.Reversed)
+}
+
+func (standIn *StandInHost) Authenticate(accountId string, pin PINBlock) (bool, error) {
+	standIn.forward()
+	return standIn.host.Authenticate(accountId, pin)
+}
+
+// SecondFactorRequired does not ask for a one-time code for a withdrawal that may be approved offline while the host can not be reached
+func (standIn *StandInHost) SecondFactorRequired(accountId string, withdrawal float64) (bool, error) {
+	standIn.forward()
+	required, err := standIn.host.SecondFactorRequired(accountId, withdrawal)
+	if errors.Is(err, &HostUnavailableError{}) && withdrawal > 0 && withdrawal <= standIn.policy.MaxWithdrawal {
+		return false, nil
+	}
+	return required, err
+}
+
+func (standIn *StandInHost) VerifyOneTimeCode(accountId string, code string) (bool, error) {
+	return standIn.host.VerifyOneTimeCode(accountId, code)
+}
+
+func (standIn *StandInHost) Balance(accountId string) (AccountBalance, error) {
+	standIn.forward()
+	return standIn.host.Balance(accountId)
+}
+
+func (standIn *StandInHost) Deposit(request DepositRequest) (*DepositResult, error) {
+	standIn.forward()
+	return standIn.host.Deposit(request)
+}
+
+// Withdraw sends the withdrawal to the bank host, approving it offline within the policy's limits if it did not reach the host.
+// A withdrawal the host may have posted, such as one that was not answered in time, is not approved offline. The withdrawal
+// is sent with an idempotency key that becomes the advice id, so the host does not post an advice for it as well
+func (standIn *StandInHost) Withdraw(request WithdrawalRequest) (*WithdrawResult, error) {
+	standIn.forward()
+	if request.IdempotencyKey == "" {
+		request.IdempotencyKey = newTransactionId()
+	}
+	result, err := standIn.host.Withdraw(request)
+	var unavailable *HostUnavailableError
+	if !errors.As(err, &unavailable) || !unavailable.NotSent {
+		return result, err
+	}
+	return standIn.approveOffline(request, err)
+}
+
+func (standIn *StandInHost) Advise(advice WithdrawalAdvice) (*WithdrawResult, error) {
+	return standIn.host.Advise(advice)
+}
+
+// Reverse forwards the queued advices first, so that a withdrawal approved offline can be reversed by its advice id.
+// A withdrawal whose advice could not be forwarded is reversed by reducing the advice
+func (standIn *StandInHost) Reverse(request ReversalRequest) (*ReversalResult, error) {
+	standIn.forward()
+	if result, ok, err := standIn.queue.reduce(request); ok {
+		return result, err
+	}
+	return standIn.host.Reverse(request)
+}
+
+// QueueReversal keeps a reversal the bank host could not be sent, forwarding it after the advices
+func (standIn *StandInHost) QueueReversal(request ReversalRequest) (*ReversalResult, error) {
+	if err := standIn.queue.AddReversal(request); err != nil {
+		return &ReversalResult{}, err
+	}
+	Logger.Printf("queued reversal of %.2f of %s for the bank host\n", request.Amount, request.TransactionId)
+	return &ReversalResult{OriginalType: WithdrawalTransaction, OriginalTerminalId: request.TerminalId, AmountReversed: request.Amount,
+		Queued: true}, nil
+}
+
+func (standIn *StandInHost) History(accountId string, query HistoryQuery) ([]LedgerHistoryEntry, int, error) {
+	standIn.forward()
+	return standIn.host.History(accountId, query)
+}
+
+// approveOffline checks the withdrawal as the host would without a balance, then queues an advice for it if it is within the limits
+func (standIn *StandInHost) approveOffline(request WithdrawalRequest, unavailable error) (*WithdrawResult, error) {
+	amount, err := StringToMoney(request.Amount)
+	if err != nil {
+		return &WithdrawResult{}, err
+	}
+	if math.Mod(amount, 20) != 0 {
+		return &WithdrawResult{}, &InvalidAmountError{message: "Withdrawals must be in units of $20."}
+	}
+	dispensable := math.Floor(request.Dispensable/20) * 20
+	if dispensable <= 0 {
+		return &WithdrawResult{}, &NoMoneyLeftError{}
+	}
+	result := WithdrawResult{Offline: true}
+	if amount > dispensable {
+		if !request.AcceptPartial {
+			return &WithdrawResult{}, &PartialDispenseError{Requested: amount, Available: dispensable}
+		}
+		amount, result.WasPartial = dispensable, true
+	}
+	accountTotal, total := standIn.queue.totals(request.AccountId)
+	if !standIn.policy.allows(amount, accountTotal, total) {
+		Logger.Printf("withdrawal of %.2f for %s is over the stand-in limits\n", amount, request.AccountId)
+		return &WithdrawResult{}, unavailable
+	}
+	description := request.Description
+	if description == "" {
+		description = "cash withdrawal"
+	}
+	advice := WithdrawalAdvice{AdviceId: request.IdempotencyKey, TerminalId: request.TerminalId, AccountId: request.AccountId,
+		Amount: amount, Description: description + " (offline)", ApprovedAt: clock.Now()}
+	if err := standIn.queue.Add(advice); err != nil {
+		Logger.Printf("unable to queue advice for %s: %+v\n", request.AccountId, err)
+		return &WithdrawResult{}, unavailable
+	}
+	Logger.Printf("approved withdrawal of %.2f for %s in stand-in as advice %s\n", amount, request.AccountId, advice.AdviceId)
+	result.TransactionId, result.AmountWithdrawn = advice.AdviceId, amount
+	return &result, nil
+}
+
+// PostAdvice posts a withdrawal a terminal approved in stand-in. The cash has been dispensed so the account is debited
+// even if it is overdrawn; an advice that was already posted, or whose withdrawal was posted with the advice id as its
+// idempotency key, returns its result with a DuplicateAdviceError
+func (ledger *Ledger) PostAdvice(advice WithdrawalAdvice) (*WithdrawResult, error) {
+	key := advice.TerminalId + "/" + advice.AdviceId
+	if posted, ok := ledger.advices[key]; ok {
+		return posted, &DuplicateAdviceError{TransactionId: posted.TransactionId}
+	}
+	if ledger.remembered(advice.AccountId, advice.AdviceId) {
+		if posted, ok := ledger.outcomes[advice.AccountId+"/"+advice.AdviceId].result.(*WithdrawResult); ok {
+			return posted, &DuplicateAdviceError{TransactionId: posted.TransactionId}
+		}
+	}
+	if _, ok := ledger.balances[advice.AccountId]; !ok {
+		return &WithdrawResult{}, &InvalidInputError{fmt.Sprintf("unknown account \"%s\"", advice.AccountId)}
+	}
+	if advice.AdviceId == "" || advice.Amount <= 0 || math.Mod(advice.Amount, 20) != 0 {
+		return &WithdrawResult{}, &InvalidAmountError{message: fmt.Sprintf("invalid advice amount %.2f", advice.Amount)}
+	}
+	description := advice.Description
+	if description == "" {
+		description = "cash withdrawal (offline)"
+	}
+	result := &WithdrawResult{}
+	ledger.debitWithdrawal(result, advice.AccountId, advice.TerminalId, description, advice.Amount)
+	if ledger.advices == nil {
+		ledger.advices = map[string]*WithdrawResult{}
+	}
+	ledger.advices[key] = result
+	Logger.Printf("posted advice %s from %s for %s as %s\n", advice.AdviceId, advice.TerminalId, advice.AccountId, result.TransactionId)
+	return result, nil
+}
@@ -0,0 +1,385 @@
+package internal
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// flakyHost is a local bank host that can be taken down, or made to post withdrawals without answering
+type flakyHost struct {
+	*LocalHost
+	down     bool
+	timedOut bool
+	// keys are the idempotency keys of the withdrawals that reached the host
+	keys []string
+}
+
+func (host *flakyHost) SecondFactorRequired(accountId string, withdrawal float64) (bool, error) {
+	if host.down {
+		return false, &HostUnavailableError{NotSent: true}
+	}
+	return host.LocalHost.SecondFactorRequired(accountId, withdrawal)
+}
+
+func (host *flakyHost) Balance(accountId string) (AccountBalance, error) {
+	if host.down {
+		return AccountBalance{}, &HostUnavailableError{NotSent: true}
+	}
+	return host.LocalHost.Balance(accountId)
+}
+
+func (host *flakyHost) Withdraw(request WithdrawalRequest) (*WithdrawResult, error) {
+	if host.down {
+		return &WithdrawResult{}, &HostUnavailableError{NotSent: true}
+	}
+	host.keys = append(host.keys, request.IdempotencyKey)
+	if host.timedOut {
+		_, _ = host.LocalHost.Withdraw(request)
+		return &WithdrawResult{}, &HostUnavailableError{}
+	}
+	return host.LocalHost.Withdraw(request)
+}
+
+func (host *flakyHost) Advise(advice WithdrawalAdvice) (*WithdrawResult, error) {
+	if host.down {
+		return &WithdrawResult{}, &HostUnavailableError{NotSent: true}
+	}
+	return host.LocalHost.Advise(advice)
+}
+
+func (host *flakyHost) Reverse(request ReversalRequest) (*ReversalResult, error) {
+	if host.down {
+		return &ReversalResult{}, &HostUnavailableError{NotSent: true}
+	}
+	return host.LocalHost.Reverse(request)
+}
+
+func newFlakyHost(balances map[string]float64) (*flakyHost, *Ledger) {
+	hostLedger := &Ledger{}
+	hostLedger.SetInitialBalances(0, balances)
+	return &flakyHost{LocalHost: NewLocalHost(hostLedger, &Authorization{})}, hostLedger
+}
+
+func TestStandInApprovesOffline(t *testing.T) {
+	InitLogger("", true)
+	host, hostLedger := newFlakyHost(map[string]float64{"jc123": 100.00, "ab456": 500.00})
+	queue, err := OpenAdviceQueue("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	standIn := NewStandInHost(host, StandInPolicy{MaxWithdrawal: 60, MaxPerAccount: 100, MaxTotal: 140}, queue)
+
+	// online withdrawals go to the host
+	result, err := standIn.Withdraw(WithdrawalRequest{TerminalId: "ATM00001", AccountId: "ab456", Amount: "100", Dispensable: 500})
+	if err != nil || result.Offline || result.RemainingBalance != 400 {
+		t.Fatalf("expected the withdrawal to be posted by the host got %+v %v", result, err)
+	}
+
+	host.down = true
+	if required, err := standIn.SecondFactorRequired("jc123", 60); required || err != nil {
+		t.Errorf("expected no second factor for an offline withdrawal got %t %v", required, err)
+	}
+	if _, err := standIn.SecondFactorRequired("jc123", 80); !errors.Is(err, &HostUnavailableError{}) {
+		t.Errorf("expected the host to be unavailable for a withdrawal over the limit got %v", err)
+	}
+	tests := []struct {
+		name      string
+		request   WithdrawalRequest
+		expected  float64
+		wantError error
+	}{
+		{"within the limits", WithdrawalRequest{AccountId: "jc123", Amount: "60", Dispensable: 500}, 60, nil},
+		{"over the withdrawal limit", WithdrawalRequest{AccountId: "jc123", Amount: "80", Dispensable: 500}, 0, &HostUnavailableError{}},
+		{"over the account limit", WithdrawalRequest{AccountId: "jc123", Amount: "60", Dispensable: 500}, 0, &HostUnavailableError{}},
+		{"not in units of $20", WithdrawalRequest{AccountId: "jc123", Amount: "30", Dispensable: 500}, 0, &InvalidAmountError{message: "Withdrawals must be in units of $20."}},
+		{"partial dispense", WithdrawalRequest{AccountId: "ab456", Amount: "60", Dispensable: 40}, 0, &PartialDispenseError{}},
+		{"accepted partial dispense", WithdrawalRequest{AccountId: "ab456", Amount: "60", Dispensable: 40, AcceptPartial: true}, 40, nil},
+		{"within the account limit", WithdrawalRequest{AccountId: "jc123", Amount: "40", Dispensable: 500}, 40, nil},
+		{"over the terminal limit", WithdrawalRequest{AccountId: "ab456", Amount: "20", Dispensable: 500}, 0, &HostUnavailableError{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.request.TerminalId = "ATM00001"
+			result, err := standIn.Withdraw(tt.request)
+			if tt.wantError != nil {
+				if !errors.Is(err, tt.wantError) {
+					t.Errorf("expected %v got %v", tt.wantError, err)
+				}
+				return
+			}
+			if err != nil || !result.Offline || result.AmountWithdrawn != tt.expected || result.TransactionId == "" {
+				t.Errorf("expected $%.2f to be approved offline got %+v %v", tt.expected, result, err)
+			}
+		})
+	}
+	if pending := queue.Pending(); len(pending) != 3 || pending[0].Description != "cash withdrawal (offline)" {
+		t.Fatalf("expected 3 queued advices got %+v", pending)
+	}
+	if balance := hostLedger.GetBalance("jc123"); balance != 100.00 {
+		t.Errorf("expected the host balance to be unchanged while offline got %.2f", balance)
+	}
+
+	// the advices are forwarded before the next call once the host is back
+	host.down = false
+	balance, err := standIn.Balance("jc123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance.Balance != 0 || len(queue.Pending()) != 0 || len(queue.Rejected()) != 0 {
+		t.Errorf("expected the advices to be posted got %+v %+v", balance, queue.Pending())
+	}
+	if balance := hostLedger.GetBalance("ab456"); balance != 360.00 {
+		t.Errorf("expected the partial dispense to be posted got %.2f", balance)
+	}
+}
+
+func TestStandInAfterTimeout(t *testing.T) {
+	InitLogger("", true)
+	host, hostLedger := newFlakyHost(map[string]float64{"jc123": 100.00})
+	queue, err := OpenAdviceQueue("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	standIn := NewStandInHost(host, StandInPolicy{MaxWithdrawal: 60}, queue)
+
+	// a withdrawal the host may have posted is not approved again offline
+	host.timedOut = true
+	if _, err := standIn.Withdraw(WithdrawalRequest{TerminalId: "ATM00001", AccountId: "jc123", Amount: "40", Dispensable: 500}); !errors.Is(err, &HostUnavailableError{}) {
+		t.Errorf("expected the host to be unavailable got %v", err)
+	}
+	if len(queue.Pending()) != 0 || hostLedger.GetBalance("jc123") != 60.00 {
+		t.Errorf("expected only the host to post the withdrawal got %+v %.2f", queue.Pending(), hostLedger.GetBalance("jc123"))
+	}
+
+	// the advice for a withdrawal approved offline has the withdrawal's idempotency key as its id, so the host does not
+	// post both should it have received the withdrawal after all
+	host.timedOut, host.down = false, true
+	request := WithdrawalRequest{TerminalId: "ATM00001", AccountId: "jc123", Amount: "20", Dispensable: 500, IdempotencyKey: "K1"}
+	result, err := standIn.Withdraw(request)
+	if err != nil || !result.Offline || result.TransactionId != "K1" {
+		t.Fatalf("expected the withdrawal to be approved offline as K1 got %+v %v", result, err)
+	}
+	posted, err := hostLedger.PostWithdrawal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host.down = false
+	report, err := standIn.Forward()
+	if err != nil || report.Duplicates != 1 || report.Posted != 0 {
+		t.Errorf("expected the advice to be a duplicate got %+v %v", report, err)
+	}
+	if balance := hostLedger.GetBalance("jc123"); balance != 40.00 || len(hostLedger.GetHistory("jc123")) != 2 {
+		t.Errorf("expected the withdrawal %s to be posted once got %.2f", posted.TransactionId, balance)
+	}
+}
+
+func TestWithdrawCashIdempotencyKey(t *testing.T) {
+	InitLogger("", true)
+	SetDevices(nil)
+	defer SetDevices(nil)
+	GetLedgerService().SetInitialBalances(100, map[string]float64{})
+	host, hostLedger := newFlakyHost(map[string]float64{"jc123": 100.00})
+	queue, err := OpenAdviceQueue("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetBankHost(NewStandInHost(host, StandInPolicy{MaxWithdrawal: 60}, queue))
+	defer SetBankHost(nil)
+
+	// the terminal's key is the id of the advice for a withdrawal approved offline
+	host.down = true
+	key := NewIdempotencyKey()
+	if result, err := WithdrawCash("jc123", "40", false, key); err != nil || !result.Offline {
+		t.Fatalf("expected the withdrawal to be approved offline got %+v %v", result, err)
+	}
+	if pending := queue.Pending(); len(pending) != 1 || pending[0].AdviceId != key {
+		t.Errorf("expected the advice id to be %s got %+v", key, pending)
+	}
+
+	// accepting a partial dispense sends the withdrawal again with the same key
+	host.down = false
+	key = NewIdempotencyKey()
+	if _, err := WithdrawCash("jc123", "80", false, key); !errors.Is(err, &PartialDispenseError{}) {
+		t.Fatalf("expected a partial dispense to be offered got %v", err)
+	}
+	result, err := WithdrawCash("jc123", "80", true, key)
+	if err != nil || result.AmountWithdrawn != 60 {
+		t.Fatalf("expected the partial dispense to be approved got %+v %v", result, err)
+	}
+	if len(host.keys) != 2 || host.keys[0] != key || host.keys[1] != key {
+		t.Errorf("expected both requests to carry %s got %v", key, host.keys)
+	}
+	if balance := hostLedger.GetBalance("jc123"); balance != 0 {
+		t.Errorf("expected the advice and the partial dispense to be posted got %.2f", balance)
+	}
+}
+
+func TestDispenserFaultWhileHostDown(t *testing.T) {
+	InitLogger("", true)
+	SetDevices(nil)
+	defer SetDevices(nil)
+	GetLedgerService().SetInitialBalances(1000, map[string]float64{})
+	host, hostLedger := newFlakyHost(map[string]float64{"jc123": 500.00})
+	path := filepath.Join(t.TempDir(), "advices.json")
+	queue, err := OpenAdviceQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	standIn := NewStandInHost(host, StandInPolicy{MaxWithdrawal: 60, MaxPerAccount: 100, MaxTotal: 100}, queue)
+	SetBankHost(standIn)
+	defer SetBankHost(nil)
+	dispenser := GetDevices().CashDispenser.(*SimulatedCashDispenser)
+
+	// the reversal of a withdrawal the host posted is queued when the host goes down before the cash is presented
+	withdrawal, err := WithdrawCash("jc123", "100", false, NewIdempotencyKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	host.down = true
+	if err := dispenser.Inject(NotesNotTaken, 0); err != nil {
+		t.Fatal(err)
+	}
+	result, err := DispenseCash(withdrawal)
+	var fault *DispenserFaultError
+	if !errors.As(err, &fault) || fault.Reversed || result.Reversal == nil || !result.Reversal.Queued {
+		t.Fatalf("expected the reversal to be queued got %+v %v", result, err)
+	}
+	reopened, err := OpenAdviceQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reversals := reopened.Reversals(); len(reversals) != 1 || reversals[0].TransactionId != withdrawal.TransactionId || reversals[0].Amount != 100 {
+		t.Errorf("expected the reversal to be saved got %+v", reversals)
+	}
+
+	// a withdrawal approved offline is reversed by reducing its advice
+	offline, err := WithdrawCash("jc123", "60", false, NewIdempotencyKey())
+	if err != nil || !offline.Offline {
+		t.Fatalf("expected the withdrawal to be approved offline got %+v %v", offline, err)
+	}
+	if err := dispenser.Inject(NotesNotTaken, 0); err != nil {
+		t.Fatal(err)
+	}
+	if result, err := DispenseCash(offline); !errors.As(err, &fault) || result.Reversal == nil || !result.Reversal.Queued {
+		t.Fatalf("expected the advice to be reduced got %+v %v", result, err)
+	}
+	if pending := queue.Pending(); len(pending) != 0 {
+		t.Errorf("expected no advice to be left got %+v", pending)
+	}
+
+	host.down = false
+	report, err := standIn.Forward()
+	if err != nil || report.Reversed != 1 || report.Posted != 0 || report.Remaining != 0 {
+		t.Errorf("expected the reversal to be forwarded got %+v %v", report, err)
+	}
+	if balance := hostLedger.GetBalance("jc123"); balance != 500.00 || len(queue.Reversals()) != 0 {
+		t.Errorf("expected the withdrawal to be reversed got %.2f %+v", balance, queue.Reversals())
+	}
+}
+
+func TestAdviceQueueSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "advices.json")
+	queue, err := OpenAdviceQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	advice := WithdrawalAdvice{AdviceId: "A1", TerminalId: "ATM00001", AccountId: "jc123", Amount: 40}
+	if err := queue.Add(advice); err != nil {
+		t.Fatal(err)
+	}
+	rejected := RejectedAdvice{Advice: WithdrawalAdvice{AdviceId: "A0", AccountId: "xx999", Amount: 20}, Reason: "unknown account"}
+	if err := queue.Add(rejected.Advice); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.complete("A0", &rejected); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenAdviceQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending := reopened.Pending(); len(pending) != 1 || pending[0] != advice {
+		t.Errorf("expected the pending advice to be read back got %+v", pending)
+	}
+	if rejected := reopened.Rejected(); len(rejected) != 1 || rejected[0].Advice.AdviceId != "A0" || rejected[0].Reason != "unknown account" {
+		t.Errorf("expected the rejected advice to be read back got %+v", rejected)
+	}
+	if files, _ := filepath.Glob(path + ".*"); len(files) != 0 {
+		t.Errorf("expected no temporary files to be left got %v", files)
+	}
+}
+
+func TestForwardAdvices(t *testing.T) {
+	InitLogger("", true)
+	host, hostLedger := newFlakyHost(map[string]float64{"jc123": 100.00})
+	queue, _ := OpenAdviceQueue("")
+	standIn := NewStandInHost(host, StandInPolicy{MaxWithdrawal: 100}, queue)
+	posted := WithdrawalAdvice{AdviceId: "A1", TerminalId: "ATM00001", AccountId: "jc123", Amount: 40}
+	for _, advice := range []WithdrawalAdvice{posted, {AdviceId: "A2", TerminalId: "ATM00001", AccountId: "xx999", Amount: 20},
+		{AdviceId: "A3", TerminalId: "ATM00001", AccountId: "jc123", Amount: 80}} {
+		if err := queue.Add(advice); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the host posted the first advice but its response was lost
+	if _, err := hostLedger.PostAdvice(posted); err != nil {
+		t.Fatal(err)
+	}
+
+	host.down = true
+	report, err := standIn.Forward()
+	if !errors.Is(err, &HostUnavailableError{}) || report.Remaining != 3 {
+		t.Errorf("expected the advices to stay queued got %+v %v", report, err)
+	}
+	host.down = false
+	report, err = standIn.Forward()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Posted != 1 || report.Duplicates != 1 || len(report.Rejected) != 1 || report.Remaining != 0 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if rejected := queue.Rejected(); len(rejected) != 1 || rejected[0].Advice.AdviceId != "A2" || rejected[0].Reason != "invalid input: unknown account \"xx999\"" {
+		t.Errorf("expected the advice for an unknown account to be rejected got %+v", rejected)
+	}
+	// the cash was dispensed so the account is overdrawn with a fee rather than declined
+	if balance := hostLedger.GetBalance("jc123"); balance != -25.00 {
+		t.Errorf("expected each advice to be posted once got %.2f", balance)
+	}
+}
+
+func TestPostAdvice(t *testing.T) {
+	InitLogger("", true)
+	hostLedger := &Ledger{}
+	hostLedger.SetInitialBalances(0, map[string]float64{"jc123": 20.00})
+	advice := WithdrawalAdvice{AdviceId: "A1", TerminalId: "ATM00001", AccountId: "jc123", Amount: 40}
+	result, err := hostLedger.PostAdvice(advice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RemainingBalance != -25.00 || !result.WasOverdrawn || result.FeeTransactionId == "" {
+		t.Errorf("unexpected result %+v", result)
+	}
+	history := hostLedger.GetHistory("jc123")
+	if len(history) != 2 || history[0].Description != "cash withdrawal (offline)" || history[0].TerminalId != "ATM00001" {
+		t.Errorf("unexpected history %+v", history)
+	}
+
+	again, err := hostLedger.PostAdvice(advice)
+	var duplicate *DuplicateAdviceError
+	if !errors.As(err, &duplicate) || duplicate.TransactionId != result.TransactionId || again.TransactionId != result.TransactionId {
+		t.Errorf("expected a duplicate advice error got %+v %v", again, err)
+	}
+	// the same advice id from another terminal is a different advice
+	other := advice
+	other.TerminalId = "ATM00002"
+	if _, err := hostLedger.PostAdvice(other); err != nil {
+		t.Errorf("expected an advice from another terminal to be posted got %v", err)
+	}
+	other.AdviceId, other.Amount = "A2", 30
+	if _, err := hostLedger.PostAdvice(other); !errors.Is(err, &InvalidAmountError{message: "invalid advice amount 30.00"}) {
+		t.Errorf("expected an invalid amount error got %v", err)
+	}
+}
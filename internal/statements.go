@@ -0,0 +1,268 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const statementPeriodFormat = "2006-01"
+
+// Statement is the monthly summary of an account's transactions
+type Statement struct {
+	AccountId      string
+	Period         string
+	Start          time.Time
+	End            time.Time
+	OpeningBalance float64
+	ClosingBalance float64
+	Transactions   []LedgerHistoryEntry
+	TotalCredits   float64
+	TotalDebits    float64
+	TotalFees      float64
+}
+
+// StatementBalanceError is used when the transactions on a statement do not account for the change in balance
+type StatementBalanceError struct {
+	AccountId string
+	Expected  float64
+	Actual    float64
+}
+
+func (e *StatementBalanceError) Error() string {
+	return fmt.Sprintf("statement for %s does not balance: opening balance plus transactions is %.2f but closing balance is %.2f", e.AccountId, e.Expected, e.Actual)
+}
+
+func (e *StatementBalanceError) Is(target error) bool {
+	_, ok := target.(*StatementBalanceError)
+	return ok
+}
+
+// ParseStatementPeriod reads a statement period in the form YYYY-MM and returns the start of the month
+func ParseStatementPeriod(period string) (time.Time, error) {
+	start, err := time.ParseInLocation(statementPeriodFormat, period, time.Local)
+	if err != nil {
+		return time.Time{}, &InvalidInputError{fmt.Sprintf("invalid statement period \"%s\", expected YYYY-MM", period)}
+	}
+	return start, nil
+}
+
+// GetAccounts returns the ids of all the accounts in the ledger, sorted
+func (ledger *Ledger) GetAccounts() []string {
+	var accounts []string
+	for account := range ledger.balances {
+		accounts = append(accounts, account)
+	}
+	sort.Strings(accounts)
+	return accounts
+}
+
+// ReadHistory reads ledger history entries from a JSON Lines export, grouping them by account
+func ReadHistory(r io.Reader) (map[string][]LedgerHistoryEntry, error) {
+	histories := map[string][]LedgerHistoryEntry{}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var record exportRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, &InvalidInputError{fmt.Sprintf("line %d: %s", line, err.Error())}
+		}
+		date, err := time.Parse(exportDateFormat, record.Date)
+		if err != nil {
+			return nil, &InvalidInputError{fmt.Sprintf("line %d: invalid date \"%s\"", line, record.Date)}
+		}
+		amount, err := record.Amount.Float64()
+		if err != nil {
+			return nil, &InvalidInputError{fmt.Sprintf("line %d: invalid amount \"%s\"", line, record.Amount)}
+		}
+		balance, err := record.Balance.Float64()
+		if err != nil {
+			return nil, &InvalidInputError{fmt.Sprintf("line %d: invalid balance \"%s\"", line, record.Balance)}
+		}
+		histories[record.AccountId] = append(histories[record.AccountId], LedgerHistoryEntry{
+			Id:          record.Id,
+			Type:        record.Type,
+			Description: record.Description,
+			TerminalId:  record.TerminalId,
+			ParentId:    record.ParentId,
+			Date:        date,
+			Amount:      amount,
+			Balance:     balance,
+		})
+	}
+	return histories, scanner.Err()
+}
+
+// BuildStatement summarizes an account's history for the month starting at periodStart.
+// currentBalance is used as the opening balance when there is no history to derive it from.
+// The entries are put in date order first, as those merged from several history files may not be.
+// A StatementBalanceError is returned when the opening balance plus the transactions does not equal the closing balance
+func BuildStatement(accountId string, periodStart time.Time, entries []LedgerHistoryEntry, currentBalance float64) (*Statement, error) {
+	entries = append([]LedgerHistoryEntry(nil), entries...)
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Date.Before(entries[j].Date) })
+	statement := &Statement{
+		AccountId:      accountId,
+		Period:         periodStart.Format(statementPeriodFormat),
+		Start:          periodStart,
+		End:            periodStart.AddDate(0, 1, 0),
+		OpeningBalance: currentBalance,
+	}
+	openingFound := false
+	for _, entry := range entries {
+		switch {
+		case entry.Date.Before(statement.Start):
+			statement.OpeningBalance = entry.Balance
+			openingFound = true
+		case entry.Date.Before(statement.End):
+			statement.Transactions = append(statement.Transactions, entry)
+		case !openingFound && len(statement.Transactions) == 0:
+			// the first transaction after the period shows what the balance was before it
+			statement.OpeningBalance = entry.Balance - entry.Amount
+			openingFound = true
+		}
+	}
+	if len(statement.Transactions) > 0 && !openingFound {
+		first := statement.Transactions[0]
+		statement.OpeningBalance = first.Balance - first.Amount
+	}
+
+	statement.ClosingBalance = statement.OpeningBalance
+	expected := statement.OpeningBalance
+	for _, entry := range statement.Transactions {
+		switch {
+		case entry.Type == FeeTransaction:
+			statement.TotalFees += entry.Amount
+		case entry.Amount >= 0:
+			statement.TotalCredits += entry.Amount
+		default:
+			statement.TotalDebits += entry.Amount
+		}
+		expected += entry.Amount
+		statement.ClosingBalance = entry.Balance
+	}
+	if math.Round(expected*100) != math.Round(statement.ClosingBalance*100) {
+		return statement, &StatementBalanceError{AccountId: accountId, Expected: expected, Actual: statement.ClosingBalance}
+	}
+	return statement, nil
+}
+
+// WriteStatementFiles renders the statement as plain text, Markdown and HTML files in the directory,
+// returning the paths of the files written
+func WriteStatementFiles(dir string, statement *Statement) ([]string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	renderers := []struct {
+		extension string
+		render    func(io.Writer, *Statement) error
+	}{
+		{"txt", RenderStatementText},
+		{"md", RenderStatementMarkdown},
+		{"html", RenderStatementHTML},
+	}
+	var paths []string
+	for _, renderer := range renderers {
+		path := filepath.Join(dir, fmt.Sprintf("%s-%s.%s", statement.AccountId, statement.Period, renderer.extension))
+		file, err := os.Create(path)
+		if err != nil {
+			return paths, err
+		}
+		err = renderer.render(file, statement)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return paths, err
+		}
+		paths = append(paths, path)
+	}
+	Logger.Printf("wrote statement for %s %s to %s\n", statement.AccountId, statement.Period, dir)
+	return paths, nil
+}
+
+// RenderStatementText writes the statement as plain text
+func RenderStatementText(w io.Writer, statement *Statement) error {
+	writer := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(writer, "Statement for account %s\n", statement.AccountId)
+	fmt.Fprintf(writer, "Period: %s to %s\n\n", statement.Start.Format("2006-01-02"), statement.End.AddDate(0, 0, -1).Format("2006-01-02"))
+	fmt.Fprintf(writer, "Opening balance:\t$%.2f\n\n", statement.OpeningBalance)
+	fmt.Fprintln(writer, "Date\tTransaction\tType\tDescription\tAmount\tBalance")
+	for _, entry := range statement.Transactions {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%.2f\t%.2f\n", entry.Date.Format("2006-01-02 15:04"), entry.Id, entry.Type, entry.Description, entry.Amount, entry.Balance)
+	}
+	fmt.Fprintf(writer, "\nTotal credits:\t$%.2f\n", statement.TotalCredits)
+	fmt.Fprintf(writer, "Total debits:\t$%.2f\n", statement.TotalDebits)
+	fmt.Fprintf(writer, "Total fees:\t$%.2f\n", statement.TotalFees)
+	fmt.Fprintf(writer, "Closing balance:\t$%.2f\n", statement.ClosingBalance)
+	return writer.Flush()
+}
+
+// RenderStatementMarkdown writes the statement as Markdown
+func RenderStatementMarkdown(w io.Writer, statement *Statement) error {
+	var md strings.Builder
+	fmt.Fprintf(&md, "# Statement for account %s\n\n", statement.AccountId)
+	fmt.Fprintf(&md, "Period: %s to %s\n\n", statement.Start.Format("2006-01-02"), statement.End.AddDate(0, 0, -1).Format("2006-01-02"))
+	fmt.Fprintf(&md, "**Opening balance:** $%.2f\n\n", statement.OpeningBalance)
+	md.WriteString("| Date | Transaction | Type | Description | Amount | Balance |\n")
+	md.WriteString("|------|-------------|------|-------------|-------:|--------:|\n")
+	for _, entry := range statement.Transactions {
+		fmt.Fprintf(&md, "| %s | %s | %s | %s | %.2f | %.2f |\n", entry.Date.Format("2006-01-02 15:04"), entry.Id, entry.Type,
+			strings.ReplaceAll(entry.Description, "|", "\\|"), entry.Amount, entry.Balance)
+	}
+	md.WriteString("\n| Total | Amount |\n|-------|-------:|\n")
+	fmt.Fprintf(&md, "| Credits | $%.2f |\n| Debits | $%.2f |\n| Fees | $%.2f |\n", statement.TotalCredits, statement.TotalDebits, statement.TotalFees)
+	fmt.Fprintf(&md, "\n**Closing balance:** $%.2f\n", statement.ClosingBalance)
+	_, err := io.WriteString(w, md.String())
+	return err
+}
+
+var statementHTMLTemplate = template.Must(template.New("statement").Funcs(template.FuncMap{
+	"money": func(amount float64) string { return fmt.Sprintf("%.2f", amount) },
+	"date":  func(date time.Time) string { return date.Format("2006-01-02") },
+	"time":  func(date time.Time) string { return date.Format("2006-01-02 15:04") },
+	"last":  func(date time.Time) time.Time { return date.AddDate(0, 0, -1) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Statement for account {{.AccountId}} {{.Period}}</title>
+</head>
+<body>
+<h1>Statement for account {{.AccountId}}</h1>
+<p>Period: {{date .Start}} to {{date (last .End)}}</p>
+<p><strong>Opening balance:</strong> ${{money .OpeningBalance}}</p>
+<table>
+<thead><tr><th>Date</th><th>Transaction</th><th>Type</th><th>Description</th><th>Amount</th><th>Balance</th></tr></thead>
+<tbody>
+{{- range .Transactions}}
+<tr><td>{{time .Date}}</td><td>{{.Id}}</td><td>{{.Type}}</td><td>{{.Description}}</td><td>{{money .Amount}}</td><td>{{money .Balance}}</td></tr>
+{{- end}}
+</tbody>
+</table>
+<table>
+<tr><th>Total credits</th><td>${{money .TotalCredits}}</td></tr>
+<tr><th>Total debits</th><td>${{money .TotalDebits}}</td></tr>
+<tr><th>Total fees</th><td>${{money .TotalFees}}</td></tr>
+</table>
+<p><strong>Closing balance:</strong> ${{money .ClosingBalance}}</p>
+</body>
+</html>
+`))
+
+// RenderStatementHTML writes the statement as an HTML page
+func RenderStatementHTML(w io.Writer, statement *Statement) error {
+	return statementHTMLTemplate.Execute(w, statement)
+}
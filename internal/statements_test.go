@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func statementEntries() []LedgerHistoryEntry {
+	return []LedgerHistoryEntry{
+		{Id: "A1", Type: DepositTransaction, Date: time.Date(2026, 8, 30, 9, 0, 0, 0, time.Local), Amount: 100, Balance: 150},
+		{Id: "B2", Type: WithdrawalTransaction, Date: time.Date(2026, 9, 2, 9, 0, 0, 0, time.Local), Amount: -160, Balance: -10},
+		{Id: "C3", Type: FeeTransaction, ParentId: "B2", Date: time.Date(2026, 9, 2, 9, 0, 0, 0, time.Local), Amount: -5, Balance: -15},
+		{Id: "D4", Type: DepositTransaction, Date: time.Date(2026, 9, 20, 9, 0, 0, 0, time.Local), Amount: 40, Balance: 25},
+		{Id: "E5", Type: DepositTransaction, Date: time.Date(2026, 10, 1, 9, 0, 0, 0, time.Local), Amount: 20, Balance: 45},
+	}
+}
+
+func TestBuildStatement(t *testing.T) {
+	InitLogger("", true)
+	tests := []struct {
+		name         string
+		period       string
+		entries      []LedgerHistoryEntry
+		opening      float64
+		closing      float64
+		transactions int
+		credits      float64
+		debits       float64
+		fees         float64
+		err          error
+	}{
+		{name: "opening from earlier transaction", period: "2026-09", entries: statementEntries(), opening: 150, closing: 25, transactions: 3, credits: 40, debits: -160, fees: -5},
+		{name: "opening from first transaction", period: "2026-09", entries: statementEntries()[1:], opening: 150, closing: 25, transactions: 3, credits: 40, debits: -160, fees: -5},
+		{name: "opening from later transaction", period: "2026-07", entries: statementEntries(), opening: 50, closing: 50},
+		{name: "no history", period: "2026-09", entries: nil, opening: 75, closing: 75},
+		{name: "merged from files out of order", period: "2026-09", entries: append(statementEntries()[3:], statementEntries()[:3]...), opening: 150, closing: 25,
+			transactions: 3, credits: 40, debits: -160, fees: -5},
+		{name: "missing transaction", period: "2026-09", entries: append(statementEntries()[:2], statementEntries()[3:]...), opening: 150, closing: 25, transactions: 2,
+			err: &StatementBalanceError{}},
+	}
+	for _, test := range tests {
+		periodStart, err := ParseStatementPeriod(test.period)
+		if err != nil {
+			t.Fatal(err)
+		}
+		statement, err := BuildStatement("jc123", periodStart, test.entries, 75)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+		if statement.OpeningBalance != test.opening || statement.ClosingBalance != test.closing {
+			t.Errorf("%s: expected opening %.2f closing %.2f got %.2f %.2f", test.name, test.opening, test.closing, statement.OpeningBalance, statement.ClosingBalance)
+		}
+		if len(statement.Transactions) != test.transactions {
+			t.Errorf("%s: expected %d transactions got %d", test.name, test.transactions, len(statement.Transactions))
+		}
+		if test.err == nil && (statement.TotalCredits != test.credits || statement.TotalDebits != test.debits || statement.TotalFees != test.fees) {
+			t.Errorf("%s: unexpected totals %.2f %.2f %.2f", test.name, statement.TotalCredits, statement.TotalDebits, statement.TotalFees)
+		}
+	}
+	if _, err := ParseStatementPeriod("September"); err == nil {
+		t.Errorf("expected an error for an invalid period")
+	}
+}
+
+func TestReadHistory(t *testing.T) {
+	var buffer bytes.Buffer
+	if err := ExportHistory(&buffer, JSONLinesExport, "jc123", statementEntries()); err != nil {
+		t.Fatal(err)
+	}
+	histories, err := ReadHistory(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := histories["jc123"]
+	if len(entries) != 5 {
+		t.Fatalf("expected 5 entries but got %d", len(entries))
+	}
+	if entries[2].Id != "C3" || entries[2].ParentId != "B2" || entries[2].Amount != -5 || entries[2].Balance != -15 || entries[2].Type != FeeTransaction {
+		t.Errorf("entry was not read back correctly %+v", entries[2])
+	}
+	if !entries[2].Date.Equal(statementEntries()[2].Date) {
+		t.Errorf("expected date %s got %s", statementEntries()[2].Date, entries[2].Date)
+	}
+	if _, err = ReadHistory(strings.NewReader("not json\n")); err == nil {
+		t.Errorf("expected an error reading invalid history")
+	}
+}
+
+func TestWriteStatementFiles(t *testing.T) {
+	InitLogger("", true)
+	periodStart, _ := ParseStatementPeriod("2026-09")
+	statement, err := BuildStatement("jc123", periodStart, statementEntries(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	paths, err := WriteStatementFiles(dir, statement)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 3 {
+		t.Fatalf("expected 3 files but got %v", paths)
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), "Closing balance:") || !strings.Contains(string(data), "25.00") {
+			t.Errorf("%s is missing the closing balance", filepath.Base(path))
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	totpPeriod     = 30 * time.Second
+	totpDigits     = 6
+	totpSecretSize = 20 // bytes, the size of a SHA-1 block recommended by RFC 4226
+	// totpSkewSteps is how many periods either side of now a code is accepted for, to allow for clock skew
+	totpSkewSteps = 1
+	totpIssuer    = "ATM-Sim"
+)
+
+// totpEncoding is the unpadded base32 used for secrets in authenticator apps
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// SecondFactorPolicy defines when a one-time code is required from accounts enrolled for TOTP
+type SecondFactorPolicy struct {
+	// OnLogin requires a code when authorizing
+	OnLogin bool
+	// WithdrawalThreshold requires a code for withdrawals above this amount, 0 never requires one
+	WithdrawalThreshold float64
+}
+
+// totpEnrollment is the TOTP secret for an account and the last time step a code was accepted for
+type totpEnrollment struct {
+	secret      []byte
+	lastCounter int64
+}
+
+// TOTPCode calculates the RFC 6238 time-based one-time password for the secret at the given time
+func TOTPCode(secret []byte, at time.Time, digits int, algorithm func() hash.Hash) string {
+	return hotpCode(secret, at.Unix()/int64(totpPeriod/time.Second), digits, algorithm)
+}
+
+// hotpCode calculates the RFC 4226 HMAC-based one-time password for the counter
+func hotpCode(secret []byte, counter int64, digits int, algorithm func() hash.Hash) string {
+	message := make([]byte, 8)
+	binary.BigEndian.PutUint64(message, uint64(counter))
+	mac := hmac.New(algorithm, secret)
+	mac.Write(message)
+	sum := mac.Sum(nil)
+	// dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulus := uint32(1)
+	for i := 0; i < digits; i++ {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%modulus)
+}
+
+// EnrollTOTP generates a new TOTP secret for the account, returning it base32 encoded
+func (auth *Authorization) EnrollTOTP(accountId string) (string, error) {
+	if _, ok := auth.accounts[accountId]; !ok {
+		return "", &InvalidInputError{fmt.Sprintf("unknown account \"%s\"", accountId)}
+	}
+	secret := make([]byte, totpSecretSize)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		return "", err
+	}
+	if auth.totp == nil {
+		auth.totp = map[string]*totpEnrollment{}
+	}
+	auth.totp[accountId] = &totpEnrollment{secret: secret}
+	Logger.Printf("enrolled %s for one-time codes\n", accountId)
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// IsTOTPEnrolled checks whether the account has a TOTP secret
+func (auth *Authorization) IsTOTPEnrolled(accountId string) bool {
+	_, ok := auth.totp[accountId]
+	return ok
+}
+
+// TOTPProvisioningURI returns the otpauth URI used to add the account to an authenticator app
+func (auth *Authorization) TOTPProvisioningURI(accountId string) (string, error) {
+	enrollment, ok := auth.totp[accountId]
+	if !ok {
+		return "", &InvalidInputError{fmt.Sprintf("%s is not enrolled for one-time codes", accountId)}
+	}
+	query := url.Values{}
+	query.Set("secret", totpEncoding.EncodeToString(enrollment.secret))
+	query.Set("issuer", totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(int(totpPeriod/time.Second)))
+	label := url.PathEscape(totpIssuer + ":" + accountId)
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, query.Encode()), nil
+}
+
+// VerifyTOTP checks a one-time code for the account. Codes from one period either side of now are accepted,
+// and a code can not be used again, nor can one older than the last code accepted
+func (auth *Authorization) VerifyTOTP(accountId string, code string) (bool, error) {
+	enrollment, ok := auth.totp[accountId]
+	if !ok {
+		return false, &InvalidInputError{fmt.Sprintf("%s is not enrolled for one-time codes", accountId)}
+	}
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return false, &InvalidInputError{fmt.Sprintf("the one-time code must be a %d-digit number", totpDigits)}
+	}
+	now := clock.Now().Unix() / int64(totpPeriod/time.Second)
+	for counter := now - totpSkewSteps; counter <= now+totpSkewSteps; counter++ {
+		if !hmac.Equal([]byte(hotpCode(enrollment.secret, counter, totpDigits, sha1.New)), []byte(code)) {
+			continue
+		}
+		if counter <= enrollment.lastCounter {
+			Logger.Printf("replayed one-time code for %s\n", accountId)
+			return false, &OneTimeCodeReusedError{}
+		}
+		enrollment.lastCounter = counter
+		return true, nil
+	}
+	Logger.Printf("invalid one-time code for %s\n", accountId)
+	return false, nil
+}
+
+// SetSecondFactorPolicy sets when enrolled accounts must give a one-time code
+func (auth *Authorization) SetSecondFactorPolicy(policy SecondFactorPolicy) {
+	auth.secondFactor = policy
+}
+
+// RequiresSecondFactorForLogin checks whether the account must give a one-time code to authorize
+func (auth *Authorization) RequiresSecondFactorForLogin(accountId string) bool {
+	return auth.secondFactor.OnLogin && auth.IsTOTPEnrolled(accountId)
+}
+
+// RequiresSecondFactorForWithdrawal checks whether the account must give a one-time code to withdraw the amount
+func (auth *Authorization) RequiresSecondFactorForWithdrawal(accountId string, amount float64) bool {
+	threshold := auth.secondFactor.WithdrawalThreshold
+	return threshold > 0 && amount > threshold && auth.IsTOTPEnrolled(accountId)
+}
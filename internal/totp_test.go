@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"hash"
+	"strings"
+	"testing"
+	"time"
+)
+
+// test vectors from RFC 6238 appendix B
+func TestTOTPCode(t *testing.T) {
+	seeds := map[string][]byte{
+		"SHA1":   []byte("12345678901234567890"),
+		"SHA256": []byte("12345678901234567890123456789012"),
+		"SHA512": []byte("1234567890123456789012345678901234567890123456789012345678901234"),
+	}
+	algorithms := map[string]func() hash.Hash{"SHA1": sha1.New, "SHA256": sha256.New, "SHA512": sha512.New}
+	tests := []struct {
+		time      int64
+		algorithm string
+		expected  string
+	}{
+		{59, "SHA1", "94287082"},
+		{59, "SHA256", "46119246"},
+		{59, "SHA512", "90693936"},
+		{1111111109, "SHA1", "07081804"},
+		{1111111109, "SHA256", "68084774"},
+		{1111111109, "SHA512", "25091201"},
+		{1111111111, "SHA1", "14050471"},
+		{1234567890, "SHA1", "89005924"},
+		{2000000000, "SHA1", "69279037"},
+		{20000000000, "SHA1", "65353130"},
+		{20000000000, "SHA256", "77737706"},
+		{20000000000, "SHA512", "47863826"},
+	}
+	for _, test := range tests {
+		code := TOTPCode(seeds[test.algorithm], time.Unix(test.time, 0), 8, algorithms[test.algorithm])
+		if code != test.expected {
+			t.Errorf("%s at %d: expected %s got %s", test.algorithm, test.time, test.expected, code)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	const accountId = "jc123"
+	InitLogger("", true)
+	auth := &Authorization{}
+	auth.SetAuthData(map[string]EncryptedPin{accountId: {}})
+
+	if _, err := auth.VerifyTOTP(accountId, "123456"); err == nil {
+		t.Errorf("expected an error for an account that is not enrolled")
+	}
+	encoded, err := auth.EnrollTOTP(accountId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := totpEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := TOTPCode(secret, time.Now().Add(-totpPeriod), totpDigits, sha1.New)
+	current := TOTPCode(secret, time.Now(), totpDigits, sha1.New)
+	tooOld := TOTPCode(secret, time.Now().Add(-3*totpPeriod), totpDigits, sha1.New)
+
+	if tooOld != previous && tooOld != current {
+		if ok, _ := auth.VerifyTOTP(accountId, tooOld); ok {
+			t.Errorf("expected a code from outside the skew window to be rejected")
+		}
+	}
+	if ok, err := auth.VerifyTOTP(accountId, previous); !ok || err != nil {
+		t.Errorf("expected the code from the previous period to be accepted %v", err)
+	}
+	if ok, err := auth.VerifyTOTP(accountId, current); !ok || err != nil {
+		t.Errorf("expected the current code to be accepted %v", err)
+	}
+	if ok, err := auth.VerifyTOTP(accountId, current); ok || !errors.Is(err, &OneTimeCodeReusedError{}) {
+		t.Errorf("expected the reused code to be rejected but got %t %v", ok, err)
+	}
+	if ok, err := auth.VerifyTOTP(accountId, previous); ok || !errors.Is(err, &OneTimeCodeReusedError{}) {
+		t.Errorf("expected an older code to be rejected but got %t %v", ok, err)
+	}
+
+	uri, err := auth.TOTPProvisioningURI(accountId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(uri, "otpauth://totp/ATM-Sim:jc123?") || !strings.Contains(uri, "secret="+encoded) || !strings.Contains(uri, "issuer=ATM-Sim") {
+		t.Errorf("unexpected provisioning URI %s", uri)
+	}
+
+	auth.SetSecondFactorPolicy(SecondFactorPolicy{WithdrawalThreshold: 500})
+	if auth.RequiresSecondFactorForWithdrawal(accountId, 500) || !auth.RequiresSecondFactorForWithdrawal(accountId, 520) {
+		t.Errorf("expected a code to be required only above the threshold")
+	}
+	if auth.RequiresSecondFactorForWithdrawal("other", 1000) || auth.RequiresSecondFactorForLogin(accountId) {
+		t.Errorf("expected a code to be required only from enrolled accounts")
+	}
+}
@@ -1,10 +1,14 @@
 package internal
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"math"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -17,20 +21,71 @@ moneyPattern defines the valid formats for money in commands. The regex requires
   - no magnitude notations (K for thousands for instance) are allowed
 */
 const moneyPattern = "^(\\$)?([1-9]\\d*(\\.\\d\\d)?)$"
-const overdraftFee = 5.00
+
+// OverdraftFee is charged for a withdrawal that overdraws the account
+const OverdraftFee = 5.00
+const defaultDayLength = 24 * time.Hour
+
+// TransactionType classifies the entries in the ledger history
+type TransactionType string
+
+const (
+	DepositTransaction    TransactionType = "deposit"
+	WithdrawalTransaction TransactionType = "withdrawal"
+	FeeTransaction        TransactionType = "fee"
+	TransferTransaction   TransactionType = "transfer"
+	ReversalTransaction   TransactionType = "reversal"
+	AdjustmentTransaction TransactionType = "adjustment"
+)
 
 // LedgerHistoryEntry holds the transaction history for accounts
 type LedgerHistoryEntry struct {
-	Date    time.Time
-	Amount  float64
-	Balance float64
+	// Id uniquely identifies the transaction
+	Id          string
+	Type        TransactionType
+	Description string
+	// TerminalId is the machine the transaction was made on
+	TerminalId string
+	// ParentId links a transaction to the one that caused it, such as an overdraft fee to its withdrawal
+	ParentId string
+	Date     time.Time
+	Amount   float64
+	Balance  float64
 }
 
 // WithdrawResult since we need multiple pieces of info for a withdrawal, wrap it in a struct
 type WithdrawResult struct {
+	TransactionId string
+	// FeeTransactionId is set when an overdraft fee was charged
+	FeeTransactionId string
 	AmountWithdrawn  float64
 	RemainingBalance float64
 	WasOverdrawn     bool
+	// WasPartial is set when the customer accepted less than the requested amount
+	WasPartial bool
+	// Offline is set when the terminal approved the withdrawal in stand-in, the balance is then not known
+	Offline bool
+	// Replayed is set when the withdrawal had already been posted for the request's idempotency key
+	Replayed bool
+}
+
+// HoldPolicy defines how much of a deposit is available immediately and how long the rest is held.
+// The zero value places no holds on deposits.
+type HoldPolicy struct {
+	// ImmediatelyAvailable is the portion of each deposit that can be withdrawn right away
+	ImmediatelyAvailable float64
+	// HoldDays is the number of simulated days the remainder of a deposit is held
+	HoldDays int
+	// DayLength is the length of a simulated day, defaults to 24 hours
+	DayLength time.Duration
+}
+
+// depositHold is the pending portion of a deposit and when it becomes available.
+// Holds for cheques are only released when the cheque is verified.
+type depositHold struct {
+	amount    float64
+	releaseAt time.Time
+	chequeId  string
 }
 
 // Ledger holds the account balances and history
@@ -40,6 +95,29 @@ type Ledger struct {
 	// map of account # to balance
 	balances  map[string]float64
 	histories map[string][]LedgerHistoryEntry
+	// map of account # to deposit funds not yet available
+	holds      map[string][]depositHold
+	holdPolicy HoldPolicy
+	// cheques deposited in this machine, in the order they were deposited
+	cheques []*ChequeDeposit
+	// identifies this machine in the transaction history
+	terminalId string
+	// map of one-time code to the cardless withdrawal it collects, kept in stagedPath when set
+	stagedWithdrawals map[string]*StagedWithdrawal
+	stagedPath        string
+	// wrong withdrawal codes entered since the last valid one, and when redeem can be used again after too many
+	codeFailures     int
+	codesLockedUntil time.Time
+	// map of terminal and advice id to the result of posting the advice
+	advices map[string]*WithdrawResult
+	// map of terminal and reversal id to the reversal posted
+	reversals map[string]*ReversalResult
+	// map of terminal and idempotency key to the withdrawal posted for it, so that one the terminal got no answer
+	// for can be reversed by its key
+	withdrawalKeys map[string]string
+	// map of account # and idempotency key to the outcome of the request
+	outcomes          map[string]idempotentOutcome
+	idempotencyWindow time.Duration
 }
 
 // the shared Ledger instance
@@ -57,13 +135,89 @@ func (ledger *Ledger) GetAvailableCash() float64 {
 func (ledger *Ledger) SetInitialBalances(availableCash float64, balances map[string]float64) {
 	ledger.balances = balances
 	ledger.availableCash = availableCash
+	ledger.holds = map[string][]depositHold{}
+	ledger.cheques = nil
+	ledger.stagedWithdrawals = map[string]*StagedWithdrawal{}
+	ledger.codeFailures = 0
+	ledger.codesLockedUntil = time.Time{}
+	ledger.advices = map[string]*WithdrawResult{}
+	ledger.reversals = map[string]*ReversalResult{}
+	ledger.withdrawalKeys = map[string]string{}
+	ledger.outcomes = map[string]idempotentOutcome{}
+}
+
+// SetTerminalId sets the id of the machine recorded against each transaction
+func (ledger *Ledger) SetTerminalId(terminalId string) {
+	ledger.terminalId = terminalId
+}
+
+// GetTerminalId returns the id of the machine recorded against each transaction
+func (ledger *Ledger) GetTerminalId() string {
+	return ledger.terminalId
+}
+
+// SetHoldPolicy sets the policy applied to all subsequent deposits
+func (ledger *Ledger) SetHoldPolicy(policy HoldPolicy) {
+	ledger.holdPolicy = policy
 }
 
-// GetBalance returns the current balance for a given account
+// GetBalance returns the current ledger balance for a given account, including funds on hold
 func (ledger *Ledger) GetBalance(account string) (balance float64) {
 	return ledger.balances[account]
 }
 
+// GetAvailableBalance returns the balance for a given account that may be withdrawn
+func (ledger *Ledger) GetAvailableBalance(account string) float64 {
+	return ledger.balances[account] - ledger.GetPendingFunds(account) - ledger.GetReservedFunds(account)
+}
+
+// GetPendingFunds returns the deposited funds for a given account that are still on hold
+func (ledger *Ledger) GetPendingFunds(account string) float64 {
+	ledger.releaseHolds(account)
+	pending := 0.0
+	for _, hold := range ledger.holds[account] {
+		pending += hold.amount
+	}
+	return pending
+}
+
+// releaseHolds drops any holds for the account whose hold period has passed
+func (ledger *Ledger) releaseHolds(account string) {
+	now := clock.Now()
+	var remaining []depositHold
+	for _, hold := range ledger.holds[account] {
+		if hold.chequeId != "" || now.Before(hold.releaseAt) {
+			remaining = append(remaining, hold)
+		} else {
+			Logger.Printf("releasing hold of %.2f for %s\n", hold.amount, account)
+		}
+	}
+	if len(remaining) == 0 {
+		delete(ledger.holds, account)
+	} else {
+		ledger.holds[account] = remaining
+	}
+}
+
+// placeHold puts the portion of a deposit beyond the policy's immediately available amount on hold
+func (ledger *Ledger) placeHold(account string, amount float64) {
+	policy := ledger.holdPolicy
+	held := amount - policy.ImmediatelyAvailable
+	if policy.HoldDays <= 0 || held <= 0 {
+		return
+	}
+	dayLength := policy.DayLength
+	if dayLength == 0 {
+		dayLength = defaultDayLength
+	}
+	if ledger.holds == nil {
+		ledger.holds = map[string][]depositHold{}
+	}
+	hold := depositHold{amount: held, releaseAt: clock.Now().Add(time.Duration(policy.HoldDays) * dayLength)}
+	Logger.Printf("placing hold of %.2f for %s until %s\n", hold.amount, account, hold.releaseAt.Format(time.RFC3339))
+	ledger.holds[account] = append(ledger.holds[account], hold)
+}
+
 // StringToMoney validates that a given string is an allowed money value and returns the amount as a float64
 func StringToMoney(input string) (float64, error) {
 	regex := regexp.MustCompile(moneyPattern)
@@ -80,28 +234,109 @@ func StringToMoney(input string) (float64, error) {
 
 // Deposit adds funds to a given account
 func (ledger *Ledger) Deposit(accountId string, amount string) (float64, error) {
-	currentBalance := ledger.balances[accountId]
-	dollarAmount, err := StringToMoney(amount)
+	result, err := ledger.PostDeposit(DepositRequest{TerminalId: ledger.terminalId, AccountId: accountId, Amount: amount})
+	if err != nil {
+		return ledger.balances[accountId], err
+	}
+	return result.Entry.Balance, nil
+}
+
+// PostDeposit credits a deposit made at a terminal, placing any hold required by the hold policy.
+// A deposit sent again with the same idempotency key returns the first result without posting again
+func (ledger *Ledger) PostDeposit(request DepositRequest) (*DepositResult, error) {
+	if request.IdempotencyKey != "" {
+		posted, ok, err := ledger.replay(request.AccountId, request.IdempotencyKey, depositFingerprint(request))
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			replayed := *posted.(*DepositResult)
+			replayed.Replayed = true
+			return &replayed, nil
+		}
+	}
+	dollarAmount, err := StringToMoney(request.Amount)
 	if err != nil {
-		return currentBalance, err
+		return nil, err
+	}
+	description := request.Description
+	if description == "" {
+		description = "deposit"
 	}
-	newValue := currentBalance + dollarAmount
-	ledger.balances[accountId] = newValue
-	ledger.addHistory(accountId, dollarAmount, newValue)
-	return newValue, nil
+	entry := ledger.credit(request.AccountId, LedgerHistoryEntry{Type: DepositTransaction, Description: description,
+		TerminalId: request.TerminalId, Amount: dollarAmount})
+	ledger.placeHold(request.AccountId, dollarAmount)
+	result := &DepositResult{Entry: entry, Available: ledger.GetAvailableBalance(request.AccountId), Pending: ledger.GetPendingFunds(request.AccountId)}
+	if request.IdempotencyKey != "" {
+		ledger.remember(request.AccountId, request.IdempotencyKey, depositFingerprint(request), result)
+	}
+	return result, nil
+}
+
+// credit adds the entry's amount to the account balance and records the entry in the history
+func (ledger *Ledger) credit(accountId string, entry LedgerHistoryEntry) LedgerHistoryEntry {
+	entry.Balance = ledger.balances[accountId] + entry.Amount
+	ledger.balances[accountId] = entry.Balance
+	return ledger.addHistory(accountId, entry)
 }
 
-// Withdraw removes funds from a given account
+// Withdraw removes funds from a given account.
+// If the machine does not hold enough cash to cover the full amount a PartialDispenseError is returned
+// and nothing is dispensed. The customer must then consent to the partial amount via WithdrawPartial.
 func (ledger *Ledger) Withdraw(accountId string, amount string) (*WithdrawResult, error) {
+	return ledger.withdraw(WithdrawalRequest{AccountId: accountId, Amount: amount, Description: "cash withdrawal"})
+}
+
+// WithdrawPartial removes funds from a given account, dispensing whatever the machine has available
+// (in units of $20) if it cannot cover the full amount. Calling this is the customer's consent to a partial dispense.
+func (ledger *Ledger) WithdrawPartial(accountId string, amount string) (*WithdrawResult, error) {
+	return ledger.withdraw(WithdrawalRequest{AccountId: accountId, Amount: amount, AcceptPartial: true, Description: "cash withdrawal"})
+}
+
+// MaxDispensable returns the largest amount the machine is able to dispense in units of $20
+func (ledger *Ledger) MaxDispensable() float64 {
+	return math.Floor(ledger.availableCash/20) * 20
+}
+
+// withdraw posts a withdrawal made at this machine and takes the amount withdrawn out of its cash
+func (ledger *Ledger) withdraw(request WithdrawalRequest) (*WithdrawResult, error) {
+	request.TerminalId, request.Dispensable = ledger.terminalId, ledger.MaxDispensable()
+	result, err := ledger.PostWithdrawal(request)
+	if err == nil && !result.Replayed {
+		ledger.availableCash = ledger.availableCash - result.AmountWithdrawn
+	}
+	return result, err
+}
+
+// PostWithdrawal debits a withdrawal made at a terminal. The terminal says how much it is able to dispense
+// and is responsible for taking the amount withdrawn out of its own cash.
+// A withdrawal sent again with the same idempotency key returns the first result without posting again
+func (ledger *Ledger) PostWithdrawal(request WithdrawalRequest) (*WithdrawResult, error) {
+	if request.IdempotencyKey != "" {
+		posted, ok, err := ledger.replay(request.AccountId, request.IdempotencyKey, withdrawalFingerprint(request))
+		if err != nil {
+			return &WithdrawResult{RemainingBalance: ledger.balances[request.AccountId]}, err
+		}
+		if ok {
+			replayed := *posted.(*WithdrawResult)
+			replayed.Replayed = true
+			return &replayed, nil
+		}
+	}
+	accountId, amount := request.AccountId, request.Amount
 	currentBalance := ledger.balances[accountId]
+	dispensable := math.Floor(request.Dispensable/20) * 20
 
-	// customer is already overdrawn
+	// customer is already overdrawn, or has nothing available because of holds and reservations
 	if currentBalance <= 0 {
 		return &WithdrawResult{RemainingBalance: currentBalance, WasOverdrawn: true}, &OverdrawnError{}
 	}
+	if available := ledger.GetAvailableBalance(accountId); available <= 0 {
+		return &WithdrawResult{RemainingBalance: currentBalance}, &FundsOnHoldError{Available: available}
+	}
 
 	// the machine is empty
-	if ledger.availableCash == 0 {
+	if dispensable <= 0 {
 		return &WithdrawResult{RemainingBalance: currentBalance}, &NoMoneyLeftError{}
 	}
 
@@ -115,30 +350,61 @@ func (ledger *Ledger) Withdraw(accountId string, amount string) (*WithdrawResult
 	if math.Mod(dollarAmount, 20) != 0 {
 		return &WithdrawResult{RemainingBalance: currentBalance}, &InvalidAmountError{message: "Withdrawals must be in units of $20."}
 	}
+
 	result := WithdrawResult{}
 	// can only dispense partial amount
-	if dollarAmount > ledger.availableCash {
-		dollarAmount = ledger.availableCash
-	}
-	newValue := currentBalance - dollarAmount
-	ledger.addHistory(accountId, dollarAmount*-1, newValue)
-	if newValue < 0 {
-		newValue = newValue - overdraftFee
-		ledger.addHistory(accountId, overdraftFee*-1, newValue)
+	if maxAmount := dispensable; dollarAmount > maxAmount {
+		if !request.AcceptPartial {
+			Logger.Printf("partial dispense required for %s: requested %.2f, available %.2f\n", accountId, dollarAmount, maxAmount)
+			return &WithdrawResult{RemainingBalance: currentBalance}, &PartialDispenseError{Requested: dollarAmount, Available: maxAmount}
+		}
+		Logger.Printf("partial dispense accepted by %s: requested %.2f, dispensing %.2f\n", accountId, dollarAmount, maxAmount)
+		dollarAmount = maxAmount
+		result.WasPartial = true
+	}
+	description := request.Description
+	if description == "" {
+		description = "cash withdrawal"
+	}
+	ledger.debitWithdrawal(&result, accountId, request.TerminalId, description, dollarAmount)
+	if request.IdempotencyKey != "" {
+		ledger.remember(accountId, request.IdempotencyKey, withdrawalFingerprint(request), &result)
+		if ledger.withdrawalKeys == nil {
+			ledger.withdrawalKeys = map[string]string{}
+		}
+		ledger.withdrawalKeys[request.TerminalId+"/"+request.IdempotencyKey] = result.TransactionId
+	}
+	return &result, nil
+}
+
+// debitWithdrawal posts the withdrawal and, when it overdraws the account, the overdraft fee
+func (ledger *Ledger) debitWithdrawal(result *WithdrawResult, accountId string, terminalId string, description string, amount float64) {
+	withdrawal := ledger.credit(accountId, LedgerHistoryEntry{Type: WithdrawalTransaction, Description: description,
+		TerminalId: terminalId, Amount: amount * -1})
+	result.TransactionId = withdrawal.Id
+	newValue := withdrawal.Balance
+	// the overdraft is measured against the available funds, so a withdrawal into held or reserved funds is charged the fee too
+	if ledger.GetAvailableBalance(accountId) < 0 {
+		fee := ledger.credit(accountId, LedgerHistoryEntry{Type: FeeTransaction, Description: "overdraft fee", ParentId: withdrawal.Id,
+			TerminalId: terminalId, Amount: OverdraftFee * -1})
+		newValue = fee.Balance
+		result.FeeTransactionId = fee.Id
 		result.WasOverdrawn = true
 	}
-	ledger.balances[accountId] = newValue
-	ledger.availableCash = ledger.availableCash - dollarAmount
 	result.RemainingBalance = newValue
-	result.AmountWithdrawn = dollarAmount
-	return &result, nil
+	result.AmountWithdrawn = amount
 }
 
-// addHistory updates the ledger history with a new transacion
-func (ledger *Ledger) addHistory(accountId string, amount float64, balance float64) {
+// addHistory updates the ledger history with a new transacion, assigning it an id, date and,
+// when the entry does not come from another terminal, this machine's terminal id
+func (ledger *Ledger) addHistory(accountId string, newEntry LedgerHistoryEntry) LedgerHistoryEntry {
+	newEntry.Id = newTransactionId()
+	newEntry.Date = clock.Now()
+	if newEntry.TerminalId == "" {
+		newEntry.TerminalId = ledger.terminalId
+	}
+	Logger.Printf("adding history for %s %s %s %.2f\n", accountId, newEntry.Id, newEntry.Type, newEntry.Amount)
 	// lazy initialization of Ledger.histories
-	newEntry := LedgerHistoryEntry{Date: time.Now(), Amount: amount, Balance: balance}
-	Logger.Printf("adding history for %s %.2f\n", accountId, newEntry.Amount)
 	if ledger.histories == nil {
 		ledger.histories = map[string][]LedgerHistoryEntry{}
 	}
@@ -150,6 +416,16 @@ func (ledger *Ledger) addHistory(accountId string, amount float64, balance float
 		Logger.Printf("starting history for %s\n", accountId)
 		ledger.histories[accountId] = []LedgerHistoryEntry{newEntry}
 	}
+	return newEntry
+}
+
+// newTransactionId generates a random id for a transaction
+func newTransactionId() string {
+	id := make([]byte, 6)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		panic(fmt.Sprintf("unable to generate a transaction id: %v", err))
+	}
+	return strings.ToUpper(hex.EncodeToString(id))
 }
 
 // GetHistory returns the transaction history for a given account
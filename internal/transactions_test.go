@@ -4,6 +4,7 @@ import (
 	"errors"
 	"reflect"
 	"testing"
+	"time"
 )
 
 const account = "jc123"
@@ -56,7 +57,7 @@ func TestWithdraw(t *testing.T) {
 		{name: "too many decimals", value: "25.222", expected: 50.00, err: &InvalidAmountError{message: "invalid number format 25.222"}, availableCash: 500},
 		{name: "overdraw", value: "80.00", expected: -35.00, err: nil, availableCash: 500},
 		{name: "empty machine", value: "20.00", expected: 50.00, err: &NoMoneyLeftError{}, availableCash: 0},
-		{name: "partial fulfillment", value: "40.00", expected: 30.00, err: nil, availableCash: 20.00},
+		{name: "partial fulfillment requires consent", value: "40.00", expected: 50.00, err: &PartialDispenseError{}, availableCash: 20.00},
 		{name: "not a multiple of 20", value: "25.00", expected: 50.00, err: &InvalidAmountError{message: "Withdrawals must be in units of $20."}, availableCash: 500},
 		{name: "good value", value: "20.00", expected: 30.00, err: nil, availableCash: 500},
 	}
@@ -86,6 +87,99 @@ func TestWithdraw(t *testing.T) {
 	}
 }
 
+func TestWithdrawPartial(t *testing.T) {
+	tests := []struct {
+		name          string
+		value         string
+		expected      float64
+		dispensed     float64
+		wasPartial    bool
+		availableCash float64
+	}{
+		{name: "partial fulfillment", value: "40.00", expected: 30.00, dispensed: 20.00, wasPartial: true, availableCash: 20.00},
+		{name: "rounds down to units of $20", value: "60.00", expected: 10.00, dispensed: 40.00, wasPartial: true, availableCash: 55.00},
+		{name: "full amount available", value: "20.00", expected: 30.00, dispensed: 20.00, wasPartial: false, availableCash: 500},
+	}
+	InitLogger("", true)
+	for _, test := range tests {
+		const accountId = "jc123"
+		var testLedger = Ledger{
+			availableCash: test.availableCash,
+			balances: map[string]float64{
+				accountId: 50.00,
+			},
+		}
+		result, err := testLedger.WithdrawPartial(accountId, test.value)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %+v\n", test.name, err)
+		}
+		if result.RemainingBalance != test.expected {
+			t.Errorf("%s: incorrect balance after withdrawl expected %.2f got %.2f\n", test.name, test.expected, result.RemainingBalance)
+		}
+		if result.AmountWithdrawn != test.dispensed {
+			t.Errorf("%s: incorrect amount dispensed expected %.2f got %.2f\n", test.name, test.dispensed, result.AmountWithdrawn)
+		}
+		if result.WasPartial != test.wasPartial {
+			t.Errorf("%s: expected WasPartial to be %t\n", test.name, test.wasPartial)
+		}
+		if testLedger.GetAvailableCash() != test.availableCash-test.dispensed {
+			t.Errorf("%s: incorrect cash left in machine %.2f\n", test.name, testLedger.GetAvailableCash())
+		}
+	}
+}
+
+func TestDepositHolds(t *testing.T) {
+	accountId := "jc123"
+	InitLogger("", true)
+	ledger := &Ledger{}
+	ledger.SetInitialBalances(500, map[string]float64{
+		accountId: 50,
+	})
+	fakeClock := NewFakeClock(time.Date(2023, 5, 1, 9, 0, 0, 0, time.UTC))
+	SetClock(fakeClock)
+	defer SetClock(nil)
+	ledger.SetHoldPolicy(HoldPolicy{ImmediatelyAvailable: 100, HoldDays: 2})
+	defer ledger.SetHoldPolicy(HoldPolicy{})
+
+	_, err := ledger.Deposit(accountId, "300.00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ledger.GetBalance(accountId) != 350 {
+		t.Errorf("expected ledger balance of 350.00 got %.2f", ledger.GetBalance(accountId))
+	}
+	if ledger.GetAvailableBalance(accountId) != 150 {
+		t.Errorf("expected available balance of 150.00 got %.2f", ledger.GetAvailableBalance(accountId))
+	}
+
+	_, err = ledger.Withdraw(accountId, "140.00")
+	if err != nil {
+		t.Errorf("unexpected error withdrawing available funds %v", err)
+	}
+	// held funds count as overdrawn the same way an account without holds is
+	result, err := ledger.Withdraw(accountId, "40.00")
+	if err != nil || !result.WasOverdrawn || result.RemainingBalance != 165 {
+		t.Errorf("expected the withdrawal to overdraw the available funds got %+v %v", result, err)
+	}
+	_, err = ledger.Withdraw(accountId, "20.00")
+	if !errors.Is(err, &FundsOnHoldError{}) {
+		t.Errorf("expected a FundsOnHoldError but got %v", err)
+	}
+
+	// the hold lasts two days
+	fakeClock.Advance(47 * time.Hour)
+	if ledger.GetPendingFunds(accountId) != 200 {
+		t.Errorf("expected the hold to still be in place")
+	}
+	fakeClock.Advance(time.Hour)
+	if ledger.GetPendingFunds(accountId) != 0 {
+		t.Errorf("expected the hold to be released")
+	}
+	if ledger.GetAvailableBalance(accountId) != 165 {
+		t.Errorf("expected available balance of 165.00 got %.2f", ledger.GetAvailableBalance(accountId))
+	}
+}
+
 func TestAlreadyOverdrawn(t *testing.T) {
 	accountId := "jc123"
 	InitLogger("", true)
@@ -131,6 +225,16 @@ func TestHistory(t *testing.T) {
 
 	overdraftHistoryRecord := history[2]
 	compareHistoryEntries(LedgerHistoryEntry{Amount: -5.00, Balance: -25.00}, overdraftHistoryRecord, t)
+
+	if depositHistoryRecord.Type != DepositTransaction || withdrawalHistoryRecord.Type != WithdrawalTransaction || overdraftHistoryRecord.Type != FeeTransaction {
+		t.Errorf("unexpected transaction types %s, %s, %s", depositHistoryRecord.Type, withdrawalHistoryRecord.Type, overdraftHistoryRecord.Type)
+	}
+	if overdraftHistoryRecord.ParentId != withdrawalHistoryRecord.Id {
+		t.Errorf("expected the overdraft fee to be linked to withdrawal %s but was %s", withdrawalHistoryRecord.Id, overdraftHistoryRecord.ParentId)
+	}
+	if depositHistoryRecord.Id == "" || depositHistoryRecord.Id == withdrawalHistoryRecord.Id || withdrawalHistoryRecord.Id == overdraftHistoryRecord.Id {
+		t.Errorf("expected unique transaction ids")
+	}
 }
 
 func compareHistoryEntries(expected LedgerHistoryEntry, actual LedgerHistoryEntry, t *testing.T) {